@@ -15,10 +15,15 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
 
 	"purelb.io/internal/allocator"
 	"purelb.io/internal/k8s"
@@ -31,9 +36,23 @@ func main() {
 	var (
 		port       = flag.Int("port", 7472, "HTTP listening port for Prometheus metrics")
 		kubeconfig = flag.String("kubeconfig", os.Getenv("KUBECONFIG"), "absolute path to the kubeconfig file (only needed when running outside of k8s)")
+		events     = flag.String("event-verbosity", "normal", "which Kubernetes events to send: errors, normal, or verbose")
+		debounce   = flag.Duration("debounce", 0, "how long to wait after a service update before processing it, so bursts of updates are processed once (0 means no delay)")
+		retryDelay = flag.Duration("max-retry-delay", k8s.DefaultMaxRetryDelay, "maximum delay between retries of a failed service update")
+		reconcile  = flag.Duration("reconcile-interval", 10*time.Minute, "how often to release the addresses of services that no longer exist (0 means never)")
+		defPool    = flag.String("default-pool", "default", "ServiceGroup from which to allocate addresses for services that don't specify one")
+		extIPs     = flag.Bool("external-ips", false, "copy allocated addresses into services' externalIPs as well as their ingress status")
+		holdDelay  = flag.Duration("release-delay", 0, "how long to hold the addresses of deleted services so they get the same addresses if they're re-created (0 means release immediately)")
+		auditLog   = flag.String("audit-log", "", "where to write a JSON audit record of each address allocation and release: a file name, \"stdout\", or \"\" for no audit log")
 	)
 	flag.Parse()
 
+	verbosity, err := k8s.ParseEventVerbosity(*events)
+	if err != nil {
+		logger.Log("op", "startup", "error", err, "msg", "invalid configuration")
+		os.Exit(1)
+	}
+
 	stopCh := make(chan struct{})
 	go func() {
 		c1 := make(chan os.Signal, 1)
@@ -46,7 +65,20 @@ func main() {
 	defer logger.Log("op", "shutdown", "msg", "done")
 
 	// Set up controller
-	c, err := allocator.NewController(logger, allocator.New(logger))
+	alloc := allocator.New(logger)
+	alloc.SetDefaultPool(*defPool)
+	alloc.SetReleaseDelay(*holdDelay)
+	alloc.SetExternalIPs(*extIPs)
+	if *auditLog != "" {
+		sink, err := openAuditLog(*auditLog)
+		if err != nil {
+			logger.Log("op", "startup", "error", err, "msg", "failed to open audit log")
+			os.Exit(1)
+		}
+		actor, _ := os.Hostname()
+		alloc.SetAuditLog(sink, actor)
+	}
+	c, err := allocator.NewController(logger, alloc)
 	if err != nil {
 		logger.Log("op", "startup", "error", err, "msg", "failed to allocate controller")
 		os.Exit(1)
@@ -57,10 +89,17 @@ func main() {
 		Logger:      logger,
 		Kubeconfig:  *kubeconfig,
 
+		EventVerbosity: verbosity,
+		MaxRetryDelay:  *retryDelay,
+		Debounce:       *debounce,
+
+		ReconcileInterval: *reconcile,
+
 		ServiceChanged: c.SetBalancer,
 		ServiceDeleted: c.DeleteBalancer,
 		ConfigChanged:  c.SetConfig,
 		Synced:         c.MarkSynced,
+		Reconcile:      c.Reconcile,
 		Shutdown:       c.Shutdown,
 	})
 	if err != nil {
@@ -70,10 +109,74 @@ func main() {
 
 	c.SetClient(client)
 
+	http.Handle("/preview", previewHandler(c))
 	go k8s.RunMetrics("", *port)
+	if *holdDelay > 0 {
+		go releaseExpired(c, *holdDelay/2, stopCh)
+	}
 
 	// the k8s client doesn't return until it's time to shut down
 	if err := client.Run(stopCh); err != nil {
 		logger.Log("op", "startup", "error", err, "msg", "failed to run k8s client")
 	}
 }
+
+// openAuditLog opens the audit log named name for appending. "stdout"
+// means our standard output.
+func openAuditLog(name string) (*os.File, error) {
+	if name == "stdout" {
+		return os.Stdout, nil
+	}
+	return os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+// releaseExpired periodically releases the addresses that we've held
+// for deleted services for longer than the release delay, until stopCh
+// is closed.
+func releaseExpired(c allocator.Controller, interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.ReleaseExpired()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// previewResult is the response body of the /preview endpoint.
+type previewResult struct {
+	Pool    string `json:"pool,omitempty"`
+	Address string `json:"address,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// previewHandler returns an http.Handler that tells the client which
+// pool and address the Service in the request body would get if it
+// were created now. Nothing is allocated.
+func previewHandler(c allocator.Controller) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		svc := &v1.Service{}
+		if err := json.NewDecoder(r.Body).Decode(svc); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(previewResult{Error: err.Error()})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		pool, ip, err := c.Preview(svc)
+		if err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(previewResult{Error: err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(previewResult{Pool: pool, Address: ip.String()})
+	})
+}
@@ -31,16 +31,19 @@ type controller struct {
 	logger     log.Logger
 	myNode     string
 	announcers []lbnodeagent.Announcer
+	ready      *k8s.Readiness
 }
 
-// NewController configures a new controller. If error is non-nil then
-// the controller object shouldn't be used.
-func NewController(l log.Logger, myNode string) (*controller, error) {
+// NewController configures a new controller. allowedPools limits the
+// ServiceGroups whose addresses this node announces; if it's empty
+// then we announce all of them. If error is non-nil then the
+// controller object shouldn't be used.
+func NewController(l log.Logger, myNode string, allowedPools []string) (*controller, error) {
 	con := &controller{
 		logger: l,
 		myNode: myNode,
 		announcers: []lbnodeagent.Announcer{
-			local.NewAnnouncer(l, myNode),
+			local.NewAnnouncer(l, myNode, allowedPools),
 		},
 	}
 
@@ -59,6 +62,13 @@ func (c *controller) SetClient(client *k8s.Client) {
 func (c *controller) ServiceChanged(svc *v1.Service, endpoints *v1.Endpoints) k8s.SyncState {
 	nsName := svc.Namespace + "/" + svc.Name
 
+	// If the user has told us that someone else manages this service
+	// then we don't touch it. The announcers withdraw any addresses
+	// that they announced before the user added the annotation.
+	if svc.Annotations[purelbv1.IgnoreAnnotation] == "true" {
+		return c.announce(svc, endpoints)
+	}
+
 	// If the service isn't a LoadBalancer Type then we might need to
 	// clean up. It might have been a load balancer before and the user
 	// might have changed it (for example, to NodePort) to tell us to
@@ -83,6 +93,16 @@ func (c *controller) ServiceChanged(svc *v1.Service, endpoints *v1.Endpoints) k8
 		return k8s.SyncStateSuccess
 	}
 
+	// Services that aren't LoadBalancers (e.g., headless services) can
+	// ask us to announce their externalIPs. The announcers decide
+	// whether there's anything to announce, and also withdraw any
+	// announcements if the user removes the annotation or the
+	// externalIPs, so they need to see these services even if they
+	// have no externalIPs.
+	if svc.Spec.Type != "LoadBalancer" {
+		return c.announce(svc, endpoints)
+	}
+
 	// If the service has no addresses assigned then there's nothing
 	// that we can do.
 	if len(svc.Status.LoadBalancer.Ingress) < 1 {
@@ -96,7 +116,11 @@ func (c *controller) ServiceChanged(svc *v1.Service, endpoints *v1.Endpoints) k8
 		return k8s.SyncStateSuccess
 	}
 
-	// give each announcer a chance to announce
+	return c.announce(svc, endpoints)
+}
+
+// announce gives each announcer a chance to announce svc.
+func (c *controller) announce(svc *v1.Service, endpoints *v1.Endpoints) k8s.SyncState {
 	announceError := k8s.SyncStateSuccess
 	for _, announcer := range c.announcers {
 		if err := announcer.SetBalancer(svc, endpoints); err != nil {
@@ -136,10 +160,20 @@ func (c *controller) SetConfig(cfg *purelbv1.Config) k8s.SyncState {
 		}
 	}
 
+	if retval != k8s.SyncStateError && c.ready != nil {
+		c.ready.SetConfigured()
+	}
+
 	return retval
 }
 
-func (c *controller) SetElection(election *election.Election) {
+// SetReadiness tells the controller to record in ready when it has
+// loaded a configuration.
+func (c *controller) SetReadiness(ready *k8s.Readiness) {
+	c.ready = ready
+}
+
+func (c *controller) SetElection(election election.Elector) {
 	for _, announcer := range c.announcers {
 		announcer.SetElection(election)
 	}
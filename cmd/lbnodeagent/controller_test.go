@@ -0,0 +1,77 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"purelb.io/internal/election"
+	"purelb.io/internal/k8s"
+	"purelb.io/internal/lbnodeagent"
+	purelbv1 "purelb.io/pkg/apis/v1"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeAnnouncer implements lbnodeagent.Announcer and records the
+// services that it's asked to announce.
+type fakeAnnouncer struct {
+	announced []string
+}
+
+func (f *fakeAnnouncer) SetConfig(*purelbv1.Config) error { return nil }
+func (f *fakeAnnouncer) SetClient(*k8s.Client)            {}
+func (f *fakeAnnouncer) SetBalancer(svc *v1.Service, _ *v1.Endpoints) error {
+	f.announced = append(f.announced, svc.Namespace+"/"+svc.Name)
+	return nil
+}
+func (f *fakeAnnouncer) DeleteBalancer(string, string, net.IP) error { return nil }
+func (f *fakeAnnouncer) SetElection(election.Elector)                {}
+func (f *fakeAnnouncer) Shutdown()                                   {}
+
+func TestExternalIPsRemoved(t *testing.T) {
+	announcer := &fakeAnnouncer{}
+	c := &controller{
+		logger:     log.NewNopLogger(),
+		myNode:     "test-node",
+		announcers: []lbnodeagent.Announcer{announcer},
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test",
+			Name:        "headless",
+			Annotations: map[string]string{purelbv1.AnnounceExternalIPsAnnotation: "true"},
+		},
+		Spec: v1.ServiceSpec{
+			Type:        v1.ServiceTypeClusterIP,
+			ClusterIP:   v1.ClusterIPNone,
+			ExternalIPs: []string{"10.42.42.1"},
+		},
+	}
+
+	// A service with externalIPs is announced
+	assert.Equal(t, k8s.SyncStateSuccess, c.ServiceChanged(svc, &v1.Endpoints{}))
+	assert.Equal(t, []string{"test/headless"}, announcer.announced)
+
+	// and so is one whose last externalIP was removed, so the
+	// announcers can withdraw it
+	svc.Spec.ExternalIPs = nil
+	assert.Equal(t, k8s.SyncStateSuccess, c.ServiceChanged(svc, &v1.Endpoints{}))
+	assert.Equal(t, []string{"test/headless", "test/headless"}, announcer.announced)
+}
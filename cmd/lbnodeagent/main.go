@@ -17,9 +17,12 @@ package main
 
 import (
 	"flag"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"purelb.io/internal/election"
 	"purelb.io/internal/k8s"
@@ -36,6 +39,14 @@ func main() {
 		host             = flag.String("host", os.Getenv("PURELB_HOST"), "HTTP host address for Prometheus metrics")
 		myNode           = flag.String("node-name", os.Getenv("PURELB_NODE_NAME"), "name of this Kubernetes node (spec.nodeName)")
 		port             = flag.Int("port", 7472, "HTTP listening port for Prometheus metrics")
+		events           = flag.String("event-verbosity", "normal", "which Kubernetes events to send: errors, normal, or verbose")
+		resyncJitter     = flag.Duration("resync-jitter", 0, "maximum random delay before reprocessing all services, e.g., after a configuration change (0 means no delay)")
+		maxRetries       = flag.Int("max-retries", 0, "number of times to retry a failed service update before giving up until the service changes (0 means retry forever)")
+		maxRetryDelay    = flag.Duration("max-retry-delay", k8s.DefaultMaxRetryDelay, "maximum delay between retries of a failed service update")
+		announcePools    = flag.String("announce-pools", os.Getenv("PURELB_ANNOUNCE_POOLS"), "comma-separated list of ServiceGroups whose addresses this node announces (empty means all of them)")
+		vrrpInstances    = flag.String("vrrp-instances", os.Getenv("PURELB_VRRP_INSTANCES"), "comma-separated list of VRRP instances that decide which node announces local addresses, e.g., VI_1=192.168.1.0/24 (empty means memberlist decides)")
+		vrrpStateDir     = flag.String("vrrp-state-dir", "/var/run/purelb/vrrp", "directory that contains a file with the state of each VRRP instance")
+		electionWait     = flag.Duration("election-wait", 0, "maximum time to wait at startup for the memberlist to converge before announcing anything (0 means don't wait)")
 	)
 	flag.Parse()
 
@@ -44,6 +55,18 @@ func main() {
 		os.Exit(1)
 	}
 
+	verbosity, err := k8s.ParseEventVerbosity(*events)
+	if err != nil {
+		logger.Log("op", "startup", "error", err, "msg", "invalid configuration")
+		os.Exit(1)
+	}
+
+	vrrp, err := election.ParseVRRPInstances(*vrrpInstances)
+	if err != nil {
+		logger.Log("op", "startup", "error", err, "msg", "invalid configuration")
+		os.Exit(1)
+	}
+
 	stopCh := make(chan struct{})
 	go func() {
 		c1 := make(chan os.Signal, 1)
@@ -55,10 +78,18 @@ func main() {
 	}()
 	defer logger.Log("op", "shutdown", "msg", "done")
 
+	var allowedPools []string
+	for _, pool := range strings.Split(*announcePools, ",") {
+		if pool = strings.TrimSpace(pool); pool != "" {
+			allowedPools = append(allowedPools, pool)
+		}
+	}
+
 	// Set up controller
 	ctrl, err := NewController(
 		logger,
 		*myNode,
+		allowedPools,
 	)
 	if err != nil {
 		logger.Log("op", "startup", "error", err, "msg", "failed to create controller")
@@ -71,6 +102,12 @@ func main() {
 		Logger:        logger,
 		Kubeconfig:    *kubeconfig,
 		ReadEndpoints: true,
+		ReadNodePods:  true,
+
+		EventVerbosity: verbosity,
+		MaxRetries:     *maxRetries,
+		ResyncJitter:   *resyncJitter,
+		MaxRetryDelay:  *maxRetryDelay,
 
 		ServiceChanged: ctrl.ServiceChanged,
 		ServiceDeleted: ctrl.DeleteBalancer,
@@ -84,7 +121,10 @@ func main() {
 
 	ctrl.SetClient(client)
 
-	election, err := election.New(&election.Config{
+	ready := &k8s.Readiness{}
+	ctrl.SetReadiness(ready)
+
+	memberlist, err := election.New(&election.Config{
 		Namespace: *memberlistNS,
 		Labels:    *memberlistLabels,
 		NodeName:  *myNode,
@@ -100,19 +140,40 @@ func main() {
 		os.Exit(1)
 	}
 
-	ctrl.SetElection(&election)
+	// If the user has VRRP instances then they decide which node
+	// announces their addresses, and memberlist decides the rest.
+	if len(vrrp) > 0 {
+		vrrpElection := election.NewVRRP(*myNode, vrrp, election.VRRPStateDir(*vrrpStateDir), &memberlist, logger)
+		go vrrpElection.Watch(time.Second, stopCh, client.ForceSync)
+		ctrl.SetElection(vrrpElection)
+	} else {
+		ctrl.SetElection(&memberlist)
+	}
 
 	iplist, err := client.GetPodsIPs(*memberlistNS, *memberlistLabels)
 	if err != nil {
 		logger.Log("op", "startup", "error", err, "msg", "failed to get PodsIPs")
 		os.Exit(1)
 	}
-	err = election.Join(iplist)
+	err = memberlist.Join(iplist)
 	if err != nil {
 		logger.Log("op", "startup", "error", err, "msg", "failed to join election")
 		os.Exit(1)
 	}
+	ready.SetMembers(memberlist.NumMembers)
+
+	// We don't announce anything until the k8s client runs, so if we
+	// wait here for the memberlist to converge then our first
+	// elections will include the other members.
+	if *electionWait > 0 {
+		if memberlist.WaitForConvergence(*electionWait) {
+			logger.Log("op", "startup", "msg", "memberlist converged", "members", memberlist.NumMembers())
+		} else {
+			logger.Log("op", "startup", "error", "memberlist not converged, announcing anyway", "timeout", *electionWait, "members", memberlist.NumMembers())
+		}
+	}
 
+	http.Handle("/readyz", ready)
 	go k8s.RunMetrics(*host, *port)
 
 	// the k8s client doesn't return until it's time to shut down
@@ -15,15 +15,23 @@
 package allocator
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
 
 	"purelb.io/internal/k8s"
 	purelbv1 "purelb.io/pkg/apis/v1"
+	"purelb.io/pkg/generated/clientset/versioned"
 )
 
 const (
@@ -32,17 +40,122 @@ const (
 
 // An Allocator tracks IP address pools and allocates addresses from them.
 type Allocator struct {
-	client k8s.ServiceEvent
-	logger log.Logger
-	pools  map[string]Pool
+	client   k8s.ServiceEvent
+	logger   log.Logger
+	pools    map[string]Pool
+	draining map[string]bool // poolName -> true if the pool is draining
+	groups   map[string]*purelbv1.ServiceGroup
+	lowFree  map[string]bool // poolName -> true if we've warned that the pool is low
+	excluded []*net.IPNet    // addresses that we never assign
+
+	// namespacedSharing is true if sharing keys are scoped to their
+	// services' namespaces.
+	namespacedSharing bool
+
+	// namespaceQuota is the number of services in each namespace that
+	// can have addresses. 0 means that there's no quota.
+	namespaceQuota int
+
+	// preferredFamily is the family preference of local pools that
+	// don't have their own.
+	preferredFamily string
+
+	// defaultPool is the pool from which we allocate addresses for
+	// services that don't ask for a specific pool.
+	defaultPool string
+
+	// externalIPs is true if we copy the addresses that we allocate
+	// into the services' externalIPs.
+	externalIPs bool
+
+	// releaseDelay is how long we hold the addresses of deleted
+	// services so they can get them back if they're re-created. 0
+	// means that we release them immediately.
+	releaseDelay time.Duration
+	held         map[string]heldAddresses // svc name -> addresses
+
+	// now returns the current time. Tests replace it with a fake
+	// clock.
+	now func() time.Time
+
+	// status writes the number of allocated addresses to each
+	// ServiceGroup's status. It's nil if we don't write them.
+	status *groupStatus
+
+	// audit records each address that we allocate, hold, and
+	// release. It's nil if the user doesn't want an audit log.
+	audit *auditLog
+
+	// dryRun is true if this is a copy that Preview allocates from. It
+	// doesn't update metrics.
+	dryRun bool
+}
+
+// heldAddresses are the addresses of a deleted service that we hold
+// in case it's re-created. They stay assigned in their pool so other
+// services don't get them unless the pool runs out of addresses.
+type heldAddresses struct {
+	pool    string
+	ips     []net.IP
+	expires time.Time
 }
 
 // New returns an Allocator managing no pools.
 func New(log log.Logger) *Allocator {
 	return &Allocator{
-		logger: log,
-		pools:  map[string]Pool{},
+		logger:   log,
+		pools:    map[string]Pool{},
+		draining: map[string]bool{},
+		groups:   map[string]*purelbv1.ServiceGroup{},
+		lowFree:  map[string]bool{},
+		held:     map[string]heldAddresses{},
+		now:      time.Now,
+
+		defaultPool: defaultPoolName,
+	}
+}
+
+// SetAuditLog tells the allocator to write a JSON audit record to sink
+// for each address that it allocates, holds, and releases. actor
+// identifies this allocator in the records. If sink is nil then we
+// don't write audit records.
+func (a *Allocator) SetAuditLog(sink io.Writer, actor string) {
+	if sink == nil {
+		a.audit = nil
+		return
+	}
+	a.audit = newAuditLog(sink, actor, a.logger)
+}
+
+// SetReleaseDelay sets how long we hold the addresses of deleted
+// services. If a service with the same name is created within delay
+// then it gets its old addresses back, if they're still free. 0 means
+// that addresses are released immediately.
+func (a *Allocator) SetReleaseDelay(delay time.Duration) {
+	a.releaseDelay = delay
+}
+
+// SetDefaultPool sets the name of the pool from which we allocate
+// addresses for services that don't ask for a specific pool. If name
+// is "" then we use "default".
+func (a *Allocator) SetDefaultPool(name string) {
+	if name == "" {
+		name = defaultPoolName
 	}
+	a.defaultPool = name
+}
+
+// SetExternalIPs determines whether we copy the addresses that we
+// allocate into the services' externalIPs, as well as their ingress
+// status, for tools that read only externalIPs.
+func (a *Allocator) SetExternalIPs(externalIPs bool) {
+	a.externalIPs = externalIPs
+}
+
+// SetStatusClient tells the allocator to write the number of
+// allocated addresses to each ServiceGroup's status through client.
+func (a *Allocator) SetStatusClient(client versioned.Interface) {
+	a.status = newGroupStatus(client, a.logger)
 }
 
 // SetClient sets this Allocator's client field.
@@ -63,24 +176,256 @@ func (a *Allocator) SetPools(groups []*purelbv1.ServiceGroup) error {
 		if pools[n] == nil {
 			poolCapacity.DeleteLabelValues(n)
 			poolActive.DeleteLabelValues(n)
+			poolAvailable.DeleteLabelValues(n)
+			for _, family := range ipFamilies {
+				poolActiveFamily.DeleteLabelValues(n, string(family))
+			}
+			poolDraining.DeleteLabelValues(n)
+			poolLowFree.DeleteLabelValues(n)
+			delete(a.lowFree, n)
 		}
 	}
 
+	// Tell the local pools which addresses they can't assign, how to
+	// compare sharing keys, and which family to prefer
+	for name, p := range pools {
+		if lpool, isLocal := p.(LocalPool); isLocal {
+			lpool.excluded = a.excluded
+			lpool.namespacedSharing = a.namespacedSharing
+			if lpool.familyPreference == "" {
+				lpool.familyPreference = a.preferredFamily
+			}
+			pools[name] = lpool
+		}
+	}
+
+	// The new pools don't know about the addresses that we're holding
+	// for deleted services, so reserve them again
+	a.carryOverHeld(pools)
+
 	a.pools = pools
 
+	a.draining = map[string]bool{}
+	a.groups = map[string]*purelbv1.ServiceGroup{}
+	for _, group := range groups {
+		a.groups[group.Name] = group
+		if group.Spec.Draining {
+			a.draining[group.Name] = true
+		}
+	}
+
 	// Refresh or initiate stats
 	for _, p := range a.pools {
 		a.updateStats(p)
 	}
+	a.updateFamilyStats()
 
 	return nil
 }
 
+// SetExcluded sets the addresses that the allocator never assigns,
+// from the agents' ExcludeAddresses. Invalid entries are reported and
+// skipped. It takes effect the next time SetPools is called.
+func (a *Allocator) SetExcluded(agents []*purelbv1.LBNodeAgent) {
+	a.excluded = []*net.IPNet{}
+
+	for _, agent := range agents {
+		for _, raw := range agent.Spec.ExcludeAddresses {
+			excluded, err := parseExcluded(raw)
+			if err != nil {
+				a.client.Errorf(agent, "ParseFailed", "Invalid excluded address: %s", err)
+				a.logger.Log("failure", "invalid excluded address", "lbnodeagent", agent.Name, "message", err)
+				continue
+			}
+			a.excluded = append(a.excluded, excluded)
+		}
+	}
+}
+
+// SetNamespacedSharing scopes sharing keys to their services'
+// namespaces if any of the agents' NamespacedSharingKeys is true. It
+// takes effect the next time SetPools is called.
+func (a *Allocator) SetNamespacedSharing(agents []*purelbv1.LBNodeAgent) {
+	a.namespacedSharing = false
+	for _, agent := range agents {
+		if agent.Spec.NamespacedSharingKeys {
+			a.namespacedSharing = true
+		}
+	}
+}
+
+// SetNamespaceQuota sets the number of services in each namespace
+// that can have addresses, from the agents' NamespaceQuota. If more
+// than one agent has a quota then the smallest wins. Invalid values
+// are reported and skipped.
+func (a *Allocator) SetNamespaceQuota(agents []*purelbv1.LBNodeAgent) {
+	a.namespaceQuota = 0
+	for _, agent := range agents {
+		quota := agent.Spec.NamespaceQuota
+		if quota < 0 {
+			a.client.Errorf(agent, "ParseFailed", "Invalid namespacequota: %d", quota)
+			a.logger.Log("failure", "invalid namespacequota", "lbnodeagent", agent.Name, "namespacequota", quota)
+			continue
+		}
+		if quota > 0 && (a.namespaceQuota == 0 || quota < a.namespaceQuota) {
+			a.namespaceQuota = quota
+		}
+	}
+}
+
+// SetPreferredFamily sets the family preference of local pools that
+// don't have their own, from the agents' PreferredFamily. Invalid
+// values are reported and skipped. It takes effect the next time
+// SetPools is called.
+func (a *Allocator) SetPreferredFamily(agents []*purelbv1.LBNodeAgent) {
+	a.preferredFamily = ""
+	for _, agent := range agents {
+		if agent.Spec.Local == nil {
+			continue
+		}
+		switch agent.Spec.Local.PreferredFamily {
+		case "":
+		case purelbv1.FamilyPreferenceIPv4, purelbv1.FamilyPreferenceIPv6:
+			a.preferredFamily = agent.Spec.Local.PreferredFamily
+		case purelbv1.FamilyPreferenceIPv6ThenIPv4:
+			a.preferredFamily = purelbv1.FamilyPreferenceIPv6
+		default:
+			a.client.Errorf(agent, "ParseFailed", "Invalid preferredfamily: %q", agent.Spec.Local.PreferredFamily)
+			a.logger.Log("failure", "invalid preferredfamily", "lbnodeagent", agent.Name, "preferredfamily", agent.Spec.Local.PreferredFamily)
+		}
+	}
+}
+
+// parseExcluded parses an excluded address, which can be either a
+// CIDR or a single address.
+func parseExcluded(raw string) (*net.IPNet, error) {
+	raw = strings.TrimSpace(raw)
+	if !strings.Contains(raw, "/") {
+		ip := net.ParseIP(raw)
+		if ip == nil {
+			return nil, fmt.Errorf("%q is neither an address nor a CIDR", raw)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, excluded, err := net.ParseCIDR(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%q is neither an address nor a CIDR", raw)
+	}
+	return excluded, nil
+}
+
+// ipFamilies are the address families that we report stats for.
+var ipFamilies = []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol}
+
 // updateStats unconditionally updates internal state to reflect svc's
 // allocation of alloc. Caller must ensure that this call is safe.
 func (a *Allocator) updateStats(pool Pool) {
+	if a.dryRun {
+		return
+	}
 	poolCapacity.WithLabelValues(pool.String()).Set(float64(pool.Size()))
 	poolActive.WithLabelValues(pool.String()).Set(float64(pool.InUse()))
+	poolAvailable.WithLabelValues(pool.String()).Set(float64(available(pool)))
+	for _, family := range ipFamilies {
+		poolActiveFamily.WithLabelValues(pool.String(), string(family)).Set(float64(pool.InUseFamily(family)))
+	}
+	a.updateFamilyStats()
+	if group := a.groups[pool.String()]; group != nil && a.status != nil {
+		a.status.set(group.Namespace, group.Name, pool.InUse())
+	}
+	if a.draining[pool.String()] {
+		poolDraining.WithLabelValues(pool.String()).Set(1)
+	} else {
+		poolDraining.WithLabelValues(pool.String()).Set(0)
+	}
+	a.checkFree(pool)
+}
+
+// updateFamilyStats updates the counts of addresses in use from all
+// pools.
+func (a *Allocator) updateFamilyStats() {
+	for _, family := range ipFamilies {
+		total := 0
+		for _, p := range a.pools {
+			total += p.InUseFamily(family)
+		}
+		activeFamily.WithLabelValues(string(family)).Set(float64(total))
+	}
+}
+
+// checkFree warns the user if pool's free addresses have dropped
+// below its group's LowFreeThreshold. We warn only when the pool
+// crosses the threshold, so the user gets one warning, not one per
+// allocation, until the pool recovers.
+func (a *Allocator) checkFree(pool Pool) {
+	name := pool.String()
+	group := a.groups[name]
+	if group == nil {
+		return
+	}
+
+	free := available(pool)
+	low := freeBelow(pool.Size(), free, group.Spec.LowFreeThreshold)
+	if low {
+		poolLowFree.WithLabelValues(name).Set(1)
+	} else {
+		poolLowFree.WithLabelValues(name).Set(0)
+	}
+
+	if low == a.lowFree[name] {
+		return
+	}
+	if low {
+		a.lowFree[name] = true
+		a.logger.Log("op", "checkFree", "pool", name, "free", free, "threshold", group.Spec.LowFreeThreshold.String(), "msg", "pool is low on addresses")
+		a.client.Errorf(group, "LowOnAddresses", "Pool %s has %d free addresses, below its threshold of %s", name, free, group.Spec.LowFreeThreshold.String())
+	} else {
+		delete(a.lowFree, name)
+		a.logger.Log("op", "checkFree", "pool", name, "free", free, "threshold", group.Spec.LowFreeThreshold.String(), "msg", "pool has recovered")
+	}
+}
+
+// available returns the number of pool's addresses that aren't in
+// use. It's 0 if we don't know how big the pool is (e.g., Netbox).
+func available(pool Pool) uint64 {
+	if pool.Size() > uint64(pool.InUse()) {
+		return pool.Size() - uint64(pool.InUse())
+	}
+	return 0
+}
+
+// freeBelow returns true if free is below threshold, which is either
+// an absolute number of addresses or a percentage of size. A size of
+// zero means that we don't know how big the pool is (e.g., Netbox), so
+// it's never below the threshold.
+func freeBelow(size uint64, free uint64, threshold intstr.IntOrString) bool {
+	if size == 0 {
+		return false
+	}
+
+	if threshold.Type == intstr.Int {
+		return threshold.IntVal > 0 && free < uint64(threshold.IntVal)
+	}
+
+	percent, err := thresholdPercent(threshold)
+	if err != nil || percent <= 0 {
+		return false
+	}
+	return float64(free)*100 < float64(percent)*float64(size)
+}
+
+// thresholdPercent parses a percentage threshold, e.g., "10%".
+func thresholdPercent(threshold intstr.IntOrString) (int, error) {
+	if !strings.HasSuffix(threshold.StrVal, "%") {
+		return 0, fmt.Errorf("%q is not a percentage", threshold.StrVal)
+	}
+	return strconv.Atoi(strings.TrimSuffix(threshold.StrVal, "%"))
 }
 
 // NotifyExisting notifies the allocator of an existing IP assignment,
@@ -105,10 +450,16 @@ func (a *Allocator) NotifyExisting(svc *v1.Service) error {
 // Allocate allocates an IP address for svc based on svc's
 // annotations and current configuration. If the user asks for a
 // specific IP then we'll attempt to use that, and if not we'll use
-// the pool specified in the purelbv1.DesiredGroupAnnotation
-// annotation. If neither is specified then we will attempt to
+// the pools specified in the purelbv1.DesiredGroupAnnotation
+// annotation (which can be a comma-separated list of pools, in which
+// case we use the first that has a free address). If neither is specified then we will attempt to
 // allocate from a pool named "default", if it exists.
 func (a *Allocator) Allocate(svc *v1.Service) error {
+	if err := a.checkQuota(svc); err != nil {
+		a.client.Errorf(svc, "NamespaceQuotaExceeded", "%s", err)
+		return err
+	}
+
 	// If the user asked for a specific IP, allocate that.
 	allocated, err := a.allocateSpecificIP(svc)
 	if err != nil {
@@ -118,23 +469,228 @@ func (a *Allocator) Allocate(svc *v1.Service) error {
 	// The user didn't ask for a specific IP so we can allocate one from
 	// a pool.
 	if !allocated {
-		// Start with the default pool name.
-		poolName := defaultPoolName
-
-		// If the user specified a desiredGroup, then use that.
-		if userPool, has := svc.Annotations[purelbv1.DesiredGroupAnnotation]; has {
-			poolName = userPool
+		poolNames, err := a.poolNames(svc)
+		if err != nil {
+			return err
 		}
 
-		pool, has := a.pools[poolName]
-		if !has {
-			return fmt.Errorf("unknown pool %q", poolName)
+		// If the service was deleted recently then give it its old
+		// addresses back.
+		if a.allocateHeld(svc, poolNames) {
+			return nil
 		}
 
-		// Try to allocate from the pool.
-		if err = a.allocateFromPool(svc, pool); err != nil {
+		// Try each pool in turn and use the first that has a free
+		// address.
+		errs := []string{}
+		for _, poolName := range poolNames {
+			if err = a.allocateFromNamedPool(svc, poolName); err == nil {
+				return nil
+			}
+			errs = append(errs, err.Error())
+		}
+		if len(errs) == 1 {
 			return err
 		}
+		return fmt.Errorf("no pool could allocate an address: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// checkQuota returns an error if svc doesn't have an address and its
+// namespace already has as many services with addresses as its quota
+// allows. Addresses that we're holding for deleted services don't
+// count.
+func (a *Allocator) checkQuota(svc *v1.Service) error {
+	if a.namespaceQuota == 0 {
+		return nil
+	}
+
+	nsName := namespacedName(svc)
+	prefix := svc.Namespace + "/"
+	services := map[string]bool{}
+	for _, p := range a.pools {
+		for _, name := range p.Services() {
+			if _, isHeld := a.held[name]; strings.HasPrefix(name, prefix) && !isHeld {
+				services[name] = true
+			}
+		}
+	}
+	if services[nsName] || len(services) < a.namespaceQuota {
+		return nil
+	}
+	return fmt.Errorf("namespace %s already has %d services with addresses, its quota is %d", svc.Namespace, len(services), a.namespaceQuota)
+}
+
+// poolNames returns the names of the pools from which svc can get an
+// address, in the order in which we should try them.
+func (a *Allocator) poolNames(svc *v1.Service) ([]string, error) {
+	// If the user specified one or more desiredGroups, then use those,
+	// in order. If not, and they asked us to spread services across the
+	// pools, then use the least-utilized pools first.
+	if userPools, has := svc.Annotations[purelbv1.DesiredGroupAnnotation]; has {
+		poolNames := strings.Split(userPools, ",")
+		for i := range poolNames {
+			poolNames[i] = strings.TrimSpace(poolNames[i])
+		}
+		return poolNames, nil
+	} else if svc.Annotations[purelbv1.AllocationPolicyAnnotation] == purelbv1.AllocationPolicySpread {
+		poolNames := a.spreadOrder()
+		if len(poolNames) == 0 {
+			return nil, fmt.Errorf("no pools to spread across")
+		}
+		return poolNames, nil
+	}
+
+	// Use the default pool.
+	return []string{a.defaultPool}, nil
+}
+
+// Preview returns the name of the pool and the address that Allocate
+// would assign to svc, without assigning them. Neither svc nor the
+// pools are modified so Preview can be used to check whether a
+// service would get an address before it's created. If svc would get
+// more than one address then the first is returned, and if they'd
+// come from more than one pool then the pool name is a
+// comma-separated list, as in the PoolAnnotation.
+func (a *Allocator) Preview(svc *v1.Service) (string, net.IP, error) {
+	svc = svc.DeepCopy()
+	svc.Status.LoadBalancer.Ingress = nil
+	if svc.Annotations == nil {
+		svc.Annotations = map[string]string{}
+	}
+
+	if err := a.previewAllocator().Allocate(svc); err != nil {
+		return "", nil, err
+	}
+	return svc.Annotations[purelbv1.PoolAnnotation], net.ParseIP(svc.Status.LoadBalancer.Ingress[0].IP), nil
+}
+
+// previewAllocator returns a copy of a that allocates from copies of
+// a's pools, so Preview runs the same code as Allocate without
+// modifying a. The copy doesn't send events, log, or update metrics,
+// ServiceGroup status, or the audit log.
+func (a *Allocator) previewAllocator() *Allocator {
+	preview := *a
+	preview.client = nopEvents{}
+	preview.logger = log.NewNopLogger()
+	preview.audit = nil
+	preview.dryRun = true
+
+	preview.pools = map[string]Pool{}
+	for name, pool := range a.pools {
+		if lpool, isLocal := pool.(LocalPool); isLocal {
+			preview.pools[name] = lpool.clone()
+		} else {
+			preview.pools[name] = unpreviewablePool{pool}
+		}
+	}
+	preview.held = map[string]heldAddresses{}
+	for svc, held := range a.held {
+		preview.held[svc] = held
+	}
+
+	return &preview
+}
+
+// unpreviewablePool stands in for a pool that can't be copied when we
+// preview an allocation. Only local pools can be copied: Netbox pools
+// allocate their addresses in Netbox.
+type unpreviewablePool struct {
+	Pool
+}
+
+func (p unpreviewablePool) Notify(*v1.Service) error {
+	return fmt.Errorf("pool %s can't preview allocations", p)
+}
+
+func (p unpreviewablePool) AssignNext(*v1.Service) error {
+	return fmt.Errorf("pool %s can't preview allocations", p)
+}
+
+func (p unpreviewablePool) Assign(net.IP, *v1.Service) error {
+	return fmt.Errorf("pool %s can't preview allocations", p)
+}
+
+func (p unpreviewablePool) Release(string) error {
+	return fmt.Errorf("pool %s can't preview allocations", p)
+}
+
+// nopEvents discards the events that a preview allocation would
+// send.
+type nopEvents struct{}
+
+func (nopEvents) Debugf(runtime.Object, string, string, ...interface{}) {}
+func (nopEvents) Infof(runtime.Object, string, string, ...interface{})  {}
+func (nopEvents) Errorf(runtime.Object, string, string, ...interface{}) {}
+func (nopEvents) ForceSync()                                            {}
+
+// spreadOrder returns the names of the pools that can allocate
+// addresses, in order of the fraction of their addresses that are in
+// use, from least to most. Pools with the same fraction are in order
+// by name so the order doesn't depend on map iteration. Pools whose
+// size we don't know (e.g., Netbox pools) and draining pools aren't
+// included.
+func (a *Allocator) spreadOrder() []string {
+	utilization := map[string]float64{}
+	names := []string{}
+	for name, pool := range a.pools {
+		if a.draining[name] || pool.Size() == 0 {
+			continue
+		}
+		utilization[name] = float64(pool.InUse()) / float64(pool.Size())
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		if utilization[names[i]] != utilization[names[j]] {
+			return utilization[names[i]] < utilization[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// desiredGroupChanged returns true if svc's address came from a pool
+// that isn't in its DesiredGroupAnnotation, i.e., the user has changed
+// the annotation since we allocated the address. Services that asked
+// for specific addresses never need to move.
+func (a *Allocator) desiredGroupChanged(svc *v1.Service) bool {
+	userPools, hasDesired := svc.Annotations[purelbv1.DesiredGroupAnnotation]
+	currentPool, hasCurrent := svc.Annotations[purelbv1.PoolAnnotation]
+	if !hasDesired || !hasCurrent {
+		return false
+	}
+	if _, hasAddrs := svc.Annotations[purelbv1.DesiredAddressAnnotation]; hasAddrs || svc.Spec.LoadBalancerIP != "" {
+		return false
+	}
+
+	for _, poolName := range strings.Split(userPools, ",") {
+		if strings.TrimSpace(poolName) == currentPool {
+			return false
+		}
+	}
+	return true
+}
+
+// allocateFromNamedPool assigns an available IP from the pool named
+// poolName to svc.
+func (a *Allocator) allocateFromNamedPool(svc *v1.Service, poolName string) error {
+	pool, has := a.pools[poolName]
+	if !has {
+		return fmt.Errorf("unknown pool %q", poolName)
+	}
+
+	// Draining pools don't allocate new addresses, but they still
+	// honor requests for specific addresses.
+	if a.draining[poolName] {
+		return fmt.Errorf("pool %q is draining", poolName)
+	}
+
+	// Try to allocate from the pool.
+	if err := a.allocateFromPool(svc, pool); err != nil {
+		return fmt.Errorf("pool %q: %w", poolName, err)
 	}
 
 	return nil
@@ -147,6 +703,7 @@ func (a *Allocator) Allocate(svc *v1.Service) error {
 // non-"". If an error happened then the error return will be non-nil.
 func (a *Allocator) allocateSpecificIP(svc *v1.Service) (bool, error) {
 	pools := ""
+	remote := true
 
 	// See if the user configured a specific address and return if not.
 	ips, err := a.serviceAddresses(svc)
@@ -165,17 +722,21 @@ func (a *Allocator) allocateSpecificIP(svc *v1.Service) (bool, error) {
 	}
 
 	// If the service had addresses before, release them.
-	if err := a.Unassign(namespacedName(svc)); err != nil {
-		return false, err
-	}
+	a.release(namespacedName(svc))
 
 	for _, ip := range(ips) {
 
 		// Check that the address belongs to a pool
 		pool := poolFor(a.pools, ip)
 		if pool == nil {
+			if subnetPool := subnetPoolFor(a.pools, ip); subnetPool != nil {
+				return false, fmt.Errorf("%q is in the subnet of group %s but outside its address range", ip, subnetPool)
+			}
 			return false, fmt.Errorf("%q does not belong to any group", ip)
 		}
+		if lpool, isLocal := pool.(LocalPool); isLocal && !lpool.InSubnet(ip) {
+			return false, fmt.Errorf("%q is in the address range of group %s but outside its subnet", ip, pool)
+		}
 
 		// Does the IP already have allocs? If so, needs to be the same
 		// sharing key, and have non-overlapping ports. If not, the proposed
@@ -183,19 +744,21 @@ func (a *Allocator) allocateSpecificIP(svc *v1.Service) (bool, error) {
 		if err := pool.Assign(ip, svc); err != nil {
 			return false, err
 		}
+		a.audit.record(a.now(), auditAllocate, namespacedName(svc), pool.String(), []net.IP{ip})
 
 		a.updateStats(pool)
 
 		// annotate the pool from which the address came
-		a.client.Infof(svc, "AddressAssigned", "Assigned %+v from pool %s", svc.Status.LoadBalancer, pool)
 		if pools == "" {
 			pools = pool.String()
 		} else {
 			pools = pools + ", " + pool.String()
 		}
+		remote = remote && isRemote(pool)
 	}
 
 	svc.Annotations[purelbv1.PoolAnnotation] = pools
+	setAnnounceMethod(svc, remote)
 
 	return true, nil
 }
@@ -203,37 +766,305 @@ func (a *Allocator) allocateSpecificIP(svc *v1.Service) (bool, error) {
 // AllocateFromPool assigns an available IP from pool to service.
 func (a *Allocator) allocateFromPool(svc *v1.Service, pool Pool) error {
 	// If the service had an IP before, release it
-	if err := a.Unassign(namespacedName(svc)); err != nil {
-		return err
+	a.release(namespacedName(svc))
+
+	// Time the whole allocation, including the retry if we have to
+	// release held addresses.
+	start := time.Now()
+	err := pool.AssignNext(svc)
+
+	// Held addresses are only soft-reserved: if the pool is out of
+	// addresses then release them and try again.
+	var exhaustedErr *PoolExhaustedError
+	if errors.As(err, &exhaustedErr) && a.releaseHeldIn(pool) {
+		err = pool.AssignNext(svc)
 	}
+	if !a.dryRun {
+		allocationDuration.WithLabelValues(pool.String()).Observe(time.Since(start).Seconds())
+	}
+
+	if err != nil {
+		// If the service asked for a family that the pool doesn't have
+		// then tell the user so they don't have to guess.
+		var familyErr *NoPoolForFamilyError
+		if errors.As(err, &familyErr) && !a.dryRun {
+			noPoolForFamily.WithLabelValues(familyErr.Pool, string(familyErr.Family)).Inc()
+			a.client.Errorf(svc, "NoPoolForFamily", "Service requested %s but pool %s has no %s addresses", svc.Spec.IPFamilies, familyErr.Pool, familyErr.Family)
+		}
+		var tooManyErr *TooManyAddressesError
+		if errors.As(err, &tooManyErr) {
+			a.client.Errorf(svc, "TooManyAddresses", "Service requested %s but pool %s allows %d address(es) per service", svc.Spec.IPFamilies, tooManyErr.Pool, tooManyErr.Max)
+		}
+		if errors.As(err, &exhaustedErr) && !a.dryRun {
+			poolExhausted.WithLabelValues(exhaustedErr.Pool).Inc()
+			a.client.Errorf(svc, "PoolExhausted", "Pool %s has no free addresses (size %d, %d in use)", exhaustedErr.Pool, pool.Size(), pool.InUse())
+		}
 
-	if err := pool.AssignNext(svc); err != nil {
 		// Woops, no IPs :( Fail.
 		return err
 	}
 
+	nsName := namespacedName(svc)
+	a.audit.record(a.now(), auditAllocate, nsName, pool.String(), serviceAddresses(pool, nsName))
+
 	// annotate the pool from which the address came
-	a.client.Infof(svc, "AddressAssigned", "Assigned %+v from pool %s", svc.Status.LoadBalancer, pool)
 	svc.Annotations[purelbv1.PoolAnnotation] = pool.String()
+	setAnnounceMethod(svc, isRemote(pool))
 	a.updateStats(pool)
 
 	return nil
 }
 
-// Unassign frees the IP associated with service, if any.
+// isRemote returns true if pool's addresses should always be
+// announced remotely.
+func isRemote(pool Pool) bool {
+	if lpool, ok := pool.(LocalPool); ok {
+		return lpool.remote
+	}
+	return false
+}
+
+// setAnnounceMethod annotates svc to tell the node agents how to
+// announce its addresses.
+func setAnnounceMethod(svc *v1.Service, remote bool) {
+	if remote {
+		svc.Annotations[purelbv1.AnnounceMethodAnnotation] = purelbv1.AnnounceMethodRemote
+	} else {
+		svc.Annotations[purelbv1.AnnounceMethodAnnotation] = purelbv1.AnnounceMethodLocal
+	}
+}
+
+// Unassign frees the IP associated with service, if any. If we have a
+// release delay then addresses from local pools are held until it
+// expires, in case the service is re-created.
 func (a *Allocator) Unassign(svc string) error {
-	var err error
+	heldPool := ""
+	if a.releaseDelay > 0 {
+		heldPool = a.hold(svc)
+	}
+	a.releaseExcept(svc, heldPool)
 
+	return nil
+}
+
+// release frees the addresses of svc, including any that we're
+// holding for it.
+func (a *Allocator) release(svc string) {
+	delete(a.held, svc)
+	a.releaseExcept(svc, "")
+}
+
+// releaseExcept frees the addresses of svc in every pool except the
+// one named except.
+func (a *Allocator) releaseExcept(svc string, except string) {
 	// tell the pools that the address has been released. there might
 	// not be a pool, e.g., in the case of a config change that moves
 	// addresses from one pool to another
+	for name, p := range a.pools {
+		if name == except {
+			continue
+		}
+		ips := serviceAddresses(p, svc)
+		if err := p.Release(svc); err == nil {
+			a.audit.record(a.now(), auditRelease, svc, name, ips)
+			a.updateStats(p) // This pool released the address
+		}
+	}
+}
+
+// hold records the addresses that svc has from local pools so we can
+// give them back to it if it's re-created within our release delay.
+// The addresses stay assigned to svc in their pool until then. It
+// returns the name of the pool, or "" if svc has no addresses from
+// local pools.
+func (a *Allocator) hold(svc string) string {
+	for name, p := range a.pools {
+		lpool, isLocal := p.(LocalPool)
+		if !isLocal {
+			continue
+		}
+		if ips := lpool.addressesOf(svc); len(ips) > 0 {
+			a.held[svc] = heldAddresses{pool: name, ips: ips, expires: a.now().Add(a.releaseDelay)}
+			a.logger.Log("op", "hold", "service", svc, "pool", name, "ips", fmt.Sprint(ips), "until", a.held[svc].expires)
+			a.audit.record(a.now(), auditHold, svc, name, ips)
+			return name
+		}
+	}
+	return ""
+}
+
+// allocateHeld gives svc the addresses that we held for it when it
+// was deleted, if they haven't expired, they're in one of poolNames,
+// and they're still free. It returns true if svc got them. Either way
+// the hold is gone afterwards.
+func (a *Allocator) allocateHeld(svc *v1.Service, poolNames []string) bool {
+	nsName := namespacedName(svc)
+	held, isHeld := a.held[nsName]
+	if !isHeld {
+		return false
+	}
+	a.releaseHeld(nsName)
+
+	ips := orderByFamilies(held.ips, svc)
+	if !a.now().Before(held.expires) || a.draining[held.pool] || ips == nil {
+		return false
+	}
+	pool, has := a.pools[held.pool]
+	if !has || !contains(poolNames, held.pool) {
+		return false
+	}
+
+	for _, ip := range ips {
+		if err := pool.Assign(ip, svc); err != nil {
+			a.logger.Log("op", "allocateHeld", "service", nsName, "ip", ip, "error", err)
+			pool.Release(nsName)
+			a.updateStats(pool)
+			return false
+		}
+	}
+	a.logger.Log("op", "allocateHeld", "service", nsName, "pool", held.pool, "ips", fmt.Sprint(held.ips), "msg", "reused held addresses")
+	a.audit.record(a.now(), auditAllocate, nsName, held.pool, ips)
+
+	svc.Annotations[purelbv1.PoolAnnotation] = held.pool
+	setAnnounceMethod(svc, isRemote(pool))
+	a.updateStats(pool)
+
+	return true
+}
+
+// releaseHeld releases the addresses that we're holding for svc, if
+// any.
+func (a *Allocator) releaseHeld(svc string) {
+	held, isHeld := a.held[svc]
+	if !isHeld {
+		return
+	}
+	delete(a.held, svc)
+	if pool, has := a.pools[held.pool]; has {
+		pool.Release(svc)
+		a.audit.record(a.now(), auditRelease, svc, held.pool, held.ips)
+		a.updateStats(pool)
+	}
+}
+
+// carryOverHeld reserves the addresses that we're holding in pools,
+// which are about to replace our current pools. Holds whose pool is
+// gone, or whose addresses are no longer in their pool, are dropped.
+func (a *Allocator) carryOverHeld(pools map[string]Pool) {
+	for svc, held := range a.held {
+		oldPool, wasLocal := a.pools[held.pool].(LocalPool)
+		newPool, isLocal := pools[held.pool].(LocalPool)
+		err := fmt.Errorf("pool %s is gone", held.pool)
+		if wasLocal && isLocal {
+			err = newPool.carryOver(oldPool, svc)
+		}
+		if err != nil {
+			a.logger.Log("op", "carryOverHeld", "service", svc, "pool", held.pool, "ips", fmt.Sprint(held.ips), "error", err, "msg", "dropping hold")
+			delete(a.held, svc)
+			a.audit.record(a.now(), auditRelease, svc, held.pool, held.ips)
+		}
+	}
+}
+
+// releaseHeldIn releases all of the held addresses in pool. It returns
+// true if there were any.
+func (a *Allocator) releaseHeldIn(pool Pool) bool {
+	released := false
+	for svc, held := range a.held {
+		if held.pool == pool.String() {
+			a.releaseHeld(svc)
+			released = true
+		}
+	}
+	return released
+}
+
+// ReleaseExpired releases the held addresses whose release delay has
+// expired. It returns the names of the services whose addresses were
+// released.
+func (a *Allocator) ReleaseExpired() []string {
+	released := []string{}
+	now := a.now()
+	for svc, held := range a.held {
+		if now.Before(held.expires) {
+			continue
+		}
+		a.releaseHeld(svc)
+		released = append(released, svc)
+	}
+	sort.Strings(released)
+
+	return released
+}
+
+// orderByFamilies returns ips in the order of the families that svc
+// asks for, or nil if they're not the families that svc asks for. If
+// svc doesn't ask for any families then ips is returned as is.
+func orderByFamilies(ips []net.IP, svc *v1.Service) []net.IP {
+	if len(svc.Spec.IPFamilies) == 0 {
+		return ips
+	}
+	if len(ips) != len(svc.Spec.IPFamilies) {
+		return nil
+	}
+
+	ordered := []net.IP{}
+	for _, family := range svc.Spec.IPFamilies {
+		for _, ip := range ips {
+			if (ip.To4() != nil) == (family == v1.IPv4Protocol) {
+				ordered = append(ordered, ip)
+				break
+			}
+		}
+	}
+	if len(ordered) != len(ips) {
+		return nil
+	}
+	return ordered
+}
+
+// contains returns true if names contains name.
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ReleaseOrphans releases the addresses of services that aren't in
+// services, i.e., services whose deletes we missed. It returns the
+// names of the services whose addresses were released.
+func (a *Allocator) ReleaseOrphans(services []string) []string {
+	exists := map[string]bool{}
+	for _, svc := range services {
+		exists[svc] = true
+	}
+
+	released := []string{}
 	for _, p := range a.pools {
-		if err = p.Release(svc); err == nil {
-			a.updateStats(p)  // This pool released the address
+		poolReleased := false
+		for _, svc := range p.Services() {
+			if _, isHeld := a.held[svc]; exists[svc] || isHeld {
+				continue
+			}
+			ips := serviceAddresses(p, svc)
+			if err := p.Release(svc); err != nil {
+				a.logger.Log("op", "releaseOrphans", "service", svc, "error", err)
+				continue
+			}
+			a.audit.record(a.now(), auditRelease, svc, p.String(), ips)
+			released = append(released, svc)
+			poolReleased = true
+		}
+		if poolReleased {
+			a.updateStats(p)
 		}
 	}
+	sort.Strings(released)
 
-	return nil
+	return released
 }
 
 // poolFor returns the pool that owns the requested IP, or "" if none.
@@ -246,14 +1077,23 @@ func poolFor(pools map[string]Pool, ip net.IP) Pool {
 	return nil
 }
 
+// subnetPoolFor returns the local pool whose subnet contains ip, or
+// nil if none.
+func subnetPoolFor(pools map[string]Pool, ip net.IP) Pool {
+	for _, p := range pools {
+		if lpool, isLocal := p.(LocalPool); isLocal && lpool.InSubnet(ip) {
+			return p
+		}
+	}
+	return nil
+}
+
 // serviceAddresses returns any IP addresses configured in the provided
 // service. There can be 0-2 addresses: the deprecated
 // svc.Spec.LoadBalancer field can contain one, and the
 // purelbv1.DesiredAddressAnnotation can contain one or two, separated
 // by commas.
 func (a *Allocator) serviceAddresses(svc *v1.Service) ([]net.IP, error) {
-	ips := []net.IP{}
-
 	// Try our annotation first.
 	rawAddrs, exists := svc.Annotations[purelbv1.DesiredAddressAnnotation]
 	if !exists {
@@ -269,6 +1109,14 @@ func (a *Allocator) serviceAddresses(svc *v1.Service) ([]net.IP, error) {
 		a.logger.Log("svc-name", svc.Name, "deprecation", "Service.Spec.LoadBalancerIP is deprecated, please use the \"" + purelbv1.DesiredAddressAnnotation + "\" annotation instead")
 	}
 
+	return parseAddresses(rawAddrs)
+}
+
+// parseAddresses parses a comma-separated list of user-specified
+// addresses.
+func parseAddresses(rawAddrs string) ([]net.IP, error) {
+	ips := []net.IP{}
+
 	for _, rawAddr := range(strings.Split(rawAddrs, ",")) {
 		ip := net.ParseIP(rawAddr)
 		if ip == nil {
@@ -314,8 +1162,17 @@ Group:
 			}
 		}
 
+		// A bad threshold isn't a reason to reject the pool, but the user
+		// needs to know that they won't get warnings
+		if group.Spec.LowFreeThreshold.Type == intstr.String {
+			if _, err := thresholdPercent(group.Spec.LowFreeThreshold); err != nil {
+				a.client.Errorf(group, "ParseFailed", "Invalid lowfreethreshold: %s", err)
+				a.logger.Log("failure", "invalid lowfreethreshold", "service-group", group.Name, "message", err)
+			}
+		}
+
 		pools[group.Name] = pool
-		a.client.Infof(group, "Parsed", "ServiceGroup parsed successfully")
+		a.client.Debugf(group, "Parsed", "ServiceGroup parsed successfully")
 	}
 
 	return pools
@@ -19,13 +19,17 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
 	ptu "github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 
 	purelbv1 "purelb.io/pkg/apis/v1"
 )
@@ -682,12 +686,15 @@ func TestPoolMetrics(t *testing.T) {
 
 	// The "test" pool contains one range: 1.2.3.4/30
 	assert.Equal(t, 4.0, ptu.ToFloat64(poolCapacity.WithLabelValues("test")), "stats.poolCapacity invalid")
+	assert.Equal(t, 4.0, ptu.ToFloat64(poolAvailable.WithLabelValues("test")), "stats.poolAvailable invalid")
+	assert.Contains(t, poolAvailable.WithLabelValues("test").Desc().String(), `"purelb_allocator_pool_available"`)
 
 	for _, test := range tests {
 		service := service(test.svc, test.ports, test.sharingKey)
 		if test.ip == "" {
 			alloc.Unassign(namespacedName(&service))
 			assert.Equal(t, test.ipsInUse, ptu.ToFloat64(poolActive.WithLabelValues(testSG.ObjectMeta.Name)), "incorrect pool active IP count after unassign")
+			assert.Equal(t, 4-test.ipsInUse, ptu.ToFloat64(poolAvailable.WithLabelValues(testSG.ObjectMeta.Name)), "incorrect pool available IP count after unassign")
 			continue
 		}
 
@@ -696,7 +703,16 @@ func TestPoolMetrics(t *testing.T) {
 		assert.Nil(t, err, "%q: Assign(%q, %q)", test.desc, test.svc, test.ip)
 		assert.Equal(t, testSG.ObjectMeta.Name, service.Annotations[purelbv1.PoolAnnotation], "incorrect pool assigned")
 		assert.Equal(t, test.ipsInUse, ptu.ToFloat64(poolActive.WithLabelValues(testSG.ObjectMeta.Name)), "incorrect pool active IP count after allocation")
+		assert.Equal(t, 4-test.ipsInUse, ptu.ToFloat64(poolAvailable.WithLabelValues(testSG.ObjectMeta.Name)), "incorrect pool available IP count after allocation")
 	}
+
+	// Pools whose size we don't know have no available addresses
+	netbox := NetboxPool{}
+	assert.Equal(t, uint64(0), available(netbox))
+
+	// Removing the pool removes its stats
+	alloc.SetPools([]*purelbv1.ServiceGroup{localServiceGroup("other", "4.3.2.1/32")})
+	assert.False(t, poolAvailable.DeleteLabelValues("test"), "pool's stats weren't removed")
 }
 
 // TestSpecificAddress tests allocations when a specific address is
@@ -823,6 +839,1048 @@ func TestSharingSimple(t *testing.T) {
 	assert.Equal(t, "1.2.3.0", svc3.Status.LoadBalancer.Ingress[0].IP, "IP wasn't assigned to service ingress")
 }
 
+// TestSharingCrossNamespace tests that services in different
+// namespaces can share an address, and that releasing one of them
+// doesn't release the address out from under the others.
+func TestSharingCrossNamespace(t *testing.T) {
+	const sharing = "sharing-is-caring"
+
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(&testK8S{t: t})
+
+	groups := []*purelbv1.ServiceGroup{
+		{ObjectMeta: metav1.ObjectMeta{Name: defaultPoolName},
+			Spec: purelbv1.ServiceGroupSpec{
+				Local: &purelbv1.ServiceGroupLocalSpec{
+					Subnet: "1.2.3.0/31",
+					Pool:   "1.2.3.0/31",
+				},
+			},
+		},
+	}
+	assert.Nil(t, alloc.SetPools(groups), "SetPools failed")
+
+	svc := func(namespace string, port string) *v1.Service {
+		svc := service("web", ports(port), sharing)
+		svc.Namespace = namespace
+		return &svc
+	}
+
+	// Services with the same name and sharing key in different
+	// namespaces share an address
+	svcA := svc("a", "tcp/80")
+	assert.Nil(t, alloc.Allocate(svcA), "error allocating address")
+	assert.Equal(t, "1.2.3.0", svcA.Status.LoadBalancer.Ingress[0].IP)
+	svcB := svc("b", "tcp/81")
+	assert.Nil(t, alloc.Allocate(svcB), "error allocating address")
+	assert.Equal(t, "1.2.3.0", svcB.Status.LoadBalancer.Ingress[0].IP, "b/web didn't share a/web's address")
+
+	// The port is in use by a/web so c/web gets a different address
+	svcC := svc("c", "tcp/80")
+	assert.Nil(t, alloc.Allocate(svcC), "error allocating address")
+	assert.Equal(t, "1.2.3.1", svcC.Status.LoadBalancer.Ingress[0].IP, "c/web shared a port with a/web")
+
+	// Releasing a/web leaves the address with b/web, but frees a/web's
+	// port
+	pool := alloc.pools[defaultPoolName].(LocalPool)
+	assert.Nil(t, alloc.Unassign(namespacedName(svcA)))
+	assert.ElementsMatch(t, []string{"b/web"}, pool.servicesOnIP(net.ParseIP("1.2.3.0")))
+	svcD := svc("d", "tcp/80")
+	assert.Nil(t, alloc.Allocate(svcD), "error allocating address")
+	assert.Equal(t, "1.2.3.0", svcD.Status.LoadBalancer.Ingress[0].IP, "d/web didn't get a/web's port")
+
+	// The address is free only when the last namespace releases it
+	assert.Nil(t, alloc.Unassign(namespacedName(svcB)))
+	assert.NotNil(t, pool.SharingKey(net.ParseIP("1.2.3.0")), "address released while d/web was using it")
+	assert.Nil(t, alloc.Unassign(namespacedName(svcD)))
+	assert.Nil(t, pool.SharingKey(net.ParseIP("1.2.3.0")), "address not released")
+}
+
+// TestNamespacedSharingKeys tests that services in different
+// namespaces don't share addresses if sharing keys are namespaced.
+func TestNamespacedSharingKeys(t *testing.T) {
+	const sharing = "web"
+
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(&testK8S{t: t})
+	alloc.SetNamespacedSharing([]*purelbv1.LBNodeAgent{
+		{ObjectMeta: metav1.ObjectMeta{Name: "agent"},
+			Spec: purelbv1.LBNodeAgentSpec{NamespacedSharingKeys: true},
+		},
+	})
+	assert.Nil(t, alloc.SetPools([]*purelbv1.ServiceGroup{
+		localServiceGroup(defaultPoolName, "1.2.3.0/31"),
+	}), "SetPools failed")
+
+	svc := func(namespace string, name string, port string) *v1.Service {
+		svc := service(name, ports(port), sharing)
+		svc.Namespace = namespace
+		return &svc
+	}
+
+	// Services in the same namespace with the same key share
+	svcA1 := svc("a", "web1", "tcp/80")
+	assert.Nil(t, alloc.Allocate(svcA1), "error allocating address")
+	assert.Equal(t, "1.2.3.0", svcA1.Status.LoadBalancer.Ingress[0].IP)
+	svcA2 := svc("a", "web2", "tcp/81")
+	assert.Nil(t, alloc.Allocate(svcA2), "error allocating address")
+	assert.Equal(t, "1.2.3.0", svcA2.Status.LoadBalancer.Ingress[0].IP, "a/web2 didn't share a/web1's address")
+
+	// A service in a different namespace with the same key doesn't
+	svcB := svc("b", "web", "tcp/82")
+	assert.Nil(t, alloc.Allocate(svcB), "error allocating address")
+	assert.Equal(t, "1.2.3.1", svcB.Status.LoadBalancer.Ingress[0].IP, "b/web shared a's address")
+
+	// ...not even if it asks for the address
+	svcC := svc("c", "web", "tcp/83")
+	svcC.Annotations[purelbv1.DesiredAddressAnnotation] = "1.2.3.0"
+	assert.Error(t, alloc.Allocate(svcC), "c/web shared a's address")
+
+	// Keys aren't namespaced unless the user asks
+	alloc.SetNamespacedSharing([]*purelbv1.LBNodeAgent{{ObjectMeta: metav1.ObjectMeta{Name: "agent"}}})
+	assert.Nil(t, alloc.SetPools([]*purelbv1.ServiceGroup{
+		localServiceGroup(defaultPoolName, "1.2.3.0/31"),
+	}), "SetPools failed")
+	assert.Nil(t, alloc.NotifyExisting(svcA1), "error notifying existing address")
+	assert.Nil(t, alloc.Allocate(svcC), "c/web didn't share a's address")
+	assert.Equal(t, "1.2.3.0", svcC.Status.LoadBalancer.Ingress[0].IP)
+}
+
+// TestAnnounceMethod tests that the allocator tells the node agents
+// to announce addresses from Remote groups remotely.
+func TestNamespaceQuota(t *testing.T) {
+	k := &testK8S{t: t}
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(k)
+	alloc.SetNamespaceQuota([]*purelbv1.LBNodeAgent{
+		{Spec: purelbv1.LBNodeAgentSpec{NamespaceQuota: 3}},
+		{Spec: purelbv1.LBNodeAgentSpec{NamespaceQuota: 2}},
+		{Spec: purelbv1.LBNodeAgentSpec{}},
+	})
+	assert.Equal(t, 2, alloc.namespaceQuota, "the smallest quota should win")
+
+	if alloc.SetPools([]*purelbv1.ServiceGroup{
+		localServiceGroup("default", "1.2.3.0/28"),
+	}) != nil {
+		t.Fatal("SetConfig failed")
+	}
+
+	// The namespace can have as many services as its quota
+	svc1 := service("svc1", ports("tcp/80"), "")
+	svc2 := service("svc2", ports("tcp/80"), "")
+	assert.NoError(t, alloc.Allocate(&svc1))
+	assert.NoError(t, alloc.Allocate(&svc2))
+	assert.Empty(t, k.warnings)
+
+	// The next one is blocked, and the user is told why
+	svc3 := service("svc3", ports("tcp/80"), "")
+	assert.Error(t, alloc.Allocate(&svc3))
+	assert.Empty(t, svc3.Status.LoadBalancer.Ingress)
+	assert.Equal(t, []string{"NamespaceQuotaExceeded"}, k.warnings)
+
+	// Services that already have addresses can be re-allocated
+	k.reset()
+	assert.NoError(t, alloc.Allocate(&svc2))
+	assert.Empty(t, k.warnings)
+
+	// Other namespaces have their own quotas
+	other := service("svc3", ports("tcp/80"), "")
+	other.Namespace = "other"
+	assert.NoError(t, alloc.Allocate(&other))
+
+	// Once a service releases its address there's room for another
+	assert.NoError(t, alloc.Unassign("unit/svc1"))
+	assert.NoError(t, alloc.Allocate(&svc3))
+
+	// Invalid quotas are reported and ignored
+	k.reset()
+	alloc.SetNamespaceQuota([]*purelbv1.LBNodeAgent{{Spec: purelbv1.LBNodeAgentSpec{NamespaceQuota: -1}}})
+	assert.Equal(t, 0, alloc.namespaceQuota)
+	assert.Equal(t, []string{"ParseFailed"}, k.warnings)
+}
+
+func TestAnnounceMethod(t *testing.T) {
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(&testK8S{t: t})
+
+	groups := []*purelbv1.ServiceGroup{
+		localServiceGroup("local", "1.2.3.0/31"),
+		serviceGroup("remote", purelbv1.ServiceGroupSpec{
+			Local: &purelbv1.ServiceGroupLocalSpec{
+				Subnet: "3.2.1.0/31",
+				Pool:   "3.2.1.0/31",
+				Remote: true,
+			},
+		}),
+	}
+	if alloc.SetPools(groups) != nil {
+		t.Fatal("SetConfig failed")
+	}
+
+	svc1 := service("svc1", ports("tcp/80"), "")
+	svc1.Annotations[purelbv1.DesiredGroupAnnotation] = "local"
+	assert.Nil(t, alloc.Allocate(&svc1), "error allocating address")
+	assert.Equal(t, purelbv1.AnnounceMethodLocal, svc1.Annotations[purelbv1.AnnounceMethodAnnotation])
+
+	svc2 := service("svc2", ports("tcp/80"), "")
+	svc2.Annotations[purelbv1.DesiredGroupAnnotation] = "remote"
+	assert.Nil(t, alloc.Allocate(&svc2), "error allocating address")
+	assert.Equal(t, purelbv1.AnnounceMethodRemote, svc2.Annotations[purelbv1.AnnounceMethodAnnotation])
+
+	// Specific addresses are stamped the same way
+	svc3 := service("svc3", ports("tcp/80"), "")
+	svc3.Annotations[purelbv1.DesiredAddressAnnotation] = "3.2.1.1"
+	assert.Nil(t, alloc.Allocate(&svc3), "error allocating address")
+	assert.Equal(t, purelbv1.AnnounceMethodRemote, svc3.Annotations[purelbv1.AnnounceMethodAnnotation])
+}
+
+// TestDrainingPool tests that draining pools don't allocate addresses
+// automatically, but still honor existing and specific allocations.
+func TestDrainingPool(t *testing.T) {
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(&testK8S{t: t})
+
+	draining := localServiceGroup("draining", "1.2.3.0/30")
+	draining.Spec.Draining = true
+	groups := []*purelbv1.ServiceGroup{
+		draining,
+		localServiceGroup("default", "3.2.1.0/31"),
+	}
+	if alloc.SetPools(groups) != nil {
+		t.Fatal("SetConfig failed")
+	}
+	assert.Equal(t, 1.0, ptu.ToFloat64(poolDraining.WithLabelValues("draining")))
+	assert.Equal(t, 0.0, ptu.ToFloat64(poolDraining.WithLabelValues("default")))
+
+	// Auto-allocation from the draining pool fails
+	svc1 := service("svc1", ports("tcp/80"), "")
+	svc1.Annotations[purelbv1.DesiredGroupAnnotation] = "draining"
+	assert.Error(t, alloc.Allocate(&svc1), "draining pool allocated an address")
+	assert.Empty(t, svc1.Status.LoadBalancer.Ingress)
+
+	// Other pools are unaffected
+	svc2 := service("svc2", ports("tcp/80"), "")
+	assert.Nil(t, alloc.Allocate(&svc2), "error allocating address")
+	assert.Equal(t, "3.2.1.0", svc2.Status.LoadBalancer.Ingress[0].IP)
+
+	// Existing allocations are honored
+	svc3 := service("svc3", ports("tcp/80"), "")
+	svc3.Annotations[purelbv1.PoolAnnotation] = "draining"
+	svc3.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "1.2.3.1"}}
+	assert.Nil(t, alloc.NotifyExisting(&svc3), "error notifying existing address")
+
+	// Specific addresses are honored
+	svc4 := service("svc4", ports("tcp/80"), "")
+	svc4.Annotations[purelbv1.DesiredAddressAnnotation] = "1.2.3.2"
+	assert.Nil(t, alloc.Allocate(&svc4), "error allocating specific address")
+	assert.Equal(t, "1.2.3.2", svc4.Status.LoadBalancer.Ingress[0].IP)
+
+	// The pool reports how many addresses remain
+	assert.Equal(t, 2.0, ptu.ToFloat64(poolActive.WithLabelValues("draining")))
+}
+
+// TestPoolList tests that the allocator uses the first pool in the
+// DesiredGroupAnnotation list that has a free address.
+func TestPoolList(t *testing.T) {
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(&testK8S{t: t})
+
+	groups := []*purelbv1.ServiceGroup{
+		localServiceGroup("first", "1.2.3.0/32"),
+		localServiceGroup("second", "3.2.1.0/32"),
+	}
+	if alloc.SetPools(groups) != nil {
+		t.Fatal("SetConfig failed")
+	}
+
+	// The first pool has a free address so we use it
+	svc1 := service("svc1", ports("tcp/80"), "")
+	svc1.Annotations[purelbv1.DesiredGroupAnnotation] = "first,second"
+	assert.Nil(t, alloc.Allocate(&svc1), "error allocating address")
+	assert.Equal(t, "1.2.3.0", svc1.Status.LoadBalancer.Ingress[0].IP)
+	assert.Equal(t, "first", svc1.Annotations[purelbv1.PoolAnnotation])
+
+	// The first pool is full so we use the second, skipping pools that
+	// don't exist
+	svc2 := service("svc2", ports("tcp/80"), "")
+	svc2.Annotations[purelbv1.DesiredGroupAnnotation] = "first, bogus, second"
+	assert.Nil(t, alloc.Allocate(&svc2), "error allocating address")
+	assert.Equal(t, "3.2.1.0", svc2.Status.LoadBalancer.Ingress[0].IP)
+	assert.Equal(t, "second", svc2.Annotations[purelbv1.PoolAnnotation])
+
+	// All of the pools are full so the allocation fails
+	svc3 := service("svc3", ports("tcp/80"), "")
+	svc3.Annotations[purelbv1.DesiredGroupAnnotation] = "first,second"
+	err := alloc.Allocate(&svc3)
+	assert.ErrorContains(t, err, `pool "first"`)
+	assert.ErrorContains(t, err, `pool "second"`)
+	assert.Empty(t, svc3.Status.LoadBalancer.Ingress)
+}
+
+// TestDefaultPoolName tests that services that don't ask for a pool
+// get addresses from the configured default pool.
+func TestDefaultPoolName(t *testing.T) {
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(&testK8S{t: t})
+	alloc.SetDefaultPool("public")
+
+	if alloc.SetPools([]*purelbv1.ServiceGroup{
+		localServiceGroup(defaultPoolName, "1.2.3.0/32"),
+		localServiceGroup("public", "3.2.1.0/32"),
+	}) != nil {
+		t.Fatal("SetConfig failed")
+	}
+
+	svc1 := service("svc1", ports("tcp/80"), "")
+	assert.Nil(t, alloc.Allocate(&svc1), "error allocating address")
+	assert.Equal(t, "3.2.1.0", svc1.Status.LoadBalancer.Ingress[0].IP)
+	assert.Equal(t, "public", svc1.Annotations[purelbv1.PoolAnnotation])
+
+	// The "default" pool is just another pool now
+	svc2 := service("svc2", ports("tcp/80"), "")
+	assert.Error(t, alloc.Allocate(&svc2), "custom default pool should be full")
+	svc2.Annotations[purelbv1.DesiredGroupAnnotation] = defaultPoolName
+	assert.Nil(t, alloc.Allocate(&svc2), "error allocating address")
+	assert.Equal(t, "1.2.3.0", svc2.Status.LoadBalancer.Ingress[0].IP)
+
+	// An empty name restores the usual default
+	alloc.SetDefaultPool("")
+	assert.Equal(t, defaultPoolName, alloc.defaultPool)
+}
+
+// TestPreferredFamily tests that the agents' PreferredFamily decides
+// which family dual-stack pools try first, unless the pool has its
+// own preference.
+func TestPreferredFamily(t *testing.T) {
+	k := &testK8S{t: t}
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(k)
+
+	dualGroup := func(name string, v4 string, v6 string, preference string) *purelbv1.ServiceGroup {
+		return &purelbv1.ServiceGroup{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: purelbv1.ServiceGroupSpec{
+				Local: &purelbv1.ServiceGroupLocalSpec{
+					V4Pools:          []*purelbv1.ServiceGroupAddressPool{{Pool: v4, Subnet: v4}},
+					V6Pools:          []*purelbv1.ServiceGroupAddressPool{{Pool: v6, Subnet: v6}},
+					FamilyPreference: preference,
+				},
+			},
+		}
+	}
+	agents := func(preferred string) []*purelbv1.LBNodeAgent {
+		return []*purelbv1.LBNodeAgent{
+			{ObjectMeta: metav1.ObjectMeta{Name: "agent"},
+				Spec: purelbv1.LBNodeAgentSpec{
+					Local: &purelbv1.LBNodeAgentLocalSpec{PreferredFamily: preferred},
+				},
+			},
+		}
+	}
+	allocate := func(name string, pool string) string {
+		svc := service(name, ports("tcp/80"), "")
+		svc.Annotations[purelbv1.DesiredGroupAnnotation] = pool
+		assert.Nil(t, alloc.Allocate(&svc), "error allocating address")
+		return svc.Status.LoadBalancer.Ingress[0].IP
+	}
+	groups := []*purelbv1.ServiceGroup{
+		dualGroup("nopref", "1.2.3.0/30", "2001:db8::/126", ""),
+		dualGroup("v6pref", "3.2.1.0/30", "2001:db8:1::/126", purelbv1.FamilyPreferenceIPv6),
+	}
+
+	// By default we try IPv6 first
+	for _, preferred := range []string{"", purelbv1.FamilyPreferenceIPv6, purelbv1.FamilyPreferenceIPv6ThenIPv4} {
+		alloc.SetPreferredFamily(agents(preferred))
+		assert.Nil(t, alloc.SetPools(groups), "SetPools failed")
+		assert.Equal(t, "2001:db8::", allocate("svc1", "nopref"))
+	}
+
+	// The agents can ask for IPv4 first, but pools' preferences win
+	alloc.SetPreferredFamily(agents(purelbv1.FamilyPreferenceIPv4))
+	assert.Nil(t, alloc.SetPools(groups), "SetPools failed")
+	assert.Equal(t, "1.2.3.0", allocate("svc1", "nopref"))
+	assert.Equal(t, "2001:db8:1::", allocate("svc2", "v6pref"))
+
+	// Invalid preferences are reported and ignored
+	k.reset()
+	alloc.SetPreferredFamily(agents("ipv5"))
+	assert.Equal(t, []string{"ParseFailed"}, k.warnings)
+	assert.Nil(t, alloc.SetPools(groups), "SetPools failed")
+	assert.Equal(t, "2001:db8::", allocate("svc1", "nopref"))
+}
+
+// TestSpreadPolicy tests that services with the spread policy get
+// addresses from the least-utilized pool.
+func TestSpreadPolicy(t *testing.T) {
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(&testK8S{t: t})
+
+	if alloc.SetPools([]*purelbv1.ServiceGroup{
+		localServiceGroup("small", "1.1.1.0/31"),  // 2 addresses
+		localServiceGroup("medium", "2.2.2.0/30"), // 4 addresses
+		localServiceGroup("large", "3.3.3.0/29"),  // 8 addresses
+	}) != nil {
+		t.Fatal("SetConfig failed")
+	}
+
+	spread := func(name string) string {
+		svc := service(name, ports("tcp/80"), "")
+		svc.Annotations[purelbv1.AllocationPolicyAnnotation] = purelbv1.AllocationPolicySpread
+		assert.Nil(t, alloc.Allocate(&svc), "error allocating address")
+		return svc.Annotations[purelbv1.PoolAnnotation]
+	}
+
+	// All of the pools are empty so the tie goes to the first name
+	assert.Equal(t, "large", spread("svc1"))  // large 0, medium 0, small 0
+	assert.Equal(t, "medium", spread("svc2")) // large 1/8, medium 0, small 0
+	assert.Equal(t, "small", spread("svc3"))  // large 1/8, medium 1/4, small 0
+	assert.Equal(t, "large", spread("svc4"))  // large 1/8, medium 1/4, small 1/2
+	assert.Equal(t, "large", spread("svc5"))  // large 2/8, medium 1/4, small 1/2
+	assert.Equal(t, "medium", spread("svc6")) // large 3/8, medium 1/4, small 1/2
+	assert.Equal(t, "large", spread("svc7"))  // large 3/8, medium 2/4, small 1/2
+
+	// Without the annotation we use the default pool, which doesn't
+	// exist here
+	svc := service("svc8", ports("tcp/80"), "")
+	assert.Error(t, alloc.Allocate(&svc))
+
+	// The DesiredGroupAnnotation overrides the spread policy
+	svc.Annotations[purelbv1.AllocationPolicyAnnotation] = purelbv1.AllocationPolicySpread
+	svc.Annotations[purelbv1.DesiredGroupAnnotation] = "small"
+	assert.Nil(t, alloc.Allocate(&svc), "error allocating address")
+	assert.Equal(t, "small", svc.Annotations[purelbv1.PoolAnnotation])
+}
+
+// TestPreview tests that Preview returns the address that Allocate
+// would assign, without assigning it.
+func TestPreview(t *testing.T) {
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(&testK8S{t: t})
+
+	if alloc.SetPools([]*purelbv1.ServiceGroup{
+		localServiceGroup(defaultPoolName, "1.2.3.0/31"),
+		localServiceGroup("other", "3.2.1.0/32"),
+	}) != nil {
+		t.Fatal("SetConfig failed")
+	}
+
+	// Repeated previews return the same address and don't consume it
+	svc1 := service("svc1", ports("tcp/80"), "")
+	orig := svc1.DeepCopy()
+	for i := 0; i < 3; i++ {
+		pool, ip, err := alloc.Preview(&svc1)
+		assert.Nil(t, err, "error previewing address")
+		assert.Equal(t, defaultPoolName, pool)
+		assert.Equal(t, "1.2.3.0", ip.String())
+	}
+	assert.Equal(t, orig, &svc1, "Preview modified the service")
+	assert.Equal(t, 0, alloc.pools[defaultPoolName].InUse())
+
+	// Allocate assigns the address that Preview returned
+	assert.Nil(t, alloc.Allocate(&svc1), "error allocating address")
+	assert.Equal(t, "1.2.3.0", svc1.Status.LoadBalancer.Ingress[0].IP)
+
+	// Previews take existing allocations into account
+	svc2 := service("svc2", ports("tcp/80"), "")
+	_, ip, err := alloc.Preview(&svc2)
+	assert.Nil(t, err, "error previewing address")
+	assert.Equal(t, "1.2.3.1", ip.String())
+
+	// A service that already has an address could keep it
+	_, ip, err = alloc.Preview(&svc1)
+	assert.Nil(t, err, "error previewing address")
+	assert.Equal(t, "1.2.3.0", ip.String())
+
+	// Desired groups and addresses are honored
+	svc2.Annotations[purelbv1.DesiredGroupAnnotation] = "other"
+	pool, ip, err := alloc.Preview(&svc2)
+	assert.Nil(t, err, "error previewing address")
+	assert.Equal(t, "other", pool)
+	assert.Equal(t, "3.2.1.0", ip.String())
+	svc2.Annotations[purelbv1.DesiredAddressAnnotation] = "1.2.3.1"
+	pool, ip, err = alloc.Preview(&svc2)
+	assert.Nil(t, err, "error previewing address")
+	assert.Equal(t, defaultPoolName, pool)
+	assert.Equal(t, "1.2.3.1", ip.String())
+	svc2.Annotations[purelbv1.DesiredAddressAnnotation] = "1.2.3.0"
+	_, _, err = alloc.Preview(&svc2)
+	assert.Error(t, err, "previewed an address that's in use")
+
+	// Full pools fail just like they would when allocating
+	svc3 := service("svc3", ports("tcp/80"), "")
+	assert.Nil(t, alloc.Allocate(&svc3), "error allocating address")
+	svc4 := service("svc4", ports("tcp/80"), "")
+	_, _, err = alloc.Preview(&svc4)
+	assert.Error(t, err, "previewed an address from a full pool")
+	assert.Equal(t, 2, alloc.pools[defaultPoolName].InUse())
+	assert.Equal(t, 0, alloc.pools["other"].InUse())
+}
+
+// TestPreviewMatchesAllocate tests that Preview follows the same rules
+// as Allocate, without side effects.
+func TestPreviewMatchesAllocate(t *testing.T) {
+	k := &testK8S{t: t}
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(k)
+	alloc.SetReleaseDelay(time.Minute)
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	alloc.now = func() time.Time { return now }
+
+	if alloc.SetPools([]*purelbv1.ServiceGroup{
+		localServiceGroup(defaultPoolName, "1.2.3.0/30"),
+	}) != nil {
+		t.Fatal("SetConfig failed")
+	}
+
+	// A deleted service would get its held address back, and the hold
+	// survives the preview
+	first := service("first", ports("tcp/80"), "")
+	assert.NoError(t, alloc.Allocate(&first))
+	assert.NoError(t, alloc.Unassign("unit/first"))
+	_, ip, err := alloc.Preview(&first)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.3.0", ip.String())
+	assert.Contains(t, alloc.held, "unit/first")
+	other := service("other", ports("tcp/80"), "")
+	_, ip, err = alloc.Preview(&other)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.3.1", ip.String())
+	assert.NoError(t, alloc.Allocate(&other))
+
+	// Every desired address is checked, not just the first
+	both := service("both", ports("tcp/80"), "")
+	both.Annotations[purelbv1.DesiredAddressAnnotation] = "1.2.3.3,1.2.3.1"
+	_, _, err = alloc.Preview(&both)
+	assert.Error(t, err, "previewed an address that's in use")
+
+	// Namespace quotas apply, but previews don't send events
+	k.reset()
+	alloc.SetNamespaceQuota([]*purelbv1.LBNodeAgent{{Spec: purelbv1.LBNodeAgentSpec{NamespaceQuota: 1}}})
+	third := service("third", ports("tcp/80"), "")
+	_, _, err = alloc.Preview(&third)
+	assert.Error(t, err, "previewed an address beyond the namespace quota")
+	assert.Empty(t, k.warnings)
+	assert.Equal(t, 2, alloc.pools[defaultPoolName].InUse())
+}
+
+// TestNoPoolForFamily tests that we tell the user when a service asks
+// for a family that its pool doesn't have.
+func TestNoPoolForFamily(t *testing.T) {
+	k := &testK8S{t: t}
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(k)
+
+	if alloc.SetPools([]*purelbv1.ServiceGroup{localServiceGroup("v4only", "1.2.3.0/31")}) != nil {
+		t.Fatal("SetConfig failed")
+	}
+
+	before := ptu.ToFloat64(noPoolForFamily.WithLabelValues("v4only", "IPv6"))
+	svc := service("svc1", ports("tcp/80"), "")
+	svc.Annotations[purelbv1.DesiredGroupAnnotation] = "v4only"
+	svc.Spec.IPFamilies = []v1.IPFamily{v1.IPv6Protocol}
+	err := alloc.Allocate(&svc)
+	var familyErr *NoPoolForFamilyError
+	assert.ErrorAs(t, err, &familyErr)
+	assert.Equal(t, v1.IPv6Protocol, familyErr.Family)
+	assert.Equal(t, []string{"NoPoolForFamily"}, k.warnings)
+	assert.Equal(t, before+1, ptu.ToFloat64(noPoolForFamily.WithLabelValues("v4only", "IPv6")))
+
+	// A family that the pool has works
+	svc.Spec.IPFamilies = []v1.IPFamily{v1.IPv4Protocol}
+	assert.Nil(t, alloc.Allocate(&svc), "error allocating address")
+}
+
+// TestPoolExhausted tests that we tell the user when a pool is full.
+func TestPoolExhausted(t *testing.T) {
+	k := &testK8S{t: t}
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(k)
+
+	if alloc.SetPools([]*purelbv1.ServiceGroup{localServiceGroup("exhaust", "1.2.3.0/31")}) != nil {
+		t.Fatal("SetConfig failed")
+	}
+
+	exhausted := func() float64 { return ptu.ToFloat64(poolExhausted.WithLabelValues("exhaust")) }
+	before := exhausted()
+
+	for _, name := range []string{"svc1", "svc2"} {
+		svc := service(name, ports("tcp/80"), "")
+		svc.Annotations[purelbv1.DesiredGroupAnnotation] = "exhaust"
+		assert.Nil(t, alloc.Allocate(&svc), "error allocating address")
+	}
+	assert.Empty(t, k.warnings)
+	assert.Equal(t, before, exhausted())
+
+	// The pool is full
+	svc := service("svc3", ports("tcp/80"), "")
+	svc.Annotations[purelbv1.DesiredGroupAnnotation] = "exhaust"
+	err := alloc.Allocate(&svc)
+	var exhaustedErr *PoolExhaustedError
+	assert.ErrorAs(t, err, &exhaustedErr)
+	assert.Equal(t, "exhaust", exhaustedErr.Pool)
+	assert.Equal(t, []string{"PoolExhausted"}, k.warnings)
+	assert.Equal(t, before+1, exhausted())
+
+	// An unknown pool isn't an exhausted pool
+	k.reset()
+	svc.Annotations[purelbv1.DesiredGroupAnnotation] = "unknown"
+	assert.Error(t, alloc.Allocate(&svc))
+	assert.Empty(t, k.warnings)
+	assert.Equal(t, before+1, exhausted())
+}
+
+// TestMaxAddresses tests that dual-stack services can't get more
+// addresses than their pool allows.
+func TestMaxAddresses(t *testing.T) {
+	k := &testK8S{t: t}
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(k)
+
+	one := 1
+	groups := []*purelbv1.ServiceGroup{
+		serviceGroup("capped", purelbv1.ServiceGroupSpec{
+			Local: &purelbv1.ServiceGroupLocalSpec{
+				V4Pools:      []*purelbv1.ServiceGroupAddressPool{{Pool: "1.2.3.0/31", Subnet: "1.2.3.0/24"}},
+				V6Pools:      []*purelbv1.ServiceGroupAddressPool{{Pool: "1000::/127", Subnet: "1000::/64"}},
+				MaxAddresses: &one,
+			},
+		}),
+	}
+	if alloc.SetPools(groups) != nil {
+		t.Fatal("SetConfig failed")
+	}
+
+	// Dual-stack services ask for two addresses so they fail
+	svc := service("svc1", ports("tcp/80"), "")
+	svc.Annotations[purelbv1.DesiredGroupAnnotation] = "capped"
+	svc.Spec.IPFamilies = []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol}
+	err := alloc.Allocate(&svc)
+	var tooManyErr *TooManyAddressesError
+	assert.ErrorAs(t, err, &tooManyErr)
+	assert.Equal(t, 2, tooManyErr.Requested)
+	assert.Equal(t, 1, tooManyErr.Max)
+	assert.Equal(t, []string{"TooManyAddresses"}, k.warnings)
+	assert.Empty(t, svc.Status.LoadBalancer.Ingress)
+	assert.Equal(t, 0, alloc.pools["capped"].InUse())
+
+	// Single-stack services are fine
+	for _, family := range []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol} {
+		svc := service("svc-"+string(family), ports("tcp/80"), "")
+		svc.Annotations[purelbv1.DesiredGroupAnnotation] = "capped"
+		svc.Spec.IPFamilies = []v1.IPFamily{family}
+		assert.NoError(t, alloc.Allocate(&svc))
+		assert.Len(t, svc.Status.LoadBalancer.Ingress, 1)
+	}
+
+	// Pools must allow at least one address
+	zero := 0
+	groups[0].Spec.Local.MaxAddresses = &zero
+	k.reset()
+	assert.Error(t, alloc.SetPools(groups))
+	assert.Equal(t, []string{"ParseFailed"}, k.warnings)
+}
+
+// TestSpecificIPOutsidePool tests that requests for specific
+// addresses that don't fit a pool get precise errors.
+func TestSpecificIPOutsidePool(t *testing.T) {
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(&testK8S{t: t})
+
+	groups := []*purelbv1.ServiceGroup{
+		serviceGroup("narrow", purelbv1.ServiceGroupSpec{
+			Local: &purelbv1.ServiceGroupLocalSpec{
+				Subnet: "10.0.0.0/24",
+				Pool:   "10.0.0.10-10.0.0.20",
+			},
+		}),
+	}
+	if alloc.SetPools(groups) != nil {
+		t.Fatal("SetConfig failed")
+	}
+
+	svc := service("svc1", ports("tcp/80"), "")
+
+	// In the range (and therefore the subnet)
+	svc.Annotations[purelbv1.DesiredAddressAnnotation] = "10.0.0.15"
+	assert.NoError(t, alloc.Allocate(&svc))
+
+	// In the subnet but outside of the range
+	svc.Annotations[purelbv1.DesiredAddressAnnotation] = "10.0.0.5"
+	assert.ErrorContains(t, alloc.Allocate(&svc), "is in the subnet of group narrow but outside its address range")
+
+	// Outside of everything
+	svc.Annotations[purelbv1.DesiredAddressAnnotation] = "192.168.0.1"
+	assert.ErrorContains(t, alloc.Allocate(&svc), "does not belong to any group")
+
+	// In the range but outside of the subnet. NewLocalPool doesn't
+	// allow this so we need to break the pool by hand.
+	pool := alloc.pools["narrow"].(LocalPool)
+	_, other, _ := net.ParseCIDR("10.1.0.0/24")
+	pool.subnets = []*net.IPNet{other}
+	alloc.pools["narrow"] = pool
+	svc.Annotations[purelbv1.DesiredAddressAnnotation] = "10.0.0.16"
+	assert.ErrorContains(t, alloc.Allocate(&svc), "is in the address range of group narrow but outside its subnet")
+}
+
+// TestLowFreeThreshold tests that the allocator warns once when a
+// pool's free addresses drop below its threshold, and again only
+// after the pool has recovered.
+func TestLowFreeThreshold(t *testing.T) {
+	k := &testK8S{t: t}
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(k)
+
+	group := localServiceGroup("lowfree", "1.2.3.0/30")
+	group.Spec.LowFreeThreshold = intstr.FromInt(2)
+	assert.Nil(t, alloc.SetPools([]*purelbv1.ServiceGroup{group}), "SetPools failed")
+
+	lowWarnings := func() int {
+		count := 0
+		for _, warning := range k.warnings {
+			if warning == "LowOnAddresses" {
+				count++
+			}
+		}
+		return count
+	}
+	allocate := func(name string) {
+		svc := service(name, ports("tcp/80"), "")
+		svc.Annotations[purelbv1.DesiredGroupAnnotation] = "lowfree"
+		assert.Nil(t, alloc.Allocate(&svc), "error allocating address")
+	}
+
+	// 4 addresses, so we're above the threshold until the third
+	// allocation
+	allocate("svc1")
+	allocate("svc2")
+	assert.Equal(t, 0, lowWarnings())
+	assert.Equal(t, 0.0, ptu.ToFloat64(poolLowFree.WithLabelValues("lowfree")))
+	allocate("svc3")
+	assert.Equal(t, 1, lowWarnings())
+	assert.Equal(t, 1.0, ptu.ToFloat64(poolLowFree.WithLabelValues("lowfree")))
+
+	// Staying below the threshold doesn't warn again
+	allocate("svc4")
+	assert.Equal(t, 1, lowWarnings())
+
+	// Recover, then cross the threshold again
+	assert.Nil(t, alloc.Unassign("unit/svc1"))
+	assert.Nil(t, alloc.Unassign("unit/svc2"))
+	assert.Equal(t, 0.0, ptu.ToFloat64(poolLowFree.WithLabelValues("lowfree")))
+	assert.Equal(t, 1, lowWarnings())
+	allocate("svc5")
+	assert.Equal(t, 2, lowWarnings())
+}
+
+func TestFreeBelow(t *testing.T) {
+	assert.False(t, freeBelow(10, 0, intstr.FromInt(0)), "zero threshold")
+	assert.True(t, freeBelow(10, 1, intstr.FromInt(2)))
+	assert.False(t, freeBelow(10, 2, intstr.FromInt(2)))
+	assert.True(t, freeBelow(10, 1, intstr.FromString("20%")))
+	assert.False(t, freeBelow(10, 2, intstr.FromString("20%")))
+	assert.False(t, freeBelow(10, 1, intstr.FromString("twenty")), "invalid threshold")
+	assert.False(t, freeBelow(0, 0, intstr.FromInt(2)), "unknown size")
+}
+
+// TestExcludedAddresses tests that the allocator never assigns
+// excluded addresses, no matter which pool they're in.
+func TestExcludedAddresses(t *testing.T) {
+	k := &testK8S{t: t}
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(k)
+
+	alloc.SetExcluded([]*purelbv1.LBNodeAgent{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "agent"},
+			Spec: purelbv1.LBNodeAgentSpec{
+				ExcludeAddresses: []string{"1.2.3.0", "3.2.1.0/31", "bogus"},
+			},
+		},
+	})
+	assert.Contains(t, k.warnings, "ParseFailed", "invalid exclusion wasn't reported")
+	groups := []*purelbv1.ServiceGroup{
+		localServiceGroup("one", "1.2.3.0/31"),
+		localServiceGroup("two", "3.2.1.0/30"),
+	}
+	assert.Nil(t, alloc.SetPools(groups), "SetPools failed")
+
+	allocate := func(name string, group string) *v1.Service {
+		svc := service(name, ports("tcp/80"), "")
+		svc.Annotations[purelbv1.DesiredGroupAnnotation] = group
+		assert.Nil(t, alloc.Allocate(&svc), "error allocating address")
+		return &svc
+	}
+
+	// Each pool skips its excluded addresses
+	assert.Equal(t, "1.2.3.1", allocate("svc1", "one").Status.LoadBalancer.Ingress[0].IP)
+	assert.Equal(t, "3.2.1.2", allocate("svc2", "two").Status.LoadBalancer.Ingress[0].IP)
+	assert.Equal(t, "3.2.1.3", allocate("svc3", "two").Status.LoadBalancer.Ingress[0].IP)
+
+	// Once the unexcluded addresses are used the pools are full
+	svc4 := service("svc4", ports("tcp/80"), "")
+	svc4.Annotations[purelbv1.DesiredGroupAnnotation] = "two"
+	assert.Error(t, alloc.Allocate(&svc4), "allocated an excluded address")
+
+	// Users can't request excluded addresses, either
+	svc5 := service("svc5", ports("tcp/80"), "")
+	svc5.Annotations[purelbv1.DesiredAddressAnnotation] = "1.2.3.0"
+	assert.Error(t, alloc.Allocate(&svc5), "allocated an excluded specific address")
+}
+
+func TestParseExcluded(t *testing.T) {
+	for raw, want := range map[string]string{
+		"192.168.1.1":    "192.168.1.1/32",
+		"192.168.1.0/24": "192.168.1.0/24",
+		"fc00::1":        "fc00::1/128",
+		"fc00::/64":      "fc00::/64",
+	} {
+		excluded, err := parseExcluded(raw)
+		assert.NoError(t, err, raw)
+		assert.Equal(t, want, excluded.String(), raw)
+	}
+
+	_, err := parseExcluded("192.168.1.300")
+	assert.Error(t, err)
+	_, err = parseExcluded("192.168.1.0/33")
+	assert.Error(t, err)
+}
+
+// TestFamilyStats tests that the per-family gauges track allocations
+// and releases.
+func TestFamilyStats(t *testing.T) {
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(&testK8S{t: t})
+
+	if alloc.SetPools([]*purelbv1.ServiceGroup{
+		localServiceGroup("fam4", "1.2.3.0/30"),
+		localServiceGroup("fam6", "2001:db8::/126"),
+	}) != nil {
+		t.Fatal("SetConfig failed")
+	}
+	inUse := func(pool string, family v1.IPFamily) float64 {
+		return ptu.ToFloat64(poolActiveFamily.WithLabelValues(pool, string(family)))
+	}
+	allInUse := func(family v1.IPFamily) float64 {
+		return ptu.ToFloat64(activeFamily.WithLabelValues(string(family)))
+	}
+	allocate := func(name string, pool string, family v1.IPFamily) {
+		svc := service(name, ports("tcp/80"), "")
+		svc.Annotations[purelbv1.DesiredGroupAnnotation] = pool
+		svc.Spec.IPFamilies = []v1.IPFamily{family}
+		assert.NoError(t, alloc.Allocate(&svc))
+	}
+
+	allocate("v4a", "fam4", v1.IPv4Protocol)
+	allocate("v4b", "fam4", v1.IPv4Protocol)
+	allocate("v6a", "fam6", v1.IPv6Protocol)
+	assert.Equal(t, 2.0, inUse("fam4", v1.IPv4Protocol))
+	assert.Equal(t, 0.0, inUse("fam4", v1.IPv6Protocol))
+	assert.Equal(t, 1.0, inUse("fam6", v1.IPv6Protocol))
+	assert.Equal(t, 2.0, allInUse(v1.IPv4Protocol))
+	assert.Equal(t, 1.0, allInUse(v1.IPv6Protocol))
+
+	// Releasing an address updates its family's gauges
+	assert.NoError(t, alloc.Unassign("unit/v4a"))
+	assert.Equal(t, 1.0, inUse("fam4", v1.IPv4Protocol))
+	assert.Equal(t, 1.0, allInUse(v1.IPv4Protocol))
+	assert.Equal(t, 1.0, allInUse(v1.IPv6Protocol))
+
+	// Removing a pool removes its addresses from the totals
+	if alloc.SetPools([]*purelbv1.ServiceGroup{localServiceGroup("fam4", "1.2.3.0/30")}) != nil {
+		t.Fatal("SetConfig failed")
+	}
+	assert.Equal(t, 0.0, allInUse(v1.IPv6Protocol))
+}
+
+func TestReleaseOrphans(t *testing.T) {
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(&testK8S{t: t})
+
+	if alloc.SetPools([]*purelbv1.ServiceGroup{
+		localServiceGroup("default", "1.2.3.0/31"),
+	}) != nil {
+		t.Fatal("SetConfig failed")
+	}
+	live := service("live", ports("tcp/80"), "")
+	orphan := service("orphan", ports("tcp/80"), "")
+	assert.NoError(t, alloc.Allocate(&live))
+	assert.NoError(t, alloc.Allocate(&orphan))
+	assert.Equal(t, 2, alloc.pools["default"].InUse())
+
+	// Services that still exist keep their addresses
+	assert.Empty(t, alloc.ReleaseOrphans([]string{"unit/live", "unit/orphan"}))
+	assert.Equal(t, 2, alloc.pools["default"].InUse())
+
+	// The orphan's address is released so another service can use it
+	assert.Equal(t, []string{"unit/orphan"}, alloc.ReleaseOrphans([]string{"unit/live"}))
+	assert.Equal(t, []string{"unit/live"}, alloc.pools["default"].Services())
+	assert.Equal(t, 1.0, ptu.ToFloat64(poolActive.WithLabelValues("default")))
+	another := service("another", ports("tcp/80"), "")
+	assert.NoError(t, alloc.Allocate(&another))
+	assert.Equal(t, orphan.Status.LoadBalancer.Ingress, another.Status.LoadBalancer.Ingress)
+}
+
+func TestReleaseDelay(t *testing.T) {
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(&testK8S{t: t})
+	alloc.SetReleaseDelay(time.Minute)
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	alloc.now = func() time.Time { return now }
+
+	if alloc.SetPools([]*purelbv1.ServiceGroup{
+		localServiceGroup("default", "1.2.3.0/30"),
+	}) != nil {
+		t.Fatal("SetConfig failed")
+	}
+	first := service("first", ports("tcp/80"), "")
+	assert.NoError(t, alloc.Allocate(&first))
+	assert.Equal(t, "1.2.3.0", first.Status.LoadBalancer.Ingress[0].IP)
+
+	// A deleted service's address is held so other services don't get
+	// it, and it's not an orphan
+	assert.NoError(t, alloc.Unassign("unit/first"))
+	other := service("other", ports("tcp/80"), "")
+	assert.NoError(t, alloc.Allocate(&other))
+	assert.Equal(t, "1.2.3.1", other.Status.LoadBalancer.Ingress[0].IP)
+	assert.Empty(t, alloc.ReleaseOrphans([]string{"unit/other"}))
+
+	// If the service is re-created within the delay then it gets its
+	// address back
+	now = now.Add(30 * time.Second)
+	first = service("first", ports("tcp/80"), "")
+	assert.NoError(t, alloc.Allocate(&first))
+	assert.Equal(t, "1.2.3.0", first.Status.LoadBalancer.Ingress[0].IP)
+	assert.Empty(t, alloc.held)
+
+	// After the delay the address is released so other services can
+	// get it
+	assert.NoError(t, alloc.Unassign("unit/first"))
+	now = now.Add(30 * time.Second)
+	assert.Empty(t, alloc.ReleaseExpired())
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, []string{"unit/first"}, alloc.ReleaseExpired())
+	assert.Equal(t, []string{"unit/other"}, alloc.pools["default"].Services())
+	another := service("another", ports("tcp/80"), "")
+	assert.NoError(t, alloc.Allocate(&another))
+	assert.Equal(t, "1.2.3.0", another.Status.LoadBalancer.Ingress[0].IP)
+
+	// If the service is re-created after the delay then its hold is
+	// dropped, even if the sweeper hasn't run
+	assert.NoError(t, alloc.Unassign("unit/another"))
+	now = now.Add(2 * time.Minute)
+	another = service("another", ports("tcp/80"), "")
+	assert.NoError(t, alloc.Allocate(&another))
+	assert.Equal(t, "1.2.3.0", another.Status.LoadBalancer.Ingress[0].IP)
+	assert.Empty(t, alloc.held)
+
+	// Held addresses are only soft-reserved: if the pool runs out then
+	// they're released
+	third := service("third", ports("tcp/80"), "")
+	assert.NoError(t, alloc.Allocate(&third))
+	assert.Equal(t, "1.2.3.2", third.Status.LoadBalancer.Ingress[0].IP)
+	assert.NoError(t, alloc.Unassign("unit/third"))
+	fourth := service("fourth", ports("tcp/80"), "")
+	assert.NoError(t, alloc.Allocate(&fourth))
+	assert.Equal(t, "1.2.3.3", fourth.Status.LoadBalancer.Ingress[0].IP)
+	fifth := service("fifth", ports("tcp/80"), "")
+	assert.NoError(t, alloc.Allocate(&fifth))
+	assert.Equal(t, "1.2.3.2", fifth.Status.LoadBalancer.Ingress[0].IP)
+	assert.Empty(t, alloc.held)
+}
+
+func TestReleaseDelayConfigChange(t *testing.T) {
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(&testK8S{t: t})
+	alloc.SetReleaseDelay(time.Minute)
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	alloc.now = func() time.Time { return now }
+
+	if alloc.SetPools([]*purelbv1.ServiceGroup{
+		localServiceGroup("default", "1.2.3.0/30"),
+	}) != nil {
+		t.Fatal("SetConfig failed")
+	}
+	first := service("first", ports("tcp/80"), "")
+	assert.NoError(t, alloc.Allocate(&first))
+	assert.Equal(t, "1.2.3.0", first.Status.LoadBalancer.Ingress[0].IP)
+	assert.NoError(t, alloc.Unassign("unit/first"))
+
+	// A config change within the delay keeps the address held, so
+	// other services don't get it and the re-created service does
+	now = now.Add(10 * time.Second)
+	if alloc.SetPools([]*purelbv1.ServiceGroup{
+		localServiceGroup("default", "1.2.3.0/30"),
+	}) != nil {
+		t.Fatal("SetConfig failed")
+	}
+	other := service("other", ports("tcp/80"), "")
+	assert.NoError(t, alloc.Allocate(&other))
+	assert.Equal(t, "1.2.3.1", other.Status.LoadBalancer.Ingress[0].IP)
+	first = service("first", ports("tcp/80"), "")
+	assert.NoError(t, alloc.Allocate(&first))
+	assert.Equal(t, "1.2.3.0", first.Status.LoadBalancer.Ingress[0].IP)
+	assert.Empty(t, alloc.held)
+
+	// If the held address is no longer in its pool then the hold is
+	// dropped
+	assert.NoError(t, alloc.Unassign("unit/first"))
+	if alloc.SetPools([]*purelbv1.ServiceGroup{
+		localServiceGroup("default", "1.2.3.4/30"),
+	}) != nil {
+		t.Fatal("SetConfig failed")
+	}
+	assert.Empty(t, alloc.held)
+	assert.Empty(t, alloc.pools["default"].Services())
+
+	// and so is one whose pool is gone
+	another := service("another", ports("tcp/80"), "")
+	assert.NoError(t, alloc.Allocate(&another))
+	assert.NoError(t, alloc.Unassign("unit/another"))
+	assert.Len(t, alloc.held, 1)
+	if alloc.SetPools([]*purelbv1.ServiceGroup{
+		localServiceGroup("other", "1.2.3.4/30"),
+	}) != nil {
+		t.Fatal("SetConfig failed")
+	}
+	assert.Empty(t, alloc.held)
+}
+
+func TestAllocationDuration(t *testing.T) {
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(&testK8S{t: t})
+
+	if alloc.SetPools([]*purelbv1.ServiceGroup{
+		localServiceGroup("timed", "1.2.3.0/31"),
+	}) != nil {
+		t.Fatal("SetConfig failed")
+	}
+	samples := func() uint64 {
+		metric := &dto.Metric{}
+		assert.NoError(t, allocationDuration.WithLabelValues("timed").(prometheus.Histogram).Write(metric))
+		return metric.GetHistogram().GetSampleCount()
+	}
+	allocate := func(name string) error {
+		svc := service(name, ports("tcp/80"), "")
+		svc.Annotations[purelbv1.DesiredGroupAnnotation] = "timed"
+		return alloc.Allocate(&svc)
+	}
+	before := samples()
+
+	// Each allocation from the pool is timed, whether it succeeds or
+	// fails because the pool is full
+	assert.NoError(t, allocate("s1"))
+	assert.NoError(t, allocate("s2"))
+	assert.Error(t, allocate("s3"))
+	assert.Equal(t, before+3, samples())
+
+	// An allocation that has to release held addresses and try again
+	// is timed once, from start to finish
+	alloc.SetReleaseDelay(time.Minute)
+	assert.NoError(t, alloc.Unassign("unit/s1"))
+	assert.NoError(t, allocate("s3"))
+	assert.Equal(t, before+4, samples())
+}
+
 func TestParseGroups(t *testing.T) {
 	tests := []struct {
 		desc string
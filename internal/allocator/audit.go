@@ -0,0 +1,95 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// Audit record operations.
+const (
+	auditAllocate = "allocate"
+	auditHold     = "hold"
+	auditRelease  = "release"
+)
+
+// auditRecord is one line of the audit log. There's one record for
+// each address that's allocated, held, or released.
+type auditRecord struct {
+	Time    time.Time `json:"time"`
+	Op      string    `json:"op"`
+	Service string    `json:"service"`
+	IP      string    `json:"ip"`
+	Pool    string    `json:"pool"`
+	Actor   string    `json:"actor"`
+}
+
+// auditLog writes audit records as JSON, one per line, to a sink. The
+// log is append-only: we never rewrite a record. A nil *auditLog
+// discards records so callers don't have to check whether auditing is
+// enabled.
+type auditLog struct {
+	encoder *json.Encoder
+	actor   string
+	logger  log.Logger
+}
+
+// newAuditLog returns an auditLog that writes to sink. actor
+// identifies us in the records, e.g., our pod's name.
+func newAuditLog(sink io.Writer, actor string, logger log.Logger) *auditLog {
+	return &auditLog{
+		encoder: json.NewEncoder(sink),
+		actor:   actor,
+		logger:  logger,
+	}
+}
+
+// record writes one record for each of ips.
+func (l *auditLog) record(now time.Time, op string, svc string, pool string, ips []net.IP) {
+	if l == nil {
+		return
+	}
+
+	for _, ip := range ips {
+		rec := auditRecord{
+			Time:    now.UTC(),
+			Op:      op,
+			Service: svc,
+			IP:      ip.String(),
+			Pool:    pool,
+			Actor:   l.actor,
+		}
+		if err := l.encoder.Encode(rec); err != nil {
+			l.logger.Log("op", "audit", "service", svc, "ip", ip, "error", err)
+		}
+	}
+}
+
+// serviceAddresses returns the addresses that pool has assigned to
+// svc.
+func serviceAddresses(pool Pool, svc string) []net.IP {
+	switch p := pool.(type) {
+	case LocalPool:
+		return p.addressesOf(svc)
+	case *NetboxPool:
+		return p.services[svc]
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	purelbv1 "purelb.io/pkg/apis/v1"
+)
+
+func TestAuditLog(t *testing.T) {
+	sink := &bytes.Buffer{}
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(&testK8S{t: t})
+	alloc.SetAuditLog(sink, "allocator-0")
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	alloc.now = func() time.Time { return now }
+	if alloc.SetPools([]*purelbv1.ServiceGroup{
+		localServiceGroup("default", "1.2.3.0/30"),
+	}) != nil {
+		t.Fatal("SetConfig failed")
+	}
+
+	// records returns the records written since the last call
+	records := func() []auditRecord {
+		recs := []auditRecord{}
+		decoder := json.NewDecoder(sink)
+		for decoder.More() {
+			rec := auditRecord{}
+			assert.NoError(t, decoder.Decode(&rec))
+			recs = append(recs, rec)
+		}
+		return recs
+	}
+
+	// Allocations are recorded, whether we pick the address or the
+	// user does
+	svc1 := service("svc1", ports("tcp/80"), "")
+	assert.NoError(t, alloc.Allocate(&svc1))
+	svc2 := service("svc2", ports("tcp/80"), "")
+	svc2.Annotations[purelbv1.DesiredAddressAnnotation] = "1.2.3.2"
+	assert.NoError(t, alloc.Allocate(&svc2))
+	assert.Equal(t, []auditRecord{
+		{Time: now, Op: "allocate", Service: "unit/svc1", IP: "1.2.3.0", Pool: "default", Actor: "allocator-0"},
+		{Time: now, Op: "allocate", Service: "unit/svc2", IP: "1.2.3.2", Pool: "default", Actor: "allocator-0"},
+	}, records())
+
+	// So are releases
+	now = now.Add(time.Minute)
+	assert.NoError(t, alloc.Unassign("unit/svc1"))
+	assert.Equal(t, []auditRecord{
+		{Time: now, Op: "release", Service: "unit/svc1", IP: "1.2.3.0", Pool: "default", Actor: "allocator-0"},
+	}, records())
+
+	// Releasing a service that has no addresses isn't recorded
+	assert.NoError(t, alloc.Unassign("unit/svc1"))
+	assert.Empty(t, records())
+
+	// With a release delay the address is held first, and released
+	// when the delay expires
+	alloc.SetReleaseDelay(time.Minute)
+	assert.NoError(t, alloc.Unassign("unit/svc2"))
+	now = now.Add(2 * time.Minute)
+	alloc.ReleaseExpired()
+	assert.Equal(t, []auditRecord{
+		{Time: now.Add(-2 * time.Minute), Op: "hold", Service: "unit/svc2", IP: "1.2.3.2", Pool: "default", Actor: "allocator-0"},
+		{Time: now, Op: "release", Service: "unit/svc2", IP: "1.2.3.2", Pool: "default", Actor: "allocator-0"},
+	}, records())
+}
@@ -16,6 +16,9 @@
 package allocator
 
 import (
+	"net"
+	"sync"
+
 	v1 "k8s.io/api/core/v1"
 
 	"purelb.io/internal/k8s"
@@ -31,17 +34,29 @@ type Controller interface {
 	SetConfig(*purelbv1.Config) k8s.SyncState
 	SetBalancer(*v1.Service, *v1.Endpoints) k8s.SyncState
 	DeleteBalancer(string) k8s.SyncState
-	MarkSynced()
+	MarkSynced([]*v1.Service)
+	Reconcile([]string)
+	ReleaseExpired()
 	Shutdown()
+	Preview(*v1.Service) (string, net.IP, error)
 }
 
 type controller struct {
+	// lock serializes the k8s client's calls with Preview calls,
+	// which come from the HTTP server.
+	lock sync.Mutex
+
 	client    k8s.ServiceEvent
 	synced    bool
 	ips       *Allocator
 	groupURL  *string
 	logger    log.Logger
 	isDefault bool
+
+	// moveBlocked holds the services that asked to move to a new
+	// desired group that couldn't give them an address, and the group,
+	// so we tell the user once and not on every resync.
+	moveBlocked map[string]string // nsName -> desired group
 }
 
 // NewController configures a new controller. If error is non-nil then
@@ -58,19 +73,27 @@ func NewController(l log.Logger, ips *Allocator) (Controller, error) {
 func (c *controller) SetClient(client *k8s.Client) {
 	c.client = client
 	c.ips.SetClient(client)
+	c.ips.SetStatusClient(client.CRClient())
 }
 
 func (c *controller) DeleteBalancer(name string) k8s.SyncState {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	if err := c.ips.Unassign(name); err != nil {
 		c.logger.Log("event", "serviceDelete", "error", err)
 		return k8s.SyncStateError
 	}
+	delete(c.moveBlocked, name)
 
 	c.logger.Log("event", "serviceDelete", "msg", "service deleted successfully")
 	return k8s.SyncStateReprocessAll
 }
 
 func (c *controller) SetConfig(cfg *purelbv1.Config) k8s.SyncState {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	defer c.logger.Log("event", "configUpdated")
 
 	if cfg == nil {
@@ -78,6 +101,13 @@ func (c *controller) SetConfig(cfg *purelbv1.Config) k8s.SyncState {
 		return k8s.SyncStateError
 	}
 
+	// The exclusions, sharing, and family configuration need to be in
+	// place before the pools so the pools can use them.
+	c.ips.SetExcluded(cfg.Agents)
+	c.ips.SetNamespacedSharing(cfg.Agents)
+	c.ips.SetNamespaceQuota(cfg.Agents)
+	c.ips.SetPreferredFamily(cfg.Agents)
+
 	if err := c.ips.SetPools(cfg.Groups); err != nil {
 		c.logger.Log("op", "setConfig", "error", err)
 		return k8s.SyncStateError
@@ -90,11 +120,73 @@ func (c *controller) SetConfig(cfg *purelbv1.Config) k8s.SyncState {
 	return k8s.SyncStateReprocessAll
 }
 
-func (c *controller) MarkSynced() {
+// MarkSynced tells the controller that it has seen all of the
+// services in the cluster, so it can allocate addresses. Before it
+// does, it tells the allocator about the addresses that services
+// already have so it won't allocate them again. This rebuilds the
+// allocator's state whenever an allocator takes over, e.g., at
+// startup, without changing any existing allocations.
+func (c *controller) MarkSynced(services []*v1.Service) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, svc := range services {
+		if !hasOurAddress(svc) {
+			continue
+		}
+		if err := c.ips.NotifyExisting(svc); err != nil {
+			c.logger.Log("op", "takeover", "svc-name", namespacedName(svc), "ingress-address", svc.Status.LoadBalancer.Ingress, "error", err)
+		}
+	}
+
 	c.synced = true
 	c.logger.Log("event", "stateSynced", "msg", "controller synced, can allocate IPs now")
 }
 
+// Reconcile releases the addresses of services that aren't in
+// services. They're services whose deletes we missed, so without this
+// their addresses would never be reused.
+func (c *controller) Reconcile(services []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.synced {
+		return
+	}
+	for _, svc := range c.ips.ReleaseOrphans(services) {
+		c.logger.Log("op", "reconcile", "service", svc, "msg", "released address of deleted service")
+	}
+}
+
+// ReleaseExpired releases the addresses that we've held for deleted
+// services for longer than the release delay.
+func (c *controller) ReleaseExpired() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, svc := range c.ips.ReleaseExpired() {
+		c.logger.Log("op", "releaseExpired", "service", svc, "msg", "released held address of deleted service")
+	}
+}
+
+// Preview returns the pool and address that svc would get if it were
+// created now, without allocating them.
+func (c *controller) Preview(svc *v1.Service) (string, net.IP, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.ips.Preview(svc)
+}
+
 func (c *controller) Shutdown() {
 	c.logger.Log("event", "shutdown")
 }
+
+// hasOurAddress returns true if svc is a LoadBalancer with an address
+// that we allocated.
+func hasOurAddress(svc *v1.Service) bool {
+	return svc.Spec.Type == v1.ServiceTypeLoadBalancer &&
+		len(svc.Status.LoadBalancer.Ingress) > 0 &&
+		svc.Annotations[purelbv1.BrandAnnotation] == purelbv1.Brand &&
+		svc.Annotations[purelbv1.IgnoreAnnotation] != "true"
+}
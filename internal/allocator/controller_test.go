@@ -48,22 +48,32 @@ func statusAssigned(ip string) v1.ServiceStatus {
 // to do to k8s.
 type testK8S struct {
 	loggedWarning bool
+	warnings      []string
+	infos         []string
 	t             *testing.T
 }
 
+func (s *testK8S) Debugf(_ runtime.Object, evtType string, msg string, args ...interface{}) {
+	s.t.Logf("k8s Debug event %q: %s", evtType, fmt.Sprintf(msg, args...))
+}
+
 func (s *testK8S) Infof(_ runtime.Object, evtType string, msg string, args ...interface{}) {
 	s.t.Logf("k8s Info event %q: %s", evtType, fmt.Sprintf(msg, args...))
+	s.infos = append(s.infos, evtType)
 }
 
 func (s *testK8S) Errorf(_ runtime.Object, evtType string, msg string, args ...interface{}) {
 	s.t.Logf("k8s Warning event %q: %s", evtType, fmt.Sprintf(msg, args...))
 	s.loggedWarning = true
+	s.warnings = append(s.warnings, evtType)
 }
 
 func (s *testK8S) ForceSync() {}
 
 func (s *testK8S) reset() {
 	s.loggedWarning = false
+	s.warnings = nil
+	s.infos = nil
 }
 
 func TestControllerConfig(t *testing.T) {
@@ -126,16 +136,17 @@ func TestControllerConfig(t *testing.T) {
 	assert.False(t, k.loggedWarning, "unsynced SetBalancer logged an error")
 
 	// Mark synced. Finally, we can allocate.
-	c.MarkSynced()
+	c.MarkSynced(nil)
 
 	wantSvc = svc.DeepCopy()
 	wantSvc.Status = statusAssigned("1.2.3.0")
 	wantSvc.ObjectMeta = metav1.ObjectMeta{
 		Name: "test",
 		Annotations: map[string]string{
-			purelbv1.DesiredGroupAnnotation: defaultPoolName,
-			purelbv1.BrandAnnotation:        purelbv1.Brand,
-			purelbv1.PoolAnnotation:         defaultPoolName,
+			purelbv1.DesiredGroupAnnotation:   defaultPoolName,
+			purelbv1.BrandAnnotation:          purelbv1.Brand,
+			purelbv1.PoolAnnotation:           defaultPoolName,
+			purelbv1.AnnounceMethodAnnotation: purelbv1.AnnounceMethodLocal,
 		},
 	}
 
@@ -172,7 +183,7 @@ func TestDeleteRecyclesIP(t *testing.T) {
 		},
 	}
 	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(cfg), "SetConfig failed")
-	c.MarkSynced()
+	c.MarkSynced(nil)
 
 	svc1 := &v1.Service{
 		ObjectMeta: metav1.ObjectMeta{
@@ -219,3 +230,507 @@ func TestDeleteRecyclesIP(t *testing.T) {
 	assert.NotEmpty(t, svc2.Status.LoadBalancer.Ingress, "svc2 didn't get an IP")
 	assert.Equal(t, "1.2.3.0", svc2.Status.LoadBalancer.Ingress[0].IP, "svc2 got the wrong IP")
 }
+
+func TestDesiredGroupChange(t *testing.T) {
+	l := log.NewNopLogger()
+	k := &testK8S{t: t}
+	a := New(l)
+	a.client = k
+	c := &controller{
+		logger: l,
+		ips:    a,
+		client: k,
+	}
+
+	cfg := &purelbv1.Config{
+		DefaultAnnouncer: true,
+		Groups: []*purelbv1.ServiceGroup{
+			localServiceGroup("old", "1.2.3.0/32"),
+			localServiceGroup("new", "3.2.1.0/32"),
+		},
+	}
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(cfg), "SetConfig failed")
+	c.MarkSynced(nil)
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      "test",
+			Annotations: map[string]string{
+				purelbv1.DesiredGroupAnnotation: "old",
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc, nil), "SetBalancer failed")
+	assert.Equal(t, "1.2.3.0", svc.Status.LoadBalancer.Ingress[0].IP, "svc got the wrong IP")
+
+	// Syncing again with no changes doesn't move the address
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc, nil), "SetBalancer failed")
+	assert.Equal(t, "1.2.3.0", svc.Status.LoadBalancer.Ingress[0].IP, "svc address moved")
+
+	// Changing the desired group doesn't move the address unless the
+	// user asks us to
+	svc.Annotations[purelbv1.DesiredGroupAnnotation] = "new"
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc, nil), "SetBalancer failed")
+	assert.Equal(t, "1.2.3.0", svc.Status.LoadBalancer.Ingress[0].IP, "svc moved without the reallocate annotation")
+	assert.Equal(t, "old", svc.Annotations[purelbv1.PoolAnnotation])
+
+	svc.Annotations[purelbv1.ReallocateAnnotation] = "true"
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc, nil), "SetBalancer failed")
+	assert.Equal(t, "3.2.1.0", svc.Status.LoadBalancer.Ingress[0].IP, "svc didn't move to the new pool")
+	assert.Equal(t, "new", svc.Annotations[purelbv1.PoolAnnotation])
+
+	// The old address is free again
+	svc2 := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      "test2",
+			Annotations: map[string]string{
+				purelbv1.DesiredGroupAnnotation: "old",
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.5",
+		},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc2, nil), "SetBalancer failed")
+	assert.Equal(t, "1.2.3.0", svc2.Status.LoadBalancer.Ingress[0].IP, "old address wasn't released")
+}
+
+func TestExternalIPs(t *testing.T) {
+	l := log.NewNopLogger()
+	k := &testK8S{t: t}
+	a := New(l)
+	a.client = k
+	a.SetExternalIPs(true)
+	c := &controller{
+		logger: l,
+		ips:    a,
+		client: k,
+	}
+
+	cfg := &purelbv1.Config{
+		DefaultAnnouncer: true,
+		Groups: []*purelbv1.ServiceGroup{
+			localServiceGroup("old", "1.2.3.0/32"),
+			localServiceGroup("new", "3.2.1.0/32"),
+		},
+	}
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(cfg), "SetConfig failed")
+	c.MarkSynced(nil)
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      "test",
+			Annotations: map[string]string{
+				purelbv1.DesiredGroupAnnotation: "old",
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Type:        "LoadBalancer",
+			ClusterIP:   "1.2.3.4",
+			ExternalIPs: []string{"192.0.2.1"},
+		},
+	}
+
+	// The allocated address is written to the ingress status and the
+	// externalIPs, and the user's externalIPs are kept
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc, nil), "SetBalancer failed")
+	assert.Equal(t, "1.2.3.0", svc.Status.LoadBalancer.Ingress[0].IP)
+	assert.Equal(t, []string{"192.0.2.1", "1.2.3.0"}, svc.Spec.ExternalIPs)
+
+	// Syncing again doesn't add it again
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc, nil), "SetBalancer failed")
+	assert.Equal(t, []string{"192.0.2.1", "1.2.3.0"}, svc.Spec.ExternalIPs)
+
+	// If the address moves then the externalIPs follow it
+	svc.Annotations[purelbv1.DesiredGroupAnnotation] = "new"
+	svc.Annotations[purelbv1.ReallocateAnnotation] = "true"
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc, nil), "SetBalancer failed")
+	assert.Equal(t, []string{"192.0.2.1", "3.2.1.0"}, svc.Spec.ExternalIPs)
+
+	// If the address is released then it's removed
+	svc.Spec.Type = "ClusterIP"
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc, nil), "SetBalancer failed")
+	assert.Empty(t, svc.Status.LoadBalancer.Ingress)
+	assert.Equal(t, []string{"192.0.2.1"}, svc.Spec.ExternalIPs)
+
+	// By default the externalIPs are left alone
+	a.SetExternalIPs(false)
+	svc.Spec.Type = "LoadBalancer"
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc, nil), "SetBalancer failed")
+	assert.Equal(t, "3.2.1.0", svc.Status.LoadBalancer.Ingress[0].IP)
+	assert.Equal(t, []string{"192.0.2.1"}, svc.Spec.ExternalIPs)
+}
+
+func TestDesiredGroupChangeFailure(t *testing.T) {
+	l := log.NewNopLogger()
+	k := &testK8S{t: t}
+	a := New(l)
+	a.client = k
+	c := &controller{
+		logger: l,
+		ips:    a,
+		client: k,
+	}
+
+	cfg := &purelbv1.Config{
+		DefaultAnnouncer: true,
+		Groups: []*purelbv1.ServiceGroup{
+			localServiceGroup("old", "1.2.3.0/32"),
+			localServiceGroup("new", "3.2.1.0/32"),
+		},
+	}
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(cfg), "SetConfig failed")
+	c.MarkSynced(nil)
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      "test",
+			Annotations: map[string]string{
+				purelbv1.DesiredGroupAnnotation: "old",
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc, nil), "SetBalancer failed")
+	assert.Equal(t, "1.2.3.0", svc.Status.LoadBalancer.Ingress[0].IP, "svc got the wrong IP")
+
+	// Fill the new pool
+	svc2 := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      "test2",
+			Annotations: map[string]string{
+				purelbv1.DesiredGroupAnnotation: "new",
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.5",
+		},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc2, nil), "SetBalancer failed")
+	assert.Equal(t, "3.2.1.0", svc2.Status.LoadBalancer.Ingress[0].IP, "svc2 got the wrong IP")
+
+	// Moving svc to the full pool fails, but svc keeps its old address
+	svc.Annotations[purelbv1.DesiredGroupAnnotation] = "new"
+	svc.Annotations[purelbv1.ReallocateAnnotation] = "true"
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc, nil), "SetBalancer failed")
+	assert.Len(t, svc.Status.LoadBalancer.Ingress, 1, "svc lost its ingress status")
+	assert.Equal(t, "1.2.3.0", svc.Status.LoadBalancer.Ingress[0].IP, "svc lost its address")
+	assert.Equal(t, "old", svc.Annotations[purelbv1.PoolAnnotation])
+
+	// The old address is still in use so nobody else can get it
+	svc3 := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      "test3",
+			Annotations: map[string]string{
+				purelbv1.DesiredGroupAnnotation: "old",
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.6",
+		},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc3, nil), "SetBalancer failed")
+	assert.Empty(t, svc3.Status.LoadBalancer.Ingress, "svc3 got svc's address")
+}
+
+func TestIPAllocatedEvent(t *testing.T) {
+	l := log.NewNopLogger()
+	k := &testK8S{t: t}
+	a := New(l)
+	a.client = k
+	c := &controller{
+		logger: l,
+		ips:    a,
+		client: k,
+	}
+
+	cfg := &purelbv1.Config{
+		DefaultAnnouncer: true,
+		Groups: []*purelbv1.ServiceGroup{
+			localServiceGroup("default", "1.2.3.0/32"),
+		},
+	}
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(cfg), "SetConfig failed")
+	c.MarkSynced(nil)
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      "test",
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+	}
+
+	// The first allocation sends an event
+	k.reset()
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc, nil), "SetBalancer failed")
+	assert.Equal(t, "1.2.3.0", svc.Status.LoadBalancer.Ingress[0].IP, "svc got the wrong IP")
+	assert.Equal(t, []string{"IPAllocated"}, k.infos)
+
+	// Resyncing doesn't send another one
+	k.reset()
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc, nil), "SetBalancer failed")
+	assert.Empty(t, k.infos)
+
+	// A failed allocation doesn't send one either
+	svc2 := svc.DeepCopy()
+	svc2.Name = "test2"
+	svc2.Status.LoadBalancer.Ingress = nil
+	k.reset()
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc2, nil), "SetBalancer failed")
+	assert.NotContains(t, k.infos, "IPAllocated")
+	assert.Contains(t, k.warnings, "AllocationFailed")
+}
+
+func TestExternalNameIgnored(t *testing.T) {
+	l := log.NewNopLogger()
+	k := &testK8S{t: t}
+	a := New(l)
+	a.client = k
+	c := &controller{
+		logger: l,
+		ips:    a,
+		client: k,
+	}
+
+	cfg := &purelbv1.Config{
+		DefaultAnnouncer: true,
+		Groups: []*purelbv1.ServiceGroup{
+			localServiceGroup("default", "1.2.3.0/32"),
+		},
+	}
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(cfg), "SetConfig failed")
+	c.MarkSynced(nil)
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      "alias",
+		},
+		Spec: v1.ServiceSpec{
+			Type:         v1.ServiceTypeExternalName,
+			ExternalName: "example.com",
+		},
+	}
+	orig := svc.DeepCopy()
+
+	// ExternalName services are left alone, without any events
+	k.reset()
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc, nil), "SetBalancer failed")
+	assert.Empty(t, diffService(orig, svc), "ExternalName service was modified")
+	assert.Empty(t, k.infos)
+	assert.Empty(t, k.warnings)
+	assert.Equal(t, 0, a.pools["default"].InUse())
+
+	// ...unless they used to be one of our LoadBalancers, in which case
+	// we release the address
+	svc.Spec.Type = "LoadBalancer"
+	svc.Spec.ClusterIP = "1.2.3.4"
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc, nil), "SetBalancer failed")
+	assert.Equal(t, 1, a.pools["default"].InUse())
+	svc.Spec.Type = v1.ServiceTypeExternalName
+	svc.Spec.ClusterIP = ""
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc, nil), "SetBalancer failed")
+	assert.Empty(t, svc.Status.LoadBalancer.Ingress)
+	assert.NotContains(t, svc.Annotations, purelbv1.PoolAnnotation)
+	assert.Equal(t, 0, a.pools["default"].InUse())
+}
+
+func TestIgnoreAnnotation(t *testing.T) {
+	l := log.NewNopLogger()
+	k := &testK8S{t: t}
+	a := New(l)
+	a.client = k
+	c := &controller{
+		logger: l,
+		ips:    a,
+		client: k,
+	}
+
+	cfg := &purelbv1.Config{
+		DefaultAnnouncer: true,
+		Groups: []*purelbv1.ServiceGroup{
+			localServiceGroup("default", "1.2.3.0/32"),
+		},
+	}
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(cfg), "SetConfig failed")
+	c.MarkSynced(nil)
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      "ignored",
+			Annotations: map[string]string{
+				purelbv1.IgnoreAnnotation: "true",
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+	}
+	orig := svc.DeepCopy()
+
+	// Ignored services are left alone, without any events
+	k.reset()
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc, nil), "SetBalancer failed")
+	assert.Empty(t, diffService(orig, svc), "ignored service was modified")
+	assert.Empty(t, k.infos)
+	assert.Empty(t, k.warnings)
+	assert.Equal(t, 0, a.pools["default"].InUse())
+
+	// ...even if another controller gave them an address
+	svc.Status = statusAssigned("1.2.3.0")
+	orig = svc.DeepCopy()
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc, nil), "SetBalancer failed")
+	assert.Empty(t, diffService(orig, svc), "ignored service was modified")
+	assert.Equal(t, 0, a.pools["default"].InUse())
+
+	// Any other value doesn't count
+	svc.Annotations[purelbv1.IgnoreAnnotation] = "false"
+	svc.Status = v1.ServiceStatus{}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc, nil), "SetBalancer failed")
+	assert.Equal(t, "1.2.3.0", svc.Status.LoadBalancer.Ingress[0].IP, "svc didn't get an address")
+}
+
+func TestTakeover(t *testing.T) {
+	l := log.NewNopLogger()
+	k := &testK8S{t: t}
+	a := New(l)
+	a.client = k
+	c := &controller{
+		logger: l,
+		ips:    a,
+		client: k,
+	}
+
+	cfg := &purelbv1.Config{
+		DefaultAnnouncer: true,
+		Groups: []*purelbv1.ServiceGroup{
+			localServiceGroup("default", "1.2.3.0/31"),
+		},
+	}
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(cfg), "SetConfig failed")
+
+	// A service that a previous allocator gave an address
+	existing := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      "existing",
+			Annotations: map[string]string{
+				purelbv1.BrandAnnotation:          purelbv1.Brand,
+				purelbv1.PoolAnnotation:           "default",
+				purelbv1.AnnounceMethodAnnotation: purelbv1.AnnounceMethodLocal,
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+		Status: statusAssigned("1.2.3.0"),
+	}
+	orig := existing.DeepCopy()
+
+	// Taking over rebuilds the allocator's state from the services
+	c.MarkSynced([]*v1.Service{existing})
+	assert.Equal(t, 1, a.pools["default"].InUse())
+	assert.Empty(t, diffService(orig, existing), "takeover modified the service")
+
+	// ...so a new service doesn't get the existing service's address,
+	// even if it's processed first
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      "new",
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.5",
+		},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc, nil), "SetBalancer failed")
+	assert.Equal(t, "1.2.3.1", svc.Status.LoadBalancer.Ingress[0].IP, "new service got the existing service's address")
+
+	// The existing service keeps its address
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(existing, nil), "SetBalancer failed")
+	assert.Empty(t, diffService(orig, existing), "existing service's address changed")
+	assert.Equal(t, 2, a.pools["default"].InUse())
+}
+
+func TestDesiredGroupChangeBlocked(t *testing.T) {
+	l := log.NewNopLogger()
+	k := &testK8S{t: t}
+	a := New(l)
+	a.client = k
+	c := &controller{
+		logger: l,
+		ips:    a,
+		client: k,
+	}
+
+	cfg := &purelbv1.Config{
+		DefaultAnnouncer: true,
+		Groups: []*purelbv1.ServiceGroup{
+			localServiceGroup("old", "1.2.3.0/32"),
+			localServiceGroup("new", "3.2.1.0/32"),
+		},
+	}
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(cfg), "SetConfig failed")
+	c.MarkSynced(nil)
+
+	newService := func(name string, group string, clusterIP string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "test",
+				Name:        name,
+				Annotations: map[string]string{purelbv1.DesiredGroupAnnotation: group},
+			},
+			Spec: v1.ServiceSpec{
+				Type:      "LoadBalancer",
+				ClusterIP: clusterIP,
+			},
+		}
+	}
+	svc := newService("test", "old", "1.2.3.4")
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc, nil), "SetBalancer failed")
+	squatter := newService("squatter", "new", "1.2.3.5")
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(squatter, nil), "SetBalancer failed")
+	k.reset()
+
+	// The new pool is full so the service keeps its address, and we
+	// tell the user once, not on every resync
+	svc.Annotations[purelbv1.DesiredGroupAnnotation] = "new"
+	svc.Annotations[purelbv1.ReallocateAnnotation] = "true"
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc, nil), "SetBalancer failed")
+		assert.Equal(t, "1.2.3.0", svc.Status.LoadBalancer.Ingress[0].IP, "svc lost its address")
+		assert.Equal(t, "old", svc.Annotations[purelbv1.PoolAnnotation])
+	}
+	assert.Equal(t, []string{"ReallocateSkipped"}, k.warnings)
+	assert.Empty(t, k.infos, "svc's address was released")
+
+	// Once the new pool has room the service moves
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.DeleteBalancer("test/squatter"))
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer(svc, nil), "SetBalancer failed")
+	assert.Equal(t, "3.2.1.0", svc.Status.LoadBalancer.Ingress[0].IP, "svc didn't move to the new pool")
+	assert.Equal(t, "new", svc.Annotations[purelbv1.PoolAnnotation])
+}
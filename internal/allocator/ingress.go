@@ -25,3 +25,45 @@ func addIngress(log log.Logger, svc *v1.Service, address net.IP) {
 	svc.Status.LoadBalancer.Ingress = append(svc.Status.LoadBalancer.Ingress, v1.LoadBalancerIngress{IP: address.String()})
 	log.Log("op", "program ingress address", "dest", "IP", "address", address.String())
 }
+
+// addExternalIPs adds the addresses in svc's ingress status to its
+// externalIPs, for tools that read externalIPs instead of the status.
+// Addresses that are already there aren't added again.
+func addExternalIPs(svc *v1.Service) {
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		if !hasExternalIP(svc, ingress.IP) {
+			svc.Spec.ExternalIPs = append(svc.Spec.ExternalIPs, ingress.IP)
+		}
+	}
+}
+
+// removeExternalIPs removes the addresses in ingresses from svc's
+// externalIPs.
+func removeExternalIPs(svc *v1.Service, ingresses []v1.LoadBalancerIngress) {
+	kept := []string{}
+	for _, externalIP := range svc.Spec.ExternalIPs {
+		remove := false
+		for _, ingress := range ingresses {
+			if ingress.IP == externalIP {
+				remove = true
+			}
+		}
+		if !remove {
+			kept = append(kept, externalIP)
+		}
+	}
+	if len(kept) == 0 {
+		kept = nil
+	}
+	svc.Spec.ExternalIPs = kept
+}
+
+// hasExternalIP returns true if ip is one of svc's externalIPs.
+func hasExternalIP(svc *v1.Service, ip string) bool {
+	for _, externalIP := range svc.Spec.ExternalIPs {
+		if externalIP == ip {
+			return true
+		}
+	}
+	return false
+}
@@ -16,9 +16,15 @@
 package allocator
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/vishvananda/netlink/nl"
@@ -50,6 +56,95 @@ type LocalPool struct {
 	sharingKeys map[string]*Key // ip.String() -> pointer to sharing key
 
 	portsInUse map[string]map[Port]string // ip.String() -> Port -> svc
+
+	// remote is true if this pool's addresses should always be
+	// announced remotely, i.e., on the node agents' virtual interface.
+	remote bool
+
+	// subnets contains the subnets that contain this pool's ranges.
+	subnets []*net.IPNet
+
+	// excluded contains addresses that we must never assign, even
+	// though they're in this pool's ranges.
+	excluded []*net.IPNet
+
+	// reservations contain addresses that we don't assign
+	// automatically, although users can ask for them.
+	reservations []reservation
+
+	// hashAllocation is true if this pool picks addresses by hashing
+	// the service's name instead of sequentially.
+	hashAllocation bool
+
+	// freed holds the time at which each address was last freed, if
+	// this pool allocates the least-recently-freed address. It's nil
+	// if the pool doesn't.
+	freed map[string]time.Time // ip.String() -> time freed
+
+	// familyPreference determines which family we try first for
+	// services that will accept either one.
+	familyPreference string
+
+	// maxAddresses is the number of addresses that each service can
+	// have from this pool. 0 means there's no limit.
+	maxAddresses int
+
+	// namespacedSharing is true if only services in the same namespace
+	// can share addresses.
+	namespacedSharing bool
+
+	// sequentialPrefixes are the service name prefixes whose services
+	// we try to give contiguous addresses.
+	sequentialPrefixes []string
+}
+
+// reservation describes the addresses in a range that we don't assign
+// automatically. Addresses below low or above high are reserved, as
+// are IPv4 addresses that end in .0 or .255 if avoidBuggy is true. If
+// low or high is nil then the whole range is reserved.
+type reservation struct {
+	r          *purelbv1.IPRange
+	low        net.IP
+	high       net.IP
+	avoidBuggy bool
+}
+
+// newReservations returns the reservations that spec makes in ranges.
+func newReservations(spec *purelbv1.ServiceGroupAddressPool, ranges []purelbv1.IPRange) ([]reservation, error) {
+	if spec.ReserveFirst < 0 || spec.ReserveLast < 0 {
+		return nil, fmt.Errorf("reservefirst and reservelast can't be negative")
+	}
+	if spec.ReserveFirst == 0 && spec.ReserveLast == 0 && !spec.AvoidBuggyIPs {
+		return nil, nil
+	}
+
+	reservations := []reservation{}
+	for i := range ranges {
+		reservations = append(reservations, reservation{
+			r:          &ranges[i],
+			low:        ranges[i].Nth(uint64(spec.ReserveFirst)),
+			high:       ranges[i].NthFromLast(uint64(spec.ReserveLast)),
+			avoidBuggy: spec.AvoidBuggyIPs,
+		})
+	}
+	return reservations, nil
+}
+
+// contains returns true if ip is reserved.
+func (res reservation) contains(ip net.IP) bool {
+	if !res.r.Contains(ip) {
+		return false
+	}
+	if res.low == nil || res.high == nil {
+		return true
+	}
+	if bytes.Compare(ip.To16(), res.low.To16()) < 0 || bytes.Compare(ip.To16(), res.high.To16()) > 0 {
+		return true
+	}
+	if ip4 := ip.To4(); res.avoidBuggy && ip4 != nil {
+		return ip4[3] == 0 || ip4[3] == 255
+	}
+	return false
 }
 
 func NewLocalPool(name string, log log.Logger, spec purelbv1.ServiceGroupLocalSpec) (LocalPool, error) {
@@ -59,6 +154,31 @@ func NewLocalPool(name string, log log.Logger, spec purelbv1.ServiceGroupLocalSp
 		addressesInUse: map[string]map[string]bool{},
 		sharingKeys:    map[string]*Key{},
 		portsInUse:     map[string]map[Port]string{},
+		remote:         spec.Remote,
+		hashAllocation: spec.Allocation == purelbv1.AllocationHash,
+
+		familyPreference:   spec.FamilyPreference,
+		sequentialPrefixes: spec.SequentialPrefixes,
+	}
+
+	if spec.MaxAddresses != nil {
+		if *spec.MaxAddresses < 1 {
+			return pool, fmt.Errorf("maxaddresses must be at least 1, not %d", *spec.MaxAddresses)
+		}
+		pool.maxAddresses = *spec.MaxAddresses
+	}
+
+	switch spec.Allocation {
+	case purelbv1.AllocationLRU:
+		pool.freed = map[string]time.Time{}
+	case "", purelbv1.AllocationSequential, purelbv1.AllocationHash:
+	default:
+		return pool, fmt.Errorf("unknown allocation %q", spec.Allocation)
+	}
+	switch spec.FamilyPreference {
+	case "", purelbv1.FamilyPreferenceIPv6, purelbv1.FamilyPreferenceIPv4, purelbv1.FamilyPreferenceMostFree:
+	default:
+		return pool, fmt.Errorf("unknown family preference %q", spec.FamilyPreference)
 	}
 
 	// If there ranges in the "legacy" slots, add them to the slices.
@@ -71,67 +191,105 @@ func NewLocalPool(name string, log log.Logger, spec purelbv1.ServiceGroupLocalSp
 
 	// See if there's an IPV6 range in the spec
 	for _, v6pool := range spec.V6Pools {
-		iprange, err := purelbv1.NewIPRange(v6pool.Pool)
+		ipranges, err := purelbv1.NewIPRanges(v6pool.Pool)
 		if err != nil {
 			return pool, err
 		}
 
-		// Validate that the range is contained by the subnet.
+		// Validate that the ranges are contained by the subnet.
 		_, subnet, err := net.ParseCIDR(v6pool.Subnet)
 		if err != nil {
 			return pool, err
 		}
-		if !iprange.ContainedBy(*subnet) {
-			return pool, fmt.Errorf("IPV6 range %s not contained by network %s", iprange, subnet)
+		for i := range ipranges {
+			if !ipranges[i].ContainedBy(*subnet) {
+				return pool, fmt.Errorf("IPV6 range %s not contained by network %s", ipranges[i], subnet)
+			}
+			pool.v6Ranges = append(pool.v6Ranges, &ipranges[i])
 		}
-
-		pool.v6Ranges = append(pool.v6Ranges, &iprange)
+		if _, err := v6pool.ParseNextHop(); err != nil {
+			return pool, err
+		}
+		if _, err := v6pool.ParseBroadcast(); err != nil {
+			return pool, err
+		}
+		if err := v6pool.ValidateAggregation(); err != nil {
+			return pool, err
+		}
+		reservations, err := newReservations(v6pool, ipranges)
+		if err != nil {
+			return pool, err
+		}
+		pool.reservations = append(pool.reservations, reservations...)
+		pool.subnets = append(pool.subnets, subnet)
 	}
 
 	// See if there's an IPV4 range in the spec
 	for _, v4pool := range spec.V4Pools {
-		iprange, err := purelbv1.NewIPRange(v4pool.Pool)
+		ipranges, err := purelbv1.NewIPRanges(v4pool.Pool)
 		if err != nil {
 			return pool, err
 		}
 
-		// Validate that the range is contained by the subnet.
+		// Validate that the ranges are contained by the subnet.
 		_, subnet, err := net.ParseCIDR(v4pool.Subnet)
 		if err != nil {
 			return pool, err
 		}
-		if !iprange.ContainedBy(*subnet) {
-			return pool, fmt.Errorf("IPV4 range %s not contained by network %s", iprange, subnet)
+		for i := range ipranges {
+			if !ipranges[i].ContainedBy(*subnet) {
+				return pool, fmt.Errorf("IPV4 range %s not contained by network %s", ipranges[i], subnet)
+			}
+			pool.v4Ranges = append(pool.v4Ranges, &ipranges[i])
+		}
+		if _, err := v4pool.ParseNextHop(); err != nil {
+			return pool, err
 		}
-
-		pool.v4Ranges = append(pool.v4Ranges, &iprange)
+		if _, err := v4pool.ParseBroadcast(); err != nil {
+			return pool, err
+		}
+		if err := v4pool.ValidateAggregation(); err != nil {
+			return pool, err
+		}
+		reservations, err := newReservations(v4pool, ipranges)
+		if err != nil {
+			return pool, err
+		}
+		pool.reservations = append(pool.reservations, reservations...)
+		pool.subnets = append(pool.subnets, subnet)
 	}
 
 	// See if there's a top-level range in the spec
 	if spec.Pool != "" {
 		// Validate that Subnet is at least well-formed
-		iprange, err := purelbv1.NewIPRange(spec.Pool)
+		ipranges, err := purelbv1.NewIPRanges(spec.Pool)
 		if err == nil {
-			// Validate that the range is contained by the subnet.
+			// Validate that the ranges are contained by the subnet, which
+			// also means that they're all the same family.
 			_, subnet, err := net.ParseCIDR(spec.Subnet)
 			if err != nil {
 				return pool, err
 			}
-			if !iprange.ContainedBy(*subnet) {
-				return pool, fmt.Errorf("Legacy range %s not contained by network %s", iprange, subnet)
+			legacy := []*purelbv1.IPRange{}
+			for i := range ipranges {
+				if !ipranges[i].ContainedBy(*subnet) {
+					return pool, fmt.Errorf("Legacy range %s not contained by network %s", ipranges[i], subnet)
+				}
+				legacy = append(legacy, &ipranges[i])
 			}
+			pool.subnets = append(pool.subnets, subnet)
 
 			// We have a legacy (i.e., top-level) range, let's see where it
 			// goes
-			if iprange.Family() == nl.FAMILY_V6 {
+			if ipranges[0].Family() == nl.FAMILY_V6 {
 				if pool.v6Ranges == nil {
-					pool.v6Ranges = append(pool.v6Ranges, &iprange)
+					pool.v6Ranges = legacy
 				} else {
 					return pool, fmt.Errorf("Invalid Spec: both legacy Pool and V6Pool are IPV6")
 				}
-			} else if iprange.Family() == nl.FAMILY_V4 {
+			} else if ipranges[0].Family() == nl.FAMILY_V4 {
 				if pool.v4Ranges == nil {
-					pool.v4Ranges = append(pool.v4Ranges, &iprange)
+					pool.v4Ranges = legacy
 				} else {
 					return pool, fmt.Errorf("Invalid Spec: both legacy Pool and V4Pool are IPV4")
 				}
@@ -150,7 +308,7 @@ func NewLocalPool(name string, log log.Logger, spec purelbv1.ServiceGroupLocalSp
 
 func (p LocalPool) Notify(service *v1.Service) error {
 	nsName := namespacedName(service)
-	sharingKey := &Key{Sharing: SharingKey(service)}
+	sharingKey := p.sharingKey(service)
 	ports := Ports(service)
 
 	for _, ingress := range service.Status.LoadBalancer.Ingress {
@@ -167,6 +325,7 @@ func (p LocalPool) Notify(service *v1.Service) error {
 			p.addressesInUse[ipstr] = map[string]bool{}
 		}
 		p.addressesInUse[ipstr][nsName] = true
+		delete(p.freed, ipstr)
 		if p.portsInUse[ipstr] == nil {
 			p.portsInUse[ipstr] = map[Port]string{}
 		}
@@ -184,9 +343,16 @@ func (p LocalPool) Notify(service *v1.Service) error {
 // nil if the ip is available, and will contain an explanation if not.
 func (p LocalPool) available(ip net.IP, service *v1.Service) error {
 	nsName := namespacedName(service)
-	key := &Key{Sharing: SharingKey(service)}
+	key := p.sharingKey(service)
 	ports := Ports(service)
 
+	// Excluded addresses are never available
+	for _, excluded := range p.excluded {
+		if excluded.Contains(ip) {
+			return fmt.Errorf("%s is excluded from allocation by %s", ip, excluded)
+		}
+	}
+
 	// No key: no sharing
 	if key == nil {
 		key = &Key{}
@@ -230,15 +396,31 @@ func (p LocalPool) AssignNext(service *v1.Service) error {
 	}
 
 	if len(families) == 0 {
-		// Any address is OK so try V6 first then V4 and assign the first
-		// one that succeeds
-		if err = p.assignFamily(nl.FAMILY_V6, service); err == nil {
-			return err
+		// Any address is OK so try the families in order of preference
+		// and assign the first one that succeeds. If none does, and one
+		// was full, then that's more interesting than the other not
+		// existing.
+		var exhausted error
+		for _, family := range p.familyOrder() {
+			if err = p.assignFamily(family, service); err == nil {
+				return nil
+			}
+			var exhaustedErr *PoolExhaustedError
+			if errors.As(err, &exhaustedErr) {
+				exhausted = err
+			}
 		}
-		return p.assignFamily(nl.FAMILY_V4, service)
+		if exhausted != nil {
+			return exhausted
+		}
+		return err
 	}
 
-	// We have a specific set of families to assign
+	// We have a specific set of families to assign, as long as there
+	// aren't more of them than the pool allows
+	if p.maxAddresses > 0 && len(families) > p.maxAddresses {
+		return &TooManyAddressesError{Pool: p.name, Requested: len(families), Max: p.maxAddresses}
+	}
 	for _, family := range families {
 		if err := p.assignFamily(family, service); err != nil {
 			return err
@@ -247,15 +429,147 @@ func (p LocalPool) AssignNext(service *v1.Service) error {
 	return nil
 }
 
+// familyOrder returns the order in which we try the families for
+// services that will accept either one. By default we try IPv6 first.
+func (p LocalPool) familyOrder() []int {
+	switch p.familyPreference {
+	case purelbv1.FamilyPreferenceIPv4:
+		return []int{nl.FAMILY_V4, nl.FAMILY_V6}
+	case purelbv1.FamilyPreferenceMostFree:
+		if p.free(nl.FAMILY_V4) > p.free(nl.FAMILY_V6) {
+			return []int{nl.FAMILY_V4, nl.FAMILY_V6}
+		}
+	}
+	return []int{nl.FAMILY_V6, nl.FAMILY_V4}
+}
+
+// free returns the number of addresses in family that aren't in use.
+func (p LocalPool) free(family int) uint64 {
+	ranges, ipFamily := p.v4Ranges, v1.IPv4Protocol
+	if family == nl.FAMILY_V6 {
+		ranges, ipFamily = p.v6Ranges, v1.IPv6Protocol
+	}
+
+	size := rangesSize(ranges)
+	inUse := uint64(p.InUseFamily(ipFamily))
+	if inUse >= size {
+		return 0
+	}
+	return size - inUse
+}
+
 func (p LocalPool) assignFamily(family int, service *v1.Service) error {
-	for pos := p.first(family); pos != nil; pos = p.next(pos) {
+	if p.firstInRanges(family) == nil {
+		ipFamily := v1.IPv4Protocol
+		if family == nl.FAMILY_V6 {
+			ipFamily = v1.IPv6Protocol
+		}
+		return &NoPoolForFamilyError{Pool: p.name, Family: ipFamily}
+	}
+
+	// If the service is part of a sequential group then try to give it
+	// the address after the group's addresses.
+	if ip := p.sequentialAddress(family, service); ip != nil {
+		if err := p.Assign(ip, service); err == nil {
+			return nil
+		}
+	}
+
+	if p.freed != nil {
+		return p.assignLRU(family, service)
+	}
+
+	// Start at the beginning of the pool, or if we're allocating by
+	// hash, at the service's hashed address. Scan to the end of the
+	// pool, then wrap around to the beginning if we didn't start there.
+	start := p.first(family)
+	if p.hashAllocation {
+		start = p.hashedAddress(family, namespacedName(service))
+		if p.reserved(start) {
+			if start = p.next(start); start == nil {
+				start = p.first(family)
+			}
+		}
+	}
+	for pos := start; pos != nil; pos = p.next(pos) {
 		if err := p.Assign(pos, service); err == nil {
 			// we found an available address
 			return err
 		}
 	}
+	for pos := p.first(family); pos != nil && !pos.Equal(start); pos = p.next(pos) {
+		if err := p.Assign(pos, service); err == nil {
+			return err
+		}
+	}
 
-	return fmt.Errorf("no available addresses for service %s in family %d", namespacedName(service), family)
+	return &PoolExhaustedError{Pool: p.name, Service: namespacedName(service), Family: family}
+}
+
+// sequentialAddress returns the address in family after the highest
+// address of the other services in service's sequential group, or nil
+// if service isn't in a group, if no other service in its group has
+// an address in family, or if there are no more addresses. A group is
+// the services in a namespace whose names start with the same
+// sequential prefix.
+func (p LocalPool) sequentialAddress(family int, service *v1.Service) net.IP {
+	prefix := ""
+	for _, candidate := range p.sequentialPrefixes {
+		if candidate != "" && strings.HasPrefix(service.Name, candidate) {
+			prefix = candidate
+			break
+		}
+	}
+	if prefix == "" {
+		return nil
+	}
+
+	nsName := namespacedName(service)
+	var highest net.IP
+	for ipstr, svcs := range p.addressesInUse {
+		ip := net.ParseIP(ipstr)
+		if purelbv1.AddrFamily(ip) != family {
+			continue
+		}
+		for svc := range svcs {
+			namespace, name, _ := strings.Cut(svc, "/")
+			if svc != nsName && namespace == service.Namespace && strings.HasPrefix(name, prefix) {
+				if highest == nil || bytes.Compare(ip.To16(), highest.To16()) > 0 {
+					highest = ip
+				}
+				break
+			}
+		}
+	}
+	if highest == nil {
+		return nil
+	}
+	return p.next(highest)
+}
+
+// assignLRU assigns the least-recently-freed address in family to
+// service. Addresses that have never been freed (and addresses that
+// service can share) are used first, in sequential order.
+func (p LocalPool) assignLRU(family int, service *v1.Service) error {
+	var oldest net.IP
+	var oldestFreed time.Time
+	for pos := p.first(family); pos != nil; pos = p.next(pos) {
+		if p.available(pos, service) != nil {
+			continue
+		}
+		freed, wasFreed := p.freed[pos.String()]
+		if !wasFreed {
+			return p.Assign(pos, service)
+		}
+		if oldest == nil || freed.Before(oldestFreed) {
+			oldest, oldestFreed = pos, freed
+		}
+	}
+	if oldest != nil {
+		return p.Assign(oldest, service)
+	}
+
+	return &PoolExhaustedError{Pool: p.name, Service: namespacedName(service), Family: family}
 }
 
 // Assign assigns a service to an IP.
@@ -271,6 +585,37 @@ func (p LocalPool) Assign(ip net.IP, service *v1.Service) error {
 	return p.Notify(service)
 }
 
+// clone returns a copy of p whose allocations can be modified
+// without modifying p's.
+func (p LocalPool) clone() LocalPool {
+	c := p
+	c.addressesInUse = map[string]map[string]bool{}
+	for ipstr, svcs := range p.addressesInUse {
+		c.addressesInUse[ipstr] = map[string]bool{}
+		for svc := range svcs {
+			c.addressesInUse[ipstr][svc] = true
+		}
+	}
+	c.sharingKeys = map[string]*Key{}
+	for ipstr, key := range p.sharingKeys {
+		c.sharingKeys[ipstr] = key
+	}
+	c.portsInUse = map[string]map[Port]string{}
+	for ipstr, ports := range p.portsInUse {
+		c.portsInUse[ipstr] = map[Port]string{}
+		for port, svc := range ports {
+			c.portsInUse[ipstr][port] = svc
+		}
+	}
+	if p.freed != nil {
+		c.freed = map[string]time.Time{}
+		for ipstr, freed := range p.freed {
+			c.freed[ipstr] = freed
+		}
+	}
+	return c
+}
+
 // Release releases an IP so it can be assigned again.
 func (p LocalPool) Release(service string) error {
 	for ipstr, allocs := range p.addressesInUse {
@@ -278,6 +623,9 @@ func (p LocalPool) Release(service string) error {
 		if len(allocs) == 0 {
 			delete(p.addressesInUse, ipstr)
 			delete(p.sharingKeys, ipstr)
+			if p.freed != nil {
+				p.freed[ipstr] = time.Now()
+			}
 		}
 		for port, svc := range p.portsInUse[ipstr] {
 			if svc == service {
@@ -297,6 +645,74 @@ func (p LocalPool) InUse() int {
 	return len(p.addressesInUse)
 }
 
+// InUseFamily returns the count of the IP addresses in family that
+// are currently assigned to services.
+func (p LocalPool) InUseFamily(family v1.IPFamily) int {
+	return inUseFamily(p.addressesInUse, family)
+}
+
+// Services returns the names of the services that have addresses
+// from this pool.
+func (p LocalPool) Services() []string {
+	return servicesInUse(p.addressesInUse)
+}
+
+// carryOver copies service's allocations in old to p, e.g., after a
+// configuration change replaces old with p. If any of service's
+// addresses isn't in p, or is excluded, then it returns an error and
+// copies nothing.
+func (p LocalPool) carryOver(old LocalPool, service string) error {
+	ips := old.addressesOf(service)
+	for _, ip := range ips {
+		if !p.Contains(ip) {
+			return fmt.Errorf("%s is not in pool %s", ip, p.name)
+		}
+		for _, excluded := range p.excluded {
+			if excluded.Contains(ip) {
+				return fmt.Errorf("%s is excluded from allocation by %s", ip, excluded)
+			}
+		}
+	}
+
+	for _, ip := range ips {
+		ipstr := ip.String()
+		if p.addressesInUse[ipstr] == nil {
+			p.addressesInUse[ipstr] = map[string]bool{}
+		}
+		p.addressesInUse[ipstr][service] = true
+		p.sharingKeys[ipstr] = old.sharingKeys[ipstr]
+		delete(p.freed, ipstr)
+		for port, svc := range old.portsInUse[ipstr] {
+			if svc != service {
+				continue
+			}
+			if p.portsInUse[ipstr] == nil {
+				p.portsInUse[ipstr] = map[Port]string{}
+			}
+			p.portsInUse[ipstr][port] = service
+		}
+	}
+	return nil
+}
+
+// addressesOf returns the addresses that are assigned to service,
+// IPv4 before IPv6.
+func (p LocalPool) addressesOf(service string) []net.IP {
+	ips := []net.IP{}
+	for ipstr, svcs := range p.addressesInUse {
+		if svcs[service] {
+			ips = append(ips, net.ParseIP(ipstr))
+		}
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		if (ips[i].To4() != nil) != (ips[j].To4() != nil) {
+			return ips[i].To4() != nil
+		}
+		return bytes.Compare(ips[i], ips[j]) < 0
+	})
+	return ips
+}
+
 // servicesOnIP returns the names of the services who are assigned to
 // the address.
 func (p LocalPool) servicesOnIP(ip net.IP) []string {
@@ -312,16 +728,96 @@ func (p LocalPool) servicesOnIP(ip net.IP) []string {
 	return []string{}
 }
 
+// sharingKey returns service's sharing key. If the pool's sharing
+// keys are namespaced then the key includes service's namespace.
+func (p LocalPool) sharingKey(service *v1.Service) *Key {
+	key := &Key{Sharing: SharingKey(service)}
+	if p.namespacedSharing {
+		key.Namespace = service.Namespace
+	}
+	return key
+}
+
 // SharingKey returns the "sharing key" for the specified address.
 func (p LocalPool) SharingKey(ip net.IP) *Key {
 	return p.sharingKeys[ip.String()]
 }
 
-// first returns the first net.IP within this Pool, or nil if the pool
-// has no addresses. The "first" address is the lowest address in the
-// first range, although it might not be the lowest in the entire
-// pool.
+// rangesSize returns the number of addresses in ranges. It saturates
+// if that's too large for a uint64 (which can happen with IPV6).
+func rangesSize(ranges []*purelbv1.IPRange) uint64 {
+	size := uint64(0)
+	for _, r := range ranges {
+		if size+r.Size() < size {
+			return ^uint64(0)
+		}
+		size += r.Size()
+	}
+	return size
+}
+
+// hashedAddress returns the address in family that nsName hashes to.
+// A given name always hashes to the same address in a given pool.
+func (p LocalPool) hashedAddress(family int, nsName string) net.IP {
+	ranges := p.v4Ranges
+	if family == nl.FAMILY_V6 {
+		ranges = p.v6Ranges
+	}
+
+	size := rangesSize(ranges)
+	if size == 0 {
+		return nil
+	}
+
+	hash := sha256.Sum256([]byte(nsName))
+	n := binary.BigEndian.Uint64(hash[:8]) % size
+
+	// Find the range that contains the nth address
+	for _, r := range ranges {
+		if n < r.Size() {
+			return r.Nth(n)
+		}
+		n -= r.Size()
+	}
+	return nil
+}
+
+// first returns the first net.IP within this Pool that isn't
+// reserved, or nil if there isn't one.
 func (p LocalPool) first(family int) net.IP {
+	ip := p.firstInRanges(family)
+	for ip != nil && p.reserved(ip) {
+		ip = p.nextInRanges(ip)
+	}
+	return ip
+}
+
+// next returns the next net.IP within this Pool that isn't reserved,
+// or nil if there isn't one.
+func (p LocalPool) next(ip net.IP) net.IP {
+	next := p.nextInRanges(ip)
+	for next != nil && p.reserved(next) {
+		next = p.nextInRanges(next)
+	}
+	return next
+}
+
+// reserved returns true if ip is reserved, i.e., we don't assign it
+// automatically.
+func (p LocalPool) reserved(ip net.IP) bool {
+	for _, res := range p.reservations {
+		if res.contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstInRanges returns the first net.IP within this Pool's ranges,
+// or nil if the pool has no addresses. The "first" address is the
+// lowest address in the first range, although it might not be the
+// lowest in the entire pool.
+func (p LocalPool) firstInRanges(family int) net.IP {
 	if family == nl.FAMILY_V6 && len(p.v6Ranges) > 0 {
 		return p.v6Ranges[0].First()
 	}
@@ -333,9 +829,9 @@ func (p LocalPool) first(family int) net.IP {
 	return nil
 }
 
-// next returns the next net.IP within this Pool, or nil if the
-// provided net.IP is the last address in the range.
-func (p LocalPool) next(ip net.IP) net.IP {
+// nextInRanges returns the next net.IP within this Pool's ranges, or
+// nil if the provided net.IP is the last address in the range.
+func (p LocalPool) nextInRanges(ip net.IP) net.IP {
 	if purelbv1.AddrFamily(ip) == nl.FAMILY_V6 {
 		for i, v6 := range p.v6Ranges {
 			// If this range contains the current address, and has another
@@ -387,14 +883,12 @@ func (p LocalPool) next(ip net.IP) net.IP {
 
 // Size returns the total number of addresses in this pool if it's a
 // local pool, or 0 if it's a remote pool.
-func (p LocalPool) Size() (size uint64) {
-	for _, v6 := range p.v6Ranges {
-		size += v6.Size()
+func (p LocalPool) Size() uint64 {
+	v6, v4 := rangesSize(p.v6Ranges), rangesSize(p.v4Ranges)
+	if v6+v4 < v6 {
+		return ^uint64(0)
 	}
-	for _, v4 := range p.v4Ranges {
-		size += v4.Size()
-	}
-	return
+	return v6 + v4
 }
 
 // Overlaps indicates whether the other Pool overlaps with this one
@@ -464,6 +958,18 @@ func (p LocalPool) whichFamilies(service *v1.Service) ([]int, error) {
 	return families, nil
 }
 
+// InSubnet returns true if ip is in one of this pool's subnets. The
+// subnets contain the pool's ranges so an address can be in a subnet
+// but not in the pool.
+func (p LocalPool) InSubnet(ip net.IP) bool {
+	for _, subnet := range p.subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func (p LocalPool) String() string {
 	return p.name
 }
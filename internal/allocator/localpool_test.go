@@ -14,6 +14,8 @@
 package allocator
 
 import (
+	"fmt"
+	"math"
 	"net"
 	"sort"
 	"testing"
@@ -125,6 +127,16 @@ func TestNewLocalPool(t *testing.T) {
 		Subnet: "192.168.1.0/32",
 	})
 	assert.Error(t, err, "pool isn't contained in its subnet")
+
+	// Test invalid aggregations
+	_, err = NewLocalPool("badaggregation", localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+		V4Pool: &purelbv1.ServiceGroupAddressPool{
+			Pool:        "192.168.1.0/30",
+			Subnet:      "192.168.1.0/24",
+			Aggregation: "/33",
+		},
+	})
+	assert.Error(t, err, "aggregation is too long for IPv4")
 }
 
 func TestFirstNext(t *testing.T) {
@@ -151,6 +163,68 @@ func TestFirstNext(t *testing.T) {
 	assert.Nil(t, next, "next() returned an incorrect address")
 }
 
+func TestAddressList(t *testing.T) {
+	// A sparse list of addresses is iterated in the order in which
+	// it's listed, and only the listed addresses are in the pool
+	p, err := NewLocalPool("list", localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+		V4Pool: &purelbv1.ServiceGroupAddressPool{
+			Pool:   "10.129.0.34, 10.129.0.29,10.129.0.40-10.129.0.41",
+			Subnet: "10.129.0.0/24",
+		},
+	})
+	assert.NoError(t, err, "Pool instantiation failed")
+	assert.Equal(t, uint64(4), p.Size())
+
+	addrs := []string{}
+	for ip := p.first(nl.FAMILY_V4); ip != nil; ip = p.next(ip) {
+		addrs = append(addrs, ip.String())
+	}
+	assert.Equal(t, []string{"10.129.0.34", "10.129.0.29", "10.129.0.40", "10.129.0.41"}, addrs)
+
+	assert.True(t, p.Contains(net.ParseIP("10.129.0.29")))
+	assert.False(t, p.Contains(net.ParseIP("10.129.0.30")), "address between listed addresses")
+	assert.False(t, p.Contains(net.ParseIP("10.129.0.33")), "address between listed addresses")
+
+	// Allocation uses only the listed addresses
+	for _, want := range addrs {
+		svc := v1.Service{}
+		svc.Name = want
+		assert.NoError(t, p.AssignNext(&svc))
+		assert.Equal(t, want, svc.Status.LoadBalancer.Ingress[0].IP)
+	}
+	svc := v1.Service{}
+	svc.Name = "full"
+	assert.Error(t, p.AssignNext(&svc), "pool should be full")
+
+	// The legacy top-level Pool can be a list, too
+	p, err = NewLocalPool("legacy", localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+		Pool:   "fc00::42,fc00::29",
+		Subnet: "fc00::/64",
+	})
+	assert.NoError(t, err, "Pool instantiation failed")
+	assert.Equal(t, net.ParseIP("fc00::42"), p.first(nl.FAMILY_V6))
+	assert.Equal(t, net.ParseIP("fc00::29"), p.next(net.ParseIP("fc00::42")))
+	assert.Nil(t, p.next(net.ParseIP("fc00::29")))
+
+	// Each address has to be in the subnet
+	_, err = NewLocalPool("uncontained", localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+		V4Pool: &purelbv1.ServiceGroupAddressPool{
+			Pool:   "10.129.0.29,10.130.0.34",
+			Subnet: "10.129.0.0/24",
+		},
+	})
+	assert.Error(t, err, "address isn't contained in its subnet")
+
+	// ...and they can't overlap
+	_, err = NewLocalPool("overlap", localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+		V4Pool: &purelbv1.ServiceGroupAddressPool{
+			Pool:   "10.129.0.29,10.129.0.28/30",
+			Subnet: "10.129.0.0/24",
+		},
+	})
+	assert.Error(t, err, "addresses overlap")
+}
+
 func TestNotify(t *testing.T) {
 	ip1 := net.ParseIP("192.168.1.2")
 	ip2 := net.ParseIP("192.168.1.3")
@@ -282,6 +356,308 @@ func TestAssignNext(t *testing.T) {
 	assert.NoError(t, p.AssignNext(&svc3))
 }
 
+func TestReservedAddresses(t *testing.T) {
+	assignAll := func(p LocalPool) []string {
+		assigned := []string{}
+		for i := 0; ; i++ {
+			svc := service(fmt.Sprintf("svc%d", i), ports("tcp/80"), "")
+			if p.AssignNext(&svc) != nil {
+				return assigned
+			}
+			assigned = append(assigned, svc.Status.LoadBalancer.Ingress[0].IP)
+		}
+	}
+
+	// The first address and the last two addresses of the /29 are
+	// skipped
+	p, err := NewLocalPool("reservetest", localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+		V4Pools: []*purelbv1.ServiceGroupAddressPool{
+			{Pool: "192.168.1.0/29", Subnet: "192.168.1.0/24", ReserveFirst: 1, ReserveLast: 2},
+		},
+	})
+	assert.NoError(t, err, "Pool instantiation failed")
+	assert.Equal(t, []string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4", "192.168.1.5"}, assignAll(p))
+
+	// ...but users can still ask for them
+	svc := service("explicit", ports("tcp/80"), "")
+	assert.NoError(t, p.Assign(net.ParseIP("192.168.1.0"), &svc))
+	assert.NoError(t, p.Assign(net.ParseIP("192.168.1.7"), &svc))
+
+	// Each range in a list is reserved separately
+	p, err = NewLocalPool("listtest", localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+		V4Pools: []*purelbv1.ServiceGroupAddressPool{
+			{Pool: "192.168.1.0/30,192.168.1.8/30", Subnet: "192.168.1.0/24", ReserveFirst: 1},
+		},
+	})
+	assert.NoError(t, err, "Pool instantiation failed")
+	assert.Equal(t, []string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.9", "192.168.1.10", "192.168.1.11"}, assignAll(p))
+
+	// Addresses that end in .0 and .255 are skipped if the user wants
+	p, err = NewLocalPool("buggytest", localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+		V4Pools: []*purelbv1.ServiceGroupAddressPool{
+			{Pool: "192.168.1.254-192.168.2.1", Subnet: "192.168.0.0/16", AvoidBuggyIPs: true},
+		},
+	})
+	assert.NoError(t, err, "Pool instantiation failed")
+	assert.Equal(t, []string{"192.168.1.254", "192.168.2.1"}, assignAll(p))
+
+	// A pool whose addresses are all reserved has none to assign
+	p, err = NewLocalPool("fulltest", localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+		V4Pools: []*purelbv1.ServiceGroupAddressPool{
+			{Pool: "192.168.1.0/31", Subnet: "192.168.1.0/24", ReserveFirst: 1, ReserveLast: 1},
+		},
+	})
+	assert.NoError(t, err, "Pool instantiation failed")
+	assert.Empty(t, assignAll(p))
+
+	// Negative reservations are invalid
+	_, err = NewLocalPool("badtest", localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+		V4Pools: []*purelbv1.ServiceGroupAddressPool{
+			{Pool: "192.168.1.0/29", Subnet: "192.168.1.0/24", ReserveFirst: -1},
+		},
+	})
+	assert.Error(t, err)
+}
+
+func TestAssignLRU(t *testing.T) {
+	p, err := NewLocalPool("lrutest", localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+		Pool:       "192.168.1.0/30",
+		Subnet:     "192.168.1.0/24",
+		Allocation: purelbv1.AllocationLRU,
+	})
+	assert.NoError(t, err, "Pool instantiation failed")
+
+	assign := func(name string) string {
+		svc := service(name, ports("tcp/80"), "")
+		assert.NoError(t, p.AssignNext(&svc))
+		return svc.Status.LoadBalancer.Ingress[0].IP
+	}
+
+	assert.Equal(t, "192.168.1.0", assign("svc1"))
+	assert.Equal(t, "192.168.1.1", assign("svc2"))
+
+	// A just-freed address isn't reassigned while there are addresses
+	// that have never been used
+	assert.NoError(t, p.Release("unit/svc1"))
+	assert.Equal(t, "192.168.1.2", assign("svc3"))
+	assert.NoError(t, p.Release("unit/svc2"))
+	assert.Equal(t, "192.168.1.3", assign("svc4"))
+
+	// Then the address that was freed first is reassigned first
+	assert.Equal(t, "192.168.1.0", assign("svc5"))
+	assert.Equal(t, "192.168.1.1", assign("svc6"))
+	svc7 := service("svc7", ports("tcp/80"), "")
+	assert.Error(t, p.AssignNext(&svc7), "assigned an address from a full pool")
+
+	// Sequential allocation reuses the lowest free address
+	p, err = NewLocalPool("seqtest", localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+		Pool:   "192.168.1.0/30",
+		Subnet: "192.168.1.0/24",
+	})
+	assert.NoError(t, err, "Pool instantiation failed")
+	assert.Equal(t, "192.168.1.0", assign("svc1"))
+	assert.Equal(t, "192.168.1.1", assign("svc2"))
+	assert.NoError(t, p.Release("unit/svc1"))
+	assert.Equal(t, "192.168.1.0", assign("svc3"))
+}
+
+func TestAssignSequentialPrefix(t *testing.T) {
+	p, err := NewLocalPool("seqprefix", localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+		Pool:               "192.168.1.0/28",
+		Subnet:             "192.168.1.0/24",
+		SequentialPrefixes: []string{"kafka-"},
+	})
+	assert.NoError(t, err, "Pool instantiation failed")
+
+	assign := func(namespace string, name string) string {
+		svc := service(name, ports("tcp/80"), "")
+		svc.Namespace = namespace
+		assert.NoError(t, p.AssignNext(&svc))
+		return svc.Status.LoadBalancer.Ingress[0].IP
+	}
+
+	// Put the first service in the group in the middle of the pool
+	kafka0 := service("kafka-0", ports("tcp/80"), "")
+	assert.NoError(t, p.Assign(net.ParseIP("192.168.1.5"), &kafka0))
+
+	// The others get the addresses after it, not the lowest free
+	// address
+	assert.Equal(t, "192.168.1.6", assign("unit", "kafka-1"))
+	assert.Equal(t, "192.168.1.7", assign("unit", "kafka-2"))
+
+	// Services without the prefix get the lowest free address
+	assert.Equal(t, "192.168.1.0", assign("unit", "zookeeper-0"))
+
+	// Groups are per namespace
+	assert.Equal(t, "192.168.1.1", assign("other", "kafka-3"))
+
+	// If the next address is taken then the service gets an address
+	// as usual
+	blocker := service("blocker", ports("tcp/80"), "")
+	assert.NoError(t, p.Assign(net.ParseIP("192.168.1.8"), &blocker))
+	assert.Equal(t, "192.168.1.2", assign("unit", "kafka-4"))
+}
+
+func TestAssignByHash(t *testing.T) {
+	hashPool := func() LocalPool {
+		p, err := NewLocalPool("hashtest", localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+			V4Pools: []*purelbv1.ServiceGroupAddressPool{
+				{Pool: "192.168.1.0/28", Subnet: "192.168.1.0/24"},
+				{Pool: "192.168.2.0/28", Subnet: "192.168.2.0/24"},
+			},
+			Allocation: purelbv1.AllocationHash,
+		})
+		assert.NoError(t, err, "Pool instantiation failed")
+		return p
+	}
+
+	// The same service gets the same address from the same pool, even
+	// if the pool is created again (e.g., when the allocator restarts)
+	svc1 := service("svc1", ports("tcp/80"), "")
+	assert.NoError(t, hashPool().AssignNext(&svc1))
+	ip1 := svc1.Status.LoadBalancer.Ingress[0].IP
+	p := hashPool()
+	svc1 = service("svc1", ports("tcp/80"), "")
+	assert.NoError(t, p.AssignNext(&svc1))
+	assert.Equal(t, ip1, svc1.Status.LoadBalancer.Ingress[0].IP, "same service got a different address")
+	assert.Equal(t, net.ParseIP(ip1), p.hashedAddress(nl.FAMILY_V4, "unit/svc1"))
+
+	// A service with the same name in a different namespace is a
+	// different service so it hashes differently
+	assert.NotEqual(t, p.hashedAddress(nl.FAMILY_V4, "unit/svc1"), p.hashedAddress(nl.FAMILY_V4, "other/svc1"))
+
+	// If the hashed address is taken then the service gets the next
+	// free one
+	collider := service("svc1", ports("tcp/80"), "")
+	collider.Namespace = "collider"
+	p2 := hashPool()
+	hashed := p2.hashedAddress(nl.FAMILY_V4, "collider/svc1")
+	assert.NoError(t, p2.Assign(hashed, &svc1))
+	assert.NoError(t, p2.AssignNext(&collider))
+	assert.NotEqual(t, hashed.String(), collider.Status.LoadBalancer.Ingress[0].IP)
+
+	// The fallback wraps around to the beginning of the pool, so a
+	// full pool except for its first address still has room
+	p3 := hashPool()
+	for pos := p3.next(p3.first(nl.FAMILY_V4)); pos != nil; pos = p3.next(pos) {
+		filler := service("filler-"+pos.String(), ports("tcp/80"), "")
+		assert.NoError(t, p3.Assign(pos, &filler))
+	}
+	svc1 = service("svc1", ports("tcp/80"), "")
+	assert.NoError(t, p3.AssignNext(&svc1))
+	assert.Equal(t, "192.168.1.0", svc1.Status.LoadBalancer.Ingress[0].IP)
+
+	// Unknown allocation methods are rejected
+	_, err := NewLocalPool("badtest", localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+		Pool:       "192.168.1.0/28",
+		Subnet:     "192.168.1.0/24",
+		Allocation: "random",
+	})
+	assert.Error(t, err)
+}
+
+func TestFamilyPreference(t *testing.T) {
+	dualPool := func(preference string) LocalPool {
+		p, err := NewLocalPool("dualtest", localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+			V4Pools:          []*purelbv1.ServiceGroupAddressPool{{Pool: "192.168.1.0/30", Subnet: "192.168.1.0/24"}},
+			V6Pools:          []*purelbv1.ServiceGroupAddressPool{{Pool: "2001:db8::/127", Subnet: "2001:db8::/64"}},
+			FamilyPreference: preference,
+		})
+		assert.NoError(t, err, "Pool instantiation failed")
+		return p
+	}
+	assignNext := func(p LocalPool, name string) net.IP {
+		svc := service(name, ports("tcp/80"), "")
+		assert.NoError(t, p.AssignNext(&svc))
+		return net.ParseIP(svc.Status.LoadBalancer.Ingress[0].IP)
+	}
+	isV4 := func(ip net.IP) bool { return ip.To4() != nil }
+
+	// By default we try IPv6 first, and fall back to IPv4 when it's
+	// full
+	p := dualPool("")
+	assert.False(t, isV4(assignNext(p, "a")))
+	assert.False(t, isV4(assignNext(p, "b")))
+	assert.True(t, isV4(assignNext(p, "c")))
+	p = dualPool(purelbv1.FamilyPreferenceIPv6)
+	assert.False(t, isV4(assignNext(p, "a")))
+
+	// ipv4 tries IPv4 first, and falls back to IPv6 when it's full
+	p = dualPool(purelbv1.FamilyPreferenceIPv4)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		assert.True(t, isV4(assignNext(p, name)))
+	}
+	assert.False(t, isV4(assignNext(p, "e")))
+
+	// mostfree tries the family with more free addresses first. The
+	// pool has 4 IPv4 addresses and 2 IPv6 addresses.
+	p = dualPool(purelbv1.FamilyPreferenceMostFree)
+	assert.True(t, isV4(assignNext(p, "a")))  // 4 IPv4 free, 2 IPv6 free
+	assert.True(t, isV4(assignNext(p, "b")))  // 3 and 2
+	assert.False(t, isV4(assignNext(p, "c"))) // 2 and 2, a tie goes to IPv6
+	assert.True(t, isV4(assignNext(p, "d")))  // 2 and 1
+
+	// Big IPv6 ranges saturate their family's size instead of wrapping
+	// around, so IPv6 still has more free addresses
+	p, err := NewLocalPool("bigv6", localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+		V4Pools: []*purelbv1.ServiceGroupAddressPool{{Pool: "192.168.1.0/24", Subnet: "192.168.1.0/24"}},
+		V6Pools: []*purelbv1.ServiceGroupAddressPool{
+			{Pool: "2001:db8::/64", Subnet: "2001:db8::/64"},
+			{Pool: "2001:db8:0:1::/64", Subnet: "2001:db8:0:1::/64"},
+		},
+		FamilyPreference: purelbv1.FamilyPreferenceMostFree,
+	})
+	assert.NoError(t, err, "Pool instantiation failed")
+	assert.Equal(t, uint64(math.MaxUint64), p.free(nl.FAMILY_V6))
+	assert.Equal(t, uint64(math.MaxUint64), p.Size())
+	assert.False(t, isV4(assignNext(p, "a")))
+
+	// Unknown preferences are rejected
+	_, err = NewLocalPool("dualtest", localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+		V4Pools:          []*purelbv1.ServiceGroupAddressPool{{Pool: "192.168.1.0/30", Subnet: "192.168.1.0/24"}},
+		FamilyPreference: "ipv5",
+	})
+	assert.Error(t, err)
+}
+
+// TestMultipleSubnets tests that a pool whose addresses are in more
+// than one subnet allocates from all of them as a unit.
+func TestMultipleSubnets(t *testing.T) {
+	p, err := NewLocalPool("multisubnet", localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+		V4Pools: []*purelbv1.ServiceGroupAddressPool{
+			{Pool: "192.0.2.0/31", Subnet: "192.0.2.0/25"},
+			{Pool: "198.51.100.0/31", Subnet: "198.51.100.0/25"},
+		},
+	})
+	assert.NoError(t, err, "Pool instantiation failed")
+	assert.Equal(t, uint64(4), p.Size())
+
+	// When the first subnet's addresses are used up the pool moves on
+	// to the second's
+	got := []string{}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		svc := service(name, ports("tcp/80"), "")
+		assert.NoError(t, p.AssignNext(&svc))
+		got = append(got, svc.Status.LoadBalancer.Ingress[0].IP)
+	}
+	assert.Equal(t, []string{"192.0.2.0", "192.0.2.1", "198.51.100.0", "198.51.100.1"}, got)
+
+	// Then the whole pool is full
+	svc := service("e", ports("tcp/80"), "")
+	assert.Error(t, p.AssignNext(&svc))
+
+	// Each address is in the pool's subnets, but other addresses in
+	// the subnets aren't in the pool
+	assert.True(t, p.InSubnet(net.ParseIP("198.51.100.100")))
+	assert.False(t, p.Contains(net.ParseIP("198.51.100.100")))
+	assert.False(t, p.InSubnet(net.ParseIP("198.51.100.200")))
+
+	// Freed addresses in either subnet are reused
+	assert.NoError(t, p.Release("unit/c"))
+	assert.NoError(t, p.AssignNext(&svc))
+	assert.Equal(t, "198.51.100.0", svc.Status.LoadBalancer.Ingress[0].IP)
+}
+
 func TestPoolSize(t *testing.T) {
 	p, err := NewLocalPool("sizetest", localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
 		V4Pool: &purelbv1.ServiceGroupAddressPool{
@@ -367,3 +743,34 @@ func mustDualStackPool(t *testing.T, pools4 []string, pools6 []string) LocalPool
 	}
 	return p
 }
+
+// BenchmarkAssignNext shows how the cost of allocating an address
+// grows as the pool fills, since AssignNext scans from the beginning
+// of the pool for a free address.
+func BenchmarkAssignNext(b *testing.B) {
+	for _, inUse := range []int{0, 1000, 4000} {
+		b.Run(fmt.Sprintf("inUse=%d", inUse), func(b *testing.B) {
+			p, err := NewLocalPool("bench", localPoolTestLogger, purelbv1.ServiceGroupLocalSpec{
+				V4Pools: []*purelbv1.ServiceGroupAddressPool{{Pool: "10.0.0.0/20", Subnet: "10.0.0.0/20"}},
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			for i := 0; i < inUse; i++ {
+				svc := service(fmt.Sprintf("fill%d", i), ports("tcp/80"), "")
+				if err := p.AssignNext(&svc); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				svc := service("bench", ports("tcp/80"), "")
+				if err := p.AssignNext(&svc); err != nil {
+					b.Fatal(err)
+				}
+				p.Release("unit/bench")
+			}
+		})
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/go-kit/kit/log"
 	v1 "k8s.io/api/core/v1"
 
+	"purelb.io/internal/logging"
 	"purelb.io/internal/netbox"
 	purelbv1 "purelb.io/pkg/apis/v1"
 )
@@ -70,12 +71,23 @@ func NewNetboxPool(name string, log log.Logger, spec purelbv1.ServiceGroupNetbox
 		logger:         log,
 		url:            url.String(),
 		userToken:      userToken,
-		netbox:         netbox.NewNetbox(url.String(), spec.Tenant, userToken),
+		netbox:         netbox.NewNetbox(url.String(), spec.Tenant, userToken, spec.Timeout.Duration, netboxHeaders(spec)),
 		services:       map[string][]net.IP{},
 		addressesInUse: map[string]map[string]bool{},
 	}, nil
 }
 
+// netboxHeaders returns the headers that identify us to Netbox: a
+// User-Agent with our release and cluster name, plus any headers in
+// spec.
+func netboxHeaders(spec purelbv1.ServiceGroupNetboxSpec) map[string]string {
+	headers := map[string]string{"User-Agent": netbox.UserAgent(logging.Release(), spec.ClusterName)}
+	for name, value := range spec.Headers {
+		headers[name] = value
+	}
+	return headers
+}
+
 func (p NetboxPool) Notify(service *v1.Service) error {
 	nsName := namespacedName(service)
 
@@ -144,6 +156,18 @@ func (p NetboxPool) InUse() int {
 	return len(p.addressesInUse)
 }
 
+// InUseFamily returns the count of the IP addresses in family that
+// are currently assigned to services.
+func (p NetboxPool) InUseFamily(family v1.IPFamily) int {
+	return inUseFamily(p.addressesInUse, family)
+}
+
+// Services returns the names of the services that have addresses
+// from this pool.
+func (p NetboxPool) Services() []string {
+	return servicesInUse(p.addressesInUse)
+}
+
 // Size returns the total number of addresses in this pool if it's a
 // local pool, or 0 if it's a remote pool.
 func (p NetboxPool) Size() uint64 {
@@ -19,6 +19,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sort"
 
 	"github.com/go-kit/kit/log"
 	v1 "k8s.io/api/core/v1"
@@ -37,8 +38,15 @@ func (p Port) String() string {
 	return fmt.Sprintf("%s/%d", p.Proto, p.Port)
 }
 
+// Key determines whether services can share an address. Services can
+// share if their keys match.
 type Key struct {
 	Sharing string
+
+	// Namespace is the namespace of the service that owns the key, if
+	// sharing keys are namespaced. Keys from different namespaces never
+	// match.
+	Namespace string
 }
 
 // Pool describes the interface to code that manages pools of
@@ -51,12 +59,89 @@ type Pool interface {
 	Assign(net.IP, *v1.Service) error
 	Release(string) error
 	InUse() int
+	// InUseFamily returns the number of addresses in family that are
+	// in use.
+	InUseFamily(family v1.IPFamily) int
+	// Services returns the names of the services that have addresses
+	// from this pool.
+	Services() []string
 	Overlaps(Pool) bool
 	Contains(net.IP) bool // FIXME: I'm not sure that we need this. It might be the case that we can always rely on the service's pool annotation to find to which pool an address belongs
 	Size() uint64
 	String() string
 }
 
+// NoPoolForFamilyError indicates that a service asked for an address
+// family that its pool doesn't have, e.g., an IPv6 address from a pool
+// that contains only IPv4 addresses.
+type NoPoolForFamilyError struct {
+	Pool   string
+	Family v1.IPFamily
+}
+
+func (e *NoPoolForFamilyError) Error() string {
+	return fmt.Sprintf("no %s addresses in pool", e.Family)
+}
+
+// TooManyAddressesError indicates that a service asked for more
+// addresses (i.e., more IP families) than its pool allows each
+// service to have.
+type TooManyAddressesError struct {
+	Pool      string
+	Requested int
+	Max       int
+}
+
+func (e *TooManyAddressesError) Error() string {
+	return fmt.Sprintf("service requested %d addresses but pool allows %d", e.Requested, e.Max)
+}
+
+// PoolExhaustedError indicates that a pool has no address that a
+// service can use in the family that it asked for, i.e., the pool is
+// full.
+type PoolExhaustedError struct {
+	Pool    string
+	Service string
+	Family  int
+}
+
+func (e *PoolExhaustedError) Error() string {
+	return fmt.Sprintf("no available addresses for service %s in family %d", e.Service, e.Family)
+}
+
+// inUseFamily returns the number of addresses in addressesInUse that
+// are in family.
+func inUseFamily(addressesInUse map[string]map[string]bool, family v1.IPFamily) int {
+	count := 0
+	for ipstr := range addressesInUse {
+		ip := net.ParseIP(ipstr)
+		if ip == nil {
+			continue
+		}
+		if (ip.To4() != nil) == (family == v1.IPv4Protocol) {
+			count++
+		}
+	}
+	return count
+}
+
+// servicesInUse returns the names of the services that have
+// addresses in addressesInUse.
+func servicesInUse(addressesInUse map[string]map[string]bool) []string {
+	names := map[string]bool{}
+	for _, svcs := range addressesInUse {
+		for svc := range svcs {
+			names[svc] = true
+		}
+	}
+	services := make([]string, 0, len(names))
+	for svc := range names {
+		services = append(services, svc)
+	}
+	sort.Strings(services)
+	return services
+}
+
 func sharingOK(existing, new *Key) error {
 	if existing.Sharing == "" {
 		return errors.New("existing service does not allow sharing")
@@ -67,6 +152,9 @@ func sharingOK(existing, new *Key) error {
 	if existing.Sharing != new.Sharing {
 		return fmt.Errorf("sharing key %q does not match existing sharing key %q", new.Sharing, existing.Sharing)
 	}
+	if existing.Namespace != new.Namespace {
+		return fmt.Errorf("sharing key %q in namespace %q does not match existing sharing key in namespace %q", new.Sharing, new.Namespace, existing.Namespace)
+	}
 	return nil
 }
 
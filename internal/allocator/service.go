@@ -18,6 +18,7 @@ package allocator
 import (
 	"fmt"
 	"net"
+	"strings"
 
 	"github.com/go-kit/kit/log"
 	v1 "k8s.io/api/core/v1"
@@ -31,6 +32,9 @@ import (
 // based on that Service's configuration. It returns a k8s.SyncState
 // value - SyncStateSuccess or SyncStateError.
 func (c *controller) SetBalancer(svc *v1.Service, _ *v1.Endpoints) k8s.SyncState {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	nsName := svc.Namespace + "/" + svc.Name
 	log := log.With(c.logger, "svc-name", nsName)
 
@@ -39,6 +43,21 @@ func (c *controller) SetBalancer(svc *v1.Service, _ *v1.Endpoints) k8s.SyncState
 		return k8s.SyncStateError
 	}
 
+	// ExternalName services are DNS aliases so they never get
+	// addresses from us. We ignore them quietly (there can be lots of
+	// them) unless one used to be one of our LoadBalancers, in which
+	// case we fall through and clean up.
+	if svc.Spec.Type == v1.ServiceTypeExternalName && svc.Annotations[purelbv1.PoolAnnotation] == "" {
+		return k8s.SyncStateSuccess
+	}
+
+	// If the user has told us that someone else manages this service
+	// then we leave it alone.
+	if svc.Annotations[purelbv1.IgnoreAnnotation] == "true" {
+		log.Log("event", "ignore", "reason", "service has the ignore annotation")
+		return k8s.SyncStateSuccess
+	}
+
 	// If the user has specified an LB class and it's not ours then we
 	// ignore the LB.
 	if svc.Spec.LoadBalancerClass != nil && *svc.Spec.LoadBalancerClass != purelbv1.ServiceLBClass {
@@ -75,6 +94,9 @@ func (c *controller) SetBalancer(svc *v1.Service, _ *v1.Endpoints) k8s.SyncState
 					c.logger.Log("event", "unassign", "error", err)
 					return k8s.SyncStateError
 				}
+				if c.ips.externalIPs {
+					removeExternalIPs(svc, svc.Status.LoadBalancer.Ingress)
+				}
 				svc.Status.LoadBalancer.Ingress = nil
 			}
 		}
@@ -83,6 +105,7 @@ func (c *controller) SetBalancer(svc *v1.Service, _ *v1.Endpoints) k8s.SyncState
 		// we'll re-allocate if the user flips this service back to a
 		// LoadBalancer
 		delete(svc.Annotations, purelbv1.PoolAnnotation)
+		delete(svc.Annotations, purelbv1.AnnounceMethodAnnotation)
 
 		// It's not a LoadBalancer so there's nothing more for us to do
 		return k8s.SyncStateSuccess
@@ -96,6 +119,25 @@ func (c *controller) SetBalancer(svc *v1.Service, _ *v1.Endpoints) k8s.SyncState
 		return k8s.SyncStateSuccess
 	}
 
+	// If the user changed the service's desired group and asked us to
+	// move its address then we need to release its address so we can
+	// allocate a new one from the new group. If the new group can't
+	// allocate an address then the service keeps the one that it has.
+	var oldIngress []v1.LoadBalancerIngress
+	if len(svc.Status.LoadBalancer.Ingress) > 0 && svc.Annotations[purelbv1.BrandAnnotation] == purelbv1.Brand && c.shouldMove(svc) {
+		oldIngress = svc.Status.LoadBalancer.Ingress
+		log.Log("event", "unassign", "ingress-address", svc.Status.LoadBalancer.Ingress, "reason", "desired group changed", "from", svc.Annotations[purelbv1.PoolAnnotation], "to", svc.Annotations[purelbv1.DesiredGroupAnnotation])
+		c.client.Infof(svc, "AddressReleased", "Desired service-group changed from %s to %s", svc.Annotations[purelbv1.PoolAnnotation], svc.Annotations[purelbv1.DesiredGroupAnnotation])
+		if err := c.ips.Unassign(nsName); err != nil {
+			c.logger.Log("event", "unassign", "error", err)
+			return k8s.SyncStateError
+		}
+		if c.ips.externalIPs {
+			removeExternalIPs(svc, oldIngress)
+		}
+		svc.Status.LoadBalancer.Ingress = nil
+	}
+
 	// Check if the service already has an address
 	if len(svc.Status.LoadBalancer.Ingress) > 0 {
 		log.Log("event", "hasIngress", "ingress", svc.Status.LoadBalancer.Ingress)
@@ -114,6 +156,9 @@ func (c *controller) SetBalancer(svc *v1.Service, _ *v1.Endpoints) k8s.SyncState
 			if err := c.ips.NotifyExisting(svc); err != nil {
 				log.Log("event", "notifyFailure", "ingress-address", svc.Status.LoadBalancer.Ingress, "reason", err.Error())
 			}
+			if c.ips.externalIPs {
+				addExternalIPs(svc)
+			}
 		}
 
 		// If the service already has an address then we don't need to
@@ -127,8 +172,72 @@ func (c *controller) SetBalancer(svc *v1.Service, _ *v1.Endpoints) k8s.SyncState
 	if err := c.ips.Allocate(svc); err != nil {
 		log.Log("op", "allocateIP", "error", err, "msg", "IP allocation failed")
 		c.client.Errorf(svc, "AllocationFailed", "Failed to allocate IP for %q: %s", nsName, err)
+
+		// If we were moving the service to a new group then it keeps its
+		// old address. Failing to allocate a new one isn't a reason to
+		// take away the one that it has.
+		if oldIngress != nil {
+			svc.Status.LoadBalancer.Ingress = oldIngress
+			if err := c.ips.NotifyExisting(svc); err != nil {
+				log.Log("event", "notifyFailure", "ingress-address", svc.Status.LoadBalancer.Ingress, "reason", err.Error())
+			}
+			if c.ips.externalIPs {
+				addExternalIPs(svc)
+			}
+		}
+
 		return k8s.SyncStateSuccess
 	}
 
+	// If we've been told to then copy the addresses into the service's
+	// externalIPs, too.
+	if c.ips.externalIPs {
+		addExternalIPs(svc)
+	}
+
+	// Tell the user what we did. We get here only when the service
+	// didn't have an address, so this happens once per allocation and
+	// not on every resync.
+	c.client.Infof(svc, "IPAllocated", "Assigned IP %s from pool %s", ingressIPs(svc), svc.Annotations[purelbv1.PoolAnnotation])
+
 	return k8s.SyncStateSuccess
 }
+
+// ingressIPs returns a comma-separated list of svc's ingress
+// addresses.
+func ingressIPs(svc *v1.Service) string {
+	ips := []string{}
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		ips = append(ips, ingress.IP)
+	}
+	return strings.Join(ips, ",")
+}
+
+// shouldMove returns true if the user asked us to move svc's address
+// to its desired group and the group can allocate an address for it.
+// If the group can't then we tell the user, once per desired group.
+func (c *controller) shouldMove(svc *v1.Service) bool {
+	nsName := namespacedName(svc)
+	desired := svc.Annotations[purelbv1.DesiredGroupAnnotation]
+
+	if svc.Annotations[purelbv1.ReallocateAnnotation] != "true" || !c.ips.desiredGroupChanged(svc) {
+		delete(c.moveBlocked, nsName)
+		return false
+	}
+
+	_, _, err := c.ips.Preview(svc)
+	if err == nil {
+		delete(c.moveBlocked, nsName)
+		return true
+	}
+
+	if blocked, isBlocked := c.moveBlocked[nsName]; !isBlocked || blocked != desired {
+		if c.moveBlocked == nil {
+			c.moveBlocked = map[string]string{}
+		}
+		c.moveBlocked[nsName] = desired
+		c.logger.Log("svc-name", nsName, "op", "reallocate", "from", svc.Annotations[purelbv1.PoolAnnotation], "to", desired, "error", err, "msg", "keeping current address")
+		c.client.Errorf(svc, "ReallocateSkipped", "Can't move address from %s to %s, keeping it: %s", svc.Annotations[purelbv1.PoolAnnotation], desired, err)
+	}
+	return false
+}
@@ -38,9 +38,80 @@ var (
 		Name:      "addresses_in_use",
 		Help:      "Number of addresses allocated from the pool",
 	}, labelNames)
+
+	// poolAvailable isn't in the address_pool subsystem since it's
+	// meant to be alerted on, like poolExhausted.
+	poolAvailable = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: "allocator",
+		Name:      "pool_available",
+		Help:      "Number of addresses in the pool that aren't allocated (0 if the pool's size is unknown)",
+	}, labelNames)
+
+	poolActiveFamily = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: subsystem,
+		Name:      "addresses_in_use_by_family",
+		Help:      "Number of addresses allocated from the pool, by address family",
+	}, []string{"pool", "family"})
+
+	activeFamily = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: subsystem,
+		Name:      "all_addresses_in_use_by_family",
+		Help:      "Number of addresses allocated from all pools, by address family",
+	}, []string{"family"})
+
+	poolDraining = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: subsystem,
+		Name:      "draining",
+		Help:      "1 if the pool is draining, 0 if not",
+	}, labelNames)
+
+	poolLowFree = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: subsystem,
+		Name:      "low_free_addresses",
+		Help:      "1 if the pool's free addresses are below its threshold, 0 if not",
+	}, labelNames)
+
+	noPoolForFamily = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: subsystem,
+		Name:      "no_pool_for_family_total",
+		Help:      "Allocations that failed because the pool has no addresses in the requested family",
+	}, []string{"pool", "family"})
+
+	// poolExhausted isn't in the address_pool subsystem since it counts
+	// the allocator's failures.
+	poolExhausted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: "allocator",
+		Name:      "pool_exhausted_total",
+		Help:      "Allocations that failed because the pool had no free addresses",
+	}, labelNames)
+
+	// allocationDuration isn't in the address_pool subsystem since it
+	// measures the allocator, not the pool. Pools scan for a free
+	// address so it grows as the pool fills.
+	allocationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Name:      "allocation_duration_seconds",
+		Help:      "Time taken to allocate an address from the pool",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+	}, labelNames)
 )
 
 func init() {
 	prometheus.MustRegister(poolCapacity)
 	prometheus.MustRegister(poolActive)
+	prometheus.MustRegister(poolAvailable)
+	prometheus.MustRegister(poolActiveFamily)
+	prometheus.MustRegister(activeFamily)
+	prometheus.MustRegister(poolDraining)
+	prometheus.MustRegister(poolLowFree)
+	prometheus.MustRegister(noPoolForFamily)
+	prometheus.MustRegister(poolExhausted)
+	prometheus.MustRegister(allocationDuration)
 }
@@ -0,0 +1,107 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"purelb.io/pkg/generated/clientset/versioned"
+)
+
+const (
+	// defaultStatusInterval is the minimum time between updates of
+	// each ServiceGroup's status.
+	defaultStatusInterval = 5 * time.Second
+)
+
+// groupStatus writes the number of allocated addresses to each
+// ServiceGroup's status. Updates are debounced so each group is
+// written at most once per interval, with its latest count. It's safe
+// to use from more than one goroutine.
+type groupStatus struct {
+	sync.Mutex
+
+	client   versioned.Interface
+	logger   log.Logger
+	interval time.Duration
+
+	pending map[string]int       // namespace/name -> count to write
+	written map[string]time.Time // namespace/name -> last write
+	queued  map[string]bool      // namespace/name -> true if a write is scheduled
+}
+
+// newGroupStatus returns a groupStatus that writes through client.
+func newGroupStatus(client versioned.Interface, logger log.Logger) *groupStatus {
+	return &groupStatus{
+		client:   client,
+		logger:   logger,
+		interval: defaultStatusInterval,
+		pending:  map[string]int{},
+		written:  map[string]time.Time{},
+		queued:   map[string]bool{},
+	}
+}
+
+// set records that the group namespace/name has allocated addresses
+// in use, and schedules a write if one isn't already scheduled.
+func (s *groupStatus) set(namespace string, name string, allocated int) {
+	s.Lock()
+	defer s.Unlock()
+
+	key := namespace + "/" + name
+	s.pending[key] = allocated
+	if s.queued[key] {
+		return
+	}
+	s.queued[key] = true
+
+	delay := time.Until(s.written[key].Add(s.interval))
+	if delay < 0 {
+		delay = 0
+	}
+	time.AfterFunc(delay, func() { s.write(namespace, name) })
+}
+
+// write writes the pending count of the group namespace/name to its
+// status.
+func (s *groupStatus) write(namespace string, name string) {
+	key := namespace + "/" + name
+
+	s.Lock()
+	allocated := s.pending[key]
+	delete(s.pending, key)
+	delete(s.queued, key)
+	s.written[key] = time.Now()
+	s.Unlock()
+
+	groups := s.client.PurelbV1().ServiceGroups(namespace)
+	group, err := groups.Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		s.logger.Log("op", "updateGroupStatus", "group", key, "error", err)
+		return
+	}
+	if group.Status.AllocatedCount == allocated {
+		return
+	}
+	group.Status.AllocatedCount = allocated
+	if _, err := groups.UpdateStatus(context.TODO(), group, metav1.UpdateOptions{}); err != nil {
+		s.logger.Log("op", "updateGroupStatus", "group", key, "error", err)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	purelbv1 "purelb.io/pkg/apis/v1"
+	"purelb.io/pkg/generated/clientset/versioned/fake"
+)
+
+func TestGroupStatus(t *testing.T) {
+	group := localServiceGroup("default", "1.2.3.0/30")
+	group.Namespace = "purelb"
+	client := fake.NewSimpleClientset(group.DeepCopy())
+
+	alloc := New(allocatorTestLogger)
+	alloc.SetClient(&testK8S{t: t})
+	alloc.SetStatusClient(client)
+	alloc.status.interval = 100 * time.Millisecond
+	if alloc.SetPools([]*purelbv1.ServiceGroup{group}) != nil {
+		t.Fatal("SetConfig failed")
+	}
+
+	allocated := func() int {
+		sg, err := client.PurelbV1().ServiceGroups("purelb").Get(context.TODO(), "default", metav1.GetOptions{})
+		assert.NoError(t, err)
+		return sg.Status.AllocatedCount
+	}
+	statusUpdates := func() int {
+		updates := 0
+		for _, action := range client.Actions() {
+			if action.GetVerb() == "update" && action.GetSubresource() == "status" {
+				updates++
+			}
+		}
+		return updates
+	}
+
+	// Allocations are written to the group's status
+	svc1 := service("svc1", ports("tcp/80"), "")
+	assert.NoError(t, alloc.Allocate(&svc1))
+	assert.Eventually(t, func() bool { return allocated() == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, statusUpdates())
+
+	// Changes within the interval are written once, with the latest
+	// count
+	svc2 := service("svc2", ports("tcp/80"), "")
+	svc3 := service("svc3", ports("tcp/80"), "")
+	assert.NoError(t, alloc.Allocate(&svc2))
+	assert.NoError(t, alloc.Allocate(&svc3))
+	assert.NoError(t, alloc.Unassign("unit/svc1"))
+	assert.Eventually(t, func() bool { return allocated() == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, statusUpdates())
+}
@@ -16,6 +16,7 @@ package election
 import (
 	"bytes"
 	"crypto/sha256"
+	"fmt"
 	"log"
 	"sort"
 	"time"
@@ -39,6 +40,26 @@ type Config struct {
 	Client    *k8s.Client
 }
 
+// k8sClient is the part of the k8s client that elections use.
+// *k8s.Client is a k8sClient.
+type k8sClient interface {
+	GetPodsIPs(namespace string, labels string) ([]string, error)
+	ForceSync()
+}
+
+// Elector decides which node announces an address. *Election is an
+// Elector.
+type Elector interface {
+	// Winner returns the name of the node that should announce the
+	// address represented by key.
+	Winner(key string) string
+	// NumMembers returns the number of nodes that take part in the
+	// elections.
+	NumMembers() int
+}
+
+var _ Elector = &Election{}
+
 type Election struct {
 	namespace  string
 	labels     string
@@ -46,21 +67,30 @@ type Election struct {
 	logger     gokitlog.Logger
 	stopCh     chan struct{}
 	eventCh    chan memberlist.NodeEvent
-	Client     *k8s.Client
+	Client     k8sClient
 }
 
+// convergencePoll is how often we check the memberlist while we wait
+// for it to converge, and convergenceStablePolls is how many checks in
+// a row the member count has to stay the same before we decide that
+// it has converged even though it doesn't match the pod count.
+const (
+	convergencePoll        = time.Second
+	convergenceStablePolls = 3
+)
+
+// deadNodeReclaimTime is how long after a member dies that another
+// member with the same name but a different address can take its
+// place.
+const deadNodeReclaimTime = 5 * time.Second
+
 func New(cfg *Config) (Election, error) {
 	election := Election{stopCh: cfg.StopCh, logger: *cfg.Logger}
 
-	mconfig := memberlist.DefaultLANConfig()
-	mconfig.Name = cfg.NodeName
-	mconfig.BindAddr = cfg.BindAddr
-	mconfig.BindPort = cfg.BindPort
-	mconfig.AdvertisePort = cfg.BindPort
-	mconfig.SecretKey = cfg.Secret
-
-	loggerout := gokitlog.NewStdlibAdapter(gokitlog.With(*cfg.Logger, "component", "MemberList"))
-	mconfig.Logger = log.New(loggerout, "", log.Lshortfile)
+	if cfg.NodeName == "" {
+		return election, fmt.Errorf("node name is required")
+	}
+	mconfig := memberlistConfig(cfg)
 
 	eventCh := make(chan memberlist.NodeEvent, 16)
 	mconfig.Events = &memberlist.ChannelEventDelegate{Ch: eventCh}
@@ -75,6 +105,29 @@ func New(cfg *Config) (Election, error) {
 	return election, err
 }
 
+// memberlistConfig returns the memberlist configuration for cfg. Each
+// member is identified by its Kubernetes node name, not its pod's
+// address, so when a node agent pod restarts (and gets a new address)
+// it rejoins as the same member. If the old pod left gracefully then
+// the new one replaces it right away, and if it crashed then the new
+// one replaces it once it's been dead for deadNodeReclaimTime.
+// Without that, memberlist would reject the new pod because its
+// address conflicts with the dead member's.
+func memberlistConfig(cfg *Config) *memberlist.Config {
+	mconfig := memberlist.DefaultLANConfig()
+	mconfig.Name = cfg.NodeName
+	mconfig.BindAddr = cfg.BindAddr
+	mconfig.BindPort = cfg.BindPort
+	mconfig.AdvertisePort = cfg.BindPort
+	mconfig.SecretKey = cfg.Secret
+	mconfig.DeadNodeReclaimTime = deadNodeReclaimTime
+
+	loggerout := gokitlog.NewStdlibAdapter(gokitlog.With(*cfg.Logger, "component", "MemberList"))
+	mconfig.Logger = log.New(loggerout, "", log.Lshortfile)
+
+	return mconfig
+}
+
 func (e *Election) Join(iplist []string) error {
 	go e.watchEvents()
 
@@ -90,6 +143,51 @@ func (e *Election) Join(iplist []string) error {
 	return err
 }
 
+// WaitForConvergence waits up to timeout for the memberlist to
+// converge after Join so we don't win elections just because we
+// haven't heard from the other members yet. The memberlist has
+// converged when it has as many members as there are node agent pods,
+// or when its member count stops changing. It returns true if the
+// memberlist converged, or false if we gave up waiting.
+func (e *Election) WaitForConvergence(timeout time.Duration) bool {
+	return waitForConvergence(e.NumMembers, e.expectedMembers, convergencePoll, timeout)
+}
+
+// expectedMembers returns the number of node agent pods, i.e., the
+// number of members that a converged memberlist has. It returns 0 if
+// it can't tell.
+func (e *Election) expectedMembers() int {
+	pods, err := e.Client.GetPodsIPs(e.namespace, e.labels)
+	if err != nil {
+		e.logger.Log("op", "startup", "error", err, "msg", "failed to get Pod count")
+		return 0
+	}
+	return len(pods)
+}
+
+func waitForConvergence(members func() int, expected func() int, poll time.Duration, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	last, stable := -1, 0
+	for {
+		count := members()
+		if want := expected(); want > 0 && count >= want {
+			return true
+		}
+		if count == last {
+			stable++
+		} else {
+			last, stable = count, 0
+		}
+		if stable >= convergenceStablePolls {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(poll)
+	}
+}
+
 func (e *Election) shutdown() error {
 	err := e.Memberlist.Leave(1 * time.Second)
 	e.Memberlist.Shutdown()
@@ -122,6 +220,11 @@ func (e *Election) Winner(key string) string {
 	return election(key, nodes)[0]
 }
 
+// NumMembers returns the number of nodes in the memberlist.
+func (e *Election) NumMembers() int {
+	return e.Memberlist.NumMembers()
+}
+
 // election conducts an election among the candidates based on the
 // provided key. The order of the candidates in the return array is
 // the result of the election.
@@ -148,7 +251,14 @@ func (e *Election) watchEvents() {
 		select {
 		case event := <-e.eventCh:
 			e.logger.Log("msg", "Node event", "node addr", event.Node.Addr, "node name", event.Node.Name, "node event", event2String(event.Event))
-			e.Client.ForceSync()
+
+			// When a node joins or leaves, the winners of some elections
+			// change, so we need to re-run the elections for all of our
+			// services. Updates don't change the members so they don't
+			// change the winners.
+			if event.Event != memberlist.NodeUpdate {
+				e.Client.ForceSync()
+			}
 		case <-e.stopCh:
 			e.shutdown()
 			return
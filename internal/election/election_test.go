@@ -13,8 +13,13 @@
 package election
 
 import (
+	"fmt"
+	"net"
 	"testing"
+	"time"
 
+	gokitlog "github.com/go-kit/kit/log"
+	"github.com/hashicorp/memberlist"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -25,3 +30,132 @@ func TestWinner(t *testing.T) {
 	assert.Equal(t, "test-node1", election("test-key-nodeXX", nodes)[0])
 	assert.Equal(t, "test-node2", election("test-key-foo", nodes)[0])
 }
+
+// fakeClient implements k8sClient and signals each ForceSync.
+type fakeClient struct {
+	syncs chan struct{}
+}
+
+func (f *fakeClient) GetPodsIPs(namespace string, labels string) ([]string, error) {
+	return []string{}, nil
+}
+
+func (f *fakeClient) ForceSync() {
+	f.syncs <- struct{}{}
+}
+
+func TestMembershipResync(t *testing.T) {
+	client := &fakeClient{syncs: make(chan struct{}, 10)}
+	e := Election{
+		logger:  gokitlog.NewNopLogger(),
+		stopCh:  make(chan struct{}),
+		eventCh: make(chan memberlist.NodeEvent, 16),
+		Client:  client,
+	}
+	go e.watchEvents()
+
+	resynced := func() bool {
+		select {
+		case <-client.syncs:
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}
+	node := &memberlist.Node{Name: "test-node3", Addr: net.ParseIP("192.168.1.3")}
+
+	// Joins and leaves change the election winners so they trigger a
+	// resync
+	e.eventCh <- memberlist.NodeEvent{Event: memberlist.NodeJoin, Node: node}
+	assert.True(t, resynced(), "join didn't trigger a resync")
+	e.eventCh <- memberlist.NodeEvent{Event: memberlist.NodeLeave, Node: node}
+	assert.True(t, resynced(), "leave didn't trigger a resync")
+
+	// Updates don't
+	e.eventCh <- memberlist.NodeEvent{Event: memberlist.NodeUpdate, Node: node}
+	assert.False(t, resynced(), "update triggered a resync")
+}
+
+func TestWaitForConvergence(t *testing.T) {
+	// members returns counts, one per check, and then keeps returning
+	// the last one
+	counter := func(counts ...int) (func() int, *int) {
+		checks := 0
+		return func() int {
+			checks++
+			if checks > len(counts) {
+				return counts[len(counts)-1]
+			}
+			return counts[checks-1]
+		}, &checks
+	}
+	expect := func(n int) func() int { return func() int { return n } }
+
+	// We wait until all of the pods have joined
+	members, checks := counter(1, 2, 2, 3)
+	assert.True(t, waitForConvergence(members, expect(3), time.Millisecond, time.Second))
+	assert.Equal(t, 4, *checks, "didn't wait for the last member")
+
+	// If the count doesn't match the pods but stops changing then
+	// that's as good as it gets
+	members, checks = counter(1, 2)
+	assert.True(t, waitForConvergence(members, expect(3), time.Millisecond, time.Second))
+	assert.Equal(t, 2+convergenceStablePolls, *checks)
+
+	// We give up eventually
+	flapping := 0
+	members = func() int { flapping++; return flapping%2 + 1 }
+	assert.False(t, waitForConvergence(members, expect(3), time.Millisecond, 20*time.Millisecond))
+}
+
+func TestStableIdentity(t *testing.T) {
+	logger := gokitlog.NewNopLogger()
+
+	// The node name is required since it's the member's identity
+	_, err := New(&Config{Logger: &logger})
+	assert.Error(t, err)
+
+	newMember := func(name string) *memberlist.Memberlist {
+		mconfig := memberlistConfig(&Config{NodeName: name, BindAddr: "127.0.0.1", Logger: &logger})
+		assert.Equal(t, name, mconfig.Name)
+
+		// Speed up failure detection so the test doesn't take long
+		mconfig.ProbeInterval = 20 * time.Millisecond
+		mconfig.ProbeTimeout = 10 * time.Millisecond
+		mconfig.SuspicionMult = 1
+		mconfig.GossipInterval = 10 * time.Millisecond
+		mconfig.DeadNodeReclaimTime = 10 * time.Millisecond
+
+		m, err := memberlist.Create(mconfig)
+		assert.NoError(t, err)
+		return m
+	}
+	addr := func(m *memberlist.Memberlist) string {
+		return fmt.Sprintf("%s:%d", m.LocalNode().Addr, m.LocalNode().Port)
+	}
+	names := func(m *memberlist.Memberlist) map[string]string {
+		members := map[string]string{}
+		for _, node := range m.Members() {
+			members[node.Name] = fmt.Sprintf("%s:%d", node.Addr, node.Port)
+		}
+		return members
+	}
+
+	a := newMember("node-a")
+	defer a.Shutdown()
+	b := newMember("node-b")
+	_, err = b.Join([]string{addr(a)})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return a.NumMembers() == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	// The node-b pod crashes and restarts with a different address. It
+	// replaces the old member instead of joining as a new one.
+	b.Shutdown()
+	restarted := newMember("node-b")
+	defer restarted.Shutdown()
+	assert.Eventually(t, func() bool {
+		restarted.Join([]string{addr(a)})
+		return names(a)["node-b"] == addr(restarted)
+	}, 5*time.Second, 50*time.Millisecond, "restarted member didn't replace the old one")
+	assert.Equal(t, 2, len(a.Members()), "restarted member was duplicated")
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package election
+
+// Router routes elections to per-tenant Electors so tenants that need
+// to be isolated from one another can each have their own memberlist
+// (with its own secret and port), so their node agents never gossip
+// together. Each pool belongs to at most one tenant. Pools that don't
+// belong to a tenant use the default Elector, i.e., the cluster-wide
+// memberlist that we've always had.
+type Router struct {
+	defaultElector Elector
+	tenants        map[string]Elector // tenant name -> Elector
+	poolTenants    map[string]string  // pool name -> tenant name
+}
+
+// NewRouter returns a Router that routes every election to
+// defaultElector until tenants are added.
+func NewRouter(defaultElector Elector) *Router {
+	return &Router{
+		defaultElector: defaultElector,
+		tenants:        map[string]Elector{},
+		poolTenants:    map[string]string{},
+	}
+}
+
+// AddTenant adds a tenant whose elections are handled by elector.
+func (r *Router) AddTenant(tenant string, elector Elector) {
+	r.tenants[tenant] = elector
+}
+
+// SetPoolTenants replaces the pool-to-tenant mapping. It's called
+// when the configuration changes.
+func (r *Router) SetPoolTenants(poolTenants map[string]string) {
+	r.poolTenants = map[string]string{}
+	for pool, tenant := range poolTenants {
+		r.poolTenants[pool] = tenant
+	}
+}
+
+// For returns the Elector that handles elections for addresses from
+// pool. If the pool belongs to a tenant that we don't have an Elector
+// for then it returns nil, since falling back to the default Elector
+// would mix that tenant's nodes with everyone else's.
+func (r *Router) For(pool string) Elector {
+	tenant, ok := r.poolTenants[pool]
+	if !ok || tenant == "" {
+		return r.defaultElector
+	}
+	return r.tenants[tenant]
+}
+
+// Winner returns the name of the node that should announce the
+// address represented by key, which belongs to pool. If there's no
+// Elector for the pool's tenant then nobody wins and it returns "".
+func (r *Router) Winner(pool string, key string) string {
+	elector := r.For(pool)
+	if elector == nil {
+		return ""
+	}
+	return elector.Winner(key)
+}
@@ -0,0 +1,69 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package election
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeElector runs elections among a fixed set of nodes, like one
+// memberlist instance would.
+type fakeElector struct {
+	nodes []string
+}
+
+func (f fakeElector) Winner(key string) string {
+	return election(key, append([]string{}, f.nodes...))[0]
+}
+
+func (f fakeElector) NumMembers() int {
+	return len(f.nodes)
+}
+
+func TestRouter(t *testing.T) {
+	def := fakeElector{nodes: []string{"shared"}}
+	red := fakeElector{nodes: []string{"red-node0", "red-node1"}}
+	blue := fakeElector{nodes: []string{"blue-node0"}}
+
+	r := NewRouter(def)
+	r.AddTenant("red", red)
+	r.AddTenant("blue", blue)
+
+	// Before we know which pools belong to which tenants everything
+	// goes to the default memberlist
+	assert.Equal(t, "shared", r.Winner("red-pool", "key"))
+
+	r.SetPoolTenants(map[string]string{
+		"red-pool":    "red",
+		"blue-pool":   "blue",
+		"orphan-pool": "green",
+		"open-pool":   "",
+	})
+
+	// Each tenant's pools are elected by that tenant's nodes
+	assert.Equal(t, red, r.For("red-pool"))
+	assert.Contains(t, red.nodes, r.Winner("red-pool", "key"))
+	assert.Equal(t, "blue-node0", r.Winner("blue-pool", "key"))
+
+	// Pools without a tenant use the default
+	assert.Equal(t, "shared", r.Winner("open-pool", "key"))
+	assert.Equal(t, "shared", r.Winner("unknown-pool", "key"))
+
+	// A pool whose tenant has no memberlist isn't announced at all
+	assert.Nil(t, r.For("orphan-pool"))
+	assert.Equal(t, "", r.Winner("orphan-pool", "key"))
+}
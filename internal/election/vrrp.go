@@ -0,0 +1,185 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package election
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	gokitlog "github.com/go-kit/kit/log"
+)
+
+// VRRPMaster is the state of a VRRP instance on the node that owns
+// its addresses.
+const VRRPMaster = "MASTER"
+
+// VRRPStateSource reports the state of VRRP instances on this node,
+// e.g., "MASTER", "BACKUP", or "FAULT".
+type VRRPStateSource interface {
+	State(instance string) (string, error)
+}
+
+// VRRPStateDir is a VRRPStateSource that reads each instance's state
+// from a file in a directory, named after the instance. keepalived
+// can maintain the files with a notify script, e.g.:
+//
+//	notify "/bin/sh -c 'echo $3 > /var/run/purelb/vrrp/$2'"
+type VRRPStateDir string
+
+// State returns instance's state from its file.
+func (d VRRPStateDir) State(instance string) (string, error) {
+	raw, err := os.ReadFile(filepath.Join(string(d), instance))
+	if err != nil {
+		return "", err
+	}
+	return strings.ToUpper(strings.TrimSpace(string(raw))), nil
+}
+
+// VRRPInstance is a VRRP instance and the addresses that it decides.
+type VRRPInstance struct {
+	Name   string
+	Subnet *net.IPNet
+}
+
+// ParseVRRPInstances parses a comma-separated list of VRRP instances
+// and their subnets, e.g., "VI_1=192.168.1.0/24,VI_2=fd00::/64".
+func ParseVRRPInstances(raw string) ([]VRRPInstance, error) {
+	instances := []VRRPInstance{}
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, cidr, found := strings.Cut(entry, "=")
+		if !found || name == "" {
+			return nil, fmt.Errorf("VRRP instance %q should be name=cidr", entry)
+		}
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("VRRP instance %s: %w", name, err)
+		}
+		instances = append(instances, VRRPInstance{Name: name, Subnet: subnet})
+	}
+	return instances, nil
+}
+
+// VRRP is an Elector that lets existing VRRP infrastructure (e.g.,
+// keepalived) decide which node announces each address. A node wins
+// the election for an address if it's the master of the VRRP
+// instance whose subnet contains the address. Addresses that aren't
+// in any instance's subnet are decided by the fallback Elector.
+type VRRP struct {
+	node      string
+	instances []VRRPInstance
+	source    VRRPStateSource
+	fallback  Elector
+	logger    gokitlog.Logger
+}
+
+var _ Elector = &VRRP{}
+
+// NewVRRP returns a VRRP Elector for node that reads the states of
+// instances from source.
+func NewVRRP(node string, instances []VRRPInstance, source VRRPStateSource, fallback Elector, logger gokitlog.Logger) *VRRP {
+	return &VRRP{
+		node:      node,
+		instances: instances,
+		source:    source,
+		fallback:  fallback,
+		logger:    logger,
+	}
+}
+
+// Winner returns our node's name if we're the master of the VRRP
+// instance that decides the address represented by key. If we're not
+// then we don't know which node is, so it returns "".
+func (v *VRRP) Winner(key string) string {
+	instance := v.instanceFor(key)
+	if instance == "" {
+		return v.fallback.Winner(key)
+	}
+
+	state, err := v.source.State(instance)
+	if err != nil {
+		v.logger.Log("op", "Election", "instance", instance, "error", err, "msg", "failed to get VRRP state")
+		return ""
+	}
+	if state == VRRPMaster {
+		return v.node
+	}
+	return ""
+}
+
+// NumMembers returns the number of members of the fallback Elector.
+// VRRP doesn't tell us how many nodes take part.
+func (v *VRRP) NumMembers() int {
+	return v.fallback.NumMembers()
+}
+
+// instanceFor returns the name of the VRRP instance that decides the
+// address represented by key, or "" if none does.
+func (v *VRRP) instanceFor(key string) string {
+	ip := net.ParseIP(key)
+	if ip == nil {
+		return ""
+	}
+	for _, instance := range v.instances {
+		if instance.Subnet.Contains(ip) {
+			return instance.Name
+		}
+	}
+	return ""
+}
+
+// Watch checks the states of our VRRP instances every interval until
+// stopCh is closed, and calls changed when any of them changes, so
+// the elections can be re-run.
+func (v *VRRP) Watch(interval time.Duration, stopCh <-chan struct{}, changed func()) {
+	states := v.states()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			current := v.states()
+			for instance, state := range current {
+				if states[instance] != state {
+					v.logger.Log("op", "Election", "instance", instance, "state", state, "msg", "VRRP state changed")
+					changed()
+					break
+				}
+			}
+			states = current
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// states returns the current states of our VRRP instances. Instances
+// whose state we can't get are in state "".
+func (v *VRRP) states() map[string]string {
+	states := map[string]string{}
+	for _, instance := range v.instances {
+		state, _ := v.source.State(instance.Name)
+		states[instance.Name] = state
+	}
+	return states
+}
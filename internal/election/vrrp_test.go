@@ -0,0 +1,127 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package election
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	gokitlog "github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeVRRP is a VRRPStateSource with states that the test controls.
+type fakeVRRP struct {
+	lock   sync.Mutex
+	states map[string]string
+}
+
+func (f *fakeVRRP) State(instance string) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	state, ok := f.states[instance]
+	if !ok {
+		return "", fmt.Errorf("unknown instance %s", instance)
+	}
+	return state, nil
+}
+
+func (f *fakeVRRP) set(instance string, state string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.states[instance] = state
+}
+
+func TestVRRP(t *testing.T) {
+	instances, err := ParseVRRPInstances("VI_1=192.168.1.0/24, VI_2=fd00::/64,VI_3=192.168.3.0/24")
+	assert.NoError(t, err)
+	source := &fakeVRRP{states: map[string]string{"VI_1": "MASTER", "VI_2": "BACKUP"}}
+	fallback := fakeElector{nodes: []string{"ml-node0", "ml-node1"}}
+	v := NewVRRP("test-node", instances, source, fallback, gokitlog.NewNopLogger())
+
+	// We win the addresses of the instances that we're the master of,
+	// and nobody wins the others as far as we know
+	assert.Equal(t, "test-node", v.Winner("192.168.1.10"))
+	assert.Equal(t, "", v.Winner("fd00::10"))
+
+	// If we can't get the instance's state then we don't win
+	assert.Equal(t, "", v.Winner("192.168.3.10"))
+
+	// Addresses that aren't in any instance are decided by the fallback
+	assert.Equal(t, fallback.Winner("10.0.0.1"), v.Winner("10.0.0.1"))
+	assert.Contains(t, fallback.nodes, v.Winner("10.0.0.1"))
+	assert.Equal(t, 2, v.NumMembers())
+
+	// A state change changes the winner
+	source.set("VI_2", "MASTER")
+	assert.Equal(t, "test-node", v.Winner("fd00::10"))
+	source.set("VI_1", "FAULT")
+	assert.Equal(t, "", v.Winner("192.168.1.10"))
+}
+
+func TestVRRPWatch(t *testing.T) {
+	instances, err := ParseVRRPInstances("VI_1=192.168.1.0/24")
+	assert.NoError(t, err)
+	source := &fakeVRRP{states: map[string]string{"VI_1": "BACKUP"}}
+	v := NewVRRP("test-node", instances, source, fakeElector{}, gokitlog.NewNopLogger())
+
+	changed := make(chan struct{}, 1)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go v.Watch(10*time.Millisecond, stopCh, func() { changed <- struct{}{} })
+
+	// When the state changes the elections are re-run
+	time.Sleep(50 * time.Millisecond)
+	source.set("VI_1", "MASTER")
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("state change wasn't noticed")
+	}
+}
+
+func TestParseVRRPInstances(t *testing.T) {
+	instances, err := ParseVRRPInstances("")
+	assert.NoError(t, err)
+	assert.Empty(t, instances)
+
+	instances, err = ParseVRRPInstances("VI_1=192.168.1.0/24")
+	assert.NoError(t, err)
+	assert.Equal(t, "VI_1", instances[0].Name)
+	assert.Equal(t, "192.168.1.0/24", instances[0].Subnet.String())
+
+	_, err = ParseVRRPInstances("VI_1")
+	assert.Error(t, err)
+	_, err = ParseVRRPInstances("=192.168.1.0/24")
+	assert.Error(t, err)
+	_, err = ParseVRRPInstances("VI_1=192.168.1.0")
+	assert.Error(t, err)
+}
+
+func TestVRRPStateDir(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "VI_1"), []byte("master\n"), 0644))
+
+	state, err := VRRPStateDir(dir).State("VI_1")
+	assert.NoError(t, err)
+	assert.Equal(t, VRRPMaster, state)
+
+	_, err = VRRPStateDir(dir).State("VI_2")
+	assert.Error(t, err)
+}
@@ -18,6 +18,7 @@ package k8s
 import (
 	"fmt"
 	"os"
+	"reflect"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -110,6 +111,13 @@ func NewCRController(
 			controller.enqueueResource("sg", added)
 		},
 		UpdateFunc: func(old, new interface{}) {
+			// The allocator updates the status, which doesn't change
+			// the configuration, so only spec changes matter.
+			oldSG, oldOK := old.(*purelbv1.ServiceGroup)
+			newSG, newOK := new.(*purelbv1.ServiceGroup)
+			if oldOK && newOK && reflect.DeepEqual(oldSG.Spec, newSG.Spec) && reflect.DeepEqual(oldSG.ObjectMeta.Labels, newSG.ObjectMeta.Labels) {
+				return
+			}
 			controller.enqueueResource("sg", new)
 		},
 		DeleteFunc: func(deleted interface{}) {
@@ -0,0 +1,77 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Readiness tracks whether a node agent is ready to announce
+// addresses: it has to have loaded a configuration and joined the
+// election memberlist. It's an http.Handler that serves the readiness
+// endpoint, and it's safe to use from more than one goroutine.
+type Readiness struct {
+	sync.Mutex
+
+	configured bool
+	members    func() int
+}
+
+// SetConfigured records that a configuration has been loaded.
+func (r *Readiness) SetConfigured() {
+	r.Lock()
+	defer r.Unlock()
+	r.configured = true
+}
+
+// SetMembers records that we've joined the memberlist. members
+// returns the number of nodes in the memberlist.
+func (r *Readiness) SetMembers(members func() int) {
+	r.Lock()
+	defer r.Unlock()
+	r.members = members
+}
+
+// Ready returns nil if we're ready, or an error that says why we
+// aren't.
+func (r *Readiness) Ready() error {
+	r.Lock()
+	defer r.Unlock()
+
+	if !r.configured {
+		return fmt.Errorf("no configuration loaded")
+	}
+	if r.members == nil || r.members() < 1 {
+		return fmt.Errorf("not a memberlist member")
+	}
+	return nil
+}
+
+// ServeHTTP responds with 200 if we're ready, or 503 and the reason
+// if we aren't.
+func (r *Readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := r.Ready(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// healthz responds with 200 as long as the process can serve HTTP.
+func healthz(w http.ResponseWriter, req *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
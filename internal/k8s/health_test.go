@@ -0,0 +1,66 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadiness(t *testing.T) {
+	ready := &Readiness{}
+	status := func() int {
+		w := httptest.NewRecorder()
+		ready.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return w.Code
+	}
+
+	// Not ready until we've loaded a configuration
+	assert.Error(t, ready.Ready())
+	assert.Equal(t, http.StatusServiceUnavailable, status())
+
+	// and joined the memberlist
+	ready.SetConfigured()
+	assert.EqualError(t, ready.Ready(), "not a memberlist member")
+	assert.Equal(t, http.StatusServiceUnavailable, status())
+
+	members := 0
+	ready.SetMembers(func() int { return members })
+	assert.Error(t, ready.Ready())
+	assert.Equal(t, http.StatusServiceUnavailable, status())
+
+	members = 1
+	assert.NoError(t, ready.Ready())
+	assert.Equal(t, http.StatusOK, status())
+
+	// If we leave the memberlist then we're no longer ready
+	members = 0
+	assert.Equal(t, http.StatusServiceUnavailable, status())
+
+	// Joining first and loading the configuration later works, too
+	ready = &Readiness{}
+	ready.SetMembers(func() int { return 3 })
+	assert.EqualError(t, ready.Ready(), "no configuration loaded")
+	ready.SetConfigured()
+	assert.Equal(t, http.StatusOK, status())
+
+	// Liveness doesn't depend on readiness
+	w := httptest.NewRecorder()
+	healthz(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
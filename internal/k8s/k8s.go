@@ -19,6 +19,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math/rand"
 	"reflect"
 	"time"
 
@@ -27,9 +28,11 @@ import (
 	"purelb.io/pkg/generated/informers/externalversions"
 
 	"github.com/go-kit/kit/log"
+	"golang.org/x/time/rate"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
+	k8slabels "k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
@@ -46,15 +49,25 @@ import (
 type Client struct {
 	logger log.Logger
 
-	client *kubernetes.Clientset
+	client kubernetes.Interface
 	events record.EventRecorder
 	queue  workqueue.RateLimitingInterface
 
+	verbosity    EventVerbosity
+	maxRetries   int
+	resyncJitter time.Duration
+	debounce     time.Duration
+
+	reconcileInterval time.Duration
+
 	svcIndexer  cache.Indexer
 	svcInformer cache.Controller
 	epIndexer   cache.Indexer
 	epInformer  cache.Controller
+	podIndexer  cache.Indexer
+	podInformer cache.Controller
 
+	crClient          versioned.Interface
 	crInformerFactory externalversions.SharedInformerFactory
 	crController      Controller
 
@@ -63,12 +76,14 @@ type Client struct {
 	serviceChanged func(*corev1.Service, *corev1.Endpoints) SyncState
 	serviceDeleted func(string) SyncState
 	configChanged  func(*purelbv1.Config) SyncState
-	synced         func()
+	synced         func([]*corev1.Service)
+	reconcile      func([]string)
 	shutdown       func()
 }
 
 // ServiceEvent adds events to services.
 type ServiceEvent interface {
+	Debugf(obj runtime.Object, desc, msg string, args ...interface{})
 	Infof(obj runtime.Object, desc, msg string, args ...interface{})
 	Errorf(obj runtime.Object, desc, msg string, args ...interface{})
 	ForceSync()
@@ -88,6 +103,34 @@ const (
 	SyncStateReprocessAll
 )
 
+// EventVerbosity controls which events the client sends to the
+// cluster.
+type EventVerbosity int
+
+const (
+	// EventVerbosityNormal sends Warning events and informational
+	// events, but not debug events. This is the default.
+	EventVerbosityNormal EventVerbosity = iota
+	// EventVerbosityErrors sends only Warning events.
+	EventVerbosityErrors
+	// EventVerbosityVerbose sends all events.
+	EventVerbosityVerbose
+)
+
+// ParseEventVerbosity parses the command-line representation of an
+// EventVerbosity: "errors", "normal", or "verbose".
+func ParseEventVerbosity(s string) (EventVerbosity, error) {
+	switch s {
+	case "errors":
+		return EventVerbosityErrors, nil
+	case "normal", "":
+		return EventVerbosityNormal, nil
+	case "verbose":
+		return EventVerbosityVerbose, nil
+	}
+	return EventVerbosityNormal, fmt.Errorf("unknown event verbosity %q, must be errors, normal, or verbose", s)
+}
+
 // Config specifies the configuration of the Kubernetes
 // client/watcher.
 type Config struct {
@@ -95,17 +138,61 @@ type Config struct {
 	NodeName      string
 	ReadEndpoints bool
 	Logger        log.Logger
+
+	// ReadNodePods tells the client to cache the pods that run on
+	// NodeName so NodePodReady doesn't have to ask the API server.
+	// The client reprocesses all services when one of those pods
+	// becomes ready or unready.
+	ReadNodePods bool
+
 	Kubeconfig    string
 
+	// EventVerbosity controls which events we send to the cluster.
+	EventVerbosity EventVerbosity
+
+	// MaxRetries is the number of times that we retry a service whose
+	// update fails before we give up on it until it changes. 0 means
+	// retry forever.
+	MaxRetries int
+
+	// ResyncJitter is the upper bound of a random delay that we wait
+	// before reprocessing all services in ForceSync. It keeps all of
+	// the nodes from hitting the API server at the same time when the
+	// configuration changes. 0 means no delay.
+	ResyncJitter time.Duration
+
+	// MaxRetryDelay is the upper bound of the delay between retries of
+	// a service whose update failed, so a long API server outage
+	// doesn't leave us waiting a long time after it's over. 0 means
+	// DefaultMaxRetryDelay.
+	MaxRetryDelay time.Duration
+
+	// Debounce is how long we wait after a service or endpoints update
+	// before processing it, so a burst of updates (e.g., from another
+	// controller) is processed once, in its latest state. 0 means
+	// process each update right away.
+	Debounce time.Duration
+
+	// ReconcileInterval is how often we call Reconcile with the names
+	// of the services that exist, so the app can clean up after
+	// services whose deletes it missed. 0 means never.
+	ReconcileInterval time.Duration
+
 	ServiceChanged func(*corev1.Service, *corev1.Endpoints) SyncState
 	ServiceDeleted func(string) SyncState
 	ConfigChanged  func(*purelbv1.Config) SyncState
-	Synced         func()
+	Synced         func([]*corev1.Service)
+	Reconcile      func([]string)
 	Shutdown       func()
 }
 
+// DefaultMaxRetryDelay is the default upper bound of the delay
+// between retries of a failed service update.
+const DefaultMaxRetryDelay = 5 * time.Minute
+
 type svcKey string
 type synced string
+type reconcile string
 
 // New connects to masterAddr, using kubeconfig to authenticate.
 //
@@ -134,17 +221,25 @@ func New(cfg *Config) (*Client, error) {
 	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: typedcorev1.New(clientset.CoreV1().RESTClient()).Events("")})
 	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: cfg.ProcessName})
 
-	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	queue := workqueue.NewRateLimitingQueue(newRateLimiter(cfg.MaxRetryDelay))
 
 	c := &Client{
 		logger: cfg.Logger,
 		client: clientset,
 		events: recorder,
 		queue:  queue,
+
+		verbosity:    cfg.EventVerbosity,
+		maxRetries:   cfg.MaxRetries,
+		resyncJitter: cfg.ResyncJitter,
+		debounce:     cfg.Debounce,
+
+		reconcileInterval: cfg.ReconcileInterval,
 	}
 
 	// Custom Resource Watcher
 
+	c.crClient = crClient
 	c.crInformerFactory = externalversions.NewSharedInformerFactory(crClient, time.Second*0)
 	c.crController = *NewCRController(c.logger, cfg.ConfigChanged, c.ForceSync, clientset, crClient, c.crInformerFactory)
 
@@ -160,7 +255,7 @@ func New(cfg *Config) (*Client, error) {
 		UpdateFunc: func(old interface{}, new interface{}) {
 			key, err := cache.MetaNamespaceKeyFunc(new)
 			if err == nil {
-				c.queue.Add(svcKey(key))
+				c.enqueueUpdate(svcKey(key))
 			}
 		},
 		DeleteFunc: func(obj interface{}) {
@@ -190,7 +285,7 @@ func New(cfg *Config) (*Client, error) {
 			UpdateFunc: func(old interface{}, new interface{}) {
 				key, err := cache.MetaNamespaceKeyFunc(new)
 				if err == nil {
-					c.queue.Add(svcKey(key))
+					c.enqueueUpdate(svcKey(key))
 				}
 			},
 			DeleteFunc: func(obj interface{}) {
@@ -206,9 +301,36 @@ func New(cfg *Config) (*Client, error) {
 		c.syncFuncs = append(c.syncFuncs, c.epInformer.HasSynced)
 	}
 
+	// Pod Watcher (used by node agents to check their companion pods)
+
+	if cfg.ReadNodePods {
+		podHandlers := cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				if podReady(obj) {
+					c.podReadinessChanged()
+				}
+			},
+			UpdateFunc: func(old interface{}, new interface{}) {
+				if podReady(old) != podReady(new) {
+					c.podReadinessChanged()
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				if podReady(obj) {
+					c.podReadinessChanged()
+				}
+			},
+		}
+		podWatcher := cache.NewListWatchFromClient(c.client.CoreV1().RESTClient(), "pods", corev1.NamespaceAll, fields.OneTermEqualSelector("spec.nodeName", cfg.NodeName))
+		c.podIndexer, c.podInformer = cache.NewIndexerInformer(podWatcher, &corev1.Pod{}, 0, podHandlers, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+
+		c.syncFuncs = append(c.syncFuncs, c.podInformer.HasSynced)
+	}
+
 	// Sync Watcher
 
 	c.synced = cfg.Synced
+	c.reconcile = cfg.Reconcile
 
 	// Shutdown hook
 
@@ -240,6 +362,80 @@ func (c *Client) GetPodsIPs(namespace string, labels string) ([]string, error) {
 	return iplist, nil
 }
 
+// CRClient returns the client for PureLB's custom resources.
+func (c *Client) CRClient() versioned.Interface {
+	return c.crClient
+}
+
+// NodePodReady returns true if any of the pods in the namespace that
+// are matched by the labels string and run on node is ready. If the
+// client caches our node's pods then it reads them from the cache,
+// otherwise it asks the API server.
+func (c *Client) NodePodReady(namespace string, labels string, node string) (bool, error) {
+	if c.podIndexer != nil {
+		selector, err := k8slabels.Parse(labels)
+		if err != nil {
+			return false, err
+		}
+		objs, err := c.podIndexer.ByIndex(cache.NamespaceIndex, namespace)
+		if err != nil {
+			return false, err
+		}
+		for _, obj := range objs {
+			pod := obj.(*corev1.Pod)
+			if pod.Spec.NodeName == node && selector.Matches(k8slabels.Set(pod.Labels)) && podReady(pod) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	pl, err := c.client.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: labels,
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", node).String(),
+	})
+	if err != nil {
+		return false, err
+	}
+	for i := range pl.Items {
+		if podReady(&pl.Items[i]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// podReady returns true if obj is a pod whose Ready condition is
+// true. obj can be a cache tombstone, i.e., a pod that was deleted
+// while we weren't watching.
+func podReady(obj interface{}) bool {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return false
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady && cond.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// podReadinessChanged reprocesses all services after one of our
+// node's pods becomes ready or unready, so the app sees the change
+// even if it isn't retrying any services. We don't reprocess while the
+// cache is loading because we process every service once it's loaded
+// anyway.
+func (c *Client) podReadinessChanged() {
+	if c.podInformer == nil || !c.podInformer.HasSynced() {
+		return
+	}
+	c.ForceSync()
+}
+
 // Run watches for events on the Kubernetes cluster, and dispatches
 // calls to the Controller.
 func (c *Client) Run(stopCh <-chan struct{}) error {
@@ -256,12 +452,16 @@ func (c *Client) Run(stopCh <-chan struct{}) error {
 	if c.epInformer != nil {
 		go c.epInformer.Run(stopCh)
 	}
+	if c.podInformer != nil {
+		go c.podInformer.Run(stopCh)
+	}
 
 	if !cache.WaitForCacheSync(stopCh, c.syncFuncs...) {
 		return errors.New("timed out waiting for cache sync")
 	}
 
 	c.queue.Add(synced(""))
+	c.scheduleReconcile()
 
 	if stopCh != nil {
 		go func() {
@@ -279,28 +479,121 @@ func (c *Client) Run(stopCh <-chan struct{}) error {
 		updates.Inc()
 		st := c.sync(key)
 		// c.logger.Log("sync", key, "result", st)
-		switch st {
-		case SyncStateSuccess:
-			c.queue.Forget(key)
-		case SyncStateError:
-			updateErrors.Inc()
-			c.queue.AddRateLimited(key)
-		case SyncStateReprocessAll:
-			c.queue.Forget(key)
-			c.ForceSync()
+		c.handleResult(key, st)
+	}
+}
+
+// services returns copies of the services in our cache.
+func (c *Client) services() []*corev1.Service {
+	services := []*corev1.Service{}
+	if c.svcIndexer == nil {
+		return services
+	}
+	for _, obj := range c.svcIndexer.List() {
+		if svc, ok := obj.(*corev1.Service); ok {
+			services = append(services, svc.DeepCopy())
 		}
 	}
+	return services
+}
+
+// scheduleReconcile queues the next reconcile, if the client has a
+// ReconcileInterval.
+func (c *Client) scheduleReconcile() {
+	if c.reconcile != nil && c.reconcileInterval > 0 {
+		c.queue.AddAfter(reconcile(""), c.reconcileInterval)
+	}
+}
+
+// enqueueUpdate queues key after an update. If the client has a
+// debounce delay then key is queued after that delay. Further updates
+// during the delay don't queue it again, so the burst is processed
+// once. We read the service from the cache when we process it so we
+// always see its latest state.
+func (c *Client) enqueueUpdate(key svcKey) {
+	if c.debounce > 0 {
+		c.queue.AddAfter(key, c.debounce)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// newRateLimiter returns a rate limiter like client-go's default
+// controller rate limiter, i.e., per-item exponential backoff plus an
+// overall rate limit, but whose backoff is capped at maxDelay. If
+// maxDelay is 0 then DefaultMaxRetryDelay is used.
+func newRateLimiter(maxDelay time.Duration) workqueue.RateLimiter {
+	if maxDelay <= 0 {
+		maxDelay = DefaultMaxRetryDelay
+	}
+	return workqueue.NewMaxOfRateLimiter(
+		workqueue.NewItemExponentialFailureRateLimiter(5*time.Millisecond, maxDelay),
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(10), 100)},
+	)
 }
 
-// ForceSync reprocess all watched services
+// handleResult decides what to do with key based on the result of
+// syncing it.
+func (c *Client) handleResult(key interface{}, st SyncState) {
+	switch st {
+	case SyncStateSuccess:
+		if retries := c.queue.NumRequeues(key); retries > 0 {
+			c.logger.Log("op", "retry", "key", key, "retries", retries, "msg", "update succeeded after retrying")
+		}
+		c.queue.Forget(key)
+	case SyncStateError:
+		updateErrors.Inc()
+		if c.maxRetries > 0 && c.queue.NumRequeues(key) >= c.maxRetries {
+			c.giveUp(key)
+			return
+		}
+		c.queue.AddRateLimited(key)
+	case SyncStateReprocessAll:
+		c.queue.Forget(key)
+		c.ForceSync()
+	}
+}
+
+// giveUp stops retrying key because it has used up its retry
+// budget. We'll try again when the service changes.
+func (c *Client) giveUp(key interface{}) {
+	retries := c.queue.NumRequeues(key)
+	c.queue.Forget(key)
+	retriesExhausted.Inc()
+
+	svcName, isSvc := key.(svcKey)
+	if !isSvc {
+		return
+	}
+	c.logger.Log("op", "retry", "service", svcName, "retries", retries, "msg", "giving up until the service changes")
+	if svcMaybe, exists, err := c.svcIndexer.GetByKey(string(svcName)); err == nil && exists {
+		c.Errorf(svcMaybe.(*corev1.Service), "RetriesExhausted", "Update failed %d times, giving up until the service changes", retries+1)
+	}
+}
+
+// ForceSync reprocess all watched services. If the client has a
+// ResyncJitter then the services are reprocessed after a random delay.
 func (c *Client) ForceSync() {
 	if c.svcIndexer != nil {
+		delay := c.resyncDelay()
 		for _, k := range c.svcIndexer.ListKeys() {
-			c.queue.AddRateLimited(svcKey(k))
+			if delay > 0 {
+				c.queue.AddAfter(svcKey(k), delay)
+			} else {
+				c.queue.AddRateLimited(svcKey(k))
+			}
 		}
 	}
 }
 
+// resyncDelay returns a random delay in the range [0, resyncJitter).
+func (c *Client) resyncDelay() time.Duration {
+	if c.resyncJitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(c.resyncJitter)))
+}
+
 // maybeUpdateService writes the "is" service back to the cluster, but
 // only if it's different than the "was" service.
 func (c *Client) maybeUpdateService(was, is *corev1.Service) error {
@@ -312,8 +605,8 @@ func (c *Client) maybeUpdateService(was, is *corev1.Service) error {
 	if !reflect.DeepEqual(was.Status, is.Status) {
 		svcUpdated, err = c.client.CoreV1().Services(is.Namespace).UpdateStatus(context.TODO(), is, metav1.UpdateOptions{})
 		if err != nil {
-			c.logger.Log("op", "updateServiceStatus", "error", err, "msg", "failed to update service status")
-			return err
+			apiErrors.WithLabelValues("updateServiceStatus").Inc()
+			return fmt.Errorf("updating service status: %w", err)
 		}
 	}
 	if !(reflect.DeepEqual(was.Annotations, is.Annotations) && reflect.DeepEqual(was.Spec, is.Spec)) {
@@ -327,16 +620,31 @@ func (c *Client) maybeUpdateService(was, is *corev1.Service) error {
 		is.Annotations = ann
 		spec.DeepCopyInto(&is.Spec)
 		if _, err = c.client.CoreV1().Services(is.Namespace).Update(context.TODO(), is, metav1.UpdateOptions{}); err != nil {
-			c.logger.Log("op", "updateService", "error", err, "msg", "failed to update service")
-			return err
+			apiErrors.WithLabelValues("updateService").Inc()
+			return fmt.Errorf("updating service: %w", err)
 		}
 	}
 
 	return nil
 }
 
-// Infof logs an informational event about obj to the Kubernetes cluster.
+// Debugf logs a debug event about obj to the Kubernetes
+// cluster. Debug events are sent only if the client's verbosity is
+// EventVerbosityVerbose.
+func (c *Client) Debugf(obj runtime.Object, kind, msg string, args ...interface{}) {
+	if c.verbosity != EventVerbosityVerbose {
+		return
+	}
+	c.events.Eventf(obj, corev1.EventTypeNormal, kind, msg, args...)
+}
+
+// Infof logs an informational event about obj to the Kubernetes
+// cluster. Informational events are not sent if the client's
+// verbosity is EventVerbosityErrors.
 func (c *Client) Infof(obj runtime.Object, kind, msg string, args ...interface{}) {
+	if c.verbosity == EventVerbosityErrors {
+		return
+	}
 	c.events.Eventf(obj, corev1.EventTypeNormal, kind, msg, args...)
 }
 
@@ -381,7 +689,13 @@ func (c *Client) sync(key interface{}) SyncState {
 			// l.Log("op", "getService", "msg", "doesn't exist")
 			return c.serviceDeleted(svcName)
 		}
-		svc := svcMaybe.(*corev1.Service)
+		// the app gets a copy of the service so anything that it does to
+		// the service only reaches the cluster (and our cache) if we
+		// write it back. Otherwise a transient error that cleared the
+		// ingress status would be remembered as the service's current
+		// state.
+		svcOriginal := svcMaybe.(*corev1.Service)
+		svc := svcOriginal.DeepCopy()
 
 		var eps *corev1.Endpoints = &corev1.Endpoints{}
 		if c.epIndexer != nil {
@@ -395,18 +709,21 @@ func (c *Client) sync(key interface{}) SyncState {
 			}
 		}
 
-		// stash a copy of the service so we'll be able to tell if the app
-		// changes it
-		svcOriginal := svc.DeepCopy()
-
 		// tell the app about the service change
 		status := c.serviceChanged(svc, eps)
 
-		// write any changes to the service back to the cluster
+		// write any changes to the service back to the cluster. If the
+		// app had a transient error then we don't write anything and
+		// we'll try again later.
 		if status == SyncStateSuccess {
 			err = c.maybeUpdateService(svcOriginal, svc)
 			if err != nil {
-				l.Log("op", "updateService", "error", err)
+				// If the API server is unavailable then every retry will
+				// fail the same way, so we log only the first failure.
+				// handleResult logs when we recover.
+				if c.queue.NumRequeues(key) == 0 {
+					l.Log("op", "updateService", "error", err, "msg", "will retry with backoff")
+				}
 				status = SyncStateError
 			}
 		}
@@ -415,8 +732,15 @@ func (c *Client) sync(key interface{}) SyncState {
 
 	case synced:
 		if c.synced != nil {
-			c.synced()
+			c.synced(c.services())
+		}
+		return SyncStateSuccess
+
+	case reconcile:
+		if c.svcIndexer != nil {
+			c.reconcile(c.svcIndexer.ListKeys())
 		}
+		c.scheduleReconcile()
 		return SyncStateSuccess
 
 	default:
@@ -0,0 +1,343 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	ptu "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestParseEventVerbosity(t *testing.T) {
+	for in, want := range map[string]EventVerbosity{
+		"":        EventVerbosityNormal,
+		"normal":  EventVerbosityNormal,
+		"errors":  EventVerbosityErrors,
+		"verbose": EventVerbosityVerbose,
+	} {
+		got, err := ParseEventVerbosity(in)
+		assert.NoError(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+
+	_, err := ParseEventVerbosity("chatty")
+	assert.Error(t, err)
+}
+
+func TestEventVerbosity(t *testing.T) {
+	svc := &corev1.Service{}
+
+	for _, test := range []struct {
+		verbosity EventVerbosity
+		want      int
+	}{
+		{EventVerbosityErrors, 1},
+		{EventVerbosityNormal, 2},
+		{EventVerbosityVerbose, 3},
+	} {
+		recorder := record.NewFakeRecorder(10)
+		c := &Client{events: recorder, verbosity: test.verbosity}
+
+		c.Debugf(svc, "Debug", "debug event")
+		c.Infof(svc, "Info", "info event")
+		c.Errorf(svc, "Error", "error event")
+		assert.Len(t, recorder.Events, test.want, "verbosity %d", test.verbosity)
+
+		// Warnings are always sent
+		if test.verbosity == EventVerbosityErrors {
+			assert.Equal(t, "Warning Error error event", <-recorder.Events)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "failing"}}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	assert.NoError(t, indexer.Add(svc))
+	recorder := record.NewFakeRecorder(10)
+	c := &Client{
+		logger:     log.NewNopLogger(),
+		events:     recorder,
+		queue:      workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, time.Millisecond)),
+		svcIndexer: indexer,
+		maxRetries: 3,
+	}
+	key := svcKey("test/failing")
+
+	// Failures within the budget are retried
+	for i := 0; i < 3; i++ {
+		c.handleResult(key, SyncStateError)
+		assert.Equal(t, i+1, c.queue.NumRequeues(key))
+	}
+	assert.Empty(t, recorder.Events)
+
+	// Once the budget is exhausted we give up and tell the user
+	c.handleResult(key, SyncStateError)
+	assert.Equal(t, 0, c.queue.NumRequeues(key))
+	assert.Equal(t, "Warning RetriesExhausted Update failed 4 times, giving up until the service changes", <-recorder.Events)
+
+	// A change to the service gets a fresh budget
+	c.handleResult(key, SyncStateError)
+	assert.Equal(t, 1, c.queue.NumRequeues(key))
+
+	// With no budget we retry forever
+	c.maxRetries = 0
+	for i := 0; i < 10; i++ {
+		c.handleResult(key, SyncStateError)
+	}
+	assert.Equal(t, 11, c.queue.NumRequeues(key))
+	c.queue.ShutDown()
+}
+
+func TestResyncJitter(t *testing.T) {
+	// No jitter means no delay
+	c := &Client{}
+	assert.Equal(t, time.Duration(0), c.resyncDelay())
+
+	// The delay is always within the bounds
+	c.resyncJitter = 50 * time.Millisecond
+	for i := 0; i < 1000; i++ {
+		delay := c.resyncDelay()
+		assert.GreaterOrEqual(t, delay, time.Duration(0))
+		assert.Less(t, delay, c.resyncJitter)
+	}
+
+	// ForceSync queues all of the services within the jitter
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	assert.NoError(t, indexer.Add(&corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc1"}}))
+	assert.NoError(t, indexer.Add(&corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc2"}}))
+	c.svcIndexer = indexer
+	c.queue = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer c.queue.ShutDown()
+	c.ForceSync()
+	assert.Eventually(t, func() bool { return c.queue.Len() == 2 }, time.Second, time.Millisecond)
+}
+
+func TestTransientErrorKeepsIngress(t *testing.T) {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "test"},
+		Status: corev1.ServiceStatus{
+			LoadBalancer: corev1.LoadBalancerStatus{
+				Ingress: []corev1.LoadBalancerIngress{{IP: "1.2.3.4"}},
+			},
+		},
+	}
+	clientset := fake.NewSimpleClientset(svc.DeepCopy())
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	assert.NoError(t, indexer.Add(svc.DeepCopy()))
+
+	status := SyncStateError
+	c := &Client{
+		logger:     log.NewNopLogger(),
+		client:     clientset,
+		queue:      workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		svcIndexer: indexer,
+		serviceChanged: func(svc *corev1.Service, _ *corev1.Endpoints) SyncState {
+			svc.Status.LoadBalancer.Ingress = nil
+			return status
+		},
+	}
+	defer c.queue.ShutDown()
+
+	ingress := func() []corev1.LoadBalancerIngress {
+		svc, err := clientset.CoreV1().Services("test").Get(context.TODO(), "test", metav1.GetOptions{})
+		assert.NoError(t, err)
+		return svc.Status.LoadBalancer.Ingress
+	}
+
+	// A transient error leaves the service's ingress status alone
+	assert.Equal(t, SyncStateError, c.sync(svcKey("test/test")))
+	assert.Equal(t, "1.2.3.4", ingress()[0].IP, "transient error cleared ingress")
+
+	// An explicit withdrawal clears it
+	status = SyncStateSuccess
+	assert.Equal(t, SyncStateSuccess, c.sync(svcKey("test/test")))
+	assert.Empty(t, ingress(), "withdrawal didn't clear ingress")
+}
+
+func TestAPIErrorBackoff(t *testing.T) {
+	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "unavailable"}}
+	clientset := fake.NewSimpleClientset(svc.DeepCopy())
+	clientset.PrependReactor("update", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("the server is currently unable to handle the request")
+	})
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	assert.NoError(t, indexer.Add(svc.DeepCopy()))
+
+	c := &Client{
+		logger:     log.NewNopLogger(),
+		client:     clientset,
+		queue:      workqueue.NewRateLimitingQueue(newRateLimiter(10 * time.Millisecond)),
+		svcIndexer: indexer,
+		serviceChanged: func(svc *corev1.Service, _ *corev1.Endpoints) SyncState {
+			svc.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "1.2.3.4"}}
+			return SyncStateSuccess
+		},
+	}
+	defer c.queue.ShutDown()
+	key := svcKey("test/unavailable")
+	before := ptu.ToFloat64(apiErrors.WithLabelValues("updateServiceStatus"))
+
+	// Each failed update is counted and retried
+	for i := 0; i < 10; i++ {
+		st := c.sync(key)
+		assert.Equal(t, SyncStateError, st)
+		c.handleResult(key, st)
+		assert.Equal(t, i+1, c.queue.NumRequeues(key))
+	}
+	assert.Equal(t, before+10, ptu.ToFloat64(apiErrors.WithLabelValues("updateServiceStatus")))
+
+	// Once the API server is back the update succeeds and the backoff
+	// is reset
+	clientset.ReactionChain = clientset.ReactionChain[1:]
+	st := c.sync(key)
+	assert.Equal(t, SyncStateSuccess, st)
+	c.handleResult(key, st)
+	assert.Equal(t, 0, c.queue.NumRequeues(key))
+}
+
+func TestNewRateLimiter(t *testing.T) {
+	// The backoff grows, but never past the limit
+	limiter := newRateLimiter(time.Second)
+	last := time.Duration(0)
+	for i := 0; i < 20; i++ {
+		delay := limiter.When("key")
+		assert.GreaterOrEqual(t, delay, last)
+		assert.LessOrEqual(t, delay, time.Second)
+		last = delay
+	}
+	assert.Equal(t, time.Second, last)
+
+	// No limit means the default
+	limiter = newRateLimiter(0)
+	for i := 0; i < 40; i++ {
+		last = limiter.When("key")
+	}
+	assert.Equal(t, DefaultMaxRetryDelay, last)
+}
+
+func TestDebounce(t *testing.T) {
+	passes := func(debounce time.Duration) int32 {
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		assert.NoError(t, indexer.Add(&corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "busy"}}))
+		var count int32
+		c := &Client{
+			logger:     log.NewNopLogger(),
+			client:     fake.NewSimpleClientset(),
+			queue:      workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+			svcIndexer: indexer,
+			debounce:   debounce,
+			serviceChanged: func(*corev1.Service, *corev1.Endpoints) SyncState {
+				atomic.AddInt32(&count, 1)
+				return SyncStateSuccess
+			},
+		}
+
+		// Process the queue like Run does
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				key, quit := c.queue.Get()
+				if quit {
+					return
+				}
+				c.handleResult(key, c.sync(key))
+			}
+		}()
+
+		// Update the service repeatedly, giving the worker time to keep
+		// up
+		for i := 0; i < 10; i++ {
+			c.enqueueUpdate(svcKey("test/busy"))
+			time.Sleep(5 * time.Millisecond)
+		}
+		time.Sleep(debounce + 50*time.Millisecond)
+		c.queue.ShutDown()
+		<-done
+
+		return atomic.LoadInt32(&count)
+	}
+
+	// Without a debounce each update is processed as it arrives
+	assert.Greater(t, passes(0), int32(1))
+
+	// With one the burst is processed once
+	assert.Equal(t, int32(1), passes(200*time.Millisecond))
+}
+
+// syncedController is a cache.Controller whose cache is loaded.
+type syncedController struct{ cache.Controller }
+
+func (syncedController) HasSynced() bool { return true }
+
+func TestNodePodReady(t *testing.T) {
+	pod := func(namespace string, name string, node string, ready corev1.ConditionStatus) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: map[string]string{"app": "bird"}},
+			Spec:       corev1.PodSpec{NodeName: node},
+			Status:     corev1.PodStatus{Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: ready}}},
+		}
+	}
+	pods := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	assert.NoError(t, pods.Add(pod("purelb", "bird-1", "node1", corev1.ConditionFalse)))
+	assert.NoError(t, pods.Add(pod("purelb", "bird-2", "node2", corev1.ConditionTrue)))
+	assert.NoError(t, pods.Add(pod("other", "bird-3", "node1", corev1.ConditionTrue)))
+
+	// The pods come from the cache, not the API server (the client
+	// doesn't have one)
+	c := &Client{podIndexer: pods}
+	ready, err := c.NodePodReady("purelb", "app=bird", "node1")
+	assert.NoError(t, err)
+	assert.False(t, ready)
+	ready, err = c.NodePodReady("purelb", "app=bird", "node2")
+	assert.NoError(t, err)
+	assert.True(t, ready)
+	ready, err = c.NodePodReady("purelb", "app=routing", "node2")
+	assert.NoError(t, err)
+	assert.False(t, ready)
+	_, err = c.NodePodReady("purelb", "app in (", "node1")
+	assert.Error(t, err)
+
+	// Deleted pods count, too
+	assert.True(t, podReady(cache.DeletedFinalStateUnknown{Obj: pod("purelb", "bird-4", "node1", corev1.ConditionTrue)}))
+
+	// A readiness change reprocesses all services, but not while the
+	// cache is loading
+	svcs := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	assert.NoError(t, svcs.Add(&corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "svc1"}}))
+	c.svcIndexer = svcs
+	c.queue = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer c.queue.ShutDown()
+	c.podReadinessChanged()
+	assert.Equal(t, 0, c.queue.Len())
+	c.podInformer = syncedController{}
+	c.podReadinessChanged()
+	assert.Eventually(t, func() bool { return c.queue.Len() == 1 }, time.Second, time.Millisecond)
+}
@@ -42,6 +42,22 @@ var (
 		Help:      "Number of k8s object updates that failed for some reason.",
 	})
 
+	retriesExhausted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: subsystem,
+		Name:      "retries_exhausted_total",
+		Help:      "Number of k8s object updates that we gave up on after too many retries.",
+	})
+
+	apiErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: purelbv1.MetricsNamespace,
+		Subsystem: subsystem,
+		Name:      "api_errors_total",
+		Help:      "Number of k8s API server requests that failed, by operation.",
+	}, []string{
+		"op",
+	})
+
 	configLoaded = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: purelbv1.MetricsNamespace,
 		Subsystem: subsystem,
@@ -53,11 +69,15 @@ var (
 func init() {
 	prometheus.MustRegister(updates)
 	prometheus.MustRegister(updateErrors)
+	prometheus.MustRegister(retriesExhausted)
+	prometheus.MustRegister(apiErrors)
 	prometheus.MustRegister(configLoaded)
 }
 
-// RunMetrics runs the metrics server. It doesn't ever return.
+// RunMetrics runs the metrics server, which also serves the /healthz
+// liveness endpoint. It doesn't ever return.
 func RunMetrics(metricsHost string, metricsPort int) {
 	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", healthz)
 	http.ListenAndServe(fmt.Sprintf("%s:%d", metricsHost, metricsPort), nil)
 }
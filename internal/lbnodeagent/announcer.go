@@ -30,6 +30,6 @@ type Announcer interface {
 	SetClient(*k8s.Client)
 	SetBalancer(*v1.Service, *v1.Endpoints) error
 	DeleteBalancer(string, string, net.IP) error
-	SetElection(*election.Election)
+	SetElection(election.Elector)
 	Shutdown()
 }
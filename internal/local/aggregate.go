@@ -0,0 +1,90 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// aggregateRefs tracks which service addresses are using each
+// aggregate in "announce aggregate only" mode, so we can add the
+// aggregate to the virtual interface when the first address needs it
+// and remove it when the last address goes away. It's a map from the
+// aggregate (in CIDR notation) to the set of addresses that use it.
+type aggregateRefs map[string]map[string]bool
+
+// hold records that lbIP uses aggr. It returns true if lbIP is the
+// first address to use aggr, i.e., the caller needs to add aggr to the
+// interface.
+func (r aggregateRefs) hold(aggr net.IPNet, lbIP net.IP) bool {
+	key := aggr.String()
+	first := len(r[key]) == 0
+	if r[key] == nil {
+		r[key] = map[string]bool{}
+	}
+	r[key][lbIP.String()] = true
+	return first
+}
+
+// release records that lbIP no longer uses any aggregate. It returns
+// the aggregates that no longer have any users, i.e., the ones that
+// the caller needs to remove from the interface.
+func (r aggregateRefs) release(lbIP net.IP) []net.IPNet {
+	unused := []net.IPNet{}
+
+	for key, addrs := range r {
+		if !addrs[lbIP.String()] {
+			continue
+		}
+		delete(addrs, lbIP.String())
+		if len(addrs) == 0 {
+			delete(r, key)
+			if _, aggr, err := net.ParseCIDR(key); err == nil {
+				unused = append(unused, *aggr)
+			}
+		}
+	}
+
+	return unused
+}
+
+// aggregateNet returns the aggregate network that contains lbIP. Its
+// mask is the subnet's mask if aggregation is "default", or the
+// aggregation (e.g., "/24") if not.
+func aggregateNet(lbIP net.IP, subnet string, aggregation string) (net.IPNet, error) {
+	_, subnetNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return net.IPNet{}, err
+	}
+	mask := subnetNet.Mask
+
+	if aggregation != "default" {
+		_, bits := mask.Size()
+		prefixLen, err := strconv.Atoi(strings.TrimPrefix(aggregation, "/"))
+		if err != nil || prefixLen < 0 || prefixLen > bits {
+			return net.IPNet{}, fmt.Errorf("invalid aggregation %q", aggregation)
+		}
+		mask = net.CIDRMask(prefixLen, bits)
+	}
+
+	ip := lbIP.Mask(mask)
+	if ip == nil {
+		return net.IPNet{}, fmt.Errorf("address %s doesn't match subnet %s", lbIP, subnet)
+	}
+	return net.IPNet{IP: ip, Mask: mask}, nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"net"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	purelbv1 "purelb.io/pkg/apis/v1"
+)
+
+func TestAggregateNet(t *testing.T) {
+	aggr, err := aggregateNet(net.ParseIP("10.42.42.17"), "10.42.0.0/16", "default")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.42.0.0/16", aggr.String())
+
+	aggr, err = aggregateNet(net.ParseIP("10.42.42.17"), "10.42.0.0/16", "/24")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.42.42.0/24", aggr.String())
+
+	aggr, err = aggregateNet(net.ParseIP("2001:db8::17"), "2001:db8::/64", "/120")
+	assert.NoError(t, err)
+	assert.Equal(t, "2001:db8::/120", aggr.String())
+
+	_, err = aggregateNet(net.ParseIP("10.42.42.17"), "10.42.0.0/16", "/33")
+	assert.Error(t, err)
+}
+
+func TestAggregateRefs(t *testing.T) {
+	refs := aggregateRefs{}
+	_, aggr1, _ := net.ParseCIDR("10.42.42.0/24")
+	_, aggr2, _ := net.ParseCIDR("10.42.43.0/24")
+	ip1 := net.ParseIP("10.42.42.1")
+	ip2 := net.ParseIP("10.42.42.2")
+	ip3 := net.ParseIP("10.42.43.1")
+
+	// The first address that uses an aggregate adds it
+	assert.True(t, refs.hold(*aggr1, ip1))
+	assert.False(t, refs.hold(*aggr1, ip2))
+	assert.True(t, refs.hold(*aggr2, ip3))
+
+	// Announcing an address again doesn't add the aggregate again
+	assert.False(t, refs.hold(*aggr1, ip1))
+
+	// The aggregate stays as long as any address uses it
+	assert.Empty(t, refs.release(ip1))
+	assert.Equal(t, []net.IPNet{*aggr1}, refs.release(ip2))
+	assert.Equal(t, []net.IPNet{*aggr2}, refs.release(ip3))
+
+	// Releasing an unknown address does nothing
+	assert.Empty(t, refs.release(ip1))
+	assert.Empty(t, refs)
+}
+
+func TestAnnounceAggregateOnly(t *testing.T) {
+	a := &announcer{
+		client:       &testK8S{t: t},
+		logger:       log.NewNopLogger(),
+		myNode:       "test-node",
+		config:       &purelbv1.LBNodeAgentLocalSpec{},
+		svcIngresses: map[string][]v1.LoadBalancerIngress{},
+		dummyInt:     missingLink(),
+		aggregates:   aggregateRefs{},
+		groups: map[string]*purelbv1.ServiceGroupLocalSpec{
+			"aggr": {
+				V4Pools: []*purelbv1.ServiceGroupAddressPool{{
+					Pool:                  "10.42.42.0/24",
+					Subnet:                "10.42.0.0/16",
+					Aggregation:           "/24",
+					AnnounceAggregateOnly: true,
+				}},
+			},
+		},
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test",
+			Name:        "aggr",
+			Annotations: map[string]string{purelbv1.PoolAnnotation: "aggr"},
+		},
+	}
+
+	// We try to add the aggregate, not the service address. The add
+	// fails because the dummy interface doesn't exist so the aggregate
+	// isn't held.
+	err := a.announceRemote(svc, &v1.Endpoints{}, a.dummyInt, net.ParseIP("10.42.42.1"))
+	assert.ErrorContains(t, err, "10.42.42.0/24")
+	assert.Empty(t, a.aggregates)
+
+	// If the aggregate is already there then we don't need to touch
+	// the interface
+	_, aggr, _ := net.ParseCIDR("10.42.42.0/24")
+	a.aggregates.hold(*aggr, net.ParseIP("10.42.42.1"))
+	assert.NoError(t, a.announceRemote(svc, &v1.Endpoints{}, a.dummyInt, net.ParseIP("10.42.42.2")))
+	assert.Len(t, a.aggregates["10.42.42.0/24"], 2)
+
+	// Withdrawing the addresses releases the aggregate
+	assert.NoError(t, a.deleteAddress("test/aggr", "test", net.ParseIP("10.42.42.1")))
+	assert.Len(t, a.aggregates["10.42.42.0/24"], 1)
+	assert.NoError(t, a.deleteAddress("test/aggr", "test", net.ParseIP("10.42.42.2")))
+	assert.Empty(t, a.aggregates)
+}
@@ -18,6 +18,10 @@ import (
 	"fmt"
 	"net"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
 
@@ -29,6 +33,7 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
 )
 
 type announcer struct {
@@ -37,7 +42,7 @@ type announcer struct {
 	myNode   string
 	config   *purelbv1.LBNodeAgentLocalSpec
 	groups   map[string]*purelbv1.ServiceGroupLocalSpec // groupName -> ServiceGroupLocalSpec
-	election *election.Election
+	election elector
 	dummyInt netlink.Link // for non-local announcements
 
 	// svcIngresses is a map from svcName to that Service's
@@ -47,16 +52,134 @@ type announcer struct {
 	// up if the Service is deleted.
 	svcIngresses map[string][]v1.LoadBalancerIngress
 
-	// localNameRegex is the pattern that we use to determine if an
+	// localNameRegexes are the patterns that we use to determine if an
 	// interface is local or not.
-	localNameRegex *regexp.Regexp
+	localNameRegexes []*regexp.Regexp
+
+	// localSubnet, if it's non-nil, selects local interfaces by address
+	// instead: an interface is local if it has an address in
+	// localSubnet.
+	localSubnet *net.IPNet
+
+	// sysctls reads and writes kernel parameters. strictARPAddrs is the
+	// set of IPv4 addresses that we've announced locally while the
+	// StrictARP option was enabled, and savedARPParams holds the values
+	// that the ARP sysctls had before we changed them (or nil if we
+	// haven't changed them).
+	sysctls        sysctl
+	strictARPAddrs map[string]bool
+	savedARPParams map[string]string
+
+	// arpQuiets holds the timers that end the quiet periods that we
+	// start when we lose elections, keyed by arpQuietKey(). arpLock
+	// protects it and the strict ARP state above since the timers
+	// change that state from their own goroutines.
+	arpQuiets map[string]*time.Timer
+	arpLock   sync.Mutex
+
+	// aggregates tracks the aggregates that we've added to the dummy
+	// interface for pools that announce only their aggregates.
+	aggregates aggregateRefs
+
+	// garpRetries holds the GARP retries that we've started, keyed by
+	// address.
+	garpRetries map[string]*garpRetry
+
+	// garpRefreshes holds the periodic GARPs that we send for
+	// addresses whose pools have a GARPInterval, keyed by address.
+	garpRefreshes map[string]*garpRefresh
+
+	// bonds resends GARPs for the addresses that we announce on bonded
+	// interfaces when the bonds fail over.
+	bonds *bondWatch
+
+	// vipLinks creates and removes the per-address macvlans that we
+	// use if the VIPMacvlan option is enabled.
+	vipLinks vipLinkBackend
+
+	// dummies creates the dummy interface and moves our addresses to
+	// a new one if the user renames it.
+	dummies dummyBackend
+
+	// addrs lets us check whether an address is already on one of
+	// the host's interfaces before we add it.
+	addrs addrBackend
+
+	// checker checks that local addresses work after we add them, if
+	// the VerifyAddress option is enabled.
+	checker addrChecker
+
+	// pods tells us whether our companion pod is ready, if the
+	// CompanionSelector option is set.
+	pods podChecker
+
+	// agentNamespace is the namespace of the LBNodeAgent from which
+	// config came.
+	agentNamespace string
+
+	// routes adds and removes the policy rules and routes that send
+	// replies from addresses in pools with a NextHop to that next hop.
+	// nextHops tracks what we've added, keyed by address.
+	routes   routeBackend
+	nextHops map[string]nextHopRoute
+
+	// links lets us check whether the announcement interface is up
+	// when we start. interfacePoll is how often we check (0 means
+	// the default) and configured is true once we've had our first
+	// configuration, after which we don't wait anymore.
+	links         linkBackend
+	interfacePoll time.Duration
+	configured    bool
+
+	// webhook tells an external system when we announce and withdraw
+	// addresses, if the user configured one. notified is the set of
+	// addresses (keyed by service and address) that we've told it
+	// we're announcing.
+	webhook  *webhook
+	notified map[string]bool
+
+	// allowedPools is the set of ServiceGroups whose addresses we
+	// announce. If it's nil then we announce addresses from every
+	// group.
+	allowedPools map[string]bool
+}
+
+// elector runs the elections that decide which node announces each
+// local address. Any election.Elector is an elector.
+type elector interface {
+	Winner(key string) string
+	NumMembers() int
 }
 
 var announcing = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 	Namespace: purelbv1.MetricsNamespace,
 	Subsystem: "lbnodeagent",
 	Name:      "announced",
-	Help:      "Services announced from this node",
+	Help:      "Services announced from this node. winner is \"true\" for local addresses, whose election this node won. Nodes that lose an election don't export a series for the address. Remote addresses are announced by every node so their winner is \"none\".",
+}, []string{
+	"service",
+	"node",
+	"ip",
+	"winner",
+})
+
+// Values of the announcing gauge's winner label.
+const (
+	electionWon = "true"
+	noElection  = "none"
+)
+
+// electionResults are the possible values of the announcing gauge's
+// winner label.
+var electionResults = []string{electionWon, noElection}
+
+// addressAddErrors counts failures per address. An address's series
+// is deleted when the address is withdrawn.
+var addressAddErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: purelbv1.MetricsNamespace,
+	Subsystem: "lbnodeagent",
+	Name:      "address_add_errors_total",
+	Help:      "Failures adding service addresses to this node's interfaces",
 }, []string{
 	"service",
 	"node",
@@ -65,16 +188,47 @@ var announcing = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 
 func init() {
 	prometheus.MustRegister(announcing)
+	prometheus.MustRegister(addressAddErrors)
 }
 
-// NewAnnouncer returns a new local Announcer.
-func NewAnnouncer(l log.Logger, node string) lbnodeagent.Announcer {
-	return &announcer{logger: l, myNode: node, svcIngresses: map[string][]v1.LoadBalancerIngress{}}
+// NewAnnouncer returns a new local Announcer. If allowedPools isn't
+// empty then the announcer announces only addresses from the
+// ServiceGroups that it names.
+func NewAnnouncer(l log.Logger, node string, allowedPools []string) lbnodeagent.Announcer {
+	var allowed map[string]bool
+	if len(allowedPools) > 0 {
+		allowed = map[string]bool{}
+		for _, pool := range allowedPools {
+			allowed[pool] = true
+		}
+	}
+
+	return &announcer{
+		allowedPools:   allowed,
+		logger:         l,
+		myNode:         node,
+		svcIngresses:   map[string][]v1.LoadBalancerIngress{},
+		sysctls:        procSysctl{},
+		strictARPAddrs: map[string]bool{},
+		arpQuiets:      map[string]*time.Timer{},
+		aggregates:     aggregateRefs{},
+		garpRetries:    map[string]*garpRetry{},
+		garpRefreshes:  map[string]*garpRefresh{},
+		bonds:          newBondWatch(l, netlink.LinkSubscribe),
+		vipLinks:       hostVIPLinks{},
+		dummies:        hostDummies{},
+		addrs:          hostAddrs{},
+		checker:        hostAddrChecker{},
+		routes:         hostRoutes{},
+		nextHops:       map[string]nextHopRoute{},
+		links:          hostLinks{},
+	}
 }
 
 // SetClient configures this announcer to use the provided client.
 func (a *announcer) SetClient(client *k8s.Client) {
 	a.client = client
+	a.pods = client
 }
 
 func (a *announcer) SetConfig(cfg *purelbv1.Config) error {
@@ -95,29 +249,88 @@ func (a *announcer) SetConfig(cfg *purelbv1.Config) error {
 				}
 			}
 
-			// if the user specified an interface regex then we'll compile
-			// that now, and use it (when we get an address) to find a local
-			// interface
-			if spec.LocalInterface != "default" {
-				if regex, err := regexp.Compile(spec.LocalInterface); err != nil {
-					return fmt.Errorf("error compiling regex \"%s\": %s", spec.LocalInterface, err.Error())
-				} else {
-					a.localNameRegex = regex
+			// let the user know if we've been told to announce pools that
+			// don't exist, since it's probably a typo
+			for pool := range a.allowedPools {
+				if _, exists := a.groups[pool]; !exists {
+					a.logger.Log("op", "setConfig", "error", "allowed pool not found", "pool", pool)
+				}
+			}
+
+			// if the user specified interface regexes then we'll compile
+			// them now, and use them (when we get an address) to find a
+			// local interface. The user can provide a comma-separated list
+			// of regexes which we try in order. Instead of regexes the user
+			// can provide a subnet, which selects the interface that has an
+			// address in it.
+			a.localSubnet = nil
+			if strings.HasPrefix(spec.LocalInterface, localSubnetPrefix) {
+				cidr := strings.TrimSpace(strings.TrimPrefix(spec.LocalInterface, localSubnetPrefix))
+				_, subnet, err := net.ParseCIDR(cidr)
+				if err != nil {
+					return fmt.Errorf("error parsing subnet \"%s\": %s", cidr, err.Error())
+				}
+				a.localSubnet = subnet
+				a.localNameRegexes = nil
+			} else if spec.LocalInterface != "default" {
+				a.localNameRegexes = []*regexp.Regexp{}
+				for _, pattern := range strings.Split(spec.LocalInterface, ",") {
+					pattern = strings.TrimSpace(pattern)
+					if regex, err := regexp.Compile(pattern); err != nil {
+						return fmt.Errorf("error compiling regex \"%s\": %s", pattern, err.Error())
+					} else {
+						a.localNameRegexes = append(a.localNameRegexes, regex)
+					}
 				}
 			} else {
-				a.localNameRegex = nil
+				a.localNameRegexes = nil
+
+			}
 
+			// If none of our interfaces match the regexes (e.g., because
+			// an interface was renamed) then every address would be
+			// announced remotely, so tell the user.
+			if (a.localNameRegexes != nil || a.localSubnet != nil) && a.addrs != nil {
+				a.checkLocalInterfaces(agent, spec)
+			}
+
+			// If this is our first configuration (e.g., the node just
+			// booted) then give the announcement interface a chance to come
+			// up so our first announcements don't fail.
+			if !a.configured && spec.InterfaceWait.Duration > 0 && a.links != nil {
+				a.logger.Log("op", "setConfig", "msg", "waiting for interface", "timeout", spec.InterfaceWait.Duration)
+				if a.waitForInterface(spec.InterfaceWait.Duration) {
+					a.logger.Log("op", "setConfig", "msg", "interface is up")
+				} else {
+					a.logger.Log("op", "setConfig", "error", "interface not up, announcing anyway", "timeout", spec.InterfaceWait.Duration)
+				}
 			}
+			a.configured = true
 
 			// now that we've got a config we can create the dummy interface
-			var err error
-			if a.dummyInt, err = addDummyInterface(spec.ExtLBInterface); err != nil {
-				return fmt.Errorf("error adding interface \"%s\": %s", spec.ExtLBInterface, err.Error())
+			if err := a.setDummyInterface(spec.ExtLBInterface); err != nil {
+				return err
+			}
+
+			// The configuration might have removed addresses that are on
+			// the dummy interface from our ServiceGroups. If the user
+			// wants us to then we remove them.
+			if spec.ReconcileDummy && a.addrs != nil {
+				a.reconcileDummy()
+			}
+
+			a.setWebhook(spec.WebhookURL)
+
+			// If the user has turned off StrictARP then undo any changes
+			// that we made to the ARP sysctls.
+			if !spec.StrictARP {
+				a.restoreARPParams()
 			}
 
 			// The dummy interface is set up so we can set the config which
 			// will allow announcements to happen.
 			a.config = spec
+			a.agentNamespace = agent.Namespace
 
 			// we've got our marching orders so we don't need to continue
 			// scanning
@@ -132,6 +345,133 @@ func (a *announcer) SetConfig(cfg *purelbv1.Config) error {
 	return nil
 }
 
+// setDummyInterface ensures that the dummy interface is named name.
+// If the user renamed it (e.g., because the old name conflicted with
+// another tool) then we move the addresses that we announced on the
+// old interface to the new one and remove the old one.
+func (a *announcer) setDummyInterface(name string) error {
+	link, err := a.dummies.AddDummy(name)
+	if err != nil {
+		return fmt.Errorf("error adding interface \"%s\": %s", name, err.Error())
+	}
+	old := a.dummyInt
+	a.dummyInt = link
+	if old == nil || old.Attrs().Name == name {
+		return nil
+	}
+
+	oldName := old.Attrs().Name
+	a.logger.Log("op", "setConfig", "msg", "dummy interface renamed", "old", oldName, "new", name)
+
+	addrs, err := a.dummies.AddrList(old, nl.FAMILY_ALL)
+	if err != nil {
+		a.logger.Log("op", "migrateDummy", "interface", oldName, "error", err)
+	}
+	for _, addr := range addrs {
+		addr := addr
+		if addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		// Labels have to start with the name of their interface
+		if addr.Label != "" {
+			addr.Label = name + strings.TrimPrefix(addr.Label, oldName)
+			if len(addr.Label) > maxLabelLen {
+				addr.Label = ""
+			}
+		}
+
+		if err := a.dummies.AddrAdd(link, &addr); err != nil {
+			a.logger.Log("op", "migrateDummy", "address", addr.IPNet, "interface", name, "error", err)
+			continue
+		}
+		a.logger.Log("op", "migrateDummy", "address", addr.IPNet, "from", oldName, "to", name)
+	}
+
+	// The old interface might have been one that the user created for
+	// us, but if it's not a dummy then it's not ours to remove.
+	if old.Type() == "dummy" {
+		if err := a.dummies.LinkDel(old); err != nil {
+			a.logger.Log("op", "migrateDummy", "interface", oldName, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// checkLocalInterfaces warns the user if none of the host's
+// interfaces match the LocalInterface regexes or subnet. If the user
+// wants us to, we fall back to the default interface.
+func (a *announcer) checkLocalInterfaces(agent *purelbv1.LBNodeAgent, spec *purelbv1.LBNodeAgentLocalSpec) {
+	links, err := a.addrs.LinkList()
+	if err != nil {
+		a.logger.Log("op", "checkLocalInterfaces", "error", err)
+		return
+	}
+
+	names := []string{}
+	for _, link := range links {
+		if a.localSubnet != nil {
+			if addrs, err := a.addrs.AddrList(link, nl.FAMILY_ALL); err == nil && hasAddressIn(addrs, a.localSubnet) {
+				return
+			}
+		} else if matchesAny(a.localNameRegexes, link.Attrs().Name) {
+			return
+		}
+		names = append(names, link.Attrs().Name)
+	}
+
+	if spec.LocalInterfaceFallback {
+		a.logger.Log("op", "setConfig", "error", "no interface matches localint, using the default interface", "localint", spec.LocalInterface, "interfaces", strings.Join(names, ","))
+		a.client.Errorf(agent, "NoLocalInterface", "No interface on node %s matches localint %q (interfaces: %s), using the default interface", a.myNode, spec.LocalInterface, strings.Join(names, ","))
+		a.localNameRegexes = nil
+		a.localSubnet = nil
+		return
+	}
+	a.logger.Log("op", "setConfig", "error", "no interface matches localint, all addresses will be remote", "localint", spec.LocalInterface, "interfaces", strings.Join(names, ","))
+	a.client.Errorf(agent, "NoLocalInterface", "No interface on node %s matches localint %q (interfaces: %s), all addresses will be announced remotely", a.myNode, spec.LocalInterface, strings.Join(names, ","))
+}
+
+// reconcileDummy removes the addresses on the dummy interface that
+// aren't in any of our ServiceGroups' pools. Aggregates are removed
+// if none of the addresses that use them are in a pool. Link-local
+// addresses belong to the kernel so we leave them alone.
+func (a *announcer) reconcileDummy() {
+	addrs, err := a.addrs.AddrList(a.dummyInt, nl.FAMILY_ALL)
+	if err != nil {
+		a.logger.Log("op", "reconcileDummy", "error", err)
+		return
+	}
+
+	for _, addr := range addrs {
+		addr := addr
+		if addr.IP.IsLinkLocalUnicast() || a.dummyAddrCovered(addr.IPNet) {
+			continue
+		}
+		if err := a.addrs.AddrDel(a.dummyInt, &addr); err != nil {
+			a.logger.Log("op", "reconcileDummy", "error", err, "address", addr.IPNet)
+			continue
+		}
+		delete(a.aggregates, addr.IPNet.String())
+		a.logger.Log("op", "reconcileDummy", "address", addr.IPNet, "msg", "removed address that's no longer in a ServiceGroup")
+	}
+}
+
+// dummyAddrCovered returns true if addr belongs on the dummy
+// interface, i.e., it's in one of our pools or it's an aggregate that
+// one of the addresses in our pools uses.
+func (a *announcer) dummyAddrCovered(addr *net.IPNet) bool {
+	if _, pool := a.groupPool(addr.IP); pool != nil {
+		return true
+	}
+	for ipstr := range a.aggregates[addr.String()] {
+		if _, pool := a.groupPool(net.ParseIP(ipstr)); pool != nil {
+			return true
+		}
+	}
+	return false
+}
+
 func (a *announcer) SetBalancer(svc *v1.Service, endpoints *v1.Endpoints) error {
 	// retErr caches an error while we try other operations. Because we
 	// might have more than one interface to announce, if an error
@@ -150,21 +490,67 @@ func (a *announcer) SetBalancer(svc *v1.Service, endpoints *v1.Endpoints) error
 		return nil
 	}
 
-	// add the address to our announcement database
-	a.svcIngresses[nsName] = svc.Status.LoadBalancer.Ingress
+	// Figure out which addresses to announce. If the user asked us to
+	// then we announce the service's externalIPs along with the ones
+	// that we allocated.
+	ingresses := append([]v1.LoadBalancerIngress{}, svc.Status.LoadBalancer.Ingress...)
+	if svc.Annotations[purelbv1.AnnounceExternalIPsAnnotation] == "true" {
+		ingresses = append(ingresses, a.externalIngresses(svc)...)
+	}
 
-	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+	// If the user has told us that someone else manages this service
+	// then we don't announce any of its addresses, and withdraw any
+	// that we announced before the user added the annotation.
+	if svc.Annotations[purelbv1.IgnoreAnnotation] == "true" {
+		l.Log("event", "ignore", "reason", "service has the ignore annotation")
+		ingresses = nil
+	}
+
+	// If we've been told to announce only some pools then ignore
+	// addresses from the others. Other nodes will announce them.
+	if a.allowedPools != nil {
+		ingresses = a.allowedIngresses(svc, ingresses)
+	}
+
+	// Withdraw any addresses that we announced previously but
+	// shouldn't announce anymore, e.g., because the user removed an
+	// externalIP.
+	for _, was := range a.svcIngresses[nsName] {
+		if !hasIngress(ingresses, was.IP) {
+			if wasIP := net.ParseIP(was.IP); wasIP != nil {
+				a.deleteAddress(nsName, "noLongerAnnounced", wasIP)
+			}
+		}
+	}
+
+	// add the addresses to our announcement database
+	if len(ingresses) == 0 {
+		delete(a.svcIngresses, nsName)
+		return nil
+	}
+	a.svcIngresses[nsName] = ingresses
+
+	for _, ingress := range ingresses {
 		// validate the allocated address
 		lbIP := net.ParseIP(ingress.IP)
 		if lbIP == nil {
-			l.Log("op", "setBalancer", "error", "invalid LoadBalancer IP", "ip", svc.Status.LoadBalancer.Ingress[0].IP)
+			l.Log("op", "setBalancer", "error", "invalid LoadBalancer IP", "ip", ingress.IP)
 			continue
 		}
 
-		if a.localNameRegex != nil {
-			// The user specified an announcement interface regex so use it to
-			// try to find a local interface, otherwise announce remote
-			lbIPNet, localif, err := findLocal(a.localNameRegex, lbIP)
+		if svc.Annotations[purelbv1.AnnounceMethodAnnotation] == purelbv1.AnnounceMethodRemote {
+			// The allocator told us that this address comes from a group
+			// that's always announced remotely so we don't need to look for
+			// a local interface.
+			if err := a.announceRemote(svc, endpoints, a.dummyInt, lbIP); err != nil {
+				retErr = err
+			}
+
+		} else if a.localNameRegexes != nil || a.localSubnet != nil {
+			// The user specified an announcement interface regex or subnet
+			// so use it to try to find a local interface, otherwise
+			// announce remote
+			lbIPNet, localif, err := a.localInterface(lbIP)
 			if err == nil {
 				// We found a local interface, announce the address on it
 				if err := a.announceLocal(svc, localif, lbIP, lbIPNet); err != nil {
@@ -231,40 +617,191 @@ func (a *announcer) announceLocal(svc *v1.Service, announceInt netlink.Link, lbI
 		}
 	}
 
-	// See if we won the announcement election
-	if winner := a.election.Winner(lbIP.String()); winner != a.myNode {
+	// See if we won the announcement election. If the service is in
+	// its maintenance window then the node that's announcing the
+	// address keeps it no matter who won.
+	winner := a.election.Winner(lbIP.String())
+	if holder := a.maintenanceHolder(svc, lbIP, time.Now()); holder != "" && holder != winner {
+		l.Log("msg", "maintenanceWindow", "node", a.myNode, "winner", winner, "holder", holder, "service", nsName)
+		winner = holder
+	}
+	if winner != a.myNode {
 		// We lost the election so we'll withdraw any announcement that
 		// we might have been making
-		l.Log("msg", "notWinner", "node", a.myNode, "winner", winner, "service", nsName, "memberCount", a.election.Memberlist.NumMembers())
+		l.Log("msg", "notWinner", "node", a.myNode, "winner", winner, "service", nsName, "memberCount", a.election.NumMembers())
+
+		// If we were announcing the address and the user wants us to,
+		// stop our other interfaces from answering ARP requests for it
+		// for a while. This has to happen before we withdraw the
+		// address so there's no gap.
+		if a.config.LoserQuietPeriod.Duration > 0 && lbIP.To4() != nil && a.wasAnnouncing(svc, lbIP) {
+			if err := a.startARPQuiet(lbIP.String(), a.config.LoserQuietPeriod.Duration); err != nil {
+				l.Log("op", "arpQuiet", "error", err)
+				a.client.Errorf(svc, "StrictARPFailed", "Node %s failed to set ARP sysctls: %s", a.myNode, err)
+			}
+		}
+
 		return a.deleteAddress(nsName, "lostElection", lbIP)
 	}
 
+	// If the address is already on a different interface then
+	// something is misconfigured (e.g., the pool overlaps a node's
+	// addresses). Adding it again would make two interfaces answer
+	// for it, so we refuse and let the user know.
+	extraInts, extraNets := a.extraLocalLinks(announceInt, lbIP)
+	if a.addrs != nil {
+		owner, err := addressOwner(a.addrs, lbIP, append([]netlink.Link{announceInt}, extraInts...)...)
+		if err != nil {
+			l.Log("op", "checkAddress", "error", err, "ip", lbIP)
+		} else if owner != "" {
+			l.Log("op", "addAddress", "error", "address already on another interface", "service", nsName, "ip", lbIP, "interface", owner)
+			a.client.Errorf(svc, "AddressConflict", "Node %s not announcing %s on interface %s: it's already on interface %s", a.myNode, lbIP, announceInt.Attrs().Name, owner)
+			return fmt.Errorf("address %s already on interface %s", lbIP, owner)
+		}
+	}
+
 	// We won the election so we'll add the service address to our
 	// node's default interface so linux will respond to ARP
 	// requests for it.
-	l.Log("msg", "Winner, winner, Chicken dinner", "node", a.myNode, "service", nsName, "memberCount", a.election.Memberlist.NumMembers())
+	l.Log("msg", "Winner, winner, Chicken dinner", "node", a.myNode, "service", nsName, "memberCount", a.election.NumMembers())
 	a.client.Infof(svc, "AnnouncingLocal", "Node %s announcing %s on interface %s", a.myNode, lbIP, announceInt.Attrs().Name)
 
-	addNetwork(lbIPNet, announceInt)
+	lbAddr := a.localAddress(svc, lbIP, lbIPNet)
+
+	// If we're configured to do so, put the address on its own macvlan
+	// so it has its own MAC. The address gets a host mask so the
+	// macvlan doesn't get a route that competes with its parent's.
+	if a.config.VIPMacvlan {
+		vipLink, err := addVIPLink(a.vipLinks, announceInt, lbIP)
+		if err != nil {
+			return a.addFailed(svc, announceInt, lbIP, err)
+		}
+		announceInt = vipLink
+		lbAddr = hostNet(lbIP)
+	}
+
+	a.logAnnouncement(svc, lbIP, "local", announceInt, lbAddr.Mask, a.myNode)
+	if err := addNetwork(lbAddr, announceInt, a.addressLabel(svc, announceInt), a.broadcastFor(svc, lbIP)); err != nil {
+		return a.addFailed(svc, announceInt, lbIP, err)
+	}
+	if pool, err := a.poolFor(svc, lbIP); err == nil {
+		if err := a.nextHopFor(svc, pool, lbIP); err != nil {
+			return err
+		}
+	}
+
+	// If the user wants us to, add the address to the other local
+	// interfaces, too. The first interface already has it so failures
+	// here don't fail the announcement.
+	garpInts := []string{announceInt.Attrs().Name}
+	for i, extraInt := range extraInts {
+		extraAddr := a.localAddress(svc, lbIP, extraNets[i])
+		a.logAnnouncement(svc, lbIP, "local", extraInt, extraAddr.Mask, a.myNode)
+		if err := addNetwork(extraAddr, extraInt, a.addressLabel(svc, extraInt), a.broadcastFor(svc, lbIP)); err != nil {
+			l.Log("op", "addAddress", "error", err, "ip", lbIP, "interface", extraInt.Attrs().Name)
+			a.client.Errorf(svc, "AnnounceFailed", "Node %s failed to add %s to interface %s: %s", a.myNode, lbIP, extraInt.Attrs().Name, err)
+			continue
+		}
+		garpInts = append(garpInts, extraInt.Attrs().Name)
+	}
+
 	if svc.Annotations == nil {
 		svc.Annotations = map[string]string{}
 	}
 	svc.Annotations[purelbv1.AnnounceAnnotation+addrFamilyName(lbIP)] = a.myNode + "," + announceInt.Attrs().Name
-	announcing.With(prometheus.Labels{
-		"service": nsName,
-		"node":    a.myNode,
-		"ip":      lbIP.String(),
-	}).Set(1)
+	a.setAnnouncing(nsName, lbIP, electionWon)
+	a.notify(nsName, lbIP, webhookAnnounce)
+
+	// If we're configured to do so, stop other interfaces from
+	// answering ARP requests for the address.
+	if a.config.StrictARP && lbIP.To4() != nil {
+		if err := a.holdStrictARP(lbIP.String()); err != nil {
+			l.Log("op", "strictARP", "error", err)
+			a.client.Errorf(svc, "StrictARPFailed", "Node %s failed to set ARP sysctls: %s", a.myNode, err)
+		}
+	}
+
+	// If we're configured to do so, broadcast a GARP message (or an
+	// unsolicited Neighbor Advertisement for IPv6) to say that we own
+	// the address.
+	if a.sendsGARP(purelbv1.AddrFamily(lbIP)) {
+		send := garpSender(lbIP, garpInts...)
+		if err := send(); err != nil {
+			return err
+		}
+
+		// If the user wants us to, keep sending them for a while in
+		// case the network misses the first ones.
+		if a.config.GARPDuration.Duration > 0 {
+			a.startGARPRetry(lbIP.String(), send, a.config.GARPDuration.Duration)
+		}
 
-	// If we're configured to do so, broadcast a GARP message to say
-	// that we own the address.
-	if a.config.SendGratuitousARP {
-		return sendGARP(announceInt.Attrs().Name, lbIP)
+		// If the interface is a bond then it can fail over to a port
+		// that the network doesn't associate with the address, so
+		// tell the network again when that happens.
+		if a.bonds != nil {
+			a.bonds.add(announceInt, lbIP.String(), send)
+		}
+	}
+
+	// If the address's pool wants us to, keep sending GARPs for as
+	// long as we announce the address.
+	if interval := a.garpInterval(svc, lbIP); interval > 0 {
+		a.startGARPRefresh(lbIP.String(), garpSender(lbIP, garpInts...), interval)
+	} else {
+		a.stopGARPRefresh(lbIP.String())
+	}
+
+	// If we're configured to do so, check that the address works.
+	if a.config.VerifyAddress {
+		a.verifyAddress(svc, announceInt, lbIP)
 	}
 
 	return nil
 }
 
+// localInterface finds the local interface for lbIP using the
+// LocalInterface regexes or subnet. If error is non-nil then no local
+// interface was found.
+func (a *announcer) localInterface(lbIP net.IP) (net.IPNet, netlink.Link, error) {
+	if a.localSubnet != nil {
+		if a.addrs == nil {
+			return net.IPNet{}, nil, fmt.Errorf("No local interface found")
+		}
+		return findLocalBySubnet(a.addrs, a.localSubnet, lbIP)
+	}
+	return findLocal(a.localNameRegexes, lbIP)
+}
+
+// extraLocalLinks returns the local interfaces other than announceInt
+// to which we add lbIP if the AnnounceOnAllMatching option is set,
+// along with lbIP with each interface's subnet mask. Each address
+// has only one macvlan so the option doesn't work with VIPMacvlan.
+func (a *announcer) extraLocalLinks(announceInt netlink.Link, lbIP net.IP) ([]netlink.Link, []net.IPNet) {
+	if !a.config.AnnounceOnAllMatching || a.config.VIPMacvlan || a.localNameRegexes == nil || a.addrs == nil {
+		return nil, nil
+	}
+
+	links, nets, err := otherLocalLinks(a.addrs, a.localNameRegexes, lbIP, announceInt)
+	if err != nil {
+		a.logger.Log("op", "findLocal", "ip", lbIP, "error", err)
+		return nil, nil
+	}
+	return links, nets
+}
+
+// verifyAddress checks that lbIP, which we've just added to intf,
+// works. If it doesn't then we warn the user, but we don't withdraw
+// the announcement since the check might be wrong.
+func (a *announcer) verifyAddress(svc *v1.Service, intf netlink.Link, lbIP net.IP) bool {
+	if err := a.checker.Check(intf, lbIP); err != nil {
+		a.logger.Log("op", "verifyAddress", "error", err, "service", svc.Namespace+"/"+svc.Name, "ip", lbIP, "interface", intf.Attrs().Name)
+		a.client.Errorf(svc, "AddressUnreachable", "Node %s announced %s on interface %s but it doesn't seem to work: %s", a.myNode, lbIP, intf.Attrs().Name, err)
+		return false
+	}
+	return true
+}
+
 func (a *announcer) announceRemote(svc *v1.Service, endpoints *v1.Endpoints, announceInt netlink.Link, lbIP net.IP) error {
 	l := log.With(a.logger, "service", svc.Name)
 	nsName := svc.Namespace + "/" + svc.Name
@@ -275,44 +812,357 @@ func (a *announcer) announceRemote(svc *v1.Service, endpoints *v1.Endpoints, ann
 	// Should we announce?
 	// No, if externalTrafficPolicy is Local && there's no ready local endpoint
 	// Yes, in all other cases
-	if svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal && !nodeHasHealthyEndpoint(endpoints, a.myNode) {
+	if svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal && !nodeHasHealthyEndpoint(endpoints, a.myNode, svc.Spec.PublishNotReadyAddresses) {
 		l.Log("msg", "policyLocalNoEndpoints", "node", a.myNode, "service", nsName)
 		return a.deleteAddress(nsName, "noEndpoints", lbIP)
 	}
 
+	// If the routing software that announces the address isn't ready
+	// then we don't add the address yet, or we withdraw it. The k8s
+	// client reprocesses all services when the companion's readiness
+	// changes. If we can't tell whether it's ready then we leave the
+	// address alone and retry.
+	ready, err := a.companionReady()
+	if err != nil {
+		l.Log("msg", "companionUnknown", "node", a.myNode, "service", nsName, "error", err)
+		return err
+	}
+	if !ready {
+		l.Log("msg", "companionNotReady", "node", a.myNode, "service", nsName, "companion", a.config.CompanionSelector)
+		return a.deleteAddress(nsName, "companionNotReady", lbIP)
+	}
+
+	// Find the pool to which this address belongs, which gives us
+	// the subnet and aggregation that we need.
+	pool, err := a.poolFor(svc, lbIP)
+	if err != nil {
+		return err
+	}
+
+	// The service can override the pool's aggregation.
+	aggregation, err := serviceAggregation(svc, pool, lbIP)
+	if err != nil {
+		a.client.Errorf(svc, "InvalidAggregation", "%s", err)
+		return err
+	}
+
 	// add this address to the "dummy" interface so routing software
 	// (e.g., bird) will announce routes for it
-	poolName, gotName := svc.Annotations[purelbv1.PoolAnnotation]
-	if gotName {
-		allocPool := a.groups[poolName]
-		l.Log("msg", "announcingNonLocal", "node", a.myNode, "service", nsName)
-		a.client.Infof(svc, "AnnouncingNonLocal", "Announcing %s from node %s interface %s", lbIP, a.myNode, a.dummyInt.Attrs().Name)
-
-		// Find the pool from which this address was allocated, which
-		// gives us the subnet and aggregation that we need.
-		pool, err := allocPool.PoolForAddress(lbIP)
-		if err != nil {
-			return err
+	l.Log("msg", "announcingNonLocal", "node", a.myNode, "service", nsName)
+	a.client.Infof(svc, "AnnouncingNonLocal", "Announcing %s from node %s interface %s", lbIP, a.myNode, a.dummyInt.Attrs().Name)
+
+	// Add the address to the dummy interface.
+	var mask net.IPMask
+	if aggr, err := aggregateNet(lbIP, pool.Subnet, aggregation); err == nil {
+		mask = aggr.Mask
+	}
+	a.logAnnouncement(svc, lbIP, "remote", a.dummyInt, mask, "all")
+	if pool.AnnounceAggregateOnly {
+		err = a.addAggregate(lbIP, pool.Subnet, aggregation)
+	} else {
+		err = addVirtualInt(lbIP, a.dummyInt, pool.Subnet, aggregation, a.addressLabel(svc, a.dummyInt))
+	}
+	if err != nil {
+		return a.addFailed(svc, a.dummyInt, lbIP, err)
+	}
+	if err := a.nextHopFor(svc, pool, lbIP); err != nil {
+		return err
+	}
+
+	a.setAnnouncing(nsName, lbIP, noElection)
+	a.notify(nsName, lbIP, webhookAnnounce)
+
+	return nil
+}
+
+// companionReady returns true if we don't have a CompanionSelector,
+// or if one of the pods that it selects on our node is ready, and
+// false if none is. If error is non-nil then we couldn't tell.
+func (a *announcer) companionReady() (bool, error) {
+	if a.config == nil || a.config.CompanionSelector == "" {
+		return true, nil
+	}
+
+	namespace := a.config.CompanionNamespace
+	if namespace == "" {
+		namespace = a.agentNamespace
+	}
+	ready, err := a.pods.NodePodReady(namespace, a.config.CompanionSelector, a.myNode)
+	if err != nil {
+		return false, fmt.Errorf("checking companion %q: %w", a.config.CompanionSelector, err)
+	}
+	return ready, nil
+}
+
+// setAnnouncing updates the announcing gauge to show that we're
+// announcing lbIP, and the result of its election, i.e., electionWon
+// or noElection. Each address has only one series, on the node that
+// announces it, so a change in the result replaces the old series
+// instead of adding to the gauge's cardinality. Losing an election
+// deletes the series (see deleteAddress).
+func (a *announcer) setAnnouncing(nsName string, lbIP net.IP, result string) {
+	labels := prometheus.Labels{
+		"service": nsName,
+		"node":    a.myNode,
+		"ip":      lbIP.String(),
+	}
+	for _, other := range electionResults {
+		if other != result {
+			labels["winner"] = other
+			announcing.Delete(labels)
 		}
+	}
+
+	labels["winner"] = result
+	announcing.With(labels).Set(1)
+}
+
+// wasAnnouncing returns true if svc's announcement annotation says
+// that we were announcing lbIP's family.
+func (a *announcer) wasAnnouncing(svc *v1.Service, lbIP net.IP) bool {
+	return announcingNode(svc, lbIP) == a.myNode
+}
+
+// announcingNode returns the node that svc's announcement annotation
+// says is announcing lbIP's family, or "" if there isn't one.
+func announcingNode(svc *v1.Service, lbIP net.IP) string {
+	announcer := svc.Annotations[purelbv1.AnnounceAnnotation+addrFamilyName(lbIP)]
+	return strings.SplitN(announcer, ",", 2)[0]
+}
 
-		// Add the address to the dummy interface.
-		l.Log("msg", "subnet", "node", a.myNode, "service", nsName, "pool", pool)
-		if err := addVirtualInt(lbIP, a.dummyInt, pool.Subnet, pool.Aggregation); err != nil {
+// nextHopFor sets up lbIP's return path via pool's next hop, if it
+// has one, and tells the user if that fails.
+func (a *announcer) nextHopFor(svc *v1.Service, pool *purelbv1.ServiceGroupAddressPool, lbIP net.IP) error {
+	if err := a.addNextHop(pool, lbIP); err != nil {
+		a.logger.Log("op", "addNextHop", "error", err, "service", svc.Namespace+"/"+svc.Name, "ip", lbIP)
+		a.client.Errorf(svc, "NextHopFailed", "Node %s failed to add return route for %s: %s", a.myNode, lbIP, err)
+		return err
+	}
+	return nil
+}
+
+// logAnnouncement logs one line that summarizes how we're announcing
+// lbIP: whether it's local or remote, on which interface, with which
+// mask, and who won the election ("all" for remote addresses since
+// every node announces them).
+func (a *announcer) logAnnouncement(svc *v1.Service, lbIP net.IP, method string, intf netlink.Link, mask net.IPMask, winner string) {
+	maskLen := "unknown"
+	if ones, bits := mask.Size(); bits > 0 {
+		maskLen = "/" + strconv.Itoa(ones)
+	}
+
+	a.logger.Log("op", "announce", "service", svc.Namespace+"/"+svc.Name, "ip", lbIP, "family", strings.TrimPrefix(addrFamilyName(lbIP), "-"), "method", method, "interface", intf.Attrs().Name, "mask", maskLen, "winner", winner)
+}
+
+// addressLabel returns the label for svc's address on link, or "" if
+// we're not configured to label addresses.
+func (a *announcer) addressLabel(svc *v1.Service, link netlink.Link) string {
+	if a.config == nil || !a.config.AddressLabels {
+		return ""
+	}
+	return addressLabel(link, svc.Name)
+}
+
+// addAggregate ensures that the aggregate that contains lbIP is on
+// the dummy interface. lbIP itself isn't added, so routing software
+// announces only the aggregate.
+func (a *announcer) addAggregate(lbIP net.IP, subnet string, aggregation string) error {
+	aggr, err := aggregateNet(lbIP, subnet, aggregation)
+	if err != nil {
+		return err
+	}
+
+	if a.aggregates == nil {
+		a.aggregates = aggregateRefs{}
+	}
+	if a.aggregates.hold(aggr, lbIP) {
+		if err := addNetwork(aggr, a.dummyInt, "", nil); err != nil {
+			a.aggregates.release(lbIP)
 			return err
 		}
-
-		announcing.With(prometheus.Labels{
-			"service": nsName,
-			"node":    a.myNode,
-			"ip":      lbIP.String(),
-		}).Set(1)
-	} else {
-		return fmt.Errorf("PoolAnnotation missing from service %s", nsName)
+		a.logger.Log("op", "addAggregate", "aggregate", aggr.String(), "ip", lbIP)
 	}
 
 	return nil
 }
 
+// localAddress returns the address that we add to a local interface
+// to announce lbIP. lbIPNet is lbIP with the interface's subnet mask,
+// which we use unless lbIP's pool asks for a host mask.
+func (a *announcer) localAddress(svc *v1.Service, lbIP net.IP, lbIPNet net.IPNet) net.IPNet {
+	pool, err := a.poolFor(svc, lbIP)
+	if err != nil || !pool.HostMask {
+		return lbIPNet
+	}
+	return hostNet(lbIPNet.IP)
+}
+
+// broadcastFor returns the broadcast address that lbIP should have
+// on a local interface, or nil if the kernel should compute it.
+func (a *announcer) broadcastFor(svc *v1.Service, lbIP net.IP) net.IP {
+	pool, err := a.poolFor(svc, lbIP)
+	if err != nil {
+		return nil
+	}
+	broadcast, err := pool.ParseBroadcast()
+	if err != nil {
+		a.logger.Log("op", "broadcastFor", "error", err, "ip", lbIP)
+		return nil
+	}
+	return broadcast
+}
+
+// hostNet returns lbIP with a host mask, i.e., /32 or /128.
+func hostNet(lbIP net.IP) net.IPNet {
+	bits := 8 * net.IPv6len
+	if lbIP.To4() != nil {
+		bits = 8 * net.IPv4len
+	}
+	return net.IPNet{IP: lbIP, Mask: net.CIDRMask(bits, bits)}
+}
+
+// poolFor returns the address pool to which lbIP belongs. If we
+// allocated the address then the service's PoolAnnotation tells us
+// which ServiceGroup to use. If not (e.g., it's an externalIP) then
+// we search all of the ServiceGroups for a pool that contains lbIP.
+func (a *announcer) poolFor(svc *v1.Service, lbIP net.IP) (*purelbv1.ServiceGroupAddressPool, error) {
+	nsName := svc.Namespace + "/" + svc.Name
+
+	if poolName, gotName := svc.Annotations[purelbv1.PoolAnnotation]; gotName {
+		allocPool, known := a.groups[poolName]
+		if !known {
+			return nil, fmt.Errorf("service %s allocated from unknown ServiceGroup %s", nsName, poolName)
+		}
+		return allocPool.PoolForAddress(lbIP)
+	}
+
+	if _, pool := a.groupPool(lbIP); pool != nil {
+		return pool, nil
+	}
+
+	return nil, fmt.Errorf("PoolAnnotation missing from service %s and no ServiceGroup contains %s", nsName, lbIP)
+}
+
+// serviceAggregation returns the aggregation to use when announcing
+// lbIP. If svc has an AggregationAnnotation then we use the first of
+// its values that's valid for lbIP's pool, i.e., no shorter than the
+// pool's subnet mask and no longer than a host address. If svc has no
+// annotation then we use the pool's aggregation.
+func serviceAggregation(svc *v1.Service, pool *purelbv1.ServiceGroupAddressPool, lbIP net.IP) (string, error) {
+	rawAggrs, has := svc.Annotations[purelbv1.AggregationAnnotation]
+	if !has {
+		return pool.Aggregation, nil
+	}
+
+	_, subnet, err := net.ParseCIDR(pool.Subnet)
+	if err != nil {
+		return "", err
+	}
+	minLen, maxLen := subnet.Mask.Size()
+
+	for _, aggr := range strings.Split(rawAggrs, ",") {
+		aggr = strings.TrimSpace(aggr)
+		if aggr == "default" {
+			return aggr, nil
+		}
+		if !strings.HasPrefix(aggr, "/") {
+			continue
+		}
+		prefixLen, err := strconv.Atoi(aggr[1:])
+		if err != nil {
+			continue
+		}
+		if prefixLen >= minLen && prefixLen <= maxLen {
+			return aggr, nil
+		}
+	}
+
+	return "", fmt.Errorf("aggregation %q is not valid for %s: must be between /%d and /%d", rawAggrs, lbIP, minLen, maxLen)
+}
+
+// allowedIngresses returns those of ingresses whose addresses come
+// from ServiceGroups that we're allowed to announce.
+func (a *announcer) allowedIngresses(svc *v1.Service, ingresses []v1.LoadBalancerIngress) []v1.LoadBalancerIngress {
+	allowed := []v1.LoadBalancerIngress{}
+
+	for _, ingress := range ingresses {
+		poolName := svc.Annotations[purelbv1.PoolAnnotation]
+		// The annotation can't tell us which pool the address came
+		// from if the service doesn't have one (e.g., externalIPs), or
+		// if it lists more than one.
+		if lbIP := net.ParseIP(ingress.IP); lbIP != nil && (poolName == "" || strings.Contains(poolName, ",")) {
+			poolName, _ = a.groupPool(lbIP)
+		}
+		if !a.allowedPools[poolName] {
+			a.logger.Log("op", "setBalancer", "msg", "pool not allowed on this node", "service", svc.Namespace+"/"+svc.Name, "ip", ingress.IP, "pool", poolName)
+			continue
+		}
+		allowed = append(allowed, ingress)
+	}
+
+	return allowed
+}
+
+// groupPool returns the name of the ServiceGroup and the address pool
+// that contain lbIP, or nil if none of our ServiceGroups contain it.
+func (a *announcer) groupPool(lbIP net.IP) (string, *purelbv1.ServiceGroupAddressPool) {
+	for name, group := range a.groups {
+		pool, err := group.PoolForAddress(lbIP)
+		if err != nil {
+			continue
+		}
+		// PoolForAddress falls back to the legacy top-level pool without
+		// checking it, so we need to check containment ourselves.
+		if pool.Contains(lbIP) {
+			return name, pool
+		}
+	}
+	return "", nil
+}
+
+// externalIngresses returns those of svc's externalIPs that belong to
+// one of our ServiceGroups. They're formatted as LoadBalancerIngresses
+// so we can announce and withdraw them the same way that we handle
+// the addresses that we allocate.
+func (a *announcer) externalIngresses(svc *v1.Service) []v1.LoadBalancerIngress {
+	ingresses := []v1.LoadBalancerIngress{}
+
+	for _, rawIP := range svc.Spec.ExternalIPs {
+		extIP := net.ParseIP(rawIP)
+		if extIP == nil {
+			a.logger.Log("op", "setBalancer", "error", "invalid externalIP", "service", svc.Namespace+"/"+svc.Name, "ip", rawIP)
+			continue
+		}
+		if _, pool := a.groupPool(extIP); pool == nil {
+			a.logger.Log("op", "setBalancer", "msg", "externalIP not in any ServiceGroup, ignoring", "service", svc.Namespace+"/"+svc.Name, "ip", rawIP)
+			continue
+		}
+		if !hasIngress(ingresses, extIP.String()) && !hasIngress(svc.Status.LoadBalancer.Ingress, extIP.String()) {
+			ingresses = append(ingresses, v1.LoadBalancerIngress{IP: extIP.String()})
+		}
+	}
+
+	return ingresses
+}
+
+// addFailed records a failure to add lbIP to intf, both as a metric
+// and as an event on the service, so an address that's missing from
+// the node doesn't go unnoticed. It returns err so callers can pass it
+// up and cause the service to be retried.
+func (a *announcer) addFailed(svc *v1.Service, intf netlink.Link, lbIP net.IP, err error) error {
+	nsName := svc.Namespace + "/" + svc.Name
+
+	a.logger.Log("op", "addAddress", "error", err, "service", nsName, "ip", lbIP, "interface", intf.Attrs().Name)
+	addressAddErrors.With(prometheus.Labels{
+		"service": nsName,
+		"node":    a.myNode,
+		"ip":      lbIP.String(),
+	}).Inc()
+	a.client.Errorf(svc, "AnnounceFailed", "Node %s failed to add %s to interface %s: %s", a.myNode, lbIP, intf.Attrs().Name, err)
+
+	return err
+}
+
 // DeleteBalancer deletes the IP address associated with the
 // balancer. nsName is a namespaced name, e.g., "root/service42". The
 // addr parameter is optional and shouldn't be necessary but in some
@@ -349,11 +1199,20 @@ func (a *announcer) DeleteBalancer(nsName, reason string, _ net.IP) error {
 func (a *announcer) deleteAddress(nsName, reason string, svcAddr net.IP) error {
 	// delete the service from Prometheus, i.e., it won't show up in the
 	// metrics anymore
-	announcing.Delete(prometheus.Labels{
+	for _, result := range electionResults {
+		announcing.Delete(prometheus.Labels{
+			"service": nsName,
+			"node":    a.myNode,
+			"ip":      svcAddr.String(),
+			"winner":  result,
+		})
+	}
+	addressAddErrors.Delete(prometheus.Labels{
 		"service": nsName,
 		"node":    a.myNode,
 		"ip":      svcAddr.String(),
 	})
+	a.notify(nsName, svcAddr, webhookWithdraw)
 
 	// if any other service is still using that address then we don't
 	// want to withdraw it
@@ -368,6 +1227,25 @@ func (a *announcer) deleteAddress(nsName, reason string, svcAddr net.IP) error {
 
 	a.logger.Log("event", "withdrawAddress", "ip", svcAddr, "service", nsName, "reason", reason)
 	deleteAddr(svcAddr)
+	if a.vipLinks != nil {
+		if err := removeVIPLink(a.vipLinks, svcAddr); err != nil {
+			a.logger.Log("op", "removeVIPLink", "ip", svcAddr, "error", err)
+		}
+	}
+	a.removeNextHop(svcAddr)
+	a.stopGARPRetry(svcAddr.String())
+	a.stopGARPRefresh(svcAddr.String())
+	if a.bonds != nil {
+		a.bonds.remove(svcAddr.String())
+	}
+	a.releaseStrictARP(svcAddr.String())
+
+	// If svcAddr was the last user of an aggregate then withdraw the
+	// aggregate, too.
+	for _, aggr := range a.aggregates.release(svcAddr) {
+		a.logger.Log("event", "withdrawAggregate", "aggregate", aggr.String(), "ip", svcAddr)
+		deleteAddr(aggr.IP)
+	}
 
 	return nil
 }
@@ -382,17 +1260,36 @@ func (a *announcer) Shutdown() {
 		}
 	}
 
+	// end any ARP quiet periods so the sysctls are restored
+	a.stopARPQuiets()
+
+	// deliver the withdrawal notifications
+	a.setWebhook("")
+
+	// stop watching for bond failovers
+	if a.bonds != nil {
+		a.bonds.Shutdown()
+	}
+
 	// remove the "dummy" interface
 	removeInterface(a.dummyInt)
 }
 
-func (a *announcer) SetElection(election *election.Election) {
+func (a *announcer) SetElection(election election.Elector) {
 	a.election = election
 }
 
 // nodeHasHealthyEndpoint returns true if node has at least one
-// healthy endpoint.
-func nodeHasHealthyEndpoint(eps *v1.Endpoints, node string) bool {
+// healthy endpoint. If includeNotReady is true (i.e., the service has
+// publishNotReadyAddresses set) then not-ready endpoints count as
+// healthy because the user wants traffic to go to them anyway.
+func nodeHasHealthyEndpoint(eps *v1.Endpoints, node string, includeNotReady bool) bool {
+	// A service that was just created might not have an Endpoints yet,
+	// which just means that it has no healthy endpoints.
+	if eps == nil {
+		return false
+	}
+
 	ready := map[string]bool{}
 	for _, subset := range eps.Subsets {
 		for _, ep := range subset.Addresses {
@@ -407,6 +1304,12 @@ func nodeHasHealthyEndpoint(eps *v1.Endpoints, node string) bool {
 			}
 		}
 		for _, ep := range subset.NotReadyAddresses {
+			if includeNotReady {
+				if ep.NodeName != nil && *ep.NodeName == node {
+					ready[ep.IP] = true
+				}
+				continue
+			}
 			ready[ep.IP] = false
 		}
 	}
@@ -420,6 +1323,17 @@ func nodeHasHealthyEndpoint(eps *v1.Endpoints, node string) bool {
 	return false
 }
 
+// hasIngress returns true if ingresses contains an ingress with the
+// address ip.
+func hasIngress(ingresses []v1.LoadBalancerIngress, ip string) bool {
+	for _, ingress := range ingresses {
+		if ingress.IP == ip {
+			return true
+		}
+	}
+	return false
+}
+
 // addrFamilyName returns whether lbIP is an IPV4 or IPV6 address.
 // The return value will be "IPv6" if the address is an IPV6 address,
 // "IPv4" if it's IPV4, or "unknown" if the family can't be determined.
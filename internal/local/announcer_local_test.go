@@ -0,0 +1,1509 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	ptu "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	purelbv1 "purelb.io/pkg/apis/v1"
+)
+
+// testK8S implements k8s.ServiceEvent by recording the events that
+// the announcer sends.
+type testK8S struct {
+	t      *testing.T
+	events []string
+}
+
+func (s *testK8S) Debugf(_ runtime.Object, evtType string, msg string, args ...interface{}) {
+	s.t.Logf("k8s Debug event %q: %s", evtType, fmt.Sprintf(msg, args...))
+	s.events = append(s.events, evtType)
+}
+
+func (s *testK8S) Infof(_ runtime.Object, evtType string, msg string, args ...interface{}) {
+	s.t.Logf("k8s Info event %q: %s", evtType, fmt.Sprintf(msg, args...))
+	s.events = append(s.events, evtType)
+}
+
+func (s *testK8S) Errorf(_ runtime.Object, evtType string, msg string, args ...interface{}) {
+	s.t.Logf("k8s Warning event %q: %s", evtType, fmt.Sprintf(msg, args...))
+	s.events = append(s.events, evtType)
+}
+
+func (s *testK8S) ForceSync() {}
+
+// missingLink returns a link that doesn't exist on this host, so
+// netlink operations on it always fail.
+func missingLink() netlink.Link {
+	return &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "purelb-nonexist"}}
+}
+
+// fakeElector implements elector with a fixed winner, and records the
+// elections that it runs.
+type fakeElector struct {
+	winner string
+	keys   []string
+}
+
+func (f *fakeElector) Winner(key string) string {
+	f.keys = append(f.keys, key)
+	return f.winner
+}
+
+func (f *fakeElector) NumMembers() int {
+	return 2
+}
+
+func TestAddFailure(t *testing.T) {
+	k := &testK8S{t: t}
+	a := &announcer{
+		client:       k,
+		logger:       log.NewNopLogger(),
+		myNode:       "test-node",
+		config:       &purelbv1.LBNodeAgentLocalSpec{},
+		svcIngresses: map[string][]v1.LoadBalancerIngress{},
+		dummyInt:     missingLink(),
+		groups: map[string]*purelbv1.ServiceGroupLocalSpec{
+			"remote": {
+				Pool:        "10.42.42.0/24",
+				Subnet:      "10.42.42.0/24",
+				Aggregation: "default",
+			},
+		},
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test",
+			Name:        "addfail",
+			Annotations: map[string]string{purelbv1.PoolAnnotation: "remote"},
+		},
+	}
+	lbIP := net.ParseIP("10.42.42.1")
+	labels := []string{"test/addfail", "test-node", lbIP.String()}
+	before := ptu.ToFloat64(addressAddErrors.WithLabelValues(labels...))
+
+	// The dummy interface doesn't exist so the add fails, which should
+	// be counted and reported to the user.
+	assert.Error(t, a.announceRemote(svc, &v1.Endpoints{}, a.dummyInt, lbIP))
+	assert.Equal(t, before+1, ptu.ToFloat64(addressAddErrors.WithLabelValues(labels...)))
+	assert.Contains(t, k.events, "AnnounceFailed")
+
+	// Each retry that fails is counted again
+	assert.Error(t, a.announceRemote(svc, &v1.Endpoints{}, a.dummyInt, lbIP))
+	assert.Equal(t, before+2, ptu.ToFloat64(addressAddErrors.WithLabelValues(labels...)))
+
+	// Withdrawing the address removes its series so the counter's
+	// cardinality doesn't grow with every address that ever failed
+	series := func() int { return ptu.CollectAndCount(addressAddErrors) }
+	count := series()
+	assert.NoError(t, a.deleteAddress("test/addfail", "test", lbIP))
+	assert.Equal(t, count-1, series())
+}
+
+func TestExternalIPs(t *testing.T) {
+	a := &announcer{
+		client:       &testK8S{t: t},
+		logger:       log.NewNopLogger(),
+		myNode:       "test-node",
+		config:       &purelbv1.LBNodeAgentLocalSpec{},
+		svcIngresses: map[string][]v1.LoadBalancerIngress{},
+		dummyInt:     missingLink(),
+		groups: map[string]*purelbv1.ServiceGroupLocalSpec{
+			"remote": {
+				V4Pools: []*purelbv1.ServiceGroupAddressPool{{
+					Pool:        "10.42.42.0/24",
+					Subnet:      "10.42.42.0/24",
+					Aggregation: "default",
+				}},
+			},
+		},
+		// Match no interfaces so every address is announced remotely
+		localNameRegexes: []*regexp.Regexp{regexp.MustCompile("^purelb-nomatch$")},
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      "headless",
+		},
+		Spec: v1.ServiceSpec{
+			Type:        v1.ServiceTypeClusterIP,
+			ClusterIP:   v1.ClusterIPNone,
+			ExternalIPs: []string{"10.42.42.1", "192.168.1.1", "10.42.42.2", "bogus"},
+		},
+	}
+
+	// Without the annotation we don't announce externalIPs
+	assert.NoError(t, a.SetBalancer(svc, &v1.Endpoints{}))
+	assert.NotContains(t, a.svcIngresses, "test/headless")
+
+	// With the annotation we announce the externalIPs that belong to
+	// our ServiceGroups. The add fails because the dummy interface
+	// doesn't exist, but the addresses are tracked so we can clean up.
+	svc.Annotations = map[string]string{purelbv1.AnnounceExternalIPsAnnotation: "true"}
+	assert.Error(t, a.SetBalancer(svc, &v1.Endpoints{}))
+	assert.Equal(t, []v1.LoadBalancerIngress{{IP: "10.42.42.1"}, {IP: "10.42.42.2"}}, a.svcIngresses["test/headless"])
+
+	// Removing an externalIP withdraws it
+	svc.Spec.ExternalIPs = []string{"10.42.42.2"}
+	assert.Error(t, a.SetBalancer(svc, &v1.Endpoints{}))
+	assert.Equal(t, []v1.LoadBalancerIngress{{IP: "10.42.42.2"}}, a.svcIngresses["test/headless"])
+
+	// Setting the annotation to anything but "true" withdraws
+	// everything
+	svc.Annotations[purelbv1.AnnounceExternalIPsAnnotation] = "false"
+	assert.NoError(t, a.SetBalancer(svc, &v1.Endpoints{}))
+	assert.NotContains(t, a.svcIngresses, "test/headless")
+
+	// and so does removing the annotation
+	svc.Annotations[purelbv1.AnnounceExternalIPsAnnotation] = "true"
+	assert.Error(t, a.SetBalancer(svc, &v1.Endpoints{}))
+	delete(svc.Annotations, purelbv1.AnnounceExternalIPsAnnotation)
+	assert.NoError(t, a.SetBalancer(svc, &v1.Endpoints{}))
+	assert.NotContains(t, a.svcIngresses, "test/headless")
+}
+
+func TestIgnoreAnnotation(t *testing.T) {
+	k := &testK8S{t: t}
+	a := &announcer{
+		client:       k,
+		logger:       log.NewNopLogger(),
+		myNode:       "test-node",
+		config:       &purelbv1.LBNodeAgentLocalSpec{},
+		svcIngresses: map[string][]v1.LoadBalancerIngress{},
+		dummyInt:     missingLink(),
+		groups: map[string]*purelbv1.ServiceGroupLocalSpec{
+			"remote": {
+				V4Pools: []*purelbv1.ServiceGroupAddressPool{{
+					Pool:        "10.42.42.0/24",
+					Subnet:      "10.42.42.0/24",
+					Aggregation: "default",
+				}},
+			},
+		},
+		// Match no interfaces so every address is announced remotely
+		localNameRegexes: []*regexp.Regexp{regexp.MustCompile("^purelb-nomatch$")},
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      "ignored",
+			Annotations: map[string]string{
+				purelbv1.BrandAnnotation:  purelbv1.Brand,
+				purelbv1.IgnoreAnnotation: "true",
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Type: v1.ServiceTypeLoadBalancer,
+		},
+		Status: v1.ServiceStatus{
+			LoadBalancer: v1.LoadBalancerStatus{
+				Ingress: []v1.LoadBalancerIngress{{IP: "10.42.42.1"}},
+			},
+		},
+	}
+	orig := svc.DeepCopy()
+
+	// Ignored services aren't announced or changed
+	assert.NoError(t, a.SetBalancer(svc, &v1.Endpoints{}))
+	assert.NotContains(t, a.svcIngresses, "test/ignored")
+	assert.Equal(t, orig, svc)
+	assert.Empty(t, k.events)
+
+	// Without the annotation we announce the address. The add fails
+	// because the dummy interface doesn't exist, but the address is
+	// tracked so we can clean up.
+	delete(svc.Annotations, purelbv1.IgnoreAnnotation)
+	assert.Error(t, a.SetBalancer(svc, &v1.Endpoints{}))
+	assert.Contains(t, a.svcIngresses, "test/ignored")
+
+	// Adding the annotation withdraws the address
+	svc.Annotations[purelbv1.IgnoreAnnotation] = "true"
+	assert.NoError(t, a.SetBalancer(svc, &v1.Endpoints{}))
+	assert.NotContains(t, a.svcIngresses, "test/ignored")
+}
+
+func TestAnnounceMethodRemote(t *testing.T) {
+	k := &testK8S{t: t}
+	a := &announcer{
+		client:       k,
+		logger:       log.NewNopLogger(),
+		myNode:       "test-node",
+		config:       &purelbv1.LBNodeAgentLocalSpec{},
+		svcIngresses: map[string][]v1.LoadBalancerIngress{},
+		dummyInt:     missingLink(),
+		groups: map[string]*purelbv1.ServiceGroupLocalSpec{
+			"loopback": {
+				Pool:        "127.0.0.5/32",
+				Subnet:      "127.0.0.0/8",
+				Aggregation: "default",
+				Remote:      true,
+			},
+		},
+		// The loopback interface is on the same subnet as the address
+		// so it would be announced locally if the allocator hadn't told
+		// us otherwise.
+		localNameRegexes: []*regexp.Regexp{regexp.MustCompile("^lo$")},
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      "remote",
+			Annotations: map[string]string{
+				purelbv1.PoolAnnotation:           "loopback",
+				purelbv1.AnnounceMethodAnnotation: purelbv1.AnnounceMethodRemote,
+			},
+		},
+		Status: v1.ServiceStatus{LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "127.0.0.5"}}}},
+	}
+
+	// The address goes to the (missing) dummy interface, not to lo.
+	assert.Error(t, a.SetBalancer(svc, &v1.Endpoints{}))
+	assert.Contains(t, k.events, "AnnouncingNonLocal")
+	assert.NotContains(t, k.events, "AnnouncingLocal")
+}
+
+// TestMixedLocalRemote tests a dual-stack service with one local and
+// one remote address. Each address is announced its own way, and
+// withdrawing one doesn't disturb the other.
+func TestMixedLocalRemote(t *testing.T) {
+	k := &testK8S{t: t}
+	// Another node wins the election so we don't add anything to lo.
+	e := &fakeElector{winner: "other-node"}
+	a := &announcer{
+		client:       k,
+		logger:       log.NewNopLogger(),
+		myNode:       "test-node",
+		config:       &purelbv1.LBNodeAgentLocalSpec{},
+		svcIngresses: map[string][]v1.LoadBalancerIngress{},
+		dummyInt:     missingLink(),
+		election:     e,
+		groups: map[string]*purelbv1.ServiceGroupLocalSpec{
+			"dual": {
+				V4Pools: []*purelbv1.ServiceGroupAddressPool{{
+					Pool:        "127.0.0.5/32",
+					Subnet:      "127.0.0.0/8",
+					Aggregation: "default",
+				}},
+				V6Pools: []*purelbv1.ServiceGroupAddressPool{{
+					Pool:        "fc00::5/128",
+					Subnet:      "fc00::/64",
+					Aggregation: "default",
+				}},
+			},
+		},
+		// The IPv4 address is on lo's subnet so it's local. The IPv6
+		// address isn't so it's remote.
+		localNameRegexes: []*regexp.Regexp{regexp.MustCompile("^lo$")},
+	}
+	v4 := v1.LoadBalancerIngress{IP: "127.0.0.5"}
+	v6 := v1.LoadBalancerIngress{IP: "fc00::5"}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test",
+			Name:        "mixed",
+			Annotations: map[string]string{purelbv1.PoolAnnotation: "dual"},
+		},
+		Status: v1.ServiceStatus{LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{v4, v6}}},
+	}
+	v6Errors := func() float64 {
+		return ptu.ToFloat64(addressAddErrors.WithLabelValues("test/mixed", "test-node", "fc00::5"))
+	}
+	before := v6Errors()
+
+	// Only the local address has an election. The remote address goes
+	// to the (missing) dummy interface.
+	assert.Error(t, a.SetBalancer(svc, &v1.Endpoints{}))
+	assert.Equal(t, []string{"127.0.0.5"}, e.keys)
+	assert.Contains(t, k.events, "AnnouncingNonLocal")
+	assert.Equal(t, before+1, v6Errors())
+	assert.Equal(t, []v1.LoadBalancerIngress{v4, v6}, a.svcIngresses["test/mixed"])
+
+	// Withdrawing the remote address leaves the local one alone, and
+	// resets the remote address's error count
+	e.keys = nil
+	svc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{v4}
+	assert.NoError(t, a.SetBalancer(svc, &v1.Endpoints{}))
+	assert.Equal(t, []string{"127.0.0.5"}, e.keys)
+	assert.Equal(t, 0.0, v6Errors(), "remote address was announced again")
+	assert.Equal(t, []v1.LoadBalancerIngress{v4}, a.svcIngresses["test/mixed"])
+
+	// Withdrawing the local address leaves the remote one alone
+	e.keys = nil
+	svc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{v6}
+	assert.Error(t, a.SetBalancer(svc, &v1.Endpoints{}))
+	assert.Empty(t, e.keys, "local address was announced again")
+	assert.Equal(t, 1.0, v6Errors(), "error count wasn't reset")
+	assert.Equal(t, []v1.LoadBalancerIngress{v6}, a.svcIngresses["test/mixed"])
+
+	// Deleting the service withdraws everything
+	assert.NoError(t, a.DeleteBalancer("test/mixed", "deleted", nil))
+	assert.NotContains(t, a.svcIngresses, "test/mixed")
+}
+
+// TestNoNodePorts tests that services with
+// allocateLoadBalancerNodePorts=false, i.e., without node ports, are
+// announced the same way as services with them, both locally and
+// remotely.
+func TestNoNodePorts(t *testing.T) {
+	announce := func(svc *v1.Service) ([]string, []error) {
+		k := &testK8S{t: t}
+		a := &announcer{
+			client:       k,
+			logger:       log.NewNopLogger(),
+			myNode:       "test-node",
+			config:       &purelbv1.LBNodeAgentLocalSpec{},
+			svcIngresses: map[string][]v1.LoadBalancerIngress{},
+			dummyInt:     missingLink(),
+			election:     &fakeElector{winner: "test-node"},
+			groups: map[string]*purelbv1.ServiceGroupLocalSpec{
+				"pool": {
+					V4Pools: []*purelbv1.ServiceGroupAddressPool{{
+						Pool:        "192.0.2.0/24",
+						Subnet:      "192.0.2.0/24",
+						Aggregation: "default",
+					}},
+				},
+			},
+		}
+		lbIP := net.ParseIP("192.0.2.1")
+		lbIPNet := net.IPNet{IP: lbIP, Mask: net.CIDRMask(24, 32)}
+
+		// Neither interface exists so the adds fail, but only after
+		// we've done everything else
+		errs := []error{
+			a.announceLocal(svc, missingLink(), lbIP, lbIPNet),
+			a.announceRemote(svc, &v1.Endpoints{}, a.dummyInt, lbIP),
+		}
+		return k.events, errs
+	}
+	service := func(name string, nodePorts bool) *v1.Service {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "test",
+				Name:        name,
+				Annotations: map[string]string{purelbv1.PoolAnnotation: "pool"},
+			},
+			Spec: v1.ServiceSpec{
+				Type:                          v1.ServiceTypeLoadBalancer,
+				AllocateLoadBalancerNodePorts: &nodePorts,
+				Ports:                         []v1.ServicePort{{Protocol: v1.ProtocolTCP, Port: 80}},
+			},
+		}
+		if nodePorts {
+			svc.Spec.Ports[0].NodePort = 30080
+		}
+		return svc
+	}
+
+	withEvents, withErrs := announce(service("with", true))
+	withoutEvents, withoutErrs := announce(service("without", false))
+	assert.Equal(t, withEvents, withoutEvents)
+	assert.Contains(t, withoutEvents, "AnnouncingLocal")
+	assert.Contains(t, withoutEvents, "AnnouncingNonLocal")
+	for i := range withErrs {
+		assert.ErrorContains(t, withoutErrs[i], "purelb-nonexist", "failed for a reason other than the missing interface")
+		assert.Equal(t, withErrs[i] == nil, withoutErrs[i] == nil)
+	}
+}
+
+func TestAnnouncementLog(t *testing.T) {
+	// Record the fields of each "announce" log line
+	announcements := []map[string]string{}
+	logger := log.LoggerFunc(func(keyvals ...interface{}) error {
+		fields := map[string]string{}
+		for i := 0; i+1 < len(keyvals); i += 2 {
+			fields[fmt.Sprint(keyvals[i])] = fmt.Sprint(keyvals[i+1])
+		}
+		if fields["op"] == "announce" {
+			announcements = append(announcements, fields)
+		}
+		return nil
+	})
+	a := &announcer{
+		client:       &testK8S{t: t},
+		logger:       logger,
+		myNode:       "test-node",
+		config:       &purelbv1.LBNodeAgentLocalSpec{},
+		svcIngresses: map[string][]v1.LoadBalancerIngress{},
+		dummyInt:     missingLink(),
+		election:     &fakeElector{winner: "test-node"},
+		groups: map[string]*purelbv1.ServiceGroupLocalSpec{
+			"pool": {
+				V4Pools: []*purelbv1.ServiceGroupAddressPool{{
+					Pool:        "192.0.2.0/24",
+					Subnet:      "192.0.2.0/24",
+					Aggregation: "/28",
+				}},
+			},
+		},
+	}
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "test",
+		Name:        "logged",
+		Annotations: map[string]string{purelbv1.PoolAnnotation: "pool"},
+	}}
+	lbIP := net.ParseIP("192.0.2.1")
+
+	// The adds fail because the interfaces don't exist but we log what
+	// we tried to do
+	assert.Error(t, a.announceLocal(svc, missingLink(), lbIP, net.IPNet{IP: lbIP, Mask: net.CIDRMask(24, 32)}))
+	assert.Error(t, a.announceRemote(svc, &v1.Endpoints{}, a.dummyInt, lbIP))
+	assert.Equal(t, []map[string]string{{
+		"op":        "announce",
+		"service":   "test/logged",
+		"ip":        "192.0.2.1",
+		"family":    "IPv4",
+		"method":    "local",
+		"interface": "purelb-nonexist",
+		"mask":      "/24",
+		"winner":    "test-node",
+	}, {
+		"op":        "announce",
+		"service":   "test/logged",
+		"ip":        "192.0.2.1",
+		"family":    "IPv4",
+		"method":    "remote",
+		"interface": "purelb-nonexist",
+		"mask":      "/28",
+		"winner":    "all",
+	}}, announcements)
+}
+
+// TestAllowedPools tests that an announcer that's allowed to announce
+// only some pools ignores addresses from the others.
+func TestAllowedPools(t *testing.T) {
+	k := &testK8S{t: t}
+	a := NewAnnouncer(log.NewNopLogger(), "test-node", []string{"edge"}).(*announcer)
+	a.client = k
+	a.config = &purelbv1.LBNodeAgentLocalSpec{}
+	a.dummyInt = missingLink()
+	a.groups = map[string]*purelbv1.ServiceGroupLocalSpec{
+		"edge": {
+			V4Pools: []*purelbv1.ServiceGroupAddressPool{{
+				Pool:        "10.42.42.0/24",
+				Subnet:      "10.42.42.0/24",
+				Aggregation: "default",
+			}},
+		},
+		"core": {
+			V4Pools: []*purelbv1.ServiceGroupAddressPool{{
+				Pool:        "10.43.43.0/24",
+				Subnet:      "10.43.43.0/24",
+				Aggregation: "default",
+			}},
+		},
+	}
+	// Match no interfaces so every address is announced remotely
+	a.localNameRegexes = []*regexp.Regexp{regexp.MustCompile("^purelb-nomatch$")}
+
+	svc := func(name string, pool string, ip string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "test",
+				Name:        name,
+				Annotations: map[string]string{purelbv1.PoolAnnotation: pool},
+			},
+			Status: v1.ServiceStatus{LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: ip}}}},
+		}
+	}
+
+	// Addresses from other pools are ignored
+	assert.NoError(t, a.SetBalancer(svc("core", "core", "10.43.43.1"), &v1.Endpoints{}))
+	assert.NotContains(t, a.svcIngresses, "test/core")
+	assert.Empty(t, k.events)
+
+	// Addresses from allowed pools are announced. The add fails because
+	// the dummy interface doesn't exist.
+	assert.Error(t, a.SetBalancer(svc("edge", "edge", "10.42.42.1"), &v1.Endpoints{}))
+	assert.Contains(t, a.svcIngresses, "test/edge")
+	assert.Contains(t, k.events, "AnnouncingNonLocal")
+
+	// Without the annotation we find the pool from the address
+	k.events = nil
+	unannotated := svc("unannotated", "", "10.43.43.2")
+	delete(unannotated.Annotations, purelbv1.PoolAnnotation)
+	assert.NoError(t, a.SetBalancer(unannotated, &v1.Endpoints{}))
+	assert.NotContains(t, a.svcIngresses, "test/unannotated")
+	assert.Empty(t, k.events)
+}
+
+func TestServiceAggregation(t *testing.T) {
+	v4Pool := &purelbv1.ServiceGroupAddressPool{Pool: "10.42.42.0/24", Subnet: "10.42.42.0/24", Aggregation: "default"}
+	v6Pool := &purelbv1.ServiceGroupAddressPool{Pool: "fc00::/64", Subnet: "fc00::/64", Aggregation: "/64"}
+	v4IP := net.ParseIP("10.42.42.1")
+	v6IP := net.ParseIP("fc00::1")
+
+	for _, test := range []struct {
+		desc       string
+		annotation string
+		pool       *purelbv1.ServiceGroupAddressPool
+		ip         net.IP
+		want       string
+		wantErr    bool
+	}{
+		{desc: "no annotation", pool: v4Pool, ip: v4IP, want: "default"},
+		{desc: "host route", annotation: "/32", pool: v4Pool, ip: v4IP, want: "/32"},
+		{desc: "subnet mask", annotation: "/24", pool: v4Pool, ip: v4IP, want: "/24"},
+		{desc: "default", annotation: "default", pool: v6Pool, ip: v6IP, want: "default"},
+		{desc: "dual-stack v4", annotation: "/32, /128", pool: v4Pool, ip: v4IP, want: "/32"},
+		{desc: "dual-stack v6", annotation: "/32, /128", pool: v6Pool, ip: v6IP, want: "/128"},
+		{desc: "shorter than subnet", annotation: "/16", pool: v4Pool, ip: v4IP, wantErr: true},
+		{desc: "longer than address", annotation: "/33", pool: v4Pool, ip: v4IP, wantErr: true},
+		{desc: "garbage", annotation: "bogus", pool: v4Pool, ip: v4IP, wantErr: true},
+	} {
+		svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}}}
+		if test.annotation != "" {
+			svc.Annotations[purelbv1.AggregationAnnotation] = test.annotation
+		}
+		got, err := serviceAggregation(svc, test.pool, test.ip)
+		if test.wantErr {
+			assert.Error(t, err, test.desc)
+			continue
+		}
+		assert.NoError(t, err, test.desc)
+		assert.Equal(t, test.want, got, test.desc)
+	}
+}
+
+func TestAnnounceRemoteAggregation(t *testing.T) {
+	k := &testK8S{t: t}
+	a := &announcer{
+		client:       k,
+		logger:       log.NewNopLogger(),
+		myNode:       "test-node",
+		config:       &purelbv1.LBNodeAgentLocalSpec{},
+		svcIngresses: map[string][]v1.LoadBalancerIngress{},
+		dummyInt:     missingLink(),
+		groups: map[string]*purelbv1.ServiceGroupLocalSpec{
+			"remote": {
+				Pool:        "10.42.42.0/24",
+				Subnet:      "10.42.42.0/24",
+				Aggregation: "default",
+			},
+		},
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test",
+			Name:      "aggregation",
+			Annotations: map[string]string{
+				purelbv1.PoolAnnotation:        "remote",
+				purelbv1.AggregationAnnotation: "/32",
+			},
+		},
+	}
+	lbIP := net.ParseIP("10.42.42.1")
+
+	// The add fails because the dummy interface doesn't exist, but the
+	// error tells us which mask we tried to use.
+	err := a.announceRemote(svc, &v1.Endpoints{}, a.dummyInt, lbIP)
+	assert.ErrorContains(t, err, "10.42.42.1/32")
+
+	// An aggregation that's outside of the pool's bounds is rejected
+	// before we touch the interface.
+	svc.Annotations[purelbv1.AggregationAnnotation] = "/8"
+	err = a.announceRemote(svc, &v1.Endpoints{}, a.dummyInt, lbIP)
+	assert.ErrorContains(t, err, "not valid")
+	assert.Contains(t, k.events, "InvalidAggregation")
+}
+
+// fakeSysctl implements sysctl using a map.
+type fakeSysctl map[string]string
+
+func (f fakeSysctl) Get(name string) (string, error) {
+	value, ok := f[name]
+	if !ok {
+		return "", fmt.Errorf("no such sysctl %s", name)
+	}
+	return value, nil
+}
+
+func (f fakeSysctl) Set(name string, value string) error {
+	f[name] = value
+	return nil
+}
+
+// failingSysctl is a fakeSysctl whose failSet'th Set fails.
+type failingSysctl struct {
+	fakeSysctl
+	sets    int
+	failSet int
+}
+
+func (f *failingSysctl) Set(name string, value string) error {
+	f.sets++
+	if f.sets == f.failSet {
+		return fmt.Errorf("can't set %s", name)
+	}
+	return f.fakeSysctl.Set(name, value)
+}
+
+func TestStrictARPFailure(t *testing.T) {
+	sysctls := &failingSysctl{
+		fakeSysctl: fakeSysctl{
+			"net/ipv4/conf/all/arp_ignore":   "0",
+			"net/ipv4/conf/all/arp_announce": "0",
+		},
+		failSet: 2,
+	}
+	a := &announcer{
+		logger:         log.NewNopLogger(),
+		myNode:         "test-node",
+		svcIngresses:   map[string][]v1.LoadBalancerIngress{},
+		sysctls:        sysctls,
+		strictARPAddrs: map[string]bool{},
+	}
+
+	// If the second sysctl fails then the first is rolled back
+	assert.Error(t, a.holdStrictARP("192.0.2.1"))
+	assert.Equal(t, fakeSysctl{
+		"net/ipv4/conf/all/arp_ignore":   "0",
+		"net/ipv4/conf/all/arp_announce": "0",
+	}, sysctls.fakeSysctl)
+	assert.Nil(t, a.savedARPParams)
+	assert.Empty(t, a.strictARPAddrs)
+
+	// so the next hold applies them all
+	assert.NoError(t, a.holdStrictARP("192.0.2.1"))
+	assert.Equal(t, fakeSysctl{
+		"net/ipv4/conf/all/arp_ignore":   "1",
+		"net/ipv4/conf/all/arp_announce": "2",
+	}, sysctls.fakeSysctl)
+
+	// and releasing restores them all
+	a.releaseStrictARP("192.0.2.1")
+	assert.Equal(t, fakeSysctl{
+		"net/ipv4/conf/all/arp_ignore":   "0",
+		"net/ipv4/conf/all/arp_announce": "0",
+	}, sysctls.fakeSysctl)
+}
+
+func TestStrictARP(t *testing.T) {
+	sysctls := fakeSysctl{
+		"net/ipv4/conf/all/arp_ignore":   "0",
+		"net/ipv4/conf/all/arp_announce": "0",
+	}
+	a := &announcer{
+		logger:         log.NewNopLogger(),
+		myNode:         "test-node",
+		svcIngresses:   map[string][]v1.LoadBalancerIngress{},
+		sysctls:        sysctls,
+		strictARPAddrs: map[string]bool{},
+	}
+
+	// The first address sets the sysctls
+	assert.NoError(t, a.holdStrictARP("192.0.2.1"))
+	assert.Equal(t, fakeSysctl{
+		"net/ipv4/conf/all/arp_ignore":   "1",
+		"net/ipv4/conf/all/arp_announce": "2",
+	}, sysctls)
+
+	// The second doesn't change anything
+	assert.NoError(t, a.holdStrictARP("192.0.2.2"))
+
+	// Withdrawing one address leaves the sysctls set because the other
+	// still needs them
+	assert.NoError(t, a.deleteAddress("test/one", "test", net.ParseIP("192.0.2.1")))
+	assert.Equal(t, "1", sysctls["net/ipv4/conf/all/arp_ignore"])
+	assert.Equal(t, "2", sysctls["net/ipv4/conf/all/arp_announce"])
+
+	// Withdrawing an address that didn't use strict ARP changes nothing
+	assert.NoError(t, a.deleteAddress("test/other", "test", net.ParseIP("192.0.2.3")))
+	assert.Equal(t, "1", sysctls["net/ipv4/conf/all/arp_ignore"])
+
+	// Withdrawing the last address restores the original values
+	assert.NoError(t, a.deleteAddress("test/two", "test", net.ParseIP("192.0.2.2")))
+	assert.Equal(t, fakeSysctl{
+		"net/ipv4/conf/all/arp_ignore":   "0",
+		"net/ipv4/conf/all/arp_announce": "0",
+	}, sysctls)
+
+	// Turning off the option also restores the original values
+	assert.NoError(t, a.holdStrictARP("192.0.2.1"))
+	assert.Equal(t, "1", sysctls["net/ipv4/conf/all/arp_ignore"])
+	a.restoreARPParams()
+	assert.Equal(t, "0", sysctls["net/ipv4/conf/all/arp_ignore"])
+	assert.Empty(t, a.strictARPAddrs)
+}
+
+func TestLoserQuietPeriod(t *testing.T) {
+	sysctls := fakeSysctl{
+		"net/ipv4/conf/all/arp_ignore":   "0",
+		"net/ipv4/conf/all/arp_announce": "0",
+	}
+	strict := func() bool {
+		return sysctls["net/ipv4/conf/all/arp_ignore"] == "1" && sysctls["net/ipv4/conf/all/arp_announce"] == "2"
+	}
+	a := &announcer{
+		client:         &testK8S{t: t},
+		logger:         log.NewNopLogger(),
+		myNode:         "test-node",
+		svcIngresses:   map[string][]v1.LoadBalancerIngress{},
+		election:       &fakeElector{winner: "other-node"},
+		sysctls:        sysctls,
+		strictARPAddrs: map[string]bool{},
+		dummies:        &fakeDummies{links: map[string]netlink.Link{}, addrs: map[string][]netlink.Addr{}},
+	}
+
+	// The quiet period comes from the LBNodeAgent
+	assert.NoError(t, a.SetConfig(&purelbv1.Config{Agents: []*purelbv1.LBNodeAgent{{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "purelb", Name: "default"},
+		Spec: purelbv1.LBNodeAgentSpec{Local: &purelbv1.LBNodeAgentLocalSpec{
+			LocalInterface:   "default",
+			ExtLBInterface:   "kube-lb0",
+			LoserQuietPeriod: metav1.Duration{Duration: 100 * time.Millisecond},
+		}},
+	}}}))
+	assert.Equal(t, 100*time.Millisecond, a.config.LoserQuietPeriod.Duration)
+
+	svc := func(announcing string) *v1.Service {
+		return &v1.Service{ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test",
+			Name:        "quiet",
+			Annotations: map[string]string{purelbv1.AnnounceAnnotation + "-IPv4": announcing},
+		}}
+	}
+	lbIP := net.ParseIP("192.0.2.1")
+	lbIPNet := net.IPNet{IP: lbIP, Mask: net.CIDRMask(24, 32)}
+
+	// Losing an address that another node was announcing doesn't start
+	// a quiet period
+	assert.NoError(t, a.announceLocal(svc("other-node,eth0"), missingLink(), lbIP, lbIPNet))
+	assert.False(t, strict())
+
+	// Losing an address that we were announcing does. The sysctls are
+	// set before the address is withdrawn so they stay set even though
+	// the withdrawal releases the address's own hold on them.
+	assert.NoError(t, a.holdStrictARP(lbIP.String()))
+	assert.NoError(t, a.announceLocal(svc("test-node,eth0"), missingLink(), lbIP, lbIPNet))
+	assert.True(t, strict())
+	assert.NotContains(t, a.strictARPAddrs, lbIP.String())
+
+	// Configuration changes don't end the quiet period
+	a.restoreARPParams()
+	assert.True(t, strict())
+
+	// It ends on its own
+	assert.Eventually(t, func() bool {
+		a.arpLock.Lock()
+		defer a.arpLock.Unlock()
+		return !strict()
+	}, time.Second, 10*time.Millisecond)
+
+	// IPv6 doesn't use ARP so it doesn't get a quiet period
+	lbIP6 := net.ParseIP("2001:db8::1")
+	svc6 := svc("")
+	svc6.Annotations[purelbv1.AnnounceAnnotation+"-IPv6"] = "test-node,eth0"
+	assert.NoError(t, a.announceLocal(svc6, missingLink(), lbIP6, net.IPNet{IP: lbIP6, Mask: net.CIDRMask(64, 128)}))
+	assert.False(t, strict())
+
+	// Shutting down ends any quiet periods
+	assert.NoError(t, a.announceLocal(svc("test-node,eth0"), missingLink(), lbIP, lbIPNet))
+	assert.True(t, strict())
+	a.stopARPQuiets()
+	assert.False(t, strict())
+	assert.Empty(t, a.arpQuiets)
+}
+
+func TestLocalHostMask(t *testing.T) {
+	a := &announcer{
+		logger: log.NewNopLogger(),
+		groups: map[string]*purelbv1.ServiceGroupLocalSpec{
+			"subnet": {
+				V4Pools: []*purelbv1.ServiceGroupAddressPool{{Pool: "192.0.2.0/28", Subnet: "192.0.2.0/24", Aggregation: "default"}},
+			},
+			"host": {
+				V4Pools: []*purelbv1.ServiceGroupAddressPool{{Pool: "192.0.2.16/28", Subnet: "192.0.2.0/24", Aggregation: "default", HostMask: true}},
+				V6Pools: []*purelbv1.ServiceGroupAddressPool{{Pool: "2001:db8::/120", Subnet: "2001:db8::/64", Aggregation: "default", HostMask: true}},
+			},
+		},
+	}
+	svc := func(group string) *v1.Service {
+		return &v1.Service{ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test",
+			Name:        group,
+			Annotations: map[string]string{purelbv1.PoolAnnotation: group},
+		}}
+	}
+	localNet := func(ip string, ones int, bits int) net.IPNet {
+		return net.IPNet{IP: net.ParseIP(ip), Mask: net.CIDRMask(ones, bits)}
+	}
+
+	// By default we use the interface's subnet mask
+	got := a.localAddress(svc("subnet"), net.ParseIP("192.0.2.1"), localNet("192.0.2.1", 24, 32))
+	assert.Equal(t, "192.0.2.1/24", got.String())
+
+	// HostMask pools use a host mask
+	got = a.localAddress(svc("host"), net.ParseIP("192.0.2.17"), localNet("192.0.2.17", 24, 32))
+	assert.Equal(t, "192.0.2.17/32", got.String())
+	got = a.localAddress(svc("host"), net.ParseIP("2001:db8::1"), localNet("2001:db8::1", 64, 128))
+	assert.Equal(t, "2001:db8::1/128", got.String())
+
+	// The host mask is what we try to add to the interface
+	err := addNetwork(a.localAddress(svc("host"), net.ParseIP("192.0.2.17"), localNet("192.0.2.17", 24, 32)), missingLink(), "", nil)
+	assert.ErrorContains(t, err, "192.0.2.17/32")
+}
+
+func TestAddressConflict(t *testing.T) {
+	k := &testK8S{t: t}
+	other := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth1", Index: 1001}}
+	addrs := &fakeAddrs{
+		links: []netlink.Link{missingLink(), other},
+		addrs: map[string][]string{"eth1": {"192.0.2.1/24"}},
+	}
+	a := &announcer{
+		client:       k,
+		logger:       log.NewNopLogger(),
+		myNode:       "test-node",
+		config:       &purelbv1.LBNodeAgentLocalSpec{},
+		svcIngresses: map[string][]v1.LoadBalancerIngress{},
+		election:     &fakeElector{winner: "test-node"},
+		addrs:        addrs,
+	}
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "conflict"}}
+	lbIP := net.ParseIP("192.0.2.1")
+	lbIPNet := net.IPNet{IP: lbIP, Mask: net.CIDRMask(24, 32)}
+
+	// The address is already on another interface so we refuse to add
+	// it, and tell the user why
+	assert.Error(t, a.announceLocal(svc, missingLink(), lbIP, lbIPNet))
+	assert.Contains(t, k.events, "AddressConflict")
+	assert.NotContains(t, k.events, "AnnounceFailed", "tried to add a conflicting address")
+
+	// Without the conflict we try to add the address (which fails
+	// because the interface doesn't exist)
+	k.events = nil
+	addrs.addrs = map[string][]string{}
+	assert.Error(t, a.announceLocal(svc, missingLink(), lbIP, lbIPNet))
+	assert.NotContains(t, k.events, "AddressConflict")
+	assert.Contains(t, k.events, "AnnounceFailed")
+}
+
+func TestAnnouncingWinner(t *testing.T) {
+	a := &announcer{
+		client:       &testK8S{t: t},
+		logger:       log.NewNopLogger(),
+		myNode:       "test-node",
+		config:       &purelbv1.LBNodeAgentLocalSpec{},
+		svcIngresses: map[string][]v1.LoadBalancerIngress{},
+		election:     &fakeElector{winner: "other-node"},
+	}
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "winner"}}
+	lbIP := net.ParseIP("192.0.2.1")
+	lbIPNet := net.IPNet{IP: lbIP, Mask: net.CIDRMask(24, 32)}
+	count := func() int {
+		return ptu.CollectAndCount(announcing)
+	}
+	gauge := func(winner string) float64 {
+		return ptu.ToFloat64(announcing.WithLabelValues("test/winner", "test-node", "192.0.2.1", winner))
+	}
+	announcing.Reset()
+
+	// When we lose the election we don't export a series, so the
+	// gauge has one series per address, not one per node
+	assert.NoError(t, a.announceLocal(svc, missingLink(), lbIP, lbIPNet))
+	assert.Equal(t, 0, count())
+
+	// When we win we export a series. We can't add the
+	// address without touching the host so we update the gauge the way
+	// announceLocal does after it adds the address.
+	a.setAnnouncing("test/winner", lbIP, electionWon)
+	assert.Equal(t, 1, count())
+	assert.Equal(t, 1.0, gauge("true"))
+
+	// Losing again deletes the won series
+	assert.NoError(t, a.announceLocal(svc, missingLink(), lbIP, lbIPNet))
+	assert.Equal(t, 0, count())
+
+	// Deleting the service removes it from the gauge
+	a.setAnnouncing("test/winner", lbIP, electionWon)
+	a.svcIngresses["test/winner"] = []v1.LoadBalancerIngress{{IP: lbIP.String()}}
+	assert.NoError(t, a.DeleteBalancer("test/winner", "test", lbIP))
+	assert.Equal(t, 0, count())
+}
+
+func TestReconcileDummy(t *testing.T) {
+	group := func(pool string) *purelbv1.ServiceGroupLocalSpec {
+		return &purelbv1.ServiceGroupLocalSpec{
+			V4Pools: []*purelbv1.ServiceGroupAddressPool{{Pool: pool, Subnet: pool, Aggregation: "default"}},
+		}
+	}
+	addrs := &fakeAddrs{addrs: map[string][]string{
+		"purelb-nonexist": {"192.0.2.1/24", "198.51.100.1/24", "203.0.113.0/24", "fe80::1/64"},
+	}}
+	a := &announcer{
+		client:       &testK8S{t: t},
+		logger:       log.NewNopLogger(),
+		myNode:       "test-node",
+		svcIngresses: map[string][]v1.LoadBalancerIngress{},
+		dummyInt:     missingLink(),
+		addrs:        addrs,
+		groups: map[string]*purelbv1.ServiceGroupLocalSpec{
+			"keep":      group("192.0.2.0/24"),
+			"remove":    group("198.51.100.0/24"),
+			"aggregate": group("203.0.113.0/24"),
+		},
+		aggregates: aggregateRefs{"203.0.113.0/24": {"203.0.113.5": true}},
+	}
+
+	// If the configuration hasn't changed then nothing is removed
+	a.reconcileDummy()
+	assert.Len(t, addrs.addrs["purelb-nonexist"], 4)
+
+	// Addresses (and aggregates) that are no longer in a pool are
+	// removed, but link-local addresses are left alone
+	delete(a.groups, "remove")
+	delete(a.groups, "aggregate")
+	a.reconcileDummy()
+	assert.Equal(t, []string{"192.0.2.1/24", "fe80::1/64"}, addrs.addrs["purelb-nonexist"])
+	assert.Empty(t, a.aggregates)
+}
+
+func TestCheckLocalInterfaces(t *testing.T) {
+	k := &testK8S{t: t}
+	addrs := &fakeAddrs{links: []netlink.Link{
+		&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "lo"}},
+		&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "enp3s0"}},
+	}}
+	a := &announcer{
+		client: k,
+		logger: log.NewNopLogger(),
+		myNode: "test-node",
+		addrs:  addrs,
+	}
+	agent := &purelbv1.LBNodeAgent{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	spec := &purelbv1.LBNodeAgentLocalSpec{LocalInterface: "eth0"}
+	regexes := []*regexp.Regexp{regexp.MustCompile("eth0")}
+
+	// An interface matches so there's nothing to tell the user
+	a.localNameRegexes = []*regexp.Regexp{regexp.MustCompile("enp.*")}
+	a.checkLocalInterfaces(agent, spec)
+	assert.Empty(t, k.events)
+	assert.NotNil(t, a.localNameRegexes)
+
+	// The interface was renamed so we warn the user, but keep the
+	// regexes so addresses are announced remotely
+	a.localNameRegexes = regexes
+	a.checkLocalInterfaces(agent, spec)
+	assert.Equal(t, []string{"NoLocalInterface"}, k.events)
+	assert.Equal(t, regexes, a.localNameRegexes)
+
+	// If the user wants us to, we fall back to the default interface
+	k.events = nil
+	spec.LocalInterfaceFallback = true
+	a.checkLocalInterfaces(agent, spec)
+	assert.Equal(t, []string{"NoLocalInterface"}, k.events)
+	assert.Nil(t, a.localNameRegexes)
+
+	// A subnet matches an interface that has an address in it
+	_, mgmt, _ := net.ParseCIDR("10.0.0.0/24")
+	addrs.addrs = map[string][]string{"enp3s0": {"10.0.0.2/24"}}
+	k.events = nil
+	spec.LocalInterfaceFallback = false
+	a.localSubnet = mgmt
+	a.checkLocalInterfaces(agent, spec)
+	assert.Empty(t, k.events)
+	assert.Equal(t, mgmt, a.localSubnet)
+
+	addrs.addrs = map[string][]string{"enp3s0": {"192.168.1.2/24"}}
+	spec.LocalInterfaceFallback = true
+	a.checkLocalInterfaces(agent, spec)
+	assert.Equal(t, []string{"NoLocalInterface"}, k.events)
+	assert.Nil(t, a.localSubnet)
+}
+
+func TestNodeHasHealthyEndpoint(t *testing.T) {
+	node := "test-node"
+	other := "other-node"
+	eps := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{{
+			Addresses:         []v1.EndpointAddress{{IP: "10.1.1.1", NodeName: &other}},
+			NotReadyAddresses: []v1.EndpointAddress{{IP: "10.1.1.2", NodeName: &node}},
+		}},
+	}
+
+	// Our node's only endpoint isn't ready
+	assert.False(t, nodeHasHealthyEndpoint(eps, node, false))
+
+	// Unless the service publishes not-ready addresses
+	assert.True(t, nodeHasHealthyEndpoint(eps, node, true))
+
+	// Other nodes' not-ready endpoints don't count
+	assert.False(t, nodeHasHealthyEndpoint(eps, "third-node", true))
+
+	// A service with ExternalTrafficPolicy Local that publishes
+	// not-ready addresses is announced from our node. The add fails
+	// because the dummy interface doesn't exist, but that tells us that
+	// we tried.
+	a := &announcer{
+		client:       &testK8S{t: t},
+		logger:       log.NewNopLogger(),
+		myNode:       node,
+		config:       &purelbv1.LBNodeAgentLocalSpec{},
+		svcIngresses: map[string][]v1.LoadBalancerIngress{},
+		dummyInt:     missingLink(),
+		groups: map[string]*purelbv1.ServiceGroupLocalSpec{
+			"remote": {Pool: "10.42.42.0/24", Subnet: "10.42.42.0/24", Aggregation: "default"},
+		},
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test",
+			Name:        "notready",
+			Annotations: map[string]string{purelbv1.PoolAnnotation: "remote"},
+		},
+		Spec: v1.ServiceSpec{ExternalTrafficPolicy: v1.ServiceExternalTrafficPolicyTypeLocal},
+	}
+	assert.NoError(t, a.announceRemote(svc, eps, a.dummyInt, net.ParseIP("10.42.42.1")))
+	svc.Spec.PublishNotReadyAddresses = true
+	assert.Error(t, a.announceRemote(svc, eps, a.dummyInt, net.ParseIP("10.42.42.1")))
+}
+
+func TestPolicyLocalMixedNodes(t *testing.T) {
+	node := "test-node"
+	other := "other-node"
+	a := &announcer{
+		client:       &testK8S{t: t},
+		logger:       log.NewNopLogger(),
+		myNode:       node,
+		config:       &purelbv1.LBNodeAgentLocalSpec{},
+		svcIngresses: map[string][]v1.LoadBalancerIngress{},
+		dummyInt:     missingLink(),
+		groups: map[string]*purelbv1.ServiceGroupLocalSpec{
+			"remote": {Pool: "10.42.42.0/24", Subnet: "10.42.42.0/24", Aggregation: "default"},
+		},
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test",
+			Name:        "mixed",
+			Annotations: map[string]string{purelbv1.PoolAnnotation: "remote"},
+		},
+		Spec: v1.ServiceSpec{ExternalTrafficPolicy: v1.ServiceExternalTrafficPolicyTypeLocal},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		subsets  []v1.EndpointSubset
+		announce bool
+	}{
+		{
+			name: "ready endpoints only on other nodes",
+			subsets: []v1.EndpointSubset{
+				{Addresses: []v1.EndpointAddress{{IP: "10.1.1.1", NodeName: &other}, {IP: "10.1.1.2", NodeName: &other}}},
+				{Addresses: []v1.EndpointAddress{{IP: "10.1.1.3", NodeName: &other}}},
+			},
+			announce: false,
+		},
+		{
+			name: "endpoint without a node",
+			subsets: []v1.EndpointSubset{
+				{Addresses: []v1.EndpointAddress{{IP: "10.1.1.1"}, {IP: "10.1.1.2", NodeName: &other}}},
+			},
+			announce: false,
+		},
+		{
+			name: "one ready endpoint on our node",
+			subsets: []v1.EndpointSubset{
+				{Addresses: []v1.EndpointAddress{{IP: "10.1.1.1", NodeName: &other}, {IP: "10.1.1.2", NodeName: &node}}},
+			},
+			announce: true,
+		},
+		{
+			name: "our endpoint is ready on one port but not another",
+			subsets: []v1.EndpointSubset{
+				{NotReadyAddresses: []v1.EndpointAddress{{IP: "10.1.1.2", NodeName: &node}}},
+				{Addresses: []v1.EndpointAddress{{IP: "10.1.1.1", NodeName: &other}, {IP: "10.1.1.2", NodeName: &node}}},
+			},
+			announce: false,
+		},
+		{
+			name: "one of our endpoints is ready",
+			subsets: []v1.EndpointSubset{
+				{
+					Addresses:         []v1.EndpointAddress{{IP: "10.1.1.3", NodeName: &node}},
+					NotReadyAddresses: []v1.EndpointAddress{{IP: "10.1.1.2", NodeName: &node}},
+				},
+			},
+			announce: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			eps := &v1.Endpoints{Subsets: tc.subsets}
+			assert.Equal(t, tc.announce, nodeHasHealthyEndpoint(eps, node, false))
+
+			// If we announce, the add fails because the dummy interface
+			// doesn't exist. If we don't, the address is withdrawn, which
+			// isn't an error.
+			err := a.announceRemote(svc, eps, a.dummyInt, net.ParseIP("10.42.42.1"))
+			if tc.announce {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestMissingEndpoints(t *testing.T) {
+	a := &announcer{
+		client:       &testK8S{t: t},
+		logger:       log.NewNopLogger(),
+		myNode:       "test-node",
+		config:       &purelbv1.LBNodeAgentLocalSpec{},
+		svcIngresses: map[string][]v1.LoadBalancerIngress{},
+		dummyInt:     missingLink(),
+		groups: map[string]*purelbv1.ServiceGroupLocalSpec{
+			"remote": {Pool: "10.42.42.0/24", Subnet: "10.42.42.0/24", Aggregation: "default"},
+		},
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test",
+			Name:        "new",
+			Annotations: map[string]string{purelbv1.PoolAnnotation: "remote"},
+		},
+		Spec: v1.ServiceSpec{ExternalTrafficPolicy: v1.ServiceExternalTrafficPolicyTypeLocal},
+	}
+
+	// A service with no endpoints yet has no healthy endpoints, which
+	// isn't an error: we just don't announce it (yet).
+	assert.False(t, nodeHasHealthyEndpoint(nil, "test-node", false))
+	assert.NoError(t, a.announceRemote(svc, nil, a.dummyInt, net.ParseIP("10.42.42.1")))
+	assert.NoError(t, a.announceRemote(svc, &v1.Endpoints{}, a.dummyInt, net.ParseIP("10.42.42.1")))
+}
+
+// fakePods implements podChecker with a fixed result, and records the
+// pods that it checks.
+type fakePods struct {
+	ready   bool
+	err     error
+	checked []string
+}
+
+func (f *fakePods) NodePodReady(namespace string, labels string, node string) (bool, error) {
+	f.checked = append(f.checked, namespace+"/"+labels+"@"+node)
+	return f.ready, f.err
+}
+
+func TestCompanionReady(t *testing.T) {
+	pods := &fakePods{}
+	a := &announcer{
+		client:         &testK8S{t: t},
+		logger:         log.NewNopLogger(),
+		myNode:         "test-node",
+		config:         &purelbv1.LBNodeAgentLocalSpec{CompanionSelector: "app=bird"},
+		agentNamespace: "purelb",
+		pods:           pods,
+		svcIngresses:   map[string][]v1.LoadBalancerIngress{},
+		dummyInt:       missingLink(),
+		aggregates:     aggregateRefs{},
+		groups: map[string]*purelbv1.ServiceGroupLocalSpec{
+			"aggr": {
+				V4Pools: []*purelbv1.ServiceGroupAddressPool{{
+					Pool:                  "10.42.42.0/24",
+					Subnet:                "10.42.0.0/16",
+					Aggregation:           "/24",
+					AnnounceAggregateOnly: true,
+				}},
+			},
+		},
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test",
+			Name:        "aggr",
+			Annotations: map[string]string{purelbv1.PoolAnnotation: "aggr"},
+		},
+	}
+	// The aggregate is already on the interface so announcing doesn't
+	// need to touch it
+	_, aggr, _ := net.ParseCIDR("10.42.42.0/24")
+	a.aggregates.hold(*aggr, net.ParseIP("10.42.42.1"))
+
+	// If the companion isn't ready then we don't announce, and we
+	// look for it in the LBNodeAgent's namespace on our node. That's
+	// not an error: the k8s client reprocesses the service when the
+	// companion becomes ready.
+	assert.NoError(t, a.announceRemote(svc, &v1.Endpoints{}, a.dummyInt, net.ParseIP("10.42.42.2")))
+	assert.Equal(t, []string{"purelb/app=bird@test-node"}, pods.checked)
+	assert.Len(t, a.aggregates["10.42.42.0/24"], 1)
+
+	// Once it's ready we announce
+	pods.ready = true
+	assert.NoError(t, a.announceRemote(svc, &v1.Endpoints{}, a.dummyInt, net.ParseIP("10.42.42.2")))
+	assert.Len(t, a.aggregates["10.42.42.0/24"], 2)
+
+	// If we can't tell whether it's ready then we retry, but we don't
+	// withdraw the address
+	pods.err = fmt.Errorf("forbidden")
+	assert.ErrorContains(t, a.announceRemote(svc, &v1.Endpoints{}, a.dummyInt, net.ParseIP("10.42.42.2")), "forbidden")
+	assert.Len(t, a.aggregates["10.42.42.0/24"], 2)
+
+	// If it stops being ready then we withdraw the address
+	pods.err = nil
+	pods.ready = false
+	assert.NoError(t, a.announceRemote(svc, &v1.Endpoints{}, a.dummyInt, net.ParseIP("10.42.42.2")))
+	assert.Len(t, a.aggregates["10.42.42.0/24"], 1)
+	pods.ready = true
+
+	// The companion can be in another namespace
+	pods.checked = nil
+	a.config.CompanionNamespace = "bird"
+	assert.NoError(t, a.announceRemote(svc, &v1.Endpoints{}, a.dummyInt, net.ParseIP("10.42.42.2")))
+	assert.Equal(t, []string{"bird/app=bird@test-node"}, pods.checked)
+
+	// Without a selector we don't check
+	pods.checked = nil
+	a.config.CompanionSelector = ""
+	assert.NoError(t, a.announceRemote(svc, &v1.Endpoints{}, a.dummyInt, net.ParseIP("10.42.42.2")))
+	assert.Empty(t, pods.checked)
+}
+
+// TestAnnounceMultipleSubnets tests that addresses from a group whose
+// pool spans more than one subnet are announced with their own
+// subnet's aggregation.
+func TestAnnounceMultipleSubnets(t *testing.T) {
+	a := &announcer{
+		client:       &testK8S{t: t},
+		logger:       log.NewNopLogger(),
+		myNode:       "test-node",
+		config:       &purelbv1.LBNodeAgentLocalSpec{},
+		svcIngresses: map[string][]v1.LoadBalancerIngress{},
+		dummyInt:     missingLink(),
+		aggregates:   aggregateRefs{},
+		groups: map[string]*purelbv1.ServiceGroupLocalSpec{
+			"multi": {
+				V4Pools: []*purelbv1.ServiceGroupAddressPool{
+					{Pool: "192.0.2.0/31", Subnet: "192.0.2.0/25", Aggregation: "/25", AnnounceAggregateOnly: true},
+					{Pool: "198.51.100.0/31", Subnet: "198.51.100.0/25", Aggregation: "/26", AnnounceAggregateOnly: true},
+				},
+			},
+		},
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test",
+			Name:        "multi",
+			Annotations: map[string]string{purelbv1.PoolAnnotation: "multi"},
+		},
+	}
+
+	// Each address is announced with the aggregation of its own
+	// subnet. The adds fail because the dummy interface doesn't exist
+	// but the errors tell us what we tried to add.
+	err := a.announceRemote(svc, &v1.Endpoints{}, a.dummyInt, net.ParseIP("192.0.2.1"))
+	assert.ErrorContains(t, err, "192.0.2.0/25")
+	err = a.announceRemote(svc, &v1.Endpoints{}, a.dummyInt, net.ParseIP("198.51.100.1"))
+	assert.ErrorContains(t, err, "198.51.100.0/26")
+
+	// Addresses that aren't in either of the pool's ranges are
+	// rejected
+	_, err = a.poolFor(svc, net.ParseIP("203.0.113.1"))
+	assert.Error(t, err)
+}
+
+// fakeDummies implements dummyBackend with a set of dummy interfaces
+// and the addresses on them.
+type fakeDummies struct {
+	links   map[string]netlink.Link
+	addrs   map[string][]netlink.Addr // link name -> addresses
+	deleted []string
+}
+
+func (f *fakeDummies) AddDummy(name string) (netlink.Link, error) {
+	if link, ok := f.links[name]; ok {
+		return link, nil
+	}
+	link := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name}}
+	f.links[name] = link
+	return link, nil
+}
+
+func (f *fakeDummies) LinkDel(link netlink.Link) error {
+	name := link.Attrs().Name
+	delete(f.links, name)
+	delete(f.addrs, name)
+	f.deleted = append(f.deleted, name)
+	return nil
+}
+
+func (f *fakeDummies) AddrList(link netlink.Link, _ int) ([]netlink.Addr, error) {
+	return f.addrs[link.Attrs().Name], nil
+}
+
+func (f *fakeDummies) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	name := link.Attrs().Name
+	f.addrs[name] = append(f.addrs[name], *addr)
+	return nil
+}
+
+func TestRenameDummyInterface(t *testing.T) {
+	mustAddr := func(cidr string, label string) netlink.Addr {
+		addr, err := netlink.ParseAddr(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr.Label = label
+		return *addr
+	}
+	dummies := &fakeDummies{
+		links: map[string]netlink.Link{},
+		addrs: map[string][]netlink.Addr{},
+	}
+	a := &announcer{
+		logger:  log.NewNopLogger(),
+		dummies: dummies,
+	}
+
+	// The first configuration creates the interface
+	assert.NoError(t, a.setDummyInterface("kube-lb0"))
+	assert.Equal(t, "kube-lb0", a.dummyInt.Attrs().Name)
+	dummies.addrs["kube-lb0"] = []netlink.Addr{
+		mustAddr("192.0.2.1/32", ""),
+		mustAddr("2001:db8::1/128", "kube-lb0:web"),
+		mustAddr("fe80::1/64", ""),
+	}
+
+	// Configuring the same name again changes nothing
+	assert.NoError(t, a.setDummyInterface("kube-lb0"))
+	assert.Len(t, dummies.addrs["kube-lb0"], 3)
+	assert.Empty(t, dummies.deleted)
+
+	// Renaming the interface moves our addresses (but not the
+	// kernel's link-local address) to the new interface, and removes
+	// the old one
+	assert.NoError(t, a.setDummyInterface("purelb0"))
+	assert.Equal(t, "purelb0", a.dummyInt.Attrs().Name)
+	assert.Equal(t, []string{"kube-lb0"}, dummies.deleted)
+	moved := dummies.addrs["purelb0"]
+	if assert.Len(t, moved, 2) {
+		assert.Equal(t, "192.0.2.1/32", moved[0].IPNet.String())
+		assert.Equal(t, "", moved[0].Label)
+		assert.Equal(t, "2001:db8::1/128", moved[1].IPNet.String())
+		assert.Equal(t, "purelb0:web", moved[1].Label, "label not renamed")
+	}
+}
+
+func TestMaintenanceWindow(t *testing.T) {
+	k := &testK8S{t: t}
+	elector := &fakeElector{winner: "other-node"}
+	a := &announcer{
+		client:       k,
+		logger:       log.NewNopLogger(),
+		myNode:       "test-node",
+		config:       &purelbv1.LBNodeAgentLocalSpec{},
+		svcIngresses: map[string][]v1.LoadBalancerIngress{},
+		election:     elector,
+	}
+	window := func(from time.Duration, to time.Duration) string {
+		now := time.Now()
+		return now.Add(from).Format(time.RFC3339) + "/" + now.Add(to).Format(time.RFC3339)
+	}
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "test",
+		Name:      "maint",
+		Annotations: map[string]string{
+			purelbv1.AnnounceAnnotation + "-IPv4": "test-node,eth0",
+			purelbv1.MaintenanceWindowAnnotation:  window(-time.Hour, time.Hour),
+		},
+	}}
+	lbIP := net.ParseIP("192.0.2.1")
+	lbIPNet := net.IPNet{IP: lbIP, Mask: net.CIDRMask(24, 32)}
+
+	// During the window we keep announcing the address even though
+	// another node won the election. The add fails because the
+	// interface doesn't exist but we tried.
+	assert.Error(t, a.announceLocal(svc, missingLink(), lbIP, lbIPNet))
+	assert.Contains(t, k.events, "AnnouncingLocal")
+
+	// ...and if another node is announcing it then we don't take it
+	// over even if we win
+	k.events = nil
+	elector.winner = "test-node"
+	svc.Annotations[purelbv1.AnnounceAnnotation+"-IPv4"] = "other-node,eth0"
+	assert.NoError(t, a.announceLocal(svc, missingLink(), lbIP, lbIPNet))
+	assert.NotContains(t, k.events, "AnnouncingLocal")
+
+	// After the window the election decides again
+	svc.Annotations[purelbv1.MaintenanceWindowAnnotation] = window(-2*time.Hour, -time.Hour)
+	assert.Error(t, a.announceLocal(svc, missingLink(), lbIP, lbIPNet))
+	assert.Contains(t, k.events, "AnnouncingLocal")
+	k.events = nil
+	elector.winner = "other-node"
+	svc.Annotations[purelbv1.AnnounceAnnotation+"-IPv4"] = "test-node,eth0"
+	assert.NoError(t, a.announceLocal(svc, missingLink(), lbIP, lbIPNet))
+	assert.NotContains(t, k.events, "AnnouncingLocal")
+
+	// So does it before the window, and if the window is invalid
+	svc.Annotations[purelbv1.MaintenanceWindowAnnotation] = window(time.Hour, 2*time.Hour)
+	assert.NoError(t, a.announceLocal(svc, missingLink(), lbIP, lbIPNet))
+	svc.Annotations[purelbv1.MaintenanceWindowAnnotation] = window(time.Hour, -time.Hour)
+	assert.NoError(t, a.announceLocal(svc, missingLink(), lbIP, lbIPNet))
+	assert.Contains(t, k.events, "InvalidMaintenanceWindow")
+	assert.NotContains(t, k.events, "AnnouncingLocal")
+}
+
+func TestAnnounceOnAllMatching(t *testing.T) {
+	eth0 := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth0", Index: 2, Flags: net.FlagUp}}
+	eth1 := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth1", Index: 3, Flags: net.FlagUp}}
+	a := &announcer{
+		logger:           log.NewNopLogger(),
+		config:           &purelbv1.LBNodeAgentLocalSpec{},
+		localNameRegexes: []*regexp.Regexp{regexp.MustCompile("^eth")},
+		addrs: &fakeAddrs{
+			links: []netlink.Link{eth0, eth1},
+			addrs: map[string][]string{
+				"eth0": {"192.0.2.10/24"},
+				"eth1": {"192.0.2.11/24"},
+			},
+		},
+	}
+	lbIP := net.ParseIP("192.0.2.1")
+
+	// By default we announce only on the first interface
+	links, _ := a.extraLocalLinks(eth0, lbIP)
+	assert.Empty(t, links)
+
+	// With the option we announce on the other one, too
+	a.config.AnnounceOnAllMatching = true
+	links, nets := a.extraLocalLinks(eth0, lbIP)
+	if assert.Len(t, links, 1) {
+		assert.Equal(t, "eth1", links[0].Attrs().Name)
+		assert.Equal(t, "192.0.2.1/24", nets[0].String())
+	}
+
+	// The option doesn't work with per-address macvlans, or without
+	// interface regexes
+	a.config.VIPMacvlan = true
+	links, _ = a.extraLocalLinks(eth0, lbIP)
+	assert.Empty(t, links)
+	a.config.VIPMacvlan = false
+	a.localNameRegexes = nil
+	links, _ = a.extraLocalLinks(eth0, lbIP)
+	assert.Empty(t, links)
+}
@@ -0,0 +1,182 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/vishvananda/netlink"
+)
+
+// linkSubscriber delivers link updates to ch until done is closed.
+// netlink.LinkSubscribe is a linkSubscriber.
+type linkSubscriber func(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error
+
+// bondWatch resends GARPs for the addresses that we announce on
+// bonded interfaces when a bond fails over to a different member.
+// The switches learned where the addresses live from the old active
+// member so they'd send traffic to the wrong port until they hear
+// from the new one. It's safe to use from more than one goroutine.
+type bondWatch struct {
+	sync.Mutex
+
+	logger    log.Logger
+	subscribe linkSubscriber
+	done      chan struct{} // nil if we're not watching
+
+	active map[string]int                     // bond name -> index of its active member
+	sends  map[string]map[string]func() error // bond name -> address -> GARP sender
+}
+
+// newBondWatch returns a bondWatch that gets link updates from
+// subscribe.
+func newBondWatch(logger log.Logger, subscribe linkSubscriber) *bondWatch {
+	return &bondWatch{
+		logger:    logger,
+		subscribe: subscribe,
+		active:    map[string]int{},
+		sends:     map[string]map[string]func() error{},
+	}
+}
+
+// add tells the watch to call send whenever the bond link fails over,
+// for as long as we announce lbIP on it. If link isn't a bond then add
+// does nothing.
+func (w *bondWatch) add(link netlink.Link, lbIP string, send func() error) {
+	bond, ok := link.(*netlink.Bond)
+	if !ok {
+		return
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	name := bond.Attrs().Name
+	if _, ok := w.sends[name]; !ok {
+		w.sends[name] = map[string]func() error{}
+		w.active[name] = bond.ActiveSlave
+	}
+	w.sends[name][lbIP] = send
+
+	w.start()
+}
+
+// remove stops resending GARPs for lbIP.
+func (w *bondWatch) remove(lbIP string) {
+	w.Lock()
+	defer w.Unlock()
+
+	for name, sends := range w.sends {
+		delete(sends, lbIP)
+		if len(sends) == 0 {
+			delete(w.sends, name)
+			delete(w.active, name)
+		}
+	}
+
+	// If we're not announcing anything on a bond then we don't need
+	// to watch them
+	if len(w.sends) == 0 {
+		w.stop()
+	}
+}
+
+// update handles a link update. If link is a bond whose active member
+// has changed then we resend the GARPs for its addresses.
+func (w *bondWatch) update(link netlink.Link) {
+	bond, ok := link.(*netlink.Bond)
+	if !ok {
+		return
+	}
+	name := bond.Attrs().Name
+
+	w.Lock()
+	previous, watched := w.active[name]
+	if !watched || previous == bond.ActiveSlave {
+		w.Unlock()
+		return
+	}
+	w.active[name] = bond.ActiveSlave
+	sends := make(map[string]func() error, len(w.sends[name]))
+	for lbIP, send := range w.sends[name] {
+		sends[lbIP] = send
+	}
+	w.Unlock()
+
+	// The bond has no active member while it's between members, so
+	// wait until it has a new one
+	if bond.ActiveSlave <= 0 {
+		return
+	}
+
+	w.logger.Log("event", "bondFailover", "interface", name, "active", bond.ActiveSlave)
+	for lbIP, send := range sends {
+		if err := send(); err != nil {
+			w.logger.Log("op", "bondFailover", "interface", name, "ip", lbIP, "error", err)
+		}
+	}
+}
+
+// start starts watching link updates if we're not already. The caller
+// must hold the lock.
+func (w *bondWatch) start() {
+	if w.done != nil {
+		return
+	}
+
+	updates := make(chan netlink.LinkUpdate)
+	done := make(chan struct{})
+	if err := w.subscribe(updates, done); err != nil {
+		w.logger.Log("op", "watchBonds", "error", err)
+		return
+	}
+	w.done = done
+
+	// The subscription closes updates when it ends, either because we
+	// stopped it or because it failed. If it failed then we forget it
+	// so the next add starts a new one.
+	go func() {
+		for update := range updates {
+			w.update(update.Link)
+		}
+
+		w.Lock()
+		defer w.Unlock()
+		if w.done == done {
+			w.logger.Log("op", "watchBonds", "msg", "link subscription ended")
+			w.done = nil
+		}
+	}()
+}
+
+// stop stops watching link updates. The caller must hold the lock.
+func (w *bondWatch) stop() {
+	if w.done != nil {
+		close(w.done)
+		w.done = nil
+	}
+}
+
+// Shutdown stops watching link updates and forgets all of the
+// addresses that we were watching.
+func (w *bondWatch) Shutdown() {
+	w.Lock()
+	defer w.Unlock()
+
+	w.stop()
+	w.sends = map[string]map[string]func() error{}
+	w.active = map[string]int{}
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+)
+
+// fakeSubscriber is a linkSubscriber that lets the test deliver link
+// updates.
+type fakeSubscriber struct {
+	updates chan<- netlink.LinkUpdate
+	done    <-chan struct{}
+}
+
+func (f *fakeSubscriber) subscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error {
+	f.updates, f.done = ch, done
+	go func() {
+		<-done
+		close(ch)
+	}()
+	return nil
+}
+
+func bond(name string, active int) *netlink.Bond {
+	b := netlink.NewLinkBond(netlink.LinkAttrs{Name: name, Index: 10})
+	b.ActiveSlave = active
+	return b
+}
+
+func TestBondWatch(t *testing.T) {
+	var sends int32
+	send := func() error {
+		atomic.AddInt32(&sends, 1)
+		return nil
+	}
+	sent := func() int32 { return atomic.LoadInt32(&sends) }
+
+	sub := &fakeSubscriber{}
+	w := newBondWatch(log.NewNopLogger(), sub.subscribe)
+
+	// Addresses on other kinds of interfaces aren't watched
+	w.add(&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth0"}}, "192.0.2.1", send)
+	assert.Nil(t, sub.updates, "watching without any bonds")
+
+	// Addresses on bonds start the watch
+	w.add(bond("bond0", 11), "192.0.2.2", send)
+	assert.NotNil(t, sub.updates, "not watching a bond")
+
+	// Updates that don't change the active member don't send GARPs
+	w.update(bond("bond0", 11))
+	w.update(bond("bond1", 12))
+	assert.Equal(t, int32(0), sent())
+
+	// Neither does the bond losing its active member...
+	w.update(bond("bond0", 0))
+	assert.Equal(t, int32(0), sent())
+
+	// ...but a failover to a new member does
+	sub.updates <- netlink.LinkUpdate{Link: bond("bond0", 12)}
+	assert.Eventually(t, func() bool { return sent() == 1 }, time.Second, 10*time.Millisecond)
+	w.update(bond("bond0", 12))
+	assert.Equal(t, int32(1), sent())
+
+	// Withdrawing the last address stops the watch
+	done := sub.done
+	w.remove("192.0.2.2")
+	assert.Empty(t, w.sends)
+	select {
+	case <-done:
+	default:
+		t.Error("still watching after the last address was withdrawn")
+	}
+	w.update(bond("bond0", 11))
+	assert.Equal(t, int32(1), sent())
+}
@@ -0,0 +1,177 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"net"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/vishvananda/netlink/nl"
+	v1 "k8s.io/api/core/v1"
+
+	purelbv1 "purelb.io/pkg/apis/v1"
+)
+
+// garpRetryInterval is how often we resend GARPs for an address while
+// we're retrying.
+const garpRetryInterval = time.Second
+
+// sendsGARP returns true if we're configured to send GARPs when we
+// add an address in family. IPv6 doesn't use ARP so for IPv6
+// addresses we send unsolicited Neighbor Advertisements instead, and
+// they have their own option.
+func (a *announcer) sendsGARP(family int) bool {
+	if family == nl.FAMILY_V6 {
+		return a.config.SendUnsolicitedNA
+	}
+	return a.config.SendGratuitousARP
+}
+
+// garpSender returns a function that tells the network that lbIP
+// lives on the interfaces named ifNames: a gratuitous ARP for IPv4
+// addresses and an unsolicited Neighbor Advertisement for IPv6. The
+// function tries all of the interfaces and returns the most recent
+// error.
+func garpSender(lbIP net.IP, ifNames ...string) func() error {
+	send := sendGARP
+	if purelbv1.AddrFamily(lbIP) == nl.FAMILY_V6 {
+		send = sendUnsolicitedNA
+	}
+	return func() error {
+		var retErr error
+		for _, ifName := range ifNames {
+			if err := send(ifName, lbIP); err != nil {
+				retErr = err
+			}
+		}
+		return retErr
+	}
+}
+
+// garpRetry resends GARPs for an address in the background. Switches
+// that are slow to relearn the address's location might miss the
+// GARPs that we send when we take over an address, so if the user
+// configures a retry duration we keep sending them for a while.
+type garpRetry struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// retryGARP calls send every interval until duration has passed or
+// the retry is stopped. If duration is 0 then it keeps going until
+// it's stopped. The caller is responsible for the first send.
+func retryGARP(logger log.Logger, send func() error, interval, duration time.Duration) *garpRetry {
+	r := &garpRetry{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(r.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var deadline <-chan time.Time
+		if duration > 0 {
+			timer := time.NewTimer(duration)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-deadline:
+				return
+			case <-ticker.C:
+				if err := send(); err != nil {
+					logger.Log("op", "retryGARP", "error", err)
+				}
+			}
+		}
+	}()
+
+	return r
+}
+
+// Stop stops r and waits until it's finished. It's OK to stop a retry
+// that has already finished, but not to stop one twice.
+func (r *garpRetry) Stop() {
+	close(r.stop)
+	<-r.done
+}
+
+// startGARPRetry starts resending GARPs for lbIP using send. The
+// retries stop after duration. We retry only once per takeover, i.e.,
+// if we've already retried for lbIP then we don't start again until
+// the address has been withdrawn.
+func (a *announcer) startGARPRetry(lbIP string, send func() error, duration time.Duration) {
+	if _, ok := a.garpRetries[lbIP]; ok {
+		return
+	}
+	a.garpRetries[lbIP] = retryGARP(log.With(a.logger, "ip", lbIP), send, garpRetryInterval, duration)
+}
+
+// stopGARPRetry stops resending GARPs for lbIP and forgets that we
+// retried for it.
+func (a *announcer) stopGARPRetry(lbIP string) {
+	if r, ok := a.garpRetries[lbIP]; ok {
+		r.Stop()
+		delete(a.garpRetries, lbIP)
+	}
+}
+
+// garpRefresh sends GARPs for an address periodically for as long as
+// we announce it.
+type garpRefresh struct {
+	*garpRetry
+	interval time.Duration
+}
+
+// garpInterval returns how often we resend GARPs for lbIP according
+// to its pool's configuration, or 0 if we don't.
+func (a *announcer) garpInterval(svc *v1.Service, lbIP net.IP) time.Duration {
+	pool, err := a.poolFor(svc, lbIP)
+	if err != nil {
+		return 0
+	}
+	return pool.GARPInterval.Duration
+}
+
+// startGARPRefresh starts sending GARPs for lbIP using send every
+// interval. If we're already sending them at a different interval
+// (e.g., because the user changed the pool) then we restart.
+func (a *announcer) startGARPRefresh(lbIP string, send func() error, interval time.Duration) {
+	if r, ok := a.garpRefreshes[lbIP]; ok {
+		if r.interval == interval {
+			return
+		}
+		a.stopGARPRefresh(lbIP)
+	}
+	a.garpRefreshes[lbIP] = &garpRefresh{
+		garpRetry: retryGARP(log.With(a.logger, "ip", lbIP), send, interval, 0),
+		interval:  interval,
+	}
+}
+
+// stopGARPRefresh stops sending periodic GARPs for lbIP.
+func (a *announcer) stopGARPRefresh(lbIP string) {
+	if r, ok := a.garpRefreshes[lbIP]; ok {
+		r.Stop()
+		delete(a.garpRefreshes, lbIP)
+	}
+}
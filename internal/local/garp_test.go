@@ -0,0 +1,170 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink/nl"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	purelbv1 "purelb.io/pkg/apis/v1"
+)
+
+func TestRetryGARP(t *testing.T) {
+	var sends int32
+	send := func() error {
+		atomic.AddInt32(&sends, 1)
+		return fmt.Errorf("errors don't stop the retries")
+	}
+
+	// The retries keep going for the whole duration, then stop on
+	// their own
+	r := retryGARP(log.NewNopLogger(), send, 10*time.Millisecond, 100*time.Millisecond)
+	<-r.done
+	count := atomic.LoadInt32(&sends)
+	assert.GreaterOrEqual(t, count, int32(3), "too few retries")
+	assert.LessOrEqual(t, count, int32(10), "too many retries")
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, count, atomic.LoadInt32(&sends), "retries continued after the duration")
+
+	// Stopping a finished retry is OK
+	r.Stop()
+}
+
+func TestStopGARPRetry(t *testing.T) {
+	var sends int32
+	send := func() error {
+		atomic.AddInt32(&sends, 1)
+		return nil
+	}
+
+	a := &announcer{
+		logger:      log.NewNopLogger(),
+		garpRetries: map[string]*garpRetry{},
+	}
+
+	a.startGARPRetry("192.168.1.1", send, time.Hour)
+	r := a.garpRetries["192.168.1.1"]
+	assert.NotNil(t, r)
+
+	// Starting again while we're retrying doesn't start another retry
+	a.startGARPRetry("192.168.1.1", send, time.Hour)
+	assert.Equal(t, r, a.garpRetries["192.168.1.1"])
+
+	// Withdrawing the address stops the retries
+	a.stopGARPRetry("192.168.1.1")
+	assert.Empty(t, a.garpRetries)
+	count := atomic.LoadInt32(&sends)
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, count, atomic.LoadInt32(&sends), "retries continued after stop")
+
+	// Stopping an address that we're not retrying is OK
+	a.stopGARPRetry("192.168.1.2")
+}
+
+func TestGARPRefresh(t *testing.T) {
+	var sends int32
+	send := func() error {
+		atomic.AddInt32(&sends, 1)
+		return nil
+	}
+
+	a := &announcer{
+		logger:        log.NewNopLogger(),
+		garpRefreshes: map[string]*garpRefresh{},
+		groups: map[string]*purelbv1.ServiceGroupLocalSpec{
+			"dhcp": {
+				V4Pools: []*purelbv1.ServiceGroupAddressPool{{
+					Pool:         "192.168.1.0/28",
+					Subnet:       "192.168.1.0/24",
+					GARPInterval: metav1.Duration{Duration: 10 * time.Millisecond},
+				}},
+				V6Pools: []*purelbv1.ServiceGroupAddressPool{{
+					Pool:         "fc00::/124",
+					Subnet:       "fc00::/64",
+					GARPInterval: metav1.Duration{Duration: 10 * time.Millisecond},
+				}},
+			},
+			"static": {
+				V4Pools: []*purelbv1.ServiceGroupAddressPool{{
+					Pool:   "192.168.2.0/28",
+					Subnet: "192.168.2.0/24",
+				}},
+			},
+		},
+	}
+	svc := func(pool string) *v1.Service {
+		return &v1.Service{ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test",
+			Name:        pool,
+			Annotations: map[string]string{purelbv1.PoolAnnotation: pool},
+		}}
+	}
+
+	// Only the addresses from the pool with the interval get periodic
+	// GARPs (or Neighbor Advertisements for IPv6)
+	assert.Equal(t, 10*time.Millisecond, a.garpInterval(svc("dhcp"), net.ParseIP("192.168.1.1")))
+	assert.Equal(t, 10*time.Millisecond, a.garpInterval(svc("dhcp"), net.ParseIP("fc00::1")))
+	assert.Zero(t, a.garpInterval(svc("static"), net.ParseIP("192.168.2.1")))
+
+	// The GARPs keep going until we stop them
+	a.startGARPRefresh("192.168.1.1", send, 10*time.Millisecond)
+	r := a.garpRefreshes["192.168.1.1"]
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&sends) >= 5 }, time.Second, 10*time.Millisecond)
+
+	// Starting again with the same interval doesn't restart, but
+	// changing the interval does
+	a.startGARPRefresh("192.168.1.1", send, 10*time.Millisecond)
+	assert.Equal(t, r, a.garpRefreshes["192.168.1.1"])
+	a.startGARPRefresh("192.168.1.1", send, 20*time.Millisecond)
+	assert.NotEqual(t, r, a.garpRefreshes["192.168.1.1"])
+	assert.Equal(t, 20*time.Millisecond, a.garpRefreshes["192.168.1.1"].interval)
+
+	// Withdrawing the address stops the GARPs
+	a.stopGARPRefresh("192.168.1.1")
+	assert.Empty(t, a.garpRefreshes)
+	count := atomic.LoadInt32(&sends)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, count, atomic.LoadInt32(&sends), "GARPs continued after stop")
+}
+
+func TestSendsGARP(t *testing.T) {
+	a := &announcer{config: &purelbv1.LBNodeAgentLocalSpec{}}
+
+	// Each family has its own switch
+	for _, test := range []struct {
+		garp, na bool
+		v4Sends  bool
+		v6Sends  bool
+	}{
+		{garp: false, na: false, v4Sends: false, v6Sends: false},
+		{garp: true, na: false, v4Sends: true, v6Sends: false},
+		{garp: false, na: true, v4Sends: false, v6Sends: true},
+		{garp: true, na: true, v4Sends: true, v6Sends: true},
+	} {
+		a.config.SendGratuitousARP = test.garp
+		a.config.SendUnsolicitedNA = test.na
+		assert.Equal(t, test.v4Sends, a.sendsGARP(nl.FAMILY_V4), "sendgarp %v sendna %v", test.garp, test.na)
+		assert.Equal(t, test.v6Sends, a.sendsGARP(nl.FAMILY_V6), "sendgarp %v sendna %v", test.garp, test.na)
+	}
+}
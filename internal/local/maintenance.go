@@ -0,0 +1,70 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+
+	purelbv1 "purelb.io/pkg/apis/v1"
+)
+
+// parseMaintenanceWindow parses the value of a
+// MaintenanceWindowAnnotation, i.e., two RFC 3339 times separated by a
+// "/".
+func parseMaintenanceWindow(value string) (time.Time, time.Time, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) != 2 {
+		return time.Time{}, time.Time{}, fmt.Errorf("maintenance window %q is not of the form start/end", value)
+	}
+	start, err := time.Parse(time.RFC3339, strings.TrimSpace(parts[0]))
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("maintenance window %q has an invalid start: %w", value, err)
+	}
+	end, err := time.Parse(time.RFC3339, strings.TrimSpace(parts[1]))
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("maintenance window %q has an invalid end: %w", value, err)
+	}
+	if !end.After(start) {
+		return time.Time{}, time.Time{}, fmt.Errorf("maintenance window %q ends before it starts", value)
+	}
+	return start, end, nil
+}
+
+// maintenanceHolder returns the node that's announcing lbIP if svc is
+// in its maintenance window, so the caller can keep that node as the
+// winner. It returns "" if svc isn't in a maintenance window or if no
+// node is announcing lbIP.
+func (a *announcer) maintenanceHolder(svc *v1.Service, lbIP net.IP, now time.Time) string {
+	window, hasWindow := svc.Annotations[purelbv1.MaintenanceWindowAnnotation]
+	if !hasWindow {
+		return ""
+	}
+	start, end, err := parseMaintenanceWindow(window)
+	if err != nil {
+		a.logger.Log("op", "maintenanceWindow", "service", svc.Namespace+"/"+svc.Name, "error", err)
+		a.client.Errorf(svc, "InvalidMaintenanceWindow", "Node %s ignoring the maintenance window: %s", a.myNode, err)
+		return ""
+	}
+	if now.Before(start) || !now.Before(end) {
+		return ""
+	}
+
+	return announcingNode(svc, lbIP)
+}
@@ -18,44 +18,195 @@ import (
 	"fmt"
 	"net"
 	"regexp"
+	"syscall"
 
 	"github.com/mdlayher/arp"
 	"github.com/mdlayher/ethernet"
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/net/icmp"
 
 	purelbv1 "purelb.io/pkg/apis/v1"
 )
 
 // findLocal tries to find a "local" network interface based on the
 // name of the interface and the IP addresses that are assigned to it.
-// A network interface is considered local if its name matches the
-// configuration regex and lbIP is within the same network as the
-// interface.  If both are true, then the netlink.Link return value
-// will be the default interface and error will be nil.  If error is
-// non-nil then no local interface was found.
-func findLocal(regex *regexp.Regexp, lbIP net.IP) (net.IPNet, netlink.Link, error) {
+// A network interface is considered local if it's up, its name
+// matches one of the configuration regexes, and lbIP is within the
+// same network as the interface. The regexes are tried in order so
+// the user can configure a fallback chain of interfaces. If we find
+// a local interface then the netlink.Link return value will be that
+// interface and error will be nil.  If error is non-nil then no local
+// interface was found.
+func findLocal(regexes []*regexp.Regexp, lbIP net.IP) (net.IPNet, netlink.Link, error) {
 	interfaces, err := net.Interfaces()
 	if err != nil {
 		return net.IPNet{}, nil, err
 	}
 
+	infos := []interfaceInfo{}
 	for _, intf := range interfaces {
-		if regex.Match([]byte(intf.Name)) {
-			// The interface name matches the local regex so check if the
-			// addresses also match
-			nlIntf, err := netlink.LinkByName(intf.Name)
-			if err != nil {
-				return net.IPNet{}, nil, err
+		if !matchesAny(regexes, intf.Name) {
+			continue
+		}
+		nlIntf, err := netlink.LinkByName(intf.Name)
+		if err != nil {
+			return net.IPNet{}, nil, err
+		}
+		addrs, err := netlink.AddrList(nlIntf, purelbv1.AddrFamily(lbIP))
+		if err != nil {
+			return net.IPNet{}, nil, err
+		}
+		infos = append(infos, interfaceInfo{name: intf.Name, up: intf.Flags&net.FlagUp != 0, addrs: addrs})
+	}
+
+	name, lbIPNet, err := selectLocal(regexes, infos, lbIP)
+	if err != nil {
+		return lbIPNet, nil, err
+	}
+	link, err := netlink.LinkByName(name)
+	return lbIPNet, link, err
+}
+
+// interfaceInfo holds what we need to know about an interface to
+// decide whether it's local to an address.
+type interfaceInfo struct {
+	name  string
+	up    bool
+	addrs []netlink.Addr
+}
+
+// selectLocal returns the name of the first interface in intfs that's
+// up and local to lbIP, trying each of the regexes in order, and lbIP
+// with that interface's subnet mask. If error is non-nil then no local
+// interface was found.
+func selectLocal(regexes []*regexp.Regexp, intfs []interfaceInfo, lbIP net.IP) (string, net.IPNet, error) {
+	for _, regex := range regexes {
+		for _, intf := range intfs {
+			if !intf.up || !regex.MatchString(intf.name) {
+				continue
+			}
+			if mask := localMask(intf.addrs, lbIP); mask != nil {
+				return intf.name, net.IPNet{IP: lbIP, Mask: mask}, nil
 			}
-			if ipnet, link, err := checkLocal(nlIntf, lbIP); err == nil {
-				// The addresses match so this is a local interface
-				return ipnet, link, nil
+		}
+	}
+
+	return "", net.IPNet{}, fmt.Errorf("No local interface found")
+}
+
+// selectAllLocal returns the names of all of the interfaces in intfs
+// that are up, match one of the regexes, and are local to lbIP, along
+// with lbIP with each interface's subnet mask. They're in the order in
+// which selectLocal would try them.
+func selectAllLocal(regexes []*regexp.Regexp, intfs []interfaceInfo, lbIP net.IP) ([]string, []net.IPNet) {
+	names := []string{}
+	nets := []net.IPNet{}
+	seen := map[string]bool{}
+	for _, regex := range regexes {
+		for _, intf := range intfs {
+			if seen[intf.name] || !intf.up || !regex.MatchString(intf.name) {
+				continue
 			}
+			if mask := localMask(intf.addrs, lbIP); mask != nil {
+				seen[intf.name] = true
+				names = append(names, intf.name)
+				nets = append(nets, net.IPNet{IP: lbIP, Mask: mask})
+			}
+		}
+	}
+	return names, nets
+}
+
+// matchesAny returns true if name matches any of regexes.
+func matchesAny(regexes []*regexp.Regexp, name string) bool {
+	for _, regex := range regexes {
+		if regex.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// localSubnetPrefix marks a LocalInterface that selects the local
+// interface by address instead of by name, e.g., "cidr:10.0.0.0/24".
+const localSubnetPrefix = "cidr:"
+
+// findLocalBySubnet tries to find a "local" network interface based
+// on the addresses that are assigned to it. A network interface is
+// considered local if it's up, it has an address in subnet, and lbIP
+// is within the same network as the interface. If more than one
+// interface is local then we use the one with the most specific route
+// to lbIP. If error is non-nil then no local interface was found.
+func findLocalBySubnet(backend addrBackend, subnet *net.IPNet, lbIP net.IP) (net.IPNet, netlink.Link, error) {
+	links, err := backend.LinkList()
+	if err != nil {
+		return net.IPNet{}, nil, err
+	}
+
+	byName := map[string]netlink.Link{}
+	infos := []interfaceInfo{}
+	for _, link := range links {
+		attrs := link.Attrs()
+		// subnet and lbIP can be in different families so we need all of
+		// the interface's addresses
+		addrs, err := backend.AddrList(link, nl.FAMILY_ALL)
+		if err != nil {
+			return net.IPNet{}, nil, err
 		}
+		byName[attrs.Name] = link
+		infos = append(infos, interfaceInfo{name: attrs.Name, up: attrs.Flags&net.FlagUp != 0, addrs: addrs})
 	}
 
-	return net.IPNet{}, nil, fmt.Errorf("No local interface found")
+	name, lbIPNet, err := selectBySubnet(subnet, infos, lbIP)
+	if err != nil {
+		return lbIPNet, nil, err
+	}
+	return lbIPNet, byName[name], nil
+}
+
+// selectBySubnet returns the name of the interface in intfs that's up,
+// has an address in subnet, and has the most specific route to lbIP,
+// and lbIP with that interface's subnet mask. If two interfaces are
+// equally specific then the first one wins. If error is non-nil then
+// no local interface was found.
+func selectBySubnet(subnet *net.IPNet, intfs []interfaceInfo, lbIP net.IP) (string, net.IPNet, error) {
+	name := ""
+	var best net.IPMask
+	for _, intf := range intfs {
+		if !intf.up || !hasAddressIn(intf.addrs, subnet) {
+			continue
+		}
+		mask := localMask(intf.addrs, lbIP)
+		if mask == nil {
+			continue
+		}
+		if best != nil && prefixLength(mask) <= prefixLength(best) {
+			continue
+		}
+		name, best = intf.name, mask
+	}
+
+	if name == "" {
+		return "", net.IPNet{}, fmt.Errorf("No local interface found")
+	}
+	return name, net.IPNet{IP: lbIP, Mask: best}, nil
+}
+
+// hasAddressIn returns true if any of addrs is in subnet.
+func hasAddressIn(addrs []netlink.Addr, subnet *net.IPNet) bool {
+	for _, addr := range addrs {
+		if addr.IPNet != nil && subnet.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixLength returns the number of leading ones in mask.
+func prefixLength(mask net.IPMask) int {
+	ones, _ := mask.Size()
+	return ones
 }
 
 // checkLocal determines whether lbIP belongs to the same network as
@@ -72,50 +223,67 @@ func checkLocal(intf netlink.Link, lbIP net.IP) (net.IPNet, netlink.Link, error)
 		return lbIPNet, intf, err
 	}
 
-	if family == nl.FAMILY_V4 {
-		for _, addrs := range defaddrs {
-			localnet := addrs.IPNet
-
-			if localnet.Contains(lbIPNet.IP) {
-				lbIPNet.Mask = localnet.Mask
-			}
-		}
-
-	} else {
-		for _, addrs := range defaddrs {
-
-			/*  ifa_flags from linux source if_addr.h
-
-			#define IFA_F_SECONDARY		0x01
-			#define IFA_F_TEMPORARY		IFA_F_SECONDARY
+	lbIPNet.Mask = localMask(defaddrs, lbIP)
+	if lbIPNet.Mask == nil {
+		return lbIPNet, intf, fmt.Errorf("non-local address")
+	}
 
-			#define	IFA_F_NODAD		0x02
-			#define IFA_F_OPTIMISTIC	0x04
-			#define IFA_F_DADFAILED		0x08
-			#define	IFA_F_HOMEADDRESS	0x10
-			#define IFA_F_DEPRECATED	0x20
-			#define IFA_F_TENTATIVE		0x40
-			#define IFA_F_PERMANENT		0x80
-			#define IFA_F_MANAGETEMPADDR	0x100
-			#define IFA_F_NOPREFIXROUTE	0x200
-			#define IFA_F_MCAUTOJOIN	0x400
-			#define IFA_F_STABLE_PRIVACY	0x800
+	return lbIPNet, intf, nil
+}
 
-			*/
+// localMask returns the mask of the subnet in addrs that contains
+// lbIP, or nil if none of them do. All of the addresses are
+// considered, not just the primary, so an interface with several
+// subnets is local to addresses in any of them. If more than one
+// subnet contains lbIP then the most specific wins. Host addresses
+// (/32 or /128) aren't subnets (they're usually service addresses
+// that we added) so they're ignored.
+func localMask(addrs []netlink.Addr, lbIP net.IP) net.IPMask {
+	var mask net.IPMask
+
+	for _, addr := range addrs {
+
+		/*  ifa_flags from linux source if_addr.h
+
+		#define IFA_F_SECONDARY		0x01
+		#define IFA_F_TEMPORARY		IFA_F_SECONDARY
+
+		#define	IFA_F_NODAD		0x02
+		#define IFA_F_OPTIMISTIC	0x04
+		#define IFA_F_DADFAILED		0x08
+		#define	IFA_F_HOMEADDRESS	0x10
+		#define IFA_F_DEPRECATED	0x20
+		#define IFA_F_TENTATIVE		0x40
+		#define IFA_F_PERMANENT		0x80
+		#define IFA_F_MANAGETEMPADDR	0x100
+		#define IFA_F_NOPREFIXROUTE	0x200
+		#define IFA_F_MCAUTOJOIN	0x400
+		#define IFA_F_STABLE_PRIVACY	0x800
+
+		*/
+
+		if purelbv1.AddrFamily(lbIP) == nl.FAMILY_V6 && addr.Flags >= 256 {
+			continue
+		}
 
-			localnet := addrs.IPNet
+		localnet := addr.IPNet
+		if localnet == nil || !localnet.Contains(lbIP) {
+			continue
+		}
 
-			if localnet.Contains(lbIPNet.IP) == true && addrs.Flags < 256 {
-				lbIPNet.Mask = localnet.Mask
+		ones, bits := localnet.Mask.Size()
+		if ones == bits {
+			continue
+		}
+		if mask != nil {
+			if current, _ := mask.Size(); current >= ones {
+				continue
 			}
 		}
+		mask = localnet.Mask
 	}
 
-	if lbIPNet.Mask == nil {
-		return lbIPNet, intf, fmt.Errorf("non-local address")
-	}
-
-	return lbIPNet, intf, nil
+	return mask
 }
 
 // defaultInterface finds the default interface (i.e., the one with
@@ -152,9 +320,53 @@ func defaultInterface(family int) (netlink.Link, error) {
 	return defaultint, err
 }
 
-// addNetwork adds lbIPNet to link.
-func addNetwork(lbIPNet net.IPNet, link netlink.Link) error {
+// maxLabelLen is the longest address label that the kernel accepts,
+// i.e., IFNAMSIZ less the terminating NUL.
+const maxLabelLen = 15
+
+// addressLabel returns the label for an address on link that belongs
+// to the service named svcName, e.g., "eth0:web". The kernel requires
+// labels to start with the interface's name and limits their length,
+// so the service name is sanitized and truncated. It returns "" if
+// the interface's name leaves no room for the service's name.
+func addressLabel(link netlink.Link, svcName string) string {
+	label := []byte(link.Attrs().Name + ":")
+	if len(label) >= maxLabelLen {
+		return ""
+	}
+	for i := 0; i < len(svcName) && len(label) < maxLabelLen; i++ {
+		c := svcName[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '.':
+			label = append(label, c)
+		default:
+			label = append(label, '_')
+		}
+	}
+	return string(label)
+}
+
+// networkAddr returns the address that addNetwork adds to the
+// interface. Only IPv4 addresses can have labels and broadcast
+// addresses so label and broadcast are ignored for IPv6 addresses.
+func networkAddr(lbIPNet net.IPNet, label string, broadcast net.IP) (*netlink.Addr, error) {
 	addr, err := netlink.ParseAddr(lbIPNet.String())
+	if err != nil {
+		return nil, err
+	}
+	if lbIPNet.IP.To4() != nil {
+		addr.Label = label
+		addr.Broadcast = broadcast
+	}
+	return addr, nil
+}
+
+// addNetwork adds lbIPNet to link. If label isn't "" then the address
+// is labeled with it. If broadcast isn't nil then the address gets it
+// as its broadcast address instead of the one that the kernel would
+// compute from lbIPNet.
+func addNetwork(lbIPNet net.IPNet, link netlink.Link, label string, broadcast net.IP) error {
+	addr, err := networkAddr(lbIPNet, label, broadcast)
 	if err != nil {
 		return err
 	}
@@ -164,6 +376,144 @@ func addNetwork(lbIPNet net.IPNet, link netlink.Link) error {
 	return nil
 }
 
+// addrBackend is the interface between the code that inspects and
+// cleans up the host's addresses and the host's network so we can
+// test that code without touching the host.
+type addrBackend interface {
+	LinkList() ([]netlink.Link, error)
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	AddrDel(link netlink.Link, addr *netlink.Addr) error
+}
+
+// hostAddrs is the addrBackend that uses the host's network.
+type hostAddrs struct{}
+
+func (hostAddrs) LinkList() ([]netlink.Link, error) {
+	return netlink.LinkList()
+}
+
+func (hostAddrs) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	return netlink.AddrList(link, family)
+}
+
+func (hostAddrs) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	return netlink.AddrDel(link, addr)
+}
+
+// podChecker tells us whether a pod is ready so we can wait for a
+// companion pod, e.g., a routing daemon, before we announce.
+type podChecker interface {
+	NodePodReady(namespace string, labels string, node string) (bool, error)
+}
+
+// addrChecker checks that an address that we've added to an
+// interface works, so we can warn the user if it doesn't.
+type addrChecker interface {
+	Check(link netlink.Link, lbIP net.IP) error
+}
+
+// hostAddrChecker is the addrChecker that uses the host's network. It
+// checks that lbIP is on link and that the kernel routes it locally,
+// i.e., that the node will answer for it.
+type hostAddrChecker struct{}
+
+func (hostAddrChecker) Check(link netlink.Link, lbIP net.IP) error {
+	addrs, err := netlink.AddrList(link, purelbv1.AddrFamily(lbIP))
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, addr := range addrs {
+		if addr.IP.Equal(lbIP) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s is not on interface %s", lbIP, link.Attrs().Name)
+	}
+
+	routes, err := netlink.RouteGet(lbIP)
+	if err != nil {
+		return err
+	}
+	if len(routes) == 0 || routes[0].Type != syscall.RTN_LOCAL {
+		return fmt.Errorf("the kernel doesn't route %s locally", lbIP)
+	}
+
+	return nil
+}
+
+// isAnyOf returns true if link is one of links.
+func isAnyOf(link netlink.Link, links []netlink.Link) bool {
+	for _, other := range links {
+		if other.Attrs().Index == link.Attrs().Index {
+			return true
+		}
+	}
+	return false
+}
+
+// otherLocalLinks returns the links other than intf that are up, match
+// one of the regexes, and are local to lbIP, along with lbIP with
+// each link's subnet mask.
+func otherLocalLinks(backend addrBackend, regexes []*regexp.Regexp, lbIP net.IP, intf netlink.Link) ([]netlink.Link, []net.IPNet, error) {
+	links, err := backend.LinkList()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byName := map[string]netlink.Link{}
+	infos := []interfaceInfo{}
+	for _, link := range links {
+		attrs := link.Attrs()
+		if attrs.Index == intf.Attrs().Index || !matchesAny(regexes, attrs.Name) {
+			continue
+		}
+		addrs, err := backend.AddrList(link, purelbv1.AddrFamily(lbIP))
+		if err != nil {
+			return nil, nil, err
+		}
+		byName[attrs.Name] = link
+		infos = append(infos, interfaceInfo{name: attrs.Name, up: attrs.Flags&net.FlagUp != 0, addrs: addrs})
+	}
+
+	names, nets := selectAllLocal(regexes, infos, lbIP)
+	others := make([]netlink.Link, len(names))
+	for i, name := range names {
+		others[i] = byName[name]
+	}
+	return others, nets, nil
+}
+
+// addressOwner returns the name of the interface other than intfs
+// that already has lbIP, or "" if none does. Dummy interfaces are
+// ignored since kube-proxy (in IPVS mode) and our own remote
+// announcements put service addresses on them, and so is lbIP's own
+// macvlan.
+func addressOwner(backend addrBackend, lbIP net.IP, intfs ...netlink.Link) (string, error) {
+	links, err := backend.LinkList()
+	if err != nil {
+		return "", err
+	}
+	for _, link := range links {
+		attrs := link.Attrs()
+		if isAnyOf(link, intfs) || link.Type() == "dummy" || attrs.Name == vipLinkName(lbIP) {
+			continue
+		}
+		addrs, err := backend.AddrList(link, purelbv1.AddrFamily(lbIP))
+		if err != nil {
+			return "", err
+		}
+		for _, addr := range addrs {
+			if addr.IPNet != nil && addr.IP.Equal(lbIP) {
+				return attrs.Name, nil
+			}
+		}
+	}
+	return "", nil
+}
+
 // addDummyInterface creates a "dummy" interface whose name is
 // specified by dummyint.
 func addDummyInterface(name string) (netlink.Link, error) {
@@ -186,6 +536,35 @@ func addDummyInterface(name string) (netlink.Link, error) {
 	return link, nil
 }
 
+// dummyBackend is the interface between the code that manages the
+// dummy interface and the host's network so we can test that code
+// without touching the host.
+type dummyBackend interface {
+	AddDummy(name string) (netlink.Link, error)
+	LinkDel(link netlink.Link) error
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	AddrAdd(link netlink.Link, addr *netlink.Addr) error
+}
+
+// hostDummies is the dummyBackend that uses the host's network.
+type hostDummies struct{}
+
+func (hostDummies) AddDummy(name string) (netlink.Link, error) {
+	return addDummyInterface(name)
+}
+
+func (hostDummies) LinkDel(link netlink.Link) error {
+	return removeInterface(link)
+}
+
+func (hostDummies) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	return netlink.AddrList(link, family)
+}
+
+func (hostDummies) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	return netlink.AddrAdd(link, addr)
+}
+
 // removeInterface removes link. It returns nil if everything goes
 // fine, an error otherwise.
 func removeInterface(link netlink.Link) error {
@@ -234,7 +613,9 @@ func deleteAddr(lbIP net.IP) error {
 	return nil
 }
 
-func addVirtualInt(lbIP net.IP, link netlink.Link, subnet, aggregation string) error {
+// addVirtualInt adds lbIP to link, with a mask based on subnet and
+// aggregation. If label isn't "" then the address is labeled with it.
+func addVirtualInt(lbIP net.IP, link netlink.Link, subnet, aggregation string, label string) error {
 
 	lbIPNet := net.IPNet{IP: lbIP}
 
@@ -249,7 +630,7 @@ func addVirtualInt(lbIP net.IP, link netlink.Link, subnet, aggregation string) e
 
 			lbIPNet.Mask = poolipnet.Mask
 
-			if err := addNetwork(lbIPNet, link); err != nil {
+			if err := addNetwork(lbIPNet, link, label, nil); err != nil {
 				return fmt.Errorf("could not add %v: to %v %w", lbIPNet, link, err)
 			}
 
@@ -261,7 +642,7 @@ func addVirtualInt(lbIP net.IP, link netlink.Link, subnet, aggregation string) e
 
 			lbIPNet.Mask = poolipnet.Mask
 
-			if err := addNetwork(lbIPNet, link); err != nil {
+			if err := addNetwork(lbIPNet, link, label, nil); err != nil {
 				return fmt.Errorf("could not add %v: to %v %w", lbIPNet, link, err)
 			}
 		}
@@ -277,7 +658,7 @@ func addVirtualInt(lbIP net.IP, link netlink.Link, subnet, aggregation string) e
 
 			lbIPNet.Mask = poolaggr.Mask
 
-			if err := addNetwork(lbIPNet, link); err != nil {
+			if err := addNetwork(lbIPNet, link, label, nil); err != nil {
 				return fmt.Errorf("could not add %v: to %v %w", lbIPNet, link, err)
 			}
 
@@ -289,7 +670,7 @@ func addVirtualInt(lbIP net.IP, link netlink.Link, subnet, aggregation string) e
 
 			lbIPNet.Mask = poolaggr.Mask
 
-			if err := addNetwork(lbIPNet, link); err != nil {
+			if err := addNetwork(lbIPNet, link, label, nil); err != nil {
 				return fmt.Errorf("could not add %v: to %v %w", lbIPNet, link, err)
 			}
 		}
@@ -298,10 +679,31 @@ func addVirtualInt(lbIP net.IP, link netlink.Link, subnet, aggregation string) e
 	return nil
 }
 
-// sendGARP sends a gratuitous ARP message for ip on ifi. This is
-// based on MetalLB's internal/layer2/arp.go, modified to be a
-// standalone function.
-func sendGARP(ifName string, ip net.IP) error {
+// garpBackend is the interface between sendGARP and the host's
+// network so we can test sendGARP without touching the host.
+type garpBackend interface {
+	LinkByName(name string) (netlink.Link, error)
+	LinkList() ([]netlink.Link, error)
+	// Send sends gratuitous ARP messages for ip out of the interface
+	// named ifName, with hwAddr as the sender hardware address.
+	Send(ifName string, hwAddr net.HardwareAddr, ip net.IP) error
+}
+
+// hostGARP is the garpBackend that uses the host's network.
+type hostGARP struct{}
+
+func (hostGARP) LinkByName(name string) (netlink.Link, error) {
+	return netlink.LinkByName(name)
+}
+
+func (hostGARP) LinkList() ([]netlink.Link, error) {
+	return netlink.LinkList()
+}
+
+// Send sends a gratuitous ARP message for ip on ifName. This is based
+// on MetalLB's internal/layer2/arp.go, modified to be a standalone
+// function.
+func (hostGARP) Send(ifName string, hwAddr net.HardwareAddr, ip net.IP) error {
 	ifi, err := net.InterfaceByName(ifName)
 	if err != nil {
 		return fmt.Errorf("finding interface named %s: %w", ifName, err)
@@ -311,9 +713,10 @@ func sendGARP(ifName string, ip net.IP) error {
 	if err != nil {
 		return fmt.Errorf("creating ARP responder for %s: %w", ifName, err)
 	}
+	defer client.Close()
 
 	for _, op := range []arp.Operation{arp.OperationRequest, arp.OperationReply} {
-		pkt, err := arp.NewPacket(op, ifi.HardwareAddr, ip, ethernet.Broadcast, ip)
+		pkt, err := arp.NewPacket(op, hwAddr, ip, ethernet.Broadcast, ip)
 		if err != nil {
 			return fmt.Errorf("assembling %q gratuitous packet for %q: %w", op, ip, err)
 		}
@@ -323,3 +726,157 @@ func sendGARP(ifName string, ip net.IP) error {
 	}
 	return nil
 }
+
+// sendGARP sends a gratuitous ARP message for ip on the interface
+// named ifName.
+func sendGARP(ifName string, ip net.IP) error {
+	return sendGARPWith(hostGARP{}, ifName, ip)
+}
+
+// sendGARPWith sends a gratuitous ARP message for ip on the interface
+// named ifName using backend. If the interface is a bridge then the
+// messages go out of the bridge's member ports (with the bridge's
+// hardware address, since that's where the address lives) so the
+// physical network sees them. If it's a bond then they go out of the
+// bond's active member, since that's the port through which the
+// network will reach the address.
+func sendGARPWith(backend garpBackend, ifName string, ip net.IP) error {
+	link, err := backend.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("finding interface named %s: %w", ifName, err)
+	}
+	hwAddr := link.Attrs().HardwareAddr
+
+	active, err := bondActiveMember(backend, link)
+	if err != nil {
+		return err
+	}
+	if active != "" {
+		return backend.Send(active, hwAddr, ip)
+	}
+
+	ports, err := bridgePorts(backend, link)
+	if err != nil {
+		return err
+	}
+	if len(ports) == 0 {
+		// Not a bridge, or a bridge with no ports, so send on the
+		// interface itself
+		return backend.Send(ifName, hwAddr, ip)
+	}
+
+	// Try all of the ports and return the most recent error
+	var retErr error
+	for _, port := range ports {
+		if err := backend.Send(port, hwAddr, ip); err != nil {
+			retErr = err
+		}
+	}
+	return retErr
+}
+
+// bridgePorts returns the names of link's member ports if link is a
+// bridge. If link isn't a bridge then it returns an empty slice.
+func bridgePorts(backend garpBackend, link netlink.Link) ([]string, error) {
+	ports := []string{}
+
+	if link.Type() != "bridge" {
+		return ports, nil
+	}
+
+	links, err := backend.LinkList()
+	if err != nil {
+		return ports, fmt.Errorf("listing interfaces: %w", err)
+	}
+	for _, member := range links {
+		if member.Attrs().MasterIndex == link.Attrs().Index {
+			ports = append(ports, member.Attrs().Name)
+		}
+	}
+
+	return ports, nil
+}
+
+// bondActiveMember returns the name of link's active member port if
+// link is a bond that has one. If link isn't a bond, or the bond
+// doesn't have an active member (e.g., because its mode doesn't use
+// one) then it returns "".
+func bondActiveMember(backend garpBackend, link netlink.Link) (string, error) {
+	bond, ok := link.(*netlink.Bond)
+	if !ok || bond.ActiveSlave < 0 {
+		return "", nil
+	}
+
+	links, err := backend.LinkList()
+	if err != nil {
+		return "", fmt.Errorf("listing interfaces: %w", err)
+	}
+	for _, member := range links {
+		if member.Attrs().Index == bond.ActiveSlave && member.Attrs().MasterIndex == bond.Attrs().Index {
+			return member.Attrs().Name, nil
+		}
+	}
+
+	return "", nil
+}
+
+// Neighbor Advertisement constants from RFC 4861.
+const (
+	icmpv6NeighborAdvertisement = 136
+	naOverrideFlag              = 0x20
+	ndOptTargetLinkLayerAddr    = 2
+)
+
+// neighborAdvertisement returns an ICMPv6 Neighbor Advertisement
+// message that says that target lives at hwAddr. The Override flag is
+// set so neighbors replace any cached binding for target, and the
+// Solicited flag is clear since nobody asked. The checksum is left as
+// zero because the kernel fills it in on ICMPv6 sockets.
+func neighborAdvertisement(hwAddr net.HardwareAddr, target net.IP) []byte {
+	msg := make([]byte, 24, 24+2+len(hwAddr))
+	msg[0] = icmpv6NeighborAdvertisement
+	msg[4] = naOverrideFlag
+	copy(msg[8:24], target.To16())
+
+	// Target Link-Layer Address option. Its length is in units of 8
+	// bytes and includes the type and length fields.
+	msg = append(msg, ndOptTargetLinkLayerAddr, byte((2+len(hwAddr)+7)/8))
+	msg = append(msg, hwAddr...)
+	for len(msg)%8 != 0 {
+		msg = append(msg, 0)
+	}
+
+	return msg
+}
+
+// sendUnsolicitedNA sends an unsolicited Neighbor Advertisement for ip
+// to all of the nodes on the interface named ifName. It's the IPv6
+// equivalent of a gratuitous ARP.
+func sendUnsolicitedNA(ifName string, ip net.IP) error {
+	ifi, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return fmt.Errorf("finding interface named %s: %w", ifName, err)
+	}
+
+	conn, err := icmp.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		return fmt.Errorf("creating ICMPv6 socket for %s: %w", ifName, err)
+	}
+	defer conn.Close()
+
+	// Neighbors drop Neighbor Discovery messages that might have been
+	// forwarded, i.e., those whose hop limit isn't 255.
+	pc := conn.IPv6PacketConn()
+	if err := pc.SetMulticastHopLimit(255); err != nil {
+		return fmt.Errorf("setting hop limit on %s: %w", ifName, err)
+	}
+	if err := pc.SetMulticastInterface(ifi); err != nil {
+		return fmt.Errorf("setting multicast interface to %s: %w", ifName, err)
+	}
+
+	dst := &net.IPAddr{IP: net.IPv6linklocalallnodes, Zone: ifName}
+	if _, err := conn.WriteTo(neighborAdvertisement(ifi.HardwareAddr, ip), dst); err != nil {
+		return fmt.Errorf("writing neighbor advertisement for %q: %w", ip, err)
+	}
+	return nil
+}
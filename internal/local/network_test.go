@@ -0,0 +1,513 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeGARP implements garpBackend with a fixed set of links and
+// records the GARPs that it's asked to send.
+type fakeGARP struct {
+	links []netlink.Link
+	sent  []string
+	macs  []string
+}
+
+func (f *fakeGARP) LinkByName(name string) (netlink.Link, error) {
+	for _, link := range f.links {
+		if link.Attrs().Name == name {
+			return link, nil
+		}
+	}
+	return nil, fmt.Errorf("no such link %s", name)
+}
+
+func (f *fakeGARP) LinkList() ([]netlink.Link, error) {
+	return f.links, nil
+}
+
+func (f *fakeGARP) Send(ifName string, hwAddr net.HardwareAddr, ip net.IP) error {
+	f.sent = append(f.sent, ifName)
+	f.macs = append(f.macs, hwAddr.String())
+	return nil
+}
+
+func TestSendGARPBridge(t *testing.T) {
+	brMAC, _ := net.ParseMAC("02:00:00:00:00:01")
+	ethMAC, _ := net.ParseMAC("02:00:00:00:00:02")
+	backend := &fakeGARP{
+		links: []netlink.Link{
+			&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0", Index: 10, HardwareAddr: brMAC}},
+			&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth0", Index: 11, MasterIndex: 10, HardwareAddr: ethMAC}},
+			&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth1", Index: 12, MasterIndex: 10}},
+			&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth2", Index: 13, HardwareAddr: ethMAC}},
+		},
+	}
+	ip := net.ParseIP("192.0.2.1")
+
+	// GARPs for addresses on a bridge go out of its member ports with
+	// the bridge's MAC
+	assert.NoError(t, sendGARPWith(backend, "br0", ip))
+	assert.Equal(t, []string{"eth0", "eth1"}, backend.sent)
+	assert.Equal(t, []string{brMAC.String(), brMAC.String()}, backend.macs)
+
+	// GARPs for addresses on other interfaces go out of the interface
+	backend.sent, backend.macs = nil, nil
+	assert.NoError(t, sendGARPWith(backend, "eth2", ip))
+	assert.Equal(t, []string{"eth2"}, backend.sent)
+	assert.Equal(t, []string{ethMAC.String()}, backend.macs)
+
+	// Unknown interfaces are an error
+	assert.Error(t, sendGARPWith(backend, "bogus", ip))
+}
+
+func TestSendGARPBond(t *testing.T) {
+	bondMAC, _ := net.ParseMAC("02:00:00:00:00:01")
+	bond := netlink.NewLinkBond(netlink.LinkAttrs{Name: "bond0", Index: 10, HardwareAddr: bondMAC})
+	bond.ActiveSlave = 12
+	backend := &fakeGARP{
+		links: []netlink.Link{
+			bond,
+			&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth0", Index: 11, MasterIndex: 10}},
+			&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth1", Index: 12, MasterIndex: 10}},
+		},
+	}
+	ip := net.ParseIP("192.0.2.1")
+
+	// GARPs for addresses on a bond go out of its active member with
+	// the bond's MAC
+	assert.NoError(t, sendGARPWith(backend, "bond0", ip))
+	assert.Equal(t, []string{"eth1"}, backend.sent)
+	assert.Equal(t, []string{bondMAC.String()}, backend.macs)
+
+	// After a failover they go out of the new active member
+	backend.sent, backend.macs = nil, nil
+	bond.ActiveSlave = 11
+	assert.NoError(t, sendGARPWith(backend, "bond0", ip))
+	assert.Equal(t, []string{"eth0"}, backend.sent)
+
+	// If the bond doesn't have an active member then they go out of
+	// the bond itself
+	backend.sent, backend.macs = nil, nil
+	bond.ActiveSlave = -1
+	assert.NoError(t, sendGARPWith(backend, "bond0", ip))
+	assert.Equal(t, []string{"bond0"}, backend.sent)
+}
+
+func TestNeighborAdvertisement(t *testing.T) {
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	target := net.ParseIP("fc00::1")
+	msg := neighborAdvertisement(mac, target)
+
+	// The header says that it's an unsolicited NA that overrides
+	// cached entries
+	assert.Len(t, msg, 32)
+	assert.Equal(t, byte(136), msg[0], "wrong ICMPv6 type")
+	assert.Equal(t, byte(0), msg[1], "wrong ICMPv6 code")
+	assert.Equal(t, byte(0x20), msg[4]&0x20, "override flag not set")
+	assert.Equal(t, byte(0), msg[4]&0x80, "router flag set")
+	assert.Equal(t, byte(0), msg[4]&0x40, "solicited flag set")
+	assert.Equal(t, target, net.IP(msg[8:24]), "wrong target address")
+
+	// The target link-layer address option carries our MAC
+	assert.Equal(t, []byte{2, 1}, msg[24:26], "wrong option type or length")
+	assert.Equal(t, mac, net.HardwareAddr(msg[26:32]), "wrong target MAC")
+}
+
+func TestLocalMaskSecondary(t *testing.T) {
+	mustAddr := func(cidr string, flags int) netlink.Addr {
+		addr, err := netlink.ParseAddr(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr.Flags = flags
+		return *addr
+	}
+
+	// An interface with a primary and a secondary subnet, a service
+	// address that we added with a host mask, and a nested subnet
+	v4addrs := []netlink.Addr{
+		mustAddr("192.168.1.10/24", 0),
+		mustAddr("10.0.0.10/16", 0x01), // IFA_F_SECONDARY
+		mustAddr("10.0.5.1/24", 0x01),
+		mustAddr("172.16.0.1/32", 0),
+	}
+
+	assert.Equal(t, net.CIDRMask(24, 32), localMask(v4addrs, net.ParseIP("192.168.1.100")), "primary subnet")
+	assert.Equal(t, net.CIDRMask(16, 32), localMask(v4addrs, net.ParseIP("10.0.200.1")), "secondary subnet")
+	assert.Equal(t, net.CIDRMask(24, 32), localMask(v4addrs, net.ParseIP("10.0.5.100")), "most specific subnet")
+	assert.Nil(t, localMask(v4addrs, net.ParseIP("172.16.0.1")), "host address")
+	assert.Nil(t, localMask(v4addrs, net.ParseIP("192.0.2.1")), "non-local")
+
+	v6addrs := []netlink.Addr{
+		mustAddr("2001:db8:1::10/64", 0x80),  // IFA_F_PERMANENT
+		mustAddr("2001:db8:2::10/64", 0x80),  // IFA_F_PERMANENT
+		mustAddr("2001:db8:3::10/64", 0x200), // IFA_F_NOPREFIXROUTE
+	}
+	assert.Equal(t, net.CIDRMask(64, 128), localMask(v6addrs, net.ParseIP("2001:db8:1::100")), "first v6 subnet")
+	assert.Equal(t, net.CIDRMask(64, 128), localMask(v6addrs, net.ParseIP("2001:db8:2::100")), "second v6 subnet")
+	assert.Nil(t, localMask(v6addrs, net.ParseIP("2001:db8:3::100")), "flagged v6 subnet")
+}
+
+func TestSelectLocalFallback(t *testing.T) {
+	mustAddrs := func(cidrs ...string) []netlink.Addr {
+		addrs := []netlink.Addr{}
+		for _, cidr := range cidrs {
+			addr, err := netlink.ParseAddr(cidr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addrs = append(addrs, *addr)
+		}
+		return addrs
+	}
+	chain := []*regexp.Regexp{
+		regexp.MustCompile("^bond0$"),
+		regexp.MustCompile("^eth[0-9]+$"),
+	}
+	lbIP := net.ParseIP("192.168.1.100")
+
+	// The first candidate is up and on the subnet so it wins
+	name, lbIPNet, err := selectLocal(chain, []interfaceInfo{
+		{name: "eth0", up: true, addrs: mustAddrs("192.168.1.2/24")},
+		{name: "bond0", up: true, addrs: mustAddrs("192.168.1.1/24")},
+	}, lbIP)
+	assert.NoError(t, err)
+	assert.Equal(t, "bond0", name)
+	assert.Equal(t, "192.168.1.100/24", lbIPNet.String())
+
+	// The first candidate is down so we fall back to the second
+	name, _, err = selectLocal(chain, []interfaceInfo{
+		{name: "bond0", up: false, addrs: mustAddrs("192.168.1.1/24")},
+		{name: "eth1", up: true, addrs: mustAddrs("192.168.1.2/24")},
+	}, lbIP)
+	assert.NoError(t, err)
+	assert.Equal(t, "eth1", name)
+
+	// The first candidate is on another subnet so we fall back to the
+	// second, skipping interfaces that are off-subnet or down
+	name, _, err = selectLocal(chain, []interfaceInfo{
+		{name: "bond0", up: true, addrs: mustAddrs("10.0.0.1/24")},
+		{name: "eth0", up: true, addrs: mustAddrs("10.0.1.1/24")},
+		{name: "eth1", up: false, addrs: mustAddrs("192.168.1.3/24")},
+		{name: "eth2", up: true, addrs: mustAddrs("192.168.1.2/24")},
+	}, lbIP)
+	assert.NoError(t, err)
+	assert.Equal(t, "eth2", name)
+
+	// No candidate is usable so the address is remote
+	_, _, err = selectLocal(chain, []interfaceInfo{
+		{name: "bond0", up: false, addrs: mustAddrs("192.168.1.1/24")},
+		{name: "eth0", up: true, addrs: mustAddrs("10.0.1.1/24")},
+		{name: "wlan0", up: true, addrs: mustAddrs("192.168.1.2/24")},
+	}, lbIP)
+	assert.Error(t, err)
+}
+
+func TestSelectBySubnet(t *testing.T) {
+	mustAddrs := func(cidrs ...string) []netlink.Addr {
+		addrs := []netlink.Addr{}
+		for _, cidr := range cidrs {
+			addr, err := netlink.ParseAddr(cidr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addrs = append(addrs, *addr)
+		}
+		return addrs
+	}
+	_, mgmt, _ := net.ParseCIDR("10.0.0.0/24")
+	lbIP := net.ParseIP("10.0.0.100")
+
+	// The interface with an address in the subnet wins, whatever its
+	// name
+	name, lbIPNet, err := selectBySubnet(mgmt, []interfaceInfo{
+		{name: "enp3s0", up: true, addrs: mustAddrs("192.168.1.2/24")},
+		{name: "enx0123456789ab", up: true, addrs: mustAddrs("10.0.0.2/24")},
+	}, lbIP)
+	assert.NoError(t, err)
+	assert.Equal(t, "enx0123456789ab", name)
+	assert.Equal(t, "10.0.0.100/24", lbIPNet.String())
+
+	// If more than one interface has an address in the subnet then the
+	// one with the most specific route to the address wins, and ties
+	// go to the first one
+	name, lbIPNet, err = selectBySubnet(mgmt, []interfaceInfo{
+		{name: "eth0", up: true, addrs: mustAddrs("10.0.0.2/16")},
+		{name: "eth1", up: true, addrs: mustAddrs("10.0.0.3/24")},
+		{name: "eth2", up: true, addrs: mustAddrs("10.0.0.4/24")},
+		{name: "eth3", up: false, addrs: mustAddrs("10.0.0.5/25")},
+	}, lbIP)
+	assert.NoError(t, err)
+	assert.Equal(t, "eth1", name)
+	assert.Equal(t, "10.0.0.100/24", lbIPNet.String())
+
+	// The subnet selects the interface, but the address still has to
+	// be local to it
+	name, lbIPNet, err = selectBySubnet(mgmt, []interfaceInfo{
+		{name: "eth0", up: true, addrs: mustAddrs("10.0.0.2/24", "2001:db8::2/64")},
+		{name: "eth1", up: true, addrs: mustAddrs("2001:db8::3/64")},
+	}, net.ParseIP("2001:db8::100"))
+	assert.NoError(t, err)
+	assert.Equal(t, "eth0", name)
+	assert.Equal(t, "2001:db8::100/64", lbIPNet.String())
+
+	_, _, err = selectBySubnet(mgmt, []interfaceInfo{
+		{name: "eth0", up: true, addrs: mustAddrs("10.0.0.2/24")},
+		{name: "eth1", up: true, addrs: mustAddrs("192.168.1.2/24")},
+	}, net.ParseIP("192.168.1.100"))
+	assert.Error(t, err)
+}
+
+func TestFindLocalBySubnet(t *testing.T) {
+	link := func(name string, index int, up bool) netlink.Link {
+		attrs := netlink.LinkAttrs{Name: name, Index: index}
+		if up {
+			attrs.Flags = net.FlagUp
+		}
+		return &netlink.Device{LinkAttrs: attrs}
+	}
+	backend := &fakeAddrs{
+		links: []netlink.Link{
+			link("lo", 1, true),
+			link("enp3s0", 2, false),
+			link("enp4s0", 3, true),
+		},
+		addrs: map[string][]string{
+			"lo":     {"127.0.0.1/8"},
+			"enp3s0": {"10.0.0.2/24"},
+			"enp4s0": {"10.0.0.3/24"},
+		},
+	}
+	_, mgmt, _ := net.ParseCIDR("10.0.0.0/24")
+
+	lbIPNet, intf, err := findLocalBySubnet(backend, mgmt, net.ParseIP("10.0.0.100"))
+	assert.NoError(t, err)
+	if assert.NotNil(t, intf) {
+		assert.Equal(t, "enp4s0", intf.Attrs().Name)
+	}
+	assert.Equal(t, "10.0.0.100/24", lbIPNet.String())
+
+	_, _, err = findLocalBySubnet(backend, mgmt, net.ParseIP("192.168.1.100"))
+	assert.Error(t, err)
+}
+
+// fakeAddrs implements addrBackend with a fixed set of links and
+// addresses.
+type fakeAddrs struct {
+	links []netlink.Link
+	addrs map[string][]string // link name -> CIDRs
+}
+
+func (f *fakeAddrs) LinkList() ([]netlink.Link, error) {
+	return f.links, nil
+}
+
+func (f *fakeAddrs) AddrList(link netlink.Link, _ int) ([]netlink.Addr, error) {
+	addrs := []netlink.Addr{}
+	for _, cidr := range f.addrs[link.Attrs().Name] {
+		addr, err := netlink.ParseAddr(cidr)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, *addr)
+	}
+	return addrs, nil
+}
+
+func (f *fakeAddrs) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	name := link.Attrs().Name
+	for i, cidr := range f.addrs[name] {
+		if cidr == addr.IPNet.String() {
+			f.addrs[name] = append(f.addrs[name][:i], f.addrs[name][i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("%s not on %s", addr.IPNet, name)
+}
+
+func TestAddressOwner(t *testing.T) {
+	eth0 := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth0", Index: 2}}
+	eth1 := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth1", Index: 3}}
+	ipvs := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "kube-ipvs0", Index: 4}}
+	ip := net.ParseIP("192.0.2.1")
+	backend := &fakeAddrs{
+		links: []netlink.Link{eth0, eth1, ipvs},
+		addrs: map[string][]string{
+			"eth0":       {"192.0.2.1/24"},
+			"eth1":       {"198.51.100.1/24"},
+			"kube-ipvs0": {"192.0.2.1/32"},
+		},
+	}
+
+	// Addresses on the interface that we're announcing on, or on dummy
+	// interfaces, don't count
+	owner, err := addressOwner(backend, ip, eth0)
+	assert.NoError(t, err)
+	assert.Equal(t, "", owner)
+
+	// Addresses on other interfaces do
+	owner, err = addressOwner(backend, ip, eth1)
+	assert.NoError(t, err)
+	assert.Equal(t, "eth0", owner)
+
+	// ...unless we're announcing on them, too
+	owner, err = addressOwner(backend, ip, eth1, eth0)
+	assert.NoError(t, err)
+	assert.Equal(t, "", owner)
+}
+
+func TestOtherLocalLinks(t *testing.T) {
+	link := func(name string, index int, up bool) netlink.Link {
+		attrs := netlink.LinkAttrs{Name: name, Index: index}
+		if up {
+			attrs.Flags = net.FlagUp
+		}
+		return &netlink.Device{LinkAttrs: attrs}
+	}
+	eth0 := link("eth0", 2, true)
+	backend := &fakeAddrs{
+		links: []netlink.Link{
+			eth0,
+			link("eth1", 3, true),
+			link("eth2", 4, true),
+			link("eth3", 5, false),
+			link("wlan0", 6, true),
+		},
+		addrs: map[string][]string{
+			"eth0":  {"192.0.2.10/24"},
+			"eth1":  {"192.0.2.11/25"},
+			"eth2":  {"198.51.100.1/24"},
+			"eth3":  {"192.0.2.13/24"},
+			"wlan0": {"192.0.2.14/24"},
+		},
+	}
+	regexes := []*regexp.Regexp{regexp.MustCompile("^eth")}
+	ip := net.ParseIP("192.0.2.1")
+
+	// Only the other interfaces that are up, match, and are in the
+	// address's subnet are local, each with its own mask
+	links, nets, err := otherLocalLinks(backend, regexes, ip, eth0)
+	assert.NoError(t, err)
+	if assert.Len(t, links, 1) {
+		assert.Equal(t, "eth1", links[0].Attrs().Name)
+		assert.Equal(t, "192.0.2.1/25", nets[0].String())
+	}
+
+	// Both matches are local from the point of view of an interface
+	// that isn't one of them
+	links, _, err = otherLocalLinks(backend, regexes, ip, link("lo", 1, true))
+	assert.NoError(t, err)
+	names := []string{}
+	for _, link := range links {
+		names = append(names, link.Attrs().Name)
+	}
+	assert.Equal(t, []string{"eth0", "eth1"}, names)
+}
+
+func TestAddressLabel(t *testing.T) {
+	link := func(name string) netlink.Link {
+		return &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name}}
+	}
+
+	assert.Equal(t, "eth0:web", addressLabel(link("eth0"), "web"))
+
+	// Labels are truncated to the kernel's limit
+	assert.Equal(t, "kube-lb0:a-very", addressLabel(link("kube-lb0"), "a-very-long-service-name"))
+
+	// Characters that don't belong in a label are replaced
+	assert.Equal(t, "eth0:a_b", addressLabel(link("eth0"), "a b"))
+
+	// If the interface's name is too long there's no room for a label
+	assert.Equal(t, "", addressLabel(link("enp0s31f6abcdef"), "web"))
+
+	// The label is on the address that we ask the kernel to add
+	_, ipnet, _ := net.ParseCIDR("192.0.2.1/32")
+	addr, err := networkAddr(*ipnet, addressLabel(link("eth0"), "web"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "eth0:web", addr.Label)
+	assert.Equal(t, "192.0.2.1/32", addr.IPNet.String())
+
+	// IPv6 addresses can't have labels
+	_, ipnet, _ = net.ParseCIDR("2001:db8::1/128")
+	addr, err = networkAddr(*ipnet, "eth0:web", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "", addr.Label)
+}
+
+func TestNetworkAddrBroadcast(t *testing.T) {
+	// By default the kernel computes the broadcast address
+	_, ipnet, _ := net.ParseCIDR("192.0.2.1/24")
+	addr, err := networkAddr(*ipnet, "", nil)
+	assert.NoError(t, err)
+	assert.Nil(t, addr.Broadcast)
+
+	// If there's an explicit broadcast address then we ask for it
+	addr, err = networkAddr(net.IPNet{IP: net.ParseIP("192.0.2.1"), Mask: net.CIDRMask(24, 32)}, "", net.ParseIP("192.0.2.127"))
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.127", addr.Broadcast.String())
+	assert.Equal(t, "192.0.2.1/24", addr.IPNet.String())
+
+	// IPv6 addresses don't have broadcast addresses
+	_, ipnet, _ = net.ParseCIDR("2001:db8::1/64")
+	addr, err = networkAddr(*ipnet, "", net.ParseIP("192.0.2.127"))
+	assert.NoError(t, err)
+	assert.Nil(t, addr.Broadcast)
+}
+
+// fakeChecker implements addrChecker with a fixed result, and records
+// the addresses that it checks.
+type fakeChecker struct {
+	err     error
+	checked []string
+}
+
+func (f *fakeChecker) Check(_ netlink.Link, lbIP net.IP) error {
+	f.checked = append(f.checked, lbIP.String())
+	return f.err
+}
+
+func TestVerifyAddress(t *testing.T) {
+	k := &testK8S{t: t}
+	checker := &fakeChecker{}
+	a := &announcer{
+		client:  k,
+		logger:  log.NewNopLogger(),
+		myNode:  "test-node",
+		checker: checker,
+	}
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "verify"}}
+	lbIP := net.ParseIP("192.0.2.1")
+
+	// The address works so there's nothing to tell the user
+	assert.True(t, a.verifyAddress(svc, missingLink(), lbIP))
+	assert.Equal(t, []string{"192.0.2.1"}, checker.checked)
+	assert.Empty(t, k.events)
+
+	// The address doesn't work so we warn the user
+	checker.err = fmt.Errorf("the kernel doesn't route 192.0.2.1 locally")
+	assert.False(t, a.verifyAddress(svc, missingLink(), lbIP))
+	assert.Equal(t, []string{"AddressUnreachable"}, k.events)
+}
@@ -0,0 +1,122 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// interfacePoll is how often we check whether the announcement
+// interface is up while we're waiting for it.
+const interfacePoll = time.Second
+
+// linkBackend is the interface between the code that waits for the
+// announcement interface and the host's network so we can test it
+// without touching the host.
+type linkBackend interface {
+	LinkList() ([]netlink.Link, error)
+	DefaultInterface(family int) (netlink.Link, error)
+}
+
+// hostLinks is the linkBackend that uses the host's network.
+type hostLinks struct{}
+
+func (hostLinks) LinkList() ([]netlink.Link, error) {
+	return netlink.LinkList()
+}
+
+func (hostLinks) DefaultInterface(family int) (netlink.Link, error) {
+	return defaultInterface(family)
+}
+
+// linkUp returns true if link is up and can carry traffic. Interfaces
+// like loopback and dummy don't report an operational state so for
+// them we use the administrative state.
+func linkUp(link netlink.Link) bool {
+	attrs := link.Attrs()
+	switch attrs.OperState {
+	case netlink.OperUp:
+		return true
+	case netlink.OperUnknown:
+		return attrs.Flags&net.FlagUp != 0
+	}
+	return false
+}
+
+// interfaceUp returns true if the interface that we'd announce on is
+// up. If the user configured interface regexes then any up interface
+// that matches one will do, and if they configured a subnet then any
+// up interface with an address in it will do. Otherwise the default
+// interface for either family has to be up.
+func (a *announcer) interfaceUp() bool {
+	if a.localSubnet != nil && a.addrs != nil {
+		links, err := a.addrs.LinkList()
+		if err != nil {
+			return false
+		}
+		for _, link := range links {
+			if !linkUp(link) {
+				continue
+			}
+			if addrs, err := a.addrs.AddrList(link, nl.FAMILY_ALL); err == nil && hasAddressIn(addrs, a.localSubnet) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if a.localNameRegexes != nil {
+		links, err := a.links.LinkList()
+		if err != nil {
+			return false
+		}
+		for _, link := range links {
+			if matchesAny(a.localNameRegexes, link.Attrs().Name) && linkUp(link) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, family := range []int{nl.FAMILY_V4, nl.FAMILY_V6} {
+		if link, err := a.links.DefaultInterface(family); err == nil && linkUp(link) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForInterface waits up to timeout for the announcement interface
+// to come up. It returns true if it's up, or false if we gave up
+// waiting.
+func (a *announcer) waitForInterface(timeout time.Duration) bool {
+	poll := a.interfacePoll
+	if poll <= 0 {
+		poll = interfacePoll
+	}
+
+	deadline := time.Now().Add(timeout)
+	for !a.interfaceUp() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(poll)
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+)
+
+// fakeLinks implements linkBackend with one interface that comes up
+// after a number of checks.
+type fakeLinks struct {
+	link    *netlink.Device
+	upAfter int
+	checks  int
+}
+
+func (f *fakeLinks) check() {
+	f.checks++
+	if f.checks > f.upAfter {
+		f.link.OperState = netlink.OperUp
+	}
+}
+
+func (f *fakeLinks) LinkList() ([]netlink.Link, error) {
+	f.check()
+	return []netlink.Link{f.link}, nil
+}
+
+func (f *fakeLinks) DefaultInterface(family int) (netlink.Link, error) {
+	f.check()
+	if f.link.OperState != netlink.OperUp {
+		return nil, fmt.Errorf("no default route")
+	}
+	return f.link, nil
+}
+
+func TestLinkUp(t *testing.T) {
+	assert.True(t, linkUp(&netlink.Device{LinkAttrs: netlink.LinkAttrs{OperState: netlink.OperUp}}))
+	assert.False(t, linkUp(&netlink.Device{LinkAttrs: netlink.LinkAttrs{OperState: netlink.OperDown, Flags: net.FlagUp}}))
+	assert.True(t, linkUp(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{OperState: netlink.OperUnknown, Flags: net.FlagUp}}))
+	assert.False(t, linkUp(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{OperState: netlink.OperUnknown}}))
+}
+
+func TestWaitForInterface(t *testing.T) {
+	newAnnouncer := func(links *fakeLinks, regexes []*regexp.Regexp) *announcer {
+		return &announcer{
+			logger:           log.NewNopLogger(),
+			links:            links,
+			interfacePoll:    time.Millisecond,
+			localNameRegexes: regexes,
+		}
+	}
+	eth0 := func() *netlink.Device {
+		return &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth0", OperState: netlink.OperDown}}
+	}
+
+	// We wait until a matching interface comes up
+	links := &fakeLinks{link: eth0(), upAfter: 5}
+	a := newAnnouncer(links, []*regexp.Regexp{regexp.MustCompile("^eth")})
+	assert.True(t, a.waitForInterface(time.Second))
+	assert.Equal(t, 6, links.checks)
+
+	// ...or the default interface comes up
+	links = &fakeLinks{link: eth0(), upAfter: 5}
+	a = newAnnouncer(links, nil)
+	assert.True(t, a.waitForInterface(time.Second))
+	assert.Greater(t, links.checks, 5)
+
+	// Interfaces that don't match don't count, so we give up
+	links = &fakeLinks{link: eth0(), upAfter: 0}
+	a = newAnnouncer(links, []*regexp.Regexp{regexp.MustCompile("^bond")})
+	start := time.Now()
+	assert.False(t, a.waitForInterface(20*time.Millisecond))
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+
+	purelbv1 "purelb.io/pkg/apis/v1"
+)
+
+// routeBackend is the interface between the next-hop route code and
+// the host's network so we can test it without touching the host.
+type routeBackend interface {
+	RuleAdd(rule *netlink.Rule) error
+	RuleDel(rule *netlink.Rule) error
+	RouteReplace(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+}
+
+// hostRoutes is the routeBackend that uses the host's network.
+type hostRoutes struct{}
+
+func (hostRoutes) RuleAdd(rule *netlink.Rule) error {
+	return netlink.RuleAdd(rule)
+}
+
+func (hostRoutes) RuleDel(rule *netlink.Rule) error {
+	return netlink.RuleDel(rule)
+}
+
+func (hostRoutes) RouteReplace(route *netlink.Route) error {
+	return netlink.RouteReplace(route)
+}
+
+func (hostRoutes) RouteDel(route *netlink.Route) error {
+	return netlink.RouteDel(route)
+}
+
+// nextHopRoute is the return path that we've set up for an address.
+type nextHopRoute struct {
+	nextHop net.IP
+	table   int
+}
+
+// rule returns the policy rule that sends traffic from lbIP to the
+// route's table.
+func (r nextHopRoute) rule(lbIP net.IP) *netlink.Rule {
+	src := hostNet(lbIP)
+	rule := netlink.NewRule()
+	rule.Family = purelbv1.AddrFamily(lbIP)
+	rule.Src = &src
+	rule.Table = r.table
+	return rule
+}
+
+// route returns the default route via the next hop in the route's
+// table.
+func (r nextHopRoute) route() *netlink.Route {
+	return &netlink.Route{Gw: r.nextHop, Table: r.table}
+}
+
+// addNextHop sets up lbIP's return path via pool's next hop, if it
+// has one. The route is shared by all of the addresses that use the
+// same next hop and table, but each address gets its own rule.
+func (a *announcer) addNextHop(pool *purelbv1.ServiceGroupAddressPool, lbIP net.IP) error {
+	if a.routes == nil {
+		return nil
+	}
+
+	nextHop, err := pool.ParseNextHop()
+	if err != nil {
+		return err
+	}
+	want := nextHopRoute{nextHop: nextHop, table: pool.RouteTable}
+
+	// If we've already set this up then there's nothing to do. If the
+	// pool's next hop has changed then remove the old one first.
+	if have, exists := a.nextHops[lbIP.String()]; exists {
+		if want.nextHop != nil && have.nextHop.Equal(want.nextHop) && have.table == want.table {
+			return nil
+		}
+		a.removeNextHop(lbIP)
+	}
+	if nextHop == nil {
+		return nil
+	}
+
+	if err := a.routes.RouteReplace(want.route()); err != nil {
+		return fmt.Errorf("adding route via %s to table %d: %w", nextHop, want.table, err)
+	}
+	if err := a.routes.RuleAdd(want.rule(lbIP)); err != nil {
+		return fmt.Errorf("adding rule from %s to table %d: %w", lbIP, want.table, err)
+	}
+	if a.nextHops == nil {
+		a.nextHops = map[string]nextHopRoute{}
+	}
+	a.nextHops[lbIP.String()] = want
+	a.logger.Log("op", "addNextHop", "ip", lbIP, "nexthop", nextHop, "table", want.table)
+
+	return nil
+}
+
+// removeNextHop removes lbIP's return path, if it has one. The route
+// is removed when the last address that uses it is withdrawn.
+func (a *announcer) removeNextHop(lbIP net.IP) {
+	have, exists := a.nextHops[lbIP.String()]
+	if !exists {
+		return
+	}
+	delete(a.nextHops, lbIP.String())
+
+	if err := a.routes.RuleDel(have.rule(lbIP)); err != nil {
+		a.logger.Log("op", "removeNextHop", "ip", lbIP, "error", err)
+	}
+
+	for _, other := range a.nextHops {
+		if other.table == have.table && other.nextHop.Equal(have.nextHop) {
+			return
+		}
+	}
+	if err := a.routes.RouteDel(have.route()); err != nil {
+		a.logger.Log("op", "removeNextHop", "nexthop", have.nextHop, "table", have.table, "error", err)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	v1 "k8s.io/api/core/v1"
+
+	purelbv1 "purelb.io/pkg/apis/v1"
+)
+
+// fakeRoutes implements routeBackend by recording the rules and
+// routes that are on the "host".
+type fakeRoutes struct {
+	rules  map[string]bool // "src table"
+	routes map[string]bool // "gw table"
+}
+
+func newFakeRoutes() *fakeRoutes {
+	return &fakeRoutes{rules: map[string]bool{}, routes: map[string]bool{}}
+}
+
+func (f *fakeRoutes) RuleAdd(rule *netlink.Rule) error {
+	f.rules[fmt.Sprintf("%s %d", rule.Src, rule.Table)] = true
+	return nil
+}
+
+func (f *fakeRoutes) RuleDel(rule *netlink.Rule) error {
+	delete(f.rules, fmt.Sprintf("%s %d", rule.Src, rule.Table))
+	return nil
+}
+
+func (f *fakeRoutes) RouteReplace(route *netlink.Route) error {
+	f.routes[fmt.Sprintf("%s %d", route.Gw, route.Table)] = true
+	return nil
+}
+
+func (f *fakeRoutes) RouteDel(route *netlink.Route) error {
+	delete(f.routes, fmt.Sprintf("%s %d", route.Gw, route.Table))
+	return nil
+}
+
+func TestNextHop(t *testing.T) {
+	backend := newFakeRoutes()
+	a := &announcer{
+		logger:       log.NewNopLogger(),
+		myNode:       "test-node",
+		svcIngresses: map[string][]v1.LoadBalancerIngress{},
+		routes:       backend,
+	}
+	pool := &purelbv1.ServiceGroupAddressPool{
+		Pool:       "192.0.2.0/28",
+		Subnet:     "192.0.2.0/24",
+		NextHop:    "192.0.2.254",
+		RouteTable: 100,
+	}
+	ip1 := net.ParseIP("192.0.2.1")
+	ip2 := net.ParseIP("192.0.2.2")
+
+	// Each address gets a rule, and they share the route
+	assert.NoError(t, a.addNextHop(pool, ip1))
+	assert.NoError(t, a.addNextHop(pool, ip2))
+	assert.Equal(t, map[string]bool{"192.0.2.1/32 100": true, "192.0.2.2/32 100": true}, backend.rules)
+	assert.Equal(t, map[string]bool{"192.0.2.254 100": true}, backend.routes)
+
+	// Adding again is OK
+	assert.NoError(t, a.addNextHop(pool, ip1))
+	assert.Len(t, backend.rules, 2)
+
+	// The route stays until the last address that uses it is withdrawn
+	a.svcIngresses["test/one"] = []v1.LoadBalancerIngress{{IP: ip1.String()}}
+	a.svcIngresses["test/two"] = []v1.LoadBalancerIngress{{IP: ip2.String()}}
+	assert.NoError(t, a.DeleteBalancer("test/one", "test", nil))
+	assert.Equal(t, map[string]bool{"192.0.2.2/32 100": true}, backend.rules)
+	assert.Len(t, backend.routes, 1)
+
+	// If the pool's next hop changes then the old one is replaced
+	pool.NextHop = "192.0.2.253"
+	pool.RouteTable = 101
+	assert.NoError(t, a.addNextHop(pool, ip2))
+	assert.Equal(t, map[string]bool{"192.0.2.2/32 101": true}, backend.rules)
+	assert.Equal(t, map[string]bool{"192.0.2.253 101": true}, backend.routes)
+
+	assert.NoError(t, a.DeleteBalancer("test/two", "test", nil))
+	assert.Empty(t, backend.rules)
+	assert.Empty(t, backend.routes)
+
+	// Invalid next hops are refused
+	pool.NextHop = "2001:db8::1"
+	assert.Error(t, a.addNextHop(pool, ip1))
+	assert.Empty(t, backend.rules)
+	assert.Empty(t, backend.routes)
+
+	// Pools without a next hop don't get any
+	pool.NextHop = ""
+	assert.NoError(t, a.addNextHop(pool, ip1))
+	assert.Empty(t, backend.rules)
+	assert.Empty(t, backend.routes)
+}
@@ -0,0 +1,226 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sysctl reads and writes kernel parameters. Names are paths
+// relative to /proc/sys, e.g., "net/ipv4/conf/all/arp_ignore". We
+// use "/" instead of "." as the separator because interface names
+// can contain dots.
+type sysctl interface {
+	Get(name string) (string, error)
+	Set(name string, value string) error
+}
+
+// procSysctl reads and writes kernel parameters using /proc/sys.
+type procSysctl struct{}
+
+func (procSysctl) Get(name string) (string, error) {
+	value, err := os.ReadFile(filepath.Join("/proc/sys", name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(value)), nil
+}
+
+func (procSysctl) Set(name string, value string) error {
+	return os.WriteFile(filepath.Join("/proc/sys", name), []byte(value), 0644)
+}
+
+// strictARPParams are the sysctls that stop Linux from answering ARP
+// requests for a VIP on interfaces other than the one to which we
+// added it. They're the same settings that kube-proxy uses in IPVS
+// "strictARP" mode. The order matters only in that it's the order in
+// which we set them.
+var strictARPParams = []struct {
+	name  string
+	value string
+}{
+	// Reply only if the target address is configured on the incoming
+	// interface.
+	{"net/ipv4/conf/all/arp_ignore", "1"},
+	// Use the best local address for the target as the ARP source.
+	{"net/ipv4/conf/all/arp_announce", "2"},
+}
+
+// holdStrictARP records that lbIP has been announced locally and
+// applies the strict ARP sysctls if they're not already applied. The
+// original values are saved so releaseStrictARP can restore them.
+func (a *announcer) holdStrictARP(lbIP string) error {
+	a.arpLock.Lock()
+	defer a.arpLock.Unlock()
+
+	return a.holdStrictARPLocked(lbIP)
+}
+
+// holdStrictARPLocked is holdStrictARP for callers who hold arpLock.
+// If we can't apply all of the sysctls then we roll back the ones that
+// we applied so the next call tries again from the start.
+func (a *announcer) holdStrictARPLocked(lbIP string) error {
+	if a.savedARPParams != nil {
+		// Already applied
+		a.strictARPAddrs[lbIP] = true
+		return nil
+	}
+
+	saved := map[string]string{}
+	for _, param := range strictARPParams {
+		orig, err := a.sysctls.Get(param.name)
+		if err == nil {
+			err = a.sysctls.Set(param.name, param.value)
+		}
+		if err != nil {
+			a.rollBackARPParams(saved)
+			return err
+		}
+		saved[param.name] = orig
+	}
+
+	a.savedARPParams = saved
+	a.strictARPAddrs[lbIP] = true
+	a.logger.Log("op", "strictARP", "msg", "applied", "saved", a.savedARPParams)
+	return nil
+}
+
+// rollBackARPParams restores the sysctls in saved, which we set before
+// we failed to set the rest.
+func (a *announcer) rollBackARPParams(saved map[string]string) {
+	for name, value := range saved {
+		if err := a.sysctls.Set(name, value); err != nil {
+			a.logger.Log("op", "strictARP", "error", err, "param", name, "value", value, "msg", "rollback failed")
+		}
+	}
+}
+
+// releaseStrictARP records that lbIP is no longer announced locally.
+// If no other addresses need the strict ARP sysctls then they're
+// restored to their original values.
+func (a *announcer) releaseStrictARP(lbIP string) {
+	a.arpLock.Lock()
+	defer a.arpLock.Unlock()
+
+	a.releaseStrictARPLocked(lbIP)
+}
+
+// releaseStrictARPLocked is releaseStrictARP for callers who hold
+// arpLock.
+func (a *announcer) releaseStrictARPLocked(lbIP string) {
+	if !a.strictARPAddrs[lbIP] {
+		return
+	}
+	delete(a.strictARPAddrs, lbIP)
+
+	if len(a.strictARPAddrs) == 0 {
+		a.restoreARPParamsLocked()
+	}
+}
+
+// restoreARPParams restores the strict ARP sysctls to the values that
+// they had before we changed them. Quiet periods that are still
+// running keep them set until they end.
+func (a *announcer) restoreARPParams() {
+	a.arpLock.Lock()
+	defer a.arpLock.Unlock()
+
+	if len(a.arpQuiets) > 0 {
+		for lbIP := range a.strictARPAddrs {
+			if _, quiet := a.arpQuiets[lbIP]; !quiet {
+				delete(a.strictARPAddrs, lbIP)
+			}
+		}
+		return
+	}
+	a.restoreARPParamsLocked()
+}
+
+// restoreARPParamsLocked restores the strict ARP sysctls for callers
+// who hold arpLock.
+func (a *announcer) restoreARPParamsLocked() {
+	for name, value := range a.savedARPParams {
+		if err := a.sysctls.Set(name, value); err != nil {
+			a.logger.Log("op", "strictARP", "error", err, "param", name, "value", value)
+		}
+	}
+	if a.savedARPParams != nil {
+		a.logger.Log("op", "strictARP", "msg", "restored", "saved", a.savedARPParams)
+	}
+	a.savedARPParams = nil
+	a.strictARPAddrs = map[string]bool{}
+}
+
+// arpQuietKey is the key under which a quiet period holds the strict
+// ARP sysctls for lbIP. It's different from lbIP's own key so the
+// quiet period and the address's announcement can hold them
+// independently.
+func arpQuietKey(lbIP string) string {
+	return "quiet/" + lbIP
+}
+
+// startARPQuiet applies the strict ARP sysctls for period after we
+// lose the election for lbIP, so other interfaces on this node don't
+// answer ARP requests for it while the network moves to the winner.
+// If lbIP is already in a quiet period then we don't extend it.
+func (a *announcer) startARPQuiet(lbIP string, period time.Duration) error {
+	a.arpLock.Lock()
+	defer a.arpLock.Unlock()
+
+	key := arpQuietKey(lbIP)
+	if _, quiet := a.arpQuiets[key]; quiet {
+		return nil
+	}
+	if err := a.holdStrictARPLocked(key); err != nil {
+		return err
+	}
+	a.logger.Log("op", "arpQuiet", "ip", lbIP, "period", period)
+
+	if a.arpQuiets == nil {
+		a.arpQuiets = map[string]*time.Timer{}
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(period, func() {
+		a.arpLock.Lock()
+		defer a.arpLock.Unlock()
+
+		// If the quiet period was stopped and restarted then this isn't
+		// our timer anymore
+		if a.arpQuiets[key] != timer {
+			return
+		}
+		delete(a.arpQuiets, key)
+		a.releaseStrictARPLocked(key)
+		a.logger.Log("op", "arpQuiet", "ip", lbIP, "msg", "ended")
+	})
+	a.arpQuiets[key] = timer
+
+	return nil
+}
+
+// stopARPQuiets ends all of the quiet periods that are running.
+func (a *announcer) stopARPQuiets() {
+	a.arpLock.Lock()
+	defer a.arpLock.Unlock()
+
+	for key, timer := range a.arpQuiets {
+		timer.Stop()
+		delete(a.arpQuiets, key)
+		a.releaseStrictARPLocked(key)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// vipLinkBackend is the interface between the per-VIP macvlan code and
+// the host's network so we can test it without touching the host.
+type vipLinkBackend interface {
+	LinkByName(name string) (netlink.Link, error)
+	LinkAdd(link netlink.Link) error
+	LinkSetUp(link netlink.Link) error
+	LinkDel(link netlink.Link) error
+}
+
+// hostVIPLinks is the vipLinkBackend that uses the host's network.
+type hostVIPLinks struct{}
+
+func (hostVIPLinks) LinkByName(name string) (netlink.Link, error) {
+	return netlink.LinkByName(name)
+}
+
+func (hostVIPLinks) LinkAdd(link netlink.Link) error {
+	return netlink.LinkAdd(link)
+}
+
+func (hostVIPLinks) LinkSetUp(link netlink.Link) error {
+	return netlink.LinkSetUp(link)
+}
+
+func (hostVIPLinks) LinkDel(link netlink.Link) error {
+	return netlink.LinkDel(link)
+}
+
+// vipHash returns a hash of ip that we use to derive the name and MAC
+// address of its macvlan. IPv4 addresses are hashed in their 4-byte
+// form so the result doesn't depend on how ip was parsed.
+func vipHash(ip net.IP) [sha256.Size]byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return sha256.Sum256(ip4)
+	}
+	return sha256.Sum256(ip.To16())
+}
+
+// vipMAC returns the MAC address of ip's macvlan. It's derived from
+// the address so it's the same on every node, which means that the
+// network sees the same MAC no matter which node announces the
+// address. It's a locally-administered unicast address.
+func vipMAC(ip net.IP) net.HardwareAddr {
+	hash := vipHash(ip)
+	return net.HardwareAddr{0x02, hash[0], hash[1], hash[2], hash[3], hash[4]}
+}
+
+// vipLinkName returns the name of ip's macvlan. Interface names can
+// be at most 15 characters long so we use part of the address's hash
+// instead of the address itself.
+func vipLinkName(ip net.IP) string {
+	hash := vipHash(ip)
+	return fmt.Sprintf("plb%x", hash[:4])
+}
+
+// addVIPLink ensures that lbIP has a macvlan on parent and that it's
+// up, and returns it. If lbIP's macvlan is on a different parent
+// (e.g., because the node's interfaces have changed) then it's
+// replaced.
+func addVIPLink(backend vipLinkBackend, parent netlink.Link, lbIP net.IP) (netlink.Link, error) {
+	name := vipLinkName(lbIP)
+
+	if link, err := backend.LinkByName(name); err == nil {
+		if link.Attrs().ParentIndex == parent.Attrs().Index {
+			return link, backend.LinkSetUp(link)
+		}
+		if err := backend.LinkDel(link); err != nil {
+			return nil, fmt.Errorf("removing macvlan %s from old parent: %w", name, err)
+		}
+	}
+
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = name
+	attrs.ParentIndex = parent.Attrs().Index
+	attrs.HardwareAddr = vipMAC(lbIP)
+	link := &netlink.Macvlan{LinkAttrs: attrs, Mode: netlink.MACVLAN_MODE_BRIDGE}
+
+	if err := backend.LinkAdd(link); err != nil {
+		return nil, fmt.Errorf("adding macvlan %s to %s: %w", name, parent.Attrs().Name, err)
+	}
+	if err := backend.LinkSetUp(link); err != nil {
+		return nil, fmt.Errorf("bringing up macvlan %s: %w", name, err)
+	}
+
+	return link, nil
+}
+
+// removeVIPLink removes lbIP's macvlan, if it has one.
+func removeVIPLink(backend vipLinkBackend, lbIP net.IP) error {
+	link, err := backend.LinkByName(vipLinkName(lbIP))
+	if err != nil {
+		// No macvlan, nothing to do
+		return nil
+	}
+	return backend.LinkDel(link)
+}
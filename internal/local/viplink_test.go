@@ -0,0 +1,140 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	v1 "k8s.io/api/core/v1"
+)
+
+// fakeVIPLinks implements vipLinkBackend with an in-memory set of
+// links.
+type fakeVIPLinks struct {
+	links map[string]netlink.Link
+	up    map[string]bool
+}
+
+func newFakeVIPLinks() *fakeVIPLinks {
+	return &fakeVIPLinks{links: map[string]netlink.Link{}, up: map[string]bool{}}
+}
+
+func (f *fakeVIPLinks) LinkByName(name string) (netlink.Link, error) {
+	if link, exists := f.links[name]; exists {
+		return link, nil
+	}
+	return nil, fmt.Errorf("link %s not found", name)
+}
+
+func (f *fakeVIPLinks) LinkAdd(link netlink.Link) error {
+	if _, exists := f.links[link.Attrs().Name]; exists {
+		return fmt.Errorf("link %s exists", link.Attrs().Name)
+	}
+	f.links[link.Attrs().Name] = link
+	return nil
+}
+
+func (f *fakeVIPLinks) LinkSetUp(link netlink.Link) error {
+	f.up[link.Attrs().Name] = true
+	return nil
+}
+
+func (f *fakeVIPLinks) LinkDel(link netlink.Link) error {
+	delete(f.links, link.Attrs().Name)
+	delete(f.up, link.Attrs().Name)
+	return nil
+}
+
+func TestVIPMAC(t *testing.T) {
+	ip4 := net.ParseIP("192.168.1.1")
+
+	// The MAC depends only on the address, not on how it was parsed
+	assert.Equal(t, vipMAC(ip4), vipMAC(ip4.To4()))
+	assert.Equal(t, vipLinkName(ip4), vipLinkName(ip4.To4()))
+
+	// Different addresses have different MACs
+	assert.NotEqual(t, vipMAC(ip4), vipMAC(net.ParseIP("192.168.1.2")))
+	assert.NotEqual(t, vipLinkName(ip4), vipLinkName(net.ParseIP("192.168.1.2")))
+
+	// MACs are locally administered unicast addresses
+	for _, ip := range []string{"192.168.1.1", "10.0.0.1", "fc00::1"} {
+		mac := vipMAC(net.ParseIP(ip))
+		assert.Len(t, mac, 6)
+		assert.Equal(t, byte(0x02), mac[0]&0x03, ip)
+	}
+
+	// Names fit in an interface name
+	assert.LessOrEqual(t, len(vipLinkName(net.ParseIP("fc00::1"))), 15)
+}
+
+func TestVIPLink(t *testing.T) {
+	backend := newFakeVIPLinks()
+	eth0 := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth0", Index: 2}}
+	eth1 := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth1", Index: 3}}
+	ip := net.ParseIP("192.168.1.1")
+
+	// The macvlan is created on the parent with the derived MAC
+	link, err := addVIPLink(backend, eth0, ip)
+	assert.NoError(t, err)
+	assert.Equal(t, vipLinkName(ip), link.Attrs().Name)
+	assert.Equal(t, 2, link.Attrs().ParentIndex)
+	assert.Equal(t, vipMAC(ip), link.Attrs().HardwareAddr)
+	assert.True(t, backend.up[vipLinkName(ip)])
+
+	// Adding it again reuses it
+	again, err := addVIPLink(backend, eth0, ip)
+	assert.NoError(t, err)
+	assert.Same(t, link, again)
+
+	// Adding it to a different parent replaces it
+	moved, err := addVIPLink(backend, eth1, ip)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, moved.Attrs().ParentIndex)
+	assert.Len(t, backend.links, 1)
+
+	// Removing it cleans up, and removing it again is OK
+	assert.NoError(t, removeVIPLink(backend, ip))
+	assert.Empty(t, backend.links)
+	assert.NoError(t, removeVIPLink(backend, ip))
+}
+
+func TestWithdrawRemovesVIPLink(t *testing.T) {
+	backend := newFakeVIPLinks()
+	eth0 := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth0", Index: 2}}
+	a := &announcer{
+		logger:       log.NewNopLogger(),
+		myNode:       "test-node",
+		svcIngresses: map[string][]v1.LoadBalancerIngress{},
+		vipLinks:     backend,
+	}
+
+	// A macvlan that's shared by two services stays until both are
+	// gone
+	ip := net.ParseIP("192.0.2.1")
+	_, err := addVIPLink(backend, eth0, ip)
+	assert.NoError(t, err)
+	a.svcIngresses["test/one"] = []v1.LoadBalancerIngress{{IP: ip.String()}}
+	a.svcIngresses["test/two"] = []v1.LoadBalancerIngress{{IP: ip.String()}}
+
+	assert.NoError(t, a.DeleteBalancer("test/one", "test", nil))
+	assert.Len(t, backend.links, 1, "macvlan removed while still in use")
+	assert.NoError(t, a.DeleteBalancer("test/two", "test", nil))
+	assert.Empty(t, backend.links, "macvlan not removed")
+}
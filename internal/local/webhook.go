@@ -0,0 +1,198 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	// webhookAnnounce and webhookWithdraw are the actions that we
+	// tell the webhook about.
+	webhookAnnounce = "announce"
+	webhookWithdraw = "withdraw"
+
+	// webhookAttempts is how many times we try to deliver each event.
+	// webhookRetryDelay is how long we wait before the first retry,
+	// and it doubles after each one.
+	webhookAttempts   = 3
+	webhookRetryDelay = time.Second
+
+	// webhookTimeout is how long we wait for the webhook to respond.
+	webhookTimeout = 5 * time.Second
+
+	// webhookQueueLen is how many events can wait to be delivered. If
+	// the webhook falls further behind than that then we drop events.
+	webhookQueueLen = 100
+)
+
+// webhookEvent is the payload that we POST to the webhook.
+type webhookEvent struct {
+	Service string `json:"service"`
+	IP      string `json:"ip"`
+	Node    string `json:"node"`
+	Action  string `json:"action"`
+}
+
+// webhook tells an external system when we announce or withdraw
+// addresses. It's best-effort: events are delivered in order by a
+// background goroutine so a slow or broken webhook never holds up an
+// announcement or a configuration change, and events that can't be
+// delivered are logged and dropped.
+type webhook struct {
+	url        string
+	http       http.Client
+	logger     log.Logger
+	events     chan webhookEvent
+	retryDelay time.Duration
+
+	// ctx is cancelled when the webhook is stopped, which interrupts
+	// the delivery that's in progress.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newWebhook returns a webhook that POSTs events to url. Call stop()
+// when it's no longer needed.
+func newWebhook(url string, logger log.Logger) *webhook {
+	w := &webhook{
+		url:        url,
+		http:       http.Client{Timeout: webhookTimeout},
+		logger:     logger,
+		events:     make(chan webhookEvent, webhookQueueLen),
+		retryDelay: webhookRetryDelay,
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	go w.run()
+	return w
+}
+
+// send queues event for delivery.
+func (w *webhook) send(event webhookEvent) {
+	select {
+	case w.events <- event:
+	default:
+		w.logger.Log("op", "webhook", "error", "queue full", "event", fmt.Sprintf("%+v", event), "msg", "dropping event")
+	}
+}
+
+// stop stops the webhook without waiting for it. Events that haven't
+// been delivered are dropped.
+func (w *webhook) stop() {
+	w.cancel()
+}
+
+func (w *webhook) run() {
+	for {
+		select {
+		case <-w.ctx.Done():
+			if dropped := len(w.events); dropped > 0 {
+				w.logger.Log("op", "webhook", "dropped", dropped, "msg", "webhook stopped, dropping events")
+			}
+			return
+		case event := <-w.events:
+			if err := w.deliver(event); err != nil {
+				w.logger.Log("op", "webhook", "error", err, "event", fmt.Sprintf("%+v", event), "msg", "dropping event")
+			}
+		}
+	}
+}
+
+// deliver POSTs event to the webhook, retrying with backoff if that
+// fails.
+func (w *webhook) deliver(event webhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	delay := w.retryDelay
+	for attempt := 1; ; attempt++ {
+		if err = w.post(body); err == nil || attempt == webhookAttempts {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-w.ctx.Done():
+			return w.ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+func (w *webhook) post(body []byte) error {
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// setWebhook starts sending events to url, or stops sending them if
+// url is "".
+func (a *announcer) setWebhook(url string) {
+	if a.webhook != nil && a.webhook.url == url {
+		return
+	}
+	if a.webhook != nil {
+		a.webhook.stop()
+		a.webhook = nil
+	}
+	if url != "" {
+		a.webhook = newWebhook(url, a.logger)
+	}
+}
+
+// notify tells the webhook, if we have one, that we've announced or
+// withdrawn nsName's lbIP. We announce addresses each time we sync
+// their services so we tell the webhook only when something changes.
+func (a *announcer) notify(nsName string, lbIP net.IP, action string) {
+	if a.webhook == nil {
+		return
+	}
+
+	key := nsName + " " + lbIP.String()
+	announced := action == webhookAnnounce
+	if a.notified[key] == announced {
+		return
+	}
+	if a.notified == nil {
+		a.notified = map[string]bool{}
+	}
+	if announced {
+		a.notified[key] = true
+	} else {
+		delete(a.notified, key)
+	}
+
+	a.webhook.send(webhookEvent{Service: nsName, IP: lbIP.String(), Node: a.myNode, Action: action})
+}
@@ -0,0 +1,166 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeWebhook records the events that it receives. It fails the
+// first "failures" requests.
+type fakeWebhook struct {
+	sync.Mutex
+	failures int
+	requests int
+	events   []webhookEvent
+}
+
+func (f *fakeWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.requests++
+	if f.requests <= f.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	event := webhookEvent{}
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.events = append(f.events, event)
+}
+
+// received returns the number of requests and the events that f has
+// received so far.
+func (f *fakeWebhook) received() (int, []webhookEvent) {
+	f.Lock()
+	defer f.Unlock()
+	return f.requests, append([]webhookEvent{}, f.events...)
+}
+
+// delivered waits until f has received count requests, and returns
+// the events.
+func (f *fakeWebhook) delivered(t *testing.T, count int) []webhookEvent {
+	assert.Eventually(t, func() bool {
+		requests, _ := f.received()
+		return requests >= count
+	}, 5*time.Second, time.Millisecond)
+	_, events := f.received()
+	return events
+}
+
+func newTestWebhook(url string) *webhook {
+	w := newWebhook(url, log.NewNopLogger())
+	w.retryDelay = time.Millisecond
+	return w
+}
+
+func TestWebhookNotify(t *testing.T) {
+	fake := &fakeWebhook{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	a := &announcer{logger: log.NewNopLogger(), myNode: "node1"}
+	a.setWebhook(server.URL)
+	a.webhook.retryDelay = time.Millisecond
+
+	lbIP := net.ParseIP("192.168.1.100")
+	a.notify("default/web", lbIP, webhookAnnounce)
+	a.notify("default/web", lbIP, webhookAnnounce) // no change so no event
+	a.notify("default/web", lbIP, webhookWithdraw)
+	a.notify("default/web", lbIP, webhookWithdraw) // no change so no event
+
+	assert.Equal(t, []webhookEvent{
+		{Service: "default/web", IP: "192.168.1.100", Node: "node1", Action: webhookAnnounce},
+		{Service: "default/web", IP: "192.168.1.100", Node: "node1", Action: webhookWithdraw},
+	}, fake.delivered(t, 2))
+
+	a.setWebhook("")
+	assert.Nil(t, a.webhook)
+}
+
+func TestWebhookRetry(t *testing.T) {
+	event := webhookEvent{Service: "default/web", IP: "192.168.1.100", Node: "node1", Action: webhookAnnounce}
+
+	// Transient failures are retried
+	fake := &fakeWebhook{failures: webhookAttempts - 1}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	w := newTestWebhook(server.URL)
+	w.send(event)
+	assert.Equal(t, []webhookEvent{event}, fake.delivered(t, webhookAttempts))
+	w.stop()
+
+	// We give up eventually
+	fake = &fakeWebhook{failures: webhookAttempts}
+	server2 := httptest.NewServer(fake)
+	defer server2.Close()
+	w = newTestWebhook(server2.URL)
+	w.send(event)
+	assert.Empty(t, fake.delivered(t, webhookAttempts))
+	w.stop()
+}
+
+func TestWebhookStop(t *testing.T) {
+	event := webhookEvent{Service: "default/web", IP: "192.168.1.100", Node: "node1", Action: webhookAnnounce}
+
+	// The webhook hangs until the request is cancelled. The server only
+	// notices that once it has read the body.
+	requests := make(chan struct{}, webhookQueueLen)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		requests <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	a := &announcer{logger: log.NewNopLogger(), myNode: "node1"}
+	a.setWebhook(server.URL)
+	for i := 0; i < 3; i++ {
+		a.webhook.send(event)
+	}
+	<-requests
+
+	// Reconfiguring doesn't wait for the hung request or the events
+	// behind it
+	stopped := make(chan struct{})
+	go func() {
+		a.setWebhook("")
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("reconfiguring the webhook blocked")
+	}
+	assert.Nil(t, a.webhook)
+
+	// The events that were waiting are dropped
+	time.Sleep(10 * time.Millisecond)
+	assert.Empty(t, requests)
+}
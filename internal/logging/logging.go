@@ -35,6 +35,15 @@ var (
 	branch  string
 )
 
+// Release returns the release that this binary was built from, or
+// "dev" if it wasn't provided at build time.
+func Release() string {
+	if release == "" {
+		return "dev"
+	}
+	return release
+}
+
 // Init returns a logger configured with common settings like
 // timestamping and source code locations. Both the stdlib logger and
 // glog are reconfigured to push logs into this logger.
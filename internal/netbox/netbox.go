@@ -21,8 +21,13 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"time"
 )
 
+// DefaultTimeout is how long we wait for Netbox to respond to each
+// request if the pool doesn't specify a timeout.
+const DefaultTimeout = 10 * time.Second
+
 type Netbox interface {
 	Fetch() (string, error)
 }
@@ -37,6 +42,8 @@ type netbox struct {
 	tenant string
 	// The Netbox user token that PureLB uses to authenticate.
 	token string
+	// Extra headers that we add to each request.
+	headers http.Header
 }
 
 type address struct {
@@ -48,9 +55,30 @@ type addressQueryResponse struct {
 	Results []address
 }
 
-// NewNetbox configures a new connection to a Netbox system.
-func NewNetbox(base string, tenant string, token string) Netbox {
-	return &netbox{http: http.Client{}, base: base, tenant: tenant, token: token}
+// UserAgent returns the User-Agent header that identifies release of
+// PureLB running in cluster. cluster can be "".
+func UserAgent(release string, cluster string) string {
+	agent := "purelb/" + release
+	if cluster != "" {
+		agent += " (cluster " + cluster + ")"
+	}
+	return agent
+}
+
+// NewNetbox configures a new connection to a Netbox system. Each
+// request fails if Netbox doesn't respond within timeout, so a hung
+// Netbox doesn't block allocation. If timeout is 0 then
+// DefaultTimeout is used. headers are added to each request, e.g., to
+// identify the client.
+func NewNetbox(base string, tenant string, token string, timeout time.Duration, headers map[string]string) Netbox {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	header := http.Header{}
+	for name, value := range headers {
+		header.Set(name, value)
+	}
+	return &netbox{http: http.Client{Timeout: timeout}, base: base, tenant: tenant, token: token, headers: header}
 }
 
 func (n *netbox) newRequest(verb string, url string) (*http.Request, error) {
@@ -58,6 +86,9 @@ func (n *netbox) newRequest(verb string, url string) (*http.Request, error) {
 	if err != nil {
 		return nil, err
 	}
+	for name, values := range n.headers {
+		req.Header[name] = values
+	}
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("accept", "application/json")
 	req.Header.Add("Authorization", "Token "+n.token)
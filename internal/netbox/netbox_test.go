@@ -0,0 +1,73 @@
+// Copyright 2020,2021 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netbox
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			fmt.Fprint(w, `{"count": 1, "results": [{"id": 42, "address": "192.0.2.1/32"}]}`)
+		}
+	}))
+	defer server.Close()
+
+	addr, err := NewNetbox(server.URL+"/", "tenant", "token", 0, nil).Fetch()
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.1/32", addr)
+}
+
+func TestFetchTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Netbox is hung
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	// The fetch fails once the timeout expires instead of waiting for
+	// Netbox
+	start := time.Now()
+	_, err := NewNetbox(server.URL+"/", "tenant", "token", 50*time.Millisecond, nil).Fetch()
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second, "fetch didn't time out")
+}
+
+func TestHeaders(t *testing.T) {
+	var got http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		fmt.Fprint(w, `{"count": 1, "results": [{"id": 42, "address": "192.0.2.1/32"}]}`)
+	}))
+	defer server.Close()
+
+	headers := map[string]string{"User-Agent": UserAgent("v1.2.3", "prod"), "X-Audit": "purelb"}
+	_, err := NewNetbox(server.URL+"/", "tenant", "token", 0, headers).Fetch()
+	assert.NoError(t, err)
+	assert.Equal(t, "purelb/v1.2.3 (cluster prod)", got.Get("User-Agent"))
+	assert.Equal(t, "purelb", got.Get("X-Audit"))
+	assert.Equal(t, "Token token", got.Get("Authorization"))
+
+	assert.Equal(t, "purelb/v1.2.3", UserAgent("v1.2.3", ""))
+}
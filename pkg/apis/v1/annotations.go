@@ -33,7 +33,9 @@ const (
 
 	// DesiredGroupAnnotation is the key for the annotation that
 	// indicates the pool from which the user would like PureLB to
-	// allocate this service's IP address.
+	// allocate this service's IP address. It can be a comma-separated
+	// list of pools, in which case PureLB allocates from the first pool
+	// that has a free address.
 	DesiredGroupAnnotation string = "purelb.io/service-group"
 
 	// AllowLocalAnnotation tells PureLB to allow this Service
@@ -44,6 +46,53 @@ const (
 	// so this annotation overrides that policy.
 	AllowLocalAnnotation string = "purelb.io/allow-local"
 
+	// AnnounceExternalIPsAnnotation tells PureLB to announce the
+	// Service's spec.externalIPs in addition to any addresses that
+	// PureLB allocated. Only externalIPs that belong to one of the
+	// ServiceGroups are announced. This works on any type of Service,
+	// including headless Services which can't be LoadBalancers.
+	AnnounceExternalIPsAnnotation string = "purelb.io/announce-external-ips"
+
+	// AggregationAnnotation overrides the ServiceGroup's aggregation
+	// when this Service's addresses are added to the virtual
+	// interface. The value is a prefix length (e.g., "/32") or
+	// "default", or a comma-separated list of them for dual-stack
+	// services (e.g., "/32,/128"). Each address uses the first value
+	// that's between its pool's subnet mask and the address length.
+	AggregationAnnotation string = "purelb.io/aggregation"
+
+	// IgnoreAnnotation tells PureLB to leave this Service alone when
+	// its value is "true", e.g., because another controller manages
+	// its addresses. The allocator doesn't allocate addresses for it
+	// or change it in any way, and the node agents don't announce its
+	// addresses.
+	IgnoreAnnotation string = "purelb.io/ignore"
+
+	// AllocationPolicyAnnotation tells the allocator how to pick the
+	// pool for a Service that doesn't have a DesiredGroupAnnotation.
+	// The only policy is AllocationPolicySpread. Without the annotation
+	// the allocator uses the default pool.
+	AllocationPolicyAnnotation string = "purelb.io/allocation-policy"
+
+	// AllocationPolicySpread tells the allocator to use the pool that
+	// has the smallest fraction of its addresses in use.
+	AllocationPolicySpread string = "spread"
+
+	// ReallocateAnnotation tells the allocator to move this Service's
+	// address when its value is "true" and its DesiredGroupAnnotation
+	// no longer lists the pool that the address came from. The
+	// allocator releases the address and allocates a new one from the
+	// desired group. Without it the Service keeps its address.
+	ReallocateAnnotation string = "purelb.io/reallocate"
+
+	// MaintenanceWindowAnnotation tells the node agents not to move
+	// this Service's local addresses to other nodes during a window of
+	// time, even if the elections pick other nodes, so nothing changes
+	// during sensitive periods. The value is the window's start and
+	// end in RFC 3339 format separated by a "/", e.g.,
+	// "2021-01-01T00:00:00Z/2021-01-01T06:00:00Z".
+	MaintenanceWindowAnnotation string = "purelb.io/maintenance-window"
+
 	// Annotations that PureLB sets that might be useful to users.
 
 	// BrandAnnotation is the key for the PureLB "brand" annotation.
@@ -59,6 +108,21 @@ const (
 	// the PureLB ServiceGroup custom resource.
 	PoolAnnotation string = "purelb.io/allocated-from"
 
+	// AnnounceMethodAnnotation is the key for the annotation that
+	// tells the node agents how to announce this service's addresses:
+	// AnnounceMethodLocal or AnnounceMethodRemote. The allocator sets
+	// it based on the ServiceGroup from which the addresses came.
+	AnnounceMethodAnnotation string = "purelb.io/announce-method"
+
+	// AnnounceMethodLocal means that the node agents decide how to
+	// announce the address by comparing it to their interfaces'
+	// subnets.
+	AnnounceMethodLocal string = "local"
+
+	// AnnounceMethodRemote means that the node agents always announce
+	// the address on the virtual interface.
+	AnnounceMethodRemote string = "remote"
+
 	// AnnounceAnnotation is the key for the annotation that indicates
 	// which node/intf is announcing this service's IP address. The IP
 	// family name will be appended because in a dual-stack service we
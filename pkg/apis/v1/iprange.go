@@ -34,20 +34,49 @@ type IPRange struct {
 
 // NewIPRange parses a string representation of an IP address range
 // and returns the corresponding IPRange.  The representation can be
-// in either of two forms: CIDR or from-to.  CIDR looks like
-// "192.168.1.0/24" and from-to looks like "192.168.1.0 -
-// 192.168.1.255". The error return value will be non-nil if the
-// representation couldn't be parsed.
+// in any of three forms: CIDR, from-to, or a single address.  CIDR
+// looks like "192.168.1.0/24", from-to looks like "192.168.1.0 -
+// 192.168.1.255", and a single address looks like "192.168.1.1". The
+// error return value will be non-nil if the representation couldn't
+// be parsed.
 func NewIPRange(raw string) (IPRange, error) {
 	if strings.Contains(raw, "-") {
 		// "from-to" notation
 		return parseFromTo(raw)
 	}
 
+	// A single address is a range that starts and ends with it
+	if ip := net.ParseIP(strings.TrimSpace(raw)); ip != nil {
+		return IPRange{from: ip, to: ip}, nil
+	}
+
 	// CIDR notation
 	return parseCIDR(raw)
 }
 
+// NewIPRanges parses a comma-separated list of IP address ranges,
+// each of which can be in any of the forms that NewIPRange accepts,
+// e.g., "10.129.0.29,10.129.0.34" or "192.168.1.0/30, 192.168.1.8".
+// The ranges are returned in the order that they're listed. The error
+// return value will be non-nil if any of the ranges couldn't be
+// parsed or if any two of them overlap.
+func NewIPRanges(raw string) ([]IPRange, error) {
+	ranges := []IPRange{}
+	for _, rawRange := range strings.Split(raw, ",") {
+		iprange, err := NewIPRange(strings.TrimSpace(rawRange))
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range ranges {
+			if iprange.Overlaps(other) || other.Overlaps(iprange) {
+				return nil, fmt.Errorf("range %s overlaps range %s", iprange, other)
+			}
+		}
+		ranges = append(ranges, iprange)
+	}
+	return ranges, nil
+}
+
 var IPRangeComparer = cmp.Comparer(func(x, y IPRange) bool {
 	return reflect.DeepEqual(x.from, y.from) && reflect.DeepEqual(x.to, y.to)
 })
@@ -106,6 +135,44 @@ func (r IPRange) Next(ip net.IP) net.IP {
 	return next
 }
 
+// Nth returns the nth net.IP (counting from zero) within this
+// IPRange, or nil if the range doesn't have that many addresses.
+func (r IPRange) Nth(n uint64) net.IP {
+	if n >= r.Size() {
+		return nil
+	}
+
+	// Add n to the first address, one byte at a time
+	nth := dup(r.from)
+	for j := len(nth) - 1; j >= 0 && n > 0; j-- {
+		sum := uint64(nth[j]) + n&0xff
+		nth[j] = byte(sum)
+		n = n>>8 + sum>>8
+	}
+	return nth
+}
+
+// NthFromLast returns the nth net.IP (counting from zero) back from
+// the end of this IPRange, or nil if the range doesn't have that many
+// addresses.
+func (r IPRange) NthFromLast(n uint64) net.IP {
+	if n >= r.Size() {
+		return nil
+	}
+
+	// Subtract n from the last address, one byte at a time
+	nth := dup(r.to)
+	for j := len(nth) - 1; j >= 0 && n > 0; j-- {
+		sub := n & 0xff
+		n >>= 8
+		if uint64(nth[j]) < sub {
+			n++ // borrow
+		}
+		nth[j] -= byte(sub)
+	}
+	return nth
+}
+
 // Size returns the count of net.IPs contained in this IPRange.  If
 // the count is too large to be represented by a uint64 then the
 // return value will be math.MaxUint64.
@@ -127,8 +194,13 @@ func (r IPRange) Size() uint64 {
 
 	// We add 1 because the range is inclusive, i.e., the addresses at
 	// both ends are available for allocation.  So, for example, if the
-	// IPRange is 1.1.1.1/32 there's one address available.
-	return 1 + toInt(r.to.To16()) - toInt(r.from.To16())
+	// IPRange is 1.1.1.1/32 there's one address available. A /64 has
+	// one more address than we can represent so it saturates, too.
+	diff := toInt(r.to.To16()) - toInt(r.from.To16())
+	if diff == math.MaxUint64 {
+		return math.MaxUint64
+	}
+	return 1 + diff
 }
 
 // String returns a human-readable representation of this range.
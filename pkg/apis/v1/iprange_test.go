@@ -55,10 +55,33 @@ func TestParseRange(t *testing.T) {
 func TestNewIPRange(t *testing.T) {
 	assertIPRange(t, mustIPRange(t, "1.1.1.1/32"), "1.1.1.1", "1.1.1.1")
 	assertIPRange(t, mustIPRange(t, "1.1.1.0-1.1.1.1"), "1.1.1.0", "1.1.1.1")
+	assertIPRange(t, mustIPRange(t, "1.1.1.1"), "1.1.1.1", "1.1.1.1")
 
 	assertIPRange(t, mustIPRange(t, "2001:db8::0 - 2001:db8::ffff"), "2001:db8::", "2001:db8::ffff")
 }
 
+func TestNewIPRanges(t *testing.T) {
+	ranges, err := NewIPRanges("10.129.0.34, 10.129.0.29,10.129.0.40-10.129.0.41,10.129.1.0/31")
+	assert.NoError(t, err)
+	assert.Len(t, ranges, 4)
+	assertIPRange(t, ranges[0], "10.129.0.34", "10.129.0.34")
+	assertIPRange(t, ranges[1], "10.129.0.29", "10.129.0.29")
+	assertIPRange(t, ranges[2], "10.129.0.40", "10.129.0.41")
+	assertIPRange(t, ranges[3], "10.129.1.0", "10.129.1.1")
+
+	// A single range is a list of one
+	ranges, err = NewIPRanges("2001:db8::/112")
+	assert.NoError(t, err)
+	assert.Len(t, ranges, 1)
+
+	_, err = NewIPRanges("10.129.0.29,bogus")
+	assert.Error(t, err, "invalid address should have failed to parse")
+	_, err = NewIPRanges("10.129.0.29,")
+	assert.Error(t, err, "empty entry should have failed to parse")
+	_, err = NewIPRanges("10.129.0.30,10.129.0.28-10.129.0.31")
+	assert.Error(t, err, "overlapping ranges should have failed")
+}
+
 func TestOverlaps(t *testing.T) {
 	ipr1 := mustIPRange(t, "1.1.1.1/32")
 	ipr2 := mustIPRange(t, "1.1.1.2/32")
@@ -91,6 +114,32 @@ func TestNext(t *testing.T) {
 	assert.Nil(t, ip)
 }
 
+func TestNth(t *testing.T) {
+	ipr1 := mustIPRange(t, "1.1.1.254-1.1.2.1")
+	assert.Equal(t, "1.1.1.254", ipr1.Nth(0).String())
+	assert.Equal(t, "1.1.2.0", ipr1.Nth(2).String())
+	assert.Equal(t, "1.1.2.1", ipr1.Nth(3).String())
+	assert.Nil(t, ipr1.Nth(4))
+
+	ipr2 := mustIPRange(t, "2001:db8::/112")
+	assert.Equal(t, "2001:db8::1:0", mustIPRange(t, "2001:db8::/96").Nth(65536).String())
+	assert.Equal(t, "2001:db8::ffff", ipr2.Nth(65535).String())
+	assert.Nil(t, ipr2.Nth(65536))
+}
+
+func TestNthFromLast(t *testing.T) {
+	ipr1 := mustIPRange(t, "1.1.1.254-1.1.2.1")
+	assert.Equal(t, "1.1.2.1", ipr1.NthFromLast(0).String())
+	assert.Equal(t, "1.1.1.255", ipr1.NthFromLast(2).String())
+	assert.Equal(t, "1.1.1.254", ipr1.NthFromLast(3).String())
+	assert.Nil(t, ipr1.NthFromLast(4))
+
+	ipr2 := mustIPRange(t, "2001:db8::/112")
+	assert.Equal(t, "2001:db8::fffe:ffff", mustIPRange(t, "2001:db8::/96").NthFromLast(65536).String())
+	assert.Equal(t, "2001:db8::", ipr2.NthFromLast(65535).String())
+	assert.Nil(t, ipr2.NthFromLast(65536))
+}
+
 func TestFamily(t *testing.T) {
 	iprV4 := mustIPRange(t, "1.1.1.0/31")
 	assert.Equal(t, nl.FAMILY_V4, iprV4.Family(), "wrong family")
@@ -138,6 +187,7 @@ func TestSize(t *testing.T) {
 
 	// IPV6 CIDR
 	assert.Equal(t, uint64(65535), mustIPRange(t, "2001:db8::1/112").Size())
+	assert.Equal(t, uint64(math.MaxUint64), mustIPRange(t, "2001:db8::/64").Size())
 
 	// IPV6 to-from
 	assert.Equal(t, uint64(5), mustIPRange(t, "2001:db8::68 - 2001:db8::6c").Size())
@@ -17,9 +17,12 @@ package v1
 import (
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 
 	"github.com/vishvananda/netlink/nl"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 // +genclient
@@ -29,6 +32,7 @@ import (
 // ServiceGroups. It contains the usual CRD metadata, and the service
 // group spec and status.
 // +kubebuilder:resource:shortName=sg;sgs
+// +kubebuilder:subresource:status
 type ServiceGroup struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
@@ -48,6 +52,21 @@ type ServiceGroupSpec struct {
 	Local *ServiceGroupLocalSpec `json:"local,omitempty"`
 	// +optional
 	Netbox *ServiceGroupNetboxSpec `json:"netbox,omitempty"`
+
+	// Draining marks this ServiceGroup for decommissioning. Services
+	// that already have addresses from a draining group keep them, and
+	// users can still request specific addresses from it, but the
+	// allocator won't allocate new addresses from it automatically.
+	// +optional
+	Draining bool `json:"draining,omitempty"`
+
+	// LowFreeThreshold is the number (e.g., 5) or percentage (e.g.,
+	// "10%") of free addresses below which the allocator warns that
+	// this group is running out of addresses. The warning is sent once
+	// each time the group drops below the threshold. The default is
+	// zero, i.e., no warning.
+	// +optional
+	LowFreeThreshold intstr.IntOrString `json:"lowfreethreshold,omitempty"`
 }
 
 // ServiceGroupLocalSpec configures the allocator to manage pools of
@@ -82,8 +101,82 @@ type ServiceGroupLocalSpec struct {
 	V4Pools []*ServiceGroupAddressPool `json:"v4pools,omitempty"`
 	// +optional
 	V6Pools []*ServiceGroupAddressPool `json:"v6pools,omitempty"`
+
+	// Remote tells the node agents to announce this group's addresses
+	// on the virtual interface (i.e., via routing) even if they're on
+	// the same subnet as a node's local interface. This is useful if
+	// you'd prefer to use BGP to announce on-subnet addresses. The
+	// default is false, which means that the node agents decide by
+	// comparing the address to their interfaces' subnets.
+	// +optional
+	Remote bool `json:"remote,omitempty"`
+
+	// Allocation determines how the allocator picks addresses from
+	// this group. "sequential" (the default) allocates the lowest free
+	// address. "hash" starts with an address derived from the service's
+	// namespace and name, so a service gets the same address each time
+	// (as long as it's free) even if the allocator restarts. If that
+	// address is in use then the allocator tries the addresses after
+	// it. "lru" allocates the least-recently-freed address, so freed
+	// addresses aren't reused while stale ARP entries might still point
+	// at their old owners. Addresses that have never been freed come
+	// first, in sequential order. The allocator forgets when addresses
+	// were freed when it restarts or the group changes.
+	// +kubebuilder:validation:Enum=sequential;hash;lru
+	// +optional
+	Allocation string `json:"allocation,omitempty"`
+
+	// FamilyPreference determines which address family the allocator
+	// tries first for services that will accept either family, i.e.,
+	// single-stack services that don't specify one. "ipv6" (the
+	// default) tries IPv6 first, "ipv4" tries IPv4 first, and
+	// "mostfree" tries the family with the most free addresses first.
+	// If the first family has no free addresses then the allocator
+	// tries the other one.
+	// +kubebuilder:validation:Enum=ipv6;ipv4;mostfree
+	// +optional
+	FamilyPreference string `json:"familypreference,omitempty"`
+
+	// MaxAddresses limits the number of addresses that the allocator
+	// will give each service from this group. Dual-stack services that
+	// ask for more families than this fail to allocate instead of
+	// getting one address from each family. If it's not set then
+	// there's no limit.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxAddresses *int `json:"maxaddresses,omitempty"`
+
+	// SequentialPrefixes groups services whose names start with one of
+	// these prefixes, e.g., "kafka-". The allocator tries to give each
+	// service in a group the address after the group's highest address
+	// so the group's addresses are contiguous. Groups are per
+	// namespace. This is best-effort: if that address isn't free then
+	// the allocator picks one as it would for any other service.
+	// +optional
+	SequentialPrefixes []string `json:"sequentialprefixes,omitempty"`
 }
 
+const (
+	// AllocationSequential allocates the lowest free address.
+	AllocationSequential = "sequential"
+	// AllocationHash allocates an address based on a hash of the
+	// service's namespace and name.
+	AllocationHash = "hash"
+	// AllocationLRU allocates the least-recently-freed address.
+	AllocationLRU = "lru"
+
+	// FamilyPreferenceIPv6 tries IPv6 before IPv4.
+	FamilyPreferenceIPv6 = "ipv6"
+	// FamilyPreferenceIPv4 tries IPv4 before IPv6.
+	FamilyPreferenceIPv4 = "ipv4"
+	// FamilyPreferenceIPv6ThenIPv4 is a synonym for
+	// FamilyPreferenceIPv6.
+	FamilyPreferenceIPv6ThenIPv4 = "ipv6-then-ipv4"
+	// FamilyPreferenceMostFree tries the family with the most free
+	// addresses first.
+	FamilyPreferenceMostFree = "mostfree"
+)
+
 // FamilyAggregation returns this Spec's aggregation value that
 // corresponds to family.
 func (s *ServiceGroupLocalSpec) FamilyAggregation(family int) (string, error) {
@@ -144,28 +237,20 @@ func (s *ServiceGroupLocalSpec) AddressAggregation(address net.IP) (string, erro
 // address.
 func (s *ServiceGroupLocalSpec) PoolForAddress(address net.IP) (*ServiceGroupAddressPool, error) {
 	for _, spec := range s.V6Pools {
-		pool, err := NewIPRange(spec.Pool)
-		if err == nil && pool.Contains(address) {
+		if spec.Contains(address) {
 			return spec, nil
 		}
 	}
 	for _, spec := range s.V4Pools {
-		pool, err := NewIPRange(spec.Pool)
-		if err == nil && pool.Contains(address) {
+		if spec.Contains(address) {
 			return spec, nil
 		}
 	}
-	if s.V6Pool != nil {
-		pool, err := NewIPRange(s.V6Pool.Pool)
-		if err == nil && pool.Contains(address) {
-			return s.V6Pool, nil
-		}
+	if s.V6Pool != nil && s.V6Pool.Contains(address) {
+		return s.V6Pool, nil
 	}
-	if s.V4Pool != nil {
-		pool, err := NewIPRange(s.V4Pool.Pool)
-		if err == nil && pool.Contains(address) {
-			return s.V4Pool, nil
-		}
+	if s.V4Pool != nil && s.V4Pool.Contains(address) {
+		return s.V4Pool, nil
 	}
 	if s.Pool != "" && s.Subnet != "" {
 		return &ServiceGroupAddressPool{
@@ -199,6 +284,25 @@ type ServiceGroupNetboxSpec struct {
 	URL         string `json:"url"`
 	Tenant      string `json:"tenant"`
 	Aggregation string `json:"aggregation"`
+
+	// Timeout is how long the allocator waits for Netbox to respond
+	// to each request, e.g., "5s". If Netbox doesn't respond in time
+	// then the allocation fails and is retried later. The default is
+	// 10 seconds.
+	// +optional
+	Timeout metav1.Duration `json:"timeout,omitempty"`
+
+	// ClusterName identifies this cluster to Netbox. It's added to the
+	// User-Agent header of the allocator's requests so Netbox's logs
+	// show which cluster made them.
+	// +optional
+	ClusterName string `json:"clustername,omitempty"`
+
+	// Headers are extra HTTP headers that the allocator adds to each
+	// request to Netbox, e.g., for auditing. They can override the
+	// User-Agent header.
+	// +optional
+	Headers map[string]string `json:"headers,omitempty"`
 }
 
 // ServiceGroupAddressPool specifies a pool of addresses that belong
@@ -206,7 +310,9 @@ type ServiceGroupNetboxSpec struct {
 type ServiceGroupAddressPool struct {
 	// Pool specifies a pool of addresses that PureLB manages. It can be
 	// a CIDR or a from-to range of addresses, e.g.,
-	// 'fd53:9ef0:8683::-fd53:9ef0:8683::3'.
+	// 'fd53:9ef0:8683::-fd53:9ef0:8683::3', or a comma-separated list
+	// of CIDRs, ranges, and individual addresses, e.g.,
+	// '10.129.0.29,10.129.0.34'.
 	Pool string `json:"pool"`
 
 	// Subnet specifies the subnet that contains all of the addresses in
@@ -219,10 +325,179 @@ type ServiceGroupAddressPool struct {
 	// from the subnet mask to the specified mask. It can be "default"
 	// or an integer in the range 8-128.
 	Aggregation string `json:"aggregation"`
+
+	// HostMask tells the node agents to add this pool's addresses to
+	// local interfaces with a host mask (/32 or /128) instead of the
+	// subnet mask. This stops the kernel from adding a connected route
+	// for the whole subnet. It doesn't affect remote announcements,
+	// which use the Aggregation.
+	// +optional
+	HostMask bool `json:"hostmask,omitempty"`
+
+	// Broadcast is the broadcast address that the node agents give
+	// this pool's IPv4 addresses when they add them to local
+	// interfaces. By default the kernel computes it from the address
+	// and its mask, which can be wrong for unusual subnets. It must be
+	// an IPv4 address.
+	// +optional
+	Broadcast string `json:"broadcast,omitempty"`
+
+	// AnnounceAggregateOnly tells the node agents to add only the
+	// aggregate network (i.e., the pool address with the Aggregation
+	// mask) to the virtual interface, not the individual addresses, so
+	// routing software announces a single route for the whole
+	// aggregate. The aggregate is added when the first address that
+	// it contains is announced and removed when the last is withdrawn.
+	// +optional
+	AnnounceAggregateOnly bool `json:"announceaggregateonly,omitempty"`
+
+	// NextHop is the gateway for traffic from this pool's addresses.
+	// If it's set then the node that announces an address adds a
+	// policy rule that sends traffic from the address to RouteTable,
+	// and a default route via NextHop to RouteTable, so replies leave
+	// through the same gateway that the requests came in on. It must
+	// be the same family as the pool.
+	// +optional
+	NextHop string `json:"nexthop,omitempty"`
+
+	// RouteTable is the routing table that holds the NextHop route.
+	// It's required if NextHop is set. Pools with different NextHops
+	// need different tables.
+	// +optional
+	RouteTable int `json:"routetable,omitempty"`
+
+	// GARPInterval tells the node that announces each of this pool's
+	// addresses on a local interface to resend a gratuitous ARP (or an
+	// unsolicited Neighbor Advertisement for IPv6) for it this often,
+	// for as long as it announces the address. This helps on networks
+	// where a DHCP server might otherwise decide that the address is
+	// free and lease it to someone else. The default (0) means that
+	// GARPs are sent only as configured in the LBNodeAgent.
+	// +optional
+	GARPInterval metav1.Duration `json:"garpinterval,omitempty"`
+
+	// ReserveFirst is the number of addresses at the start of the
+	// Pool that the allocator doesn't allocate automatically, e.g.,
+	// because they're used by gateways. ReserveLast is the number at
+	// the end. If the Pool is a list then each of its ranges is
+	// reserved separately. Users can still ask for reserved addresses.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	ReserveFirst int `json:"reservefirst,omitempty"`
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	ReserveLast int `json:"reservelast,omitempty"`
+
+	// AvoidBuggyIPs tells the allocator not to allocate IPv4 addresses
+	// that end in .0 or .255 automatically, since some network
+	// equipment mistakes them for network or broadcast addresses.
+	// Users can still ask for them.
+	// +optional
+	AvoidBuggyIPs bool `json:"avoidbuggyips,omitempty"`
+}
+
+// Contains returns true if address is one of this pool's addresses.
+func (p *ServiceGroupAddressPool) Contains(address net.IP) bool {
+	ranges, err := NewIPRanges(p.Pool)
+	if err != nil {
+		return false
+	}
+	for _, r := range ranges {
+		if r.Contains(address) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateAggregation returns an error if this pool's Aggregation
+// isn't "default" or a mask between /8 and the length of an address
+// in its Subnet's family, e.g., /32 for IPv4. An empty Aggregation is
+// the same as "default".
+func (p *ServiceGroupAddressPool) ValidateAggregation() error {
+	if p.Aggregation == "" || p.Aggregation == "default" {
+		return nil
+	}
+
+	_, subnet, err := net.ParseCIDR(p.Subnet)
+	if err != nil {
+		return err
+	}
+	maxLen := 8 * net.IPv6len
+	if subnet.IP.To4() != nil {
+		maxLen = 8 * net.IPv4len
+	}
+
+	if !strings.HasPrefix(p.Aggregation, "/") {
+		return fmt.Errorf("invalid aggregation %q: must be \"default\" or a mask, e.g., \"/24\"", p.Aggregation)
+	}
+	prefixLen, err := strconv.Atoi(p.Aggregation[1:])
+	if err != nil || prefixLen < 8 || prefixLen > maxLen {
+		return fmt.Errorf("invalid aggregation %q for subnet %s: must be between /8 and /%d", p.Aggregation, subnet, maxLen)
+	}
+
+	return nil
+}
+
+// ParseBroadcast returns this pool's Broadcast address, or nil if it
+// doesn't have one. It returns an error if the Broadcast address is
+// invalid or the pool isn't IPv4.
+func (p *ServiceGroupAddressPool) ParseBroadcast() (net.IP, error) {
+	if p.Broadcast == "" {
+		return nil, nil
+	}
+
+	broadcast := net.ParseIP(p.Broadcast)
+	if broadcast == nil || broadcast.To4() == nil {
+		return nil, fmt.Errorf("invalid broadcast %q", p.Broadcast)
+	}
+	_, subnet, err := net.ParseCIDR(p.Subnet)
+	if err != nil {
+		return nil, err
+	}
+	if subnet.IP.To4() == nil {
+		return nil, fmt.Errorf("broadcast %s can't be used with IPv6 subnet %s", broadcast, subnet)
+	}
+
+	return broadcast.To4(), nil
 }
 
-// ServiceGroupStatus is currently unused.
+// ParseNextHop returns this pool's NextHop, or nil if it doesn't
+// have one. It returns an error if the NextHop or RouteTable is
+// invalid.
+func (p *ServiceGroupAddressPool) ParseNextHop() (net.IP, error) {
+	if p.NextHop == "" {
+		return nil, nil
+	}
+
+	nextHop := net.ParseIP(p.NextHop)
+	if nextHop == nil {
+		return nil, fmt.Errorf("invalid nexthop %q", p.NextHop)
+	}
+	_, subnet, err := net.ParseCIDR(p.Subnet)
+	if err != nil {
+		return nil, err
+	}
+	if addrFamily(nextHop) != addrFamily(subnet.IP) {
+		return nil, fmt.Errorf("nexthop %s isn't in the same family as subnet %s", nextHop, subnet)
+	}
+
+	// Tables 253-255 are the kernel's default, main and local tables
+	// so we can't use them.
+	if p.RouteTable <= 0 || (p.RouteTable >= 253 && p.RouteTable <= 255) {
+		return nil, fmt.Errorf("invalid routetable %d for nexthop %s", p.RouteTable, nextHop)
+	}
+
+	return nextHop, nil
+}
+
+// ServiceGroupStatus is the ServiceGroup's status, which the
+// allocator updates.
 type ServiceGroupStatus struct {
+	// AllocatedCount is the number of the ServiceGroup's addresses
+	// that are allocated to services.
+	// +optional
+	AllocatedCount int `json:"allocatedcount,omitempty"`
 }
 
 // +genclient
@@ -246,6 +521,32 @@ type LBNodeAgent struct {
 // see the "config/" directory in the PureLB source tree.
 type LBNodeAgentSpec struct {
 	Local *LBNodeAgentLocalSpec `json:"local"`
+
+	// ExcludeAddresses is a list of addresses and CIDRs (e.g.,
+	// "192.168.1.1" or "10.0.0.0/24") that the allocator never
+	// assigns to services, no matter which ServiceGroup contains
+	// them. It's useful for addresses that other infrastructure
+	// uses. Services that already have excluded addresses keep them.
+	// +optional
+	ExcludeAddresses []string `json:"excludeaddresses,omitempty"`
+
+	// NamespacedSharingKeys determines whether or not sharing keys are
+	// scoped to their services' namespaces. If it's true then only
+	// services in the same namespace with the same sharing key can
+	// share an address. If it's false (the default) then any services
+	// with the same sharing key can share an address, no matter which
+	// namespaces they're in.
+	// +kubebuilder:default=false
+	// +optional
+	NamespacedSharingKeys bool `json:"namespacedsharingkeys,omitempty"`
+
+	// NamespaceQuota is the number of LoadBalancer services in each
+	// namespace that can have addresses. Services beyond the quota
+	// stay pending until another service in their namespace releases
+	// its address. 0 (the default) means that there's no quota.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	NamespaceQuota int `json:"namespacequota,omitempty"`
 }
 
 // LBNodeAgentLocalSpec configures the announcers to announce service
@@ -258,24 +559,163 @@ type LBNodeAgentLocalSpec struct {
 	// LocalInterface allows the user to specify the interface to use
 	// for announcement of local addresses. This field is optional but
 	// the default is "default" which will make PureLB use the interface
-	// that has the default route, which works in most cases.
+	// that has the default route, which works in most cases. It can be
+	// a regex or a comma-separated list of regexes which are tried in
+	// order. It can also be "cidr:" and a subnet, e.g.,
+	// "cidr:10.0.0.0/24", which selects the interface that has an
+	// address in that subnet.
 	// +kubebuilder:default="default"
 	// +optional
 	LocalInterface string `json:"localint"`
 
+	// LocalInterfaceFallback tells the node agent what to do if none
+	// of the node's interfaces match LocalInterface, e.g., because an
+	// interface was renamed. If it's false (the default) then the
+	// agent warns the user and announces every address remotely. If
+	// it's true then the agent warns the user and uses the interface
+	// with the default route instead, as if LocalInterface were
+	// "default".
+	// +kubebuilder:default=false
+	// +optional
+	LocalInterfaceFallback bool `json:"localintfallback,omitempty"`
+
+	// AnnounceOnAllMatching tells the node agent to add each local
+	// address to every interface that's up, matches LocalInterface,
+	// and is in the address's subnet, instead of only the first one.
+	// This gives hosts with redundant NICs on the same subnet
+	// redundancy without bonding. It has no effect if LocalInterface
+	// is "default" or a subnet, or if VIPMacvlan is true.
+	// +optional
+	AnnounceOnAllMatching bool `json:"announceonallmatching,omitempty"`
+
 	// ExtLBInterface specifies the name of the interface to use for
 	// announcement of non-local routes. This field is optional but the
-	// default is "kube-lb0" which works in most cases.
+	// default is "kube-lb0" which works in most cases. If it changes
+	// then the node agent moves its addresses to the new interface and
+	// removes the old one.
 	// +kubebuilder:default="kube-lb0"
 	// +optional
 	ExtLBInterface string `json:"extlbint"`
 
 	// SendGratuitousARP determines whether or not the node agent should
-	// send Gratuitous ARP messages when it adds an IP address to the
-	// local interface. This can be used to alert network equipment that
-	// the IP-to-MAC binding has changed.
+	// send Gratuitous ARP messages when it adds an IPv4 address to the
+	// local interface. This can be used to alert network equipment
+	// that the IP-to-MAC binding has changed.
 	// +kubebuilder:default=false
 	SendGratuitousARP bool `json:"sendgarp"`
+
+	// SendUnsolicitedNA determines whether or not the node agent
+	// should send unsolicited Neighbor Advertisements when it adds an
+	// IPv6 address to the local interface. It's the IPv6 equivalent of
+	// SendGratuitousARP.
+	// +kubebuilder:default=false
+	// +optional
+	SendUnsolicitedNA bool `json:"sendna,omitempty"`
+
+	// GARPDuration is how long the node agent should keep resending
+	// Gratuitous ARP messages (or Neighbor Advertisements) after it
+	// takes over an address, e.g., "30s". Some switches are slow to
+	// relearn where an address lives so they can miss the messages
+	// that we send when we add it. The default is zero, i.e., the
+	// messages are sent only when the address is added. It has no
+	// effect on addresses whose family has messages turned off.
+	// +optional
+	GARPDuration metav1.Duration `json:"garpduration,omitempty"`
+
+	// StrictARP determines whether or not the node agent should set the
+	// arp_ignore and arp_announce sysctls so that only the interface to
+	// which it adds an IPv4 service address answers ARP requests for
+	// it. The original values are restored when the node stops
+	// announcing local addresses.
+	// +kubebuilder:default=false
+	// +optional
+	StrictARP bool `json:"strictarp,omitempty"`
+
+	// LoserQuietPeriod is how long the node agent keeps the strict ARP
+	// sysctls (see StrictARP) set after it loses the election for an
+	// IPv4 address that it was announcing, e.g., "5s". While elections
+	// flap a node that has just lost an address could otherwise answer
+	// ARP requests for it from another interface and draw traffic away
+	// from the winner. The default is zero, i.e., no quiet period.
+	// +optional
+	LoserQuietPeriod metav1.Duration `json:"loserquietperiod,omitempty"`
+
+	// VIPMacvlan determines whether or not the node agent should add
+	// each local service address to its own macvlan interface (on top
+	// of the local interface) instead of to the local interface
+	// itself. Each macvlan's MAC address is derived from the service
+	// address so it's the same no matter which node announces it,
+	// which suits network equipment that expects a stable MAC for each
+	// address.
+	// +kubebuilder:default=false
+	// +optional
+	VIPMacvlan bool `json:"vipmacvlan,omitempty"`
+
+	// InterfaceWait is how long the node agent should wait, when it
+	// starts, for the local interface (or the default interface if
+	// LocalInterface is "default") to come up before it announces
+	// anything, e.g., "60s". This avoids announcement failures when
+	// the agent starts before the node's network is ready. If the
+	// interface isn't up by then the agent carries on anyway. The
+	// default is zero, i.e., don't wait.
+	// +optional
+	InterfaceWait metav1.Duration `json:"interfacewait,omitempty"`
+
+	// AddressLabels determines whether or not the node agent should
+	// label each IPv4 service address that it adds with the name of
+	// its service, e.g., "eth0:web", so the addresses are easy to
+	// identify in "ip addr" output. The kernel limits labels to 15
+	// characters so long names are truncated.
+	// +kubebuilder:default=false
+	// +optional
+	AddressLabels bool `json:"addresslabels,omitempty"`
+
+	// ReconcileDummy determines whether or not the node agent should
+	// remove addresses from the virtual interface (ExtLBInterface) when
+	// the configuration changes if they're no longer in any
+	// ServiceGroup, e.g., because a pool was removed or shrunk.
+	// +kubebuilder:default=false
+	// +optional
+	ReconcileDummy bool `json:"reconciledummy,omitempty"`
+
+	// WebhookURL is a URL to which the node agent POSTs a JSON
+	// notification (with the service, address, node, and action) when
+	// it announces or withdraws a service's address. Delivery is
+	// best-effort: failures are retried a few times and then logged,
+	// and never stop the announcement.
+	// +optional
+	WebhookURL string `json:"webhookurl,omitempty"`
+
+	// VerifyAddress determines whether or not the node agent should
+	// check that each local service address works after it adds it,
+	// i.e., that the address is on the interface and that the kernel
+	// routes it locally. If the check fails the agent posts a Warning
+	// event on the service but keeps announcing the address.
+	// +kubebuilder:default=false
+	// +optional
+	VerifyAddress bool `json:"verifyaddress,omitempty"`
+
+	// PreferredFamily determines which address family the allocator
+	// tries first for services that will accept either family, in
+	// ServiceGroups that don't set their own FamilyPreference. "ipv6"
+	// and "ipv6-then-ipv4" (the default) try IPv6 first, and "ipv4"
+	// tries IPv4 first.
+	// +kubebuilder:validation:Enum=ipv4;ipv6;ipv6-then-ipv4
+	// +optional
+	PreferredFamily string `json:"preferredfamily,omitempty"`
+
+	// CompanionSelector is a label selector (e.g., "app=bird") for a
+	// companion pod, such as a routing daemon, that announces the
+	// addresses that the node agent adds to the virtual interface. If
+	// it's set then the node agent adds addresses to the virtual
+	// interface only while a matching pod on the same node is ready.
+	// +optional
+	CompanionSelector string `json:"companionselector,omitempty"`
+
+	// CompanionNamespace is the namespace of the CompanionSelector's
+	// pods. The default is the node agent's own namespace.
+	// +optional
+	CompanionNamespace string `json:"companionnamespace,omitempty"`
 }
 
 // LBNodeAgentStatus is currently unused.
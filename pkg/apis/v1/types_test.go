@@ -80,3 +80,88 @@ func TestSubnet(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "2001:db8::68/124", subnet, "incorrect dual-stack IPV6 subnet")
 }
+
+func TestValidateAggregation(t *testing.T) {
+	for _, test := range []struct {
+		subnet      string
+		aggregation string
+		valid       bool
+	}{
+		{"192.0.2.0/24", "", true},
+		{"192.0.2.0/24", "default", true},
+		{"192.0.2.0/24", "/8", true},
+		{"192.0.2.0/24", "/24", true},
+		{"192.0.2.0/24", "/32", true},
+		{"192.0.2.0/24", "/33", false},
+		{"192.0.2.0/24", "/7", false},
+		{"192.0.2.0/24", "24", false},
+		{"192.0.2.0/24", "/bogus", false},
+		{"2001:db8::/64", "/128", true},
+		{"2001:db8::/64", "/129", false},
+		{"bogus", "/24", false},
+	} {
+		pool := v1.ServiceGroupAddressPool{Subnet: test.subnet, Aggregation: test.aggregation}
+		err := pool.ValidateAggregation()
+		if test.valid {
+			assert.NoError(t, err, "%s %s", test.subnet, test.aggregation)
+		} else {
+			assert.Error(t, err, "%s %s", test.subnet, test.aggregation)
+		}
+	}
+}
+
+func TestParseBroadcast(t *testing.T) {
+	pool := v1.ServiceGroupAddressPool{Pool: "192.0.2.0/28", Subnet: "192.0.2.0/24"}
+
+	// No broadcast is OK
+	broadcast, err := pool.ParseBroadcast()
+	assert.NoError(t, err)
+	assert.Nil(t, broadcast)
+
+	pool.Broadcast = "192.0.2.127"
+	broadcast, err = pool.ParseBroadcast()
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.127", broadcast.String())
+
+	// The broadcast has to be a valid IPv4 address
+	for _, bad := range []string{"bogus", "2001:db8::1"} {
+		pool.Broadcast = bad
+		_, err = pool.ParseBroadcast()
+		assert.Error(t, err, bad)
+	}
+
+	// IPv6 pools can't have one
+	pool = v1.ServiceGroupAddressPool{Pool: "2001:db8::/120", Subnet: "2001:db8::/64", Broadcast: "192.0.2.127"}
+	_, err = pool.ParseBroadcast()
+	assert.Error(t, err)
+}
+
+func TestParseNextHop(t *testing.T) {
+	pool := v1.ServiceGroupAddressPool{Pool: "192.0.2.0/28", Subnet: "192.0.2.0/24"}
+
+	// No next hop is OK
+	nextHop, err := pool.ParseNextHop()
+	assert.NoError(t, err)
+	assert.Nil(t, nextHop)
+
+	pool.NextHop = "198.51.100.1"
+	pool.RouteTable = 100
+	nextHop, err = pool.ParseNextHop()
+	assert.NoError(t, err)
+	assert.Equal(t, "198.51.100.1", nextHop.String())
+
+	// The next hop has to be valid and in the pool's family
+	for _, bad := range []string{"bogus", "2001:db8::1"} {
+		pool.NextHop = bad
+		_, err = pool.ParseNextHop()
+		assert.Error(t, err, bad)
+	}
+
+	// The table has to be set and can't be one of the kernel's
+	pool.NextHop = "198.51.100.1"
+	for _, table := range []int{0, -1, 253, 254, 255} {
+		pool.RouteTable = table
+		_, err = pool.ParseNextHop()
+		assert.Error(t, err, table)
+	}
+}
@@ -145,6 +145,11 @@ func (in *LBNodeAgentSpec) DeepCopyInto(out *LBNodeAgentSpec) {
 		*out = new(LBNodeAgentLocalSpec)
 		**out = **in
 	}
+	if in.ExcludeAddresses != nil {
+		in, out := &in.ExcludeAddresses, &out.ExcludeAddresses
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 	return
 }
 
@@ -264,6 +269,16 @@ func (in *ServiceGroupLocalSpec) DeepCopyInto(out *ServiceGroupLocalSpec) {
 		*out = new(ServiceGroupAddressPool)
 		**out = **in
 	}
+	if in.MaxAddresses != nil {
+		in, out := &in.MaxAddresses, &out.MaxAddresses
+		*out = new(int)
+		**out = **in
+	}
+	if in.SequentialPrefixes != nil {
+		in, out := &in.SequentialPrefixes, &out.SequentialPrefixes
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 	return
 }
 
@@ -280,6 +295,14 @@ func (in *ServiceGroupLocalSpec) DeepCopy() *ServiceGroupLocalSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ServiceGroupNetboxSpec) DeepCopyInto(out *ServiceGroupNetboxSpec) {
 	*out = *in
+	out.Timeout = in.Timeout
+	if in.Headers != nil {
+		in, out := &in.Headers, &out.Headers
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
 	return
 }
 
@@ -304,7 +327,7 @@ func (in *ServiceGroupSpec) DeepCopyInto(out *ServiceGroupSpec) {
 	if in.Netbox != nil {
 		in, out := &in.Netbox, &out.Netbox
 		*out = new(ServiceGroupNetboxSpec)
-		**out = **in
+		(*in).DeepCopyInto(*out)
 	}
 	return
 }